@@ -9,11 +9,13 @@ import (
 	"time"
 
 	"git.sr.ht/~migadu/alps"
+	"github.com/fernet/fernet-go"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/labstack/gommon/log"
 
 	"git.sr.ht/~migadu/alps/config"
+	"git.sr.ht/~migadu/alps/demo"
 	_ "git.sr.ht/~migadu/alps/plugins/base"
 	_ "git.sr.ht/~migadu/alps/plugins/caldav"
 	_ "git.sr.ht/~migadu/alps/plugins/carddav"
@@ -29,8 +31,36 @@ var (
 	ThemesPath = "./themes"
 )
 
+// loadConfig loads the configuration file, or starts the demo servers and
+// returns a configuration pointing to them if the "demo" command is given.
+func loadConfig(args []string) (*config.AlpsConfig, *demo.Server, error) {
+	if len(args) == 0 || args[0] != "demo" {
+		cfg, err := config.LoadConfig(ConfigFile, ThemesPath)
+		return cfg, nil, err
+	}
+
+	demoServer, err := demo.Start()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start demo servers: %v", err)
+	}
+
+	cfg := config.DefaultConfig(ThemesPath)
+	cfg.General.Upstreams = demoServer.Upstreams()
+	cfg.UI.Theme = "alps"
+	cfg.OpenPGP.WKDURL = demoServer.WKDURL
+
+	// A transient login key allows scheduling jobs in the demo
+	var key fernet.Key
+	if err := key.Generate(); err != nil {
+		return nil, nil, err
+	}
+	cfg.Security.LoginKey = &key
+
+	return cfg, demoServer, nil
+}
+
 func main() {
-	config, err := config.LoadConfig(ConfigFile, ThemesPath)
+	config, demoServer, err := loadConfig(os.Args[1:])
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
 		os.Exit(1)
@@ -62,6 +92,11 @@ func main() {
 		e.Logger.SetLevel(log.DEBUG)
 	}
 
+	if demoServer != nil {
+		e.Logger.Printf("Demo mode enabled, log in as %q with password %q",
+			demo.Username, demo.Password)
+	}
+
 	go e.Start(config.Server.Address)
 
 	sigs := make(chan os.Signal, 1)
@@ -83,4 +118,7 @@ func main() {
 	cancel()
 
 	s.Close()
+	if demoServer != nil {
+		demoServer.Close()
+	}
 }
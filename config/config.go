@@ -40,17 +40,53 @@ type SessionConfig struct {
 	AttachmentCacheSize int64         `ini:"-"`
 }
 
+type SchedulerConfig struct {
+	Path string `ini:"path"`
+}
+
+type IdentitiesConfig struct {
+	// Patterns of the addresses users can send as, in addition to their
+	// username. Any address is allowed if empty.
+	AllowedAddresses []string `ini:"allowed-addresses" delim:","`
+}
+
+type OpenPGPConfig struct {
+	// Look up the keys of recipients with the Web Key Directory
+	WKD bool `ini:"wkd"`
+	// Base URL of the Web Key Directory, in place of the recipient's domain
+	WKDURL string `ini:"wkd-url"`
+}
+
+type SMIMEConfig struct {
+	// PEM file with the certificates of the trusted authorities. The
+	// system's certificates are used if empty.
+	TrustStore string `ini:"trust-store"`
+}
+
+type AuthResultsConfig struct {
+	// Authentication-Results header fields added by these servers are
+	// displayed, others are ignored
+	TrustedAuthServIDs []string `ini:"trusted-authserv-ids" delim:","`
+}
+
 type AlpsConfig struct {
-	General  GeneralConfig  `ini:"general"`
-	Server   ServerConfig   `ini:"server"`
-	UI       UIConfig       `ini:"ui"`
-	Log      LogConfig      `ini:"log"`
-	Security SecurityConfig `ini:"security"`
-	Session  SessionConfig  `ini:"session"`
+	General     GeneralConfig     `ini:"general"`
+	Server      ServerConfig      `ini:"server"`
+	UI          UIConfig          `ini:"ui"`
+	Log         LogConfig         `ini:"log"`
+	Security    SecurityConfig    `ini:"security"`
+	Session     SessionConfig     `ini:"session"`
+	Scheduler   SchedulerConfig   `ini:"scheduler"`
+	Identities  IdentitiesConfig  `ini:"identities"`
+	OpenPGP     OpenPGPConfig     `ini:"openpgp"`
+	SMIME       SMIMEConfig       `ini:"smime"`
+	AuthResults AuthResultsConfig `ini:"authentication-results"`
 }
 
-func LoadConfig(filename string, themesPath string) (*AlpsConfig, error) {
-	config := &AlpsConfig{
+// DefaultConfig returns the configuration used for settings missing from the
+// configuration file. It doesn't contain any upstream server.
+func DefaultConfig(themesPath string) *AlpsConfig {
+	return &AlpsConfig{
 		Server: ServerConfig{
 			Address: ":1323",
 		},
@@ -70,9 +106,17 @@ func LoadConfig(filename string, themesPath string) (*AlpsConfig, error) {
 			LoginTokenRememberLifetime:   30 * 24 * time.Hour,
 		},
 		Session: SessionConfig{
-			IdleTimeout: 30 * time.Minute,
+			IdleTimeout:         30 * time.Minute,
+			AttachmentCacheSize: 32 << 20,
+		},
+		OpenPGP: OpenPGPConfig{
+			WKD: true,
 		},
 	}
+}
+
+func LoadConfig(filename string, themesPath string) (*AlpsConfig, error) {
+	config := DefaultConfig(themesPath)
 
 	file, err := ini.Load(filename)
 	if err != nil {
@@ -0,0 +1,556 @@
+// Package demo provides in-memory IMAP, SMTP, CalDAV and CardDAV servers
+// pre-filled with sample data. They allow alps to be tried out, and themes and
+// plugins to be developed, without access to a real mail server. The base
+// plugin tests run against them too.
+package demo
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	gomessage "github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+const delimiter = "/"
+
+// backend is an in-memory IMAP backend. A single mutex protects all users,
+// mailboxes and messages.
+type backend struct {
+	mutex sync.Mutex
+	users map[string]*user
+}
+
+func newBackend() *backend {
+	return &backend{users: make(map[string]*user)}
+}
+
+func (be *backend) Login(_ *imap.ConnInfo, username, password string) (imapbackend.User, error) {
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+
+	u, ok := be.users[username]
+	if !ok || u.password != password {
+		return nil, imapbackend.ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+func (be *backend) addUser(username, password string) *user {
+	u := &user{
+		backend:   be,
+		username:  username,
+		password:  password,
+		mailboxes: make(map[string]*mailbox),
+		metadata:  make(map[string]string),
+	}
+	u.addMailbox("INBOX", "")
+	be.users[username] = u
+	return u
+}
+
+// deliver appends a message to the INBOX of the user with the specified
+// username.
+func (be *backend) deliver(username string, b []byte) error {
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+
+	u, ok := be.users[username]
+	if !ok {
+		return errors.New("no such user")
+	}
+	u.mailboxes["INBOX"].appendMessage(b, nil, time.Now())
+	return nil
+}
+
+type user struct {
+	backend   *backend
+	username  string
+	password  string
+	mailboxes map[string]*mailbox
+	metadata  map[string]string
+}
+
+func normalizeMailboxName(name string) string {
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX"
+	}
+	return name
+}
+
+func (u *user) addMailbox(name, attr string) *mailbox {
+	mbox := &mailbox{
+		user:        u,
+		name:        name,
+		subscribed:  true,
+		uidValidity: uint32(time.Now().Unix()),
+		uidNext:     1,
+	}
+	if attr != "" {
+		mbox.attrs = []string{attr}
+	}
+	u.mailboxes[name] = mbox
+	return mbox
+}
+
+func (u *user) Username() string {
+	return u.username
+}
+
+func (u *user) ListMailboxes(subscribed bool) ([]imapbackend.Mailbox, error) {
+	u.backend.mutex.Lock()
+	defer u.backend.mutex.Unlock()
+
+	var names []string
+	for name, mbox := range u.mailboxes {
+		if subscribed && !mbox.subscribed {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	l := make([]imapbackend.Mailbox, len(names))
+	for i, name := range names {
+		l[i] = u.mailboxes[name]
+	}
+	return l, nil
+}
+
+func (u *user) GetMailbox(name string) (imapbackend.Mailbox, error) {
+	u.backend.mutex.Lock()
+	defer u.backend.mutex.Unlock()
+
+	mbox, ok := u.mailboxes[normalizeMailboxName(name)]
+	if !ok {
+		return nil, imapbackend.ErrNoSuchMailbox
+	}
+	return mbox, nil
+}
+
+func (u *user) CreateMailbox(name string) error {
+	u.backend.mutex.Lock()
+	defer u.backend.mutex.Unlock()
+
+	name = strings.TrimSuffix(normalizeMailboxName(name), delimiter)
+	if _, ok := u.mailboxes[name]; ok {
+		return imapbackend.ErrMailboxAlreadyExists
+	}
+	u.addMailbox(name, "")
+	return nil
+}
+
+func (u *user) DeleteMailbox(name string) error {
+	u.backend.mutex.Lock()
+	defer u.backend.mutex.Unlock()
+
+	name = normalizeMailboxName(name)
+	if name == "INBOX" {
+		return errors.New("Cannot delete INBOX")
+	}
+	if _, ok := u.mailboxes[name]; !ok {
+		return imapbackend.ErrNoSuchMailbox
+	}
+	delete(u.mailboxes, name)
+	return nil
+}
+
+func (u *user) RenameMailbox(existingName, newName string) error {
+	u.backend.mutex.Lock()
+	defer u.backend.mutex.Unlock()
+
+	existingName = normalizeMailboxName(existingName)
+	newName = normalizeMailboxName(newName)
+	mbox, ok := u.mailboxes[existingName]
+	if !ok {
+		return imapbackend.ErrNoSuchMailbox
+	}
+	if _, ok := u.mailboxes[newName]; ok {
+		return imapbackend.ErrMailboxAlreadyExists
+	}
+
+	// Renaming INBOX moves its messages to a new mailbox and leaves INBOX
+	// empty, see RFC 3501 section 6.3.5
+	if existingName == "INBOX" {
+		dest := u.addMailbox(newName, "")
+		dest.messages = mbox.messages
+		dest.uidNext = mbox.uidNext
+		mbox.messages = nil
+		return nil
+	}
+
+	prefix := existingName + delimiter
+	for name, child := range u.mailboxes {
+		if strings.HasPrefix(name, prefix) {
+			delete(u.mailboxes, name)
+			child.name = newName + delimiter + strings.TrimPrefix(name, prefix)
+			u.mailboxes[child.name] = child
+		}
+	}
+
+	delete(u.mailboxes, existingName)
+	mbox.name = newName
+	u.mailboxes[newName] = mbox
+	return nil
+}
+
+func (u *user) Logout() error {
+	return nil
+}
+
+type mailbox struct {
+	user        *user
+	name        string
+	attrs       []string
+	subscribed  bool
+	uidValidity uint32
+	uidNext     uint32
+	messages    []*message
+}
+
+func (mbox *mailbox) appendMessage(b []byte, flags []string, date time.Time) *message {
+	msg := &message{
+		uid:   mbox.uidNext,
+		date:  date,
+		flags: flags,
+		body:  b,
+	}
+	mbox.uidNext++
+	mbox.messages = append(mbox.messages, msg)
+	return msg
+}
+
+// forEach calls f for each message in the set, along with its sequence
+// number.
+func (mbox *mailbox) forEach(uid bool, seqSet *imap.SeqSet, f func(seqNum uint32, msg *message)) {
+	for i, msg := range mbox.messages {
+		seqNum := uint32(i + 1)
+		id := seqNum
+		if uid {
+			id = msg.uid
+		}
+		if seqSet.Contains(id) {
+			f(seqNum, msg)
+		}
+	}
+}
+
+func (mbox *mailbox) Name() string {
+	return mbox.name
+}
+
+func (mbox *mailbox) Info() (*imap.MailboxInfo, error) {
+	mbox.user.backend.mutex.Lock()
+	defer mbox.user.backend.mutex.Unlock()
+
+	attrs := append([]string(nil), mbox.attrs...)
+	hasChildren := false
+	for name := range mbox.user.mailboxes {
+		if strings.HasPrefix(name, mbox.name+delimiter) {
+			hasChildren = true
+			break
+		}
+	}
+	if hasChildren {
+		attrs = append(attrs, imap.HasChildrenAttr)
+	} else {
+		attrs = append(attrs, imap.HasNoChildrenAttr)
+	}
+
+	return &imap.MailboxInfo{
+		Attributes: attrs,
+		Delimiter:  delimiter,
+		Name:       mbox.name,
+	}, nil
+}
+
+func (mbox *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	mbox.user.backend.mutex.Lock()
+	defer mbox.user.backend.mutex.Unlock()
+
+	status := imap.NewMailboxStatus(mbox.name, items)
+	status.Flags = []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag}
+	status.PermanentFlags = append(append([]string(nil), status.Flags...), "\\*")
+
+	var unseen uint32
+	for i, msg := range mbox.messages {
+		if !msg.hasFlag(imap.SeenFlag) {
+			if unseen == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+			unseen++
+		}
+	}
+
+	for _, name := range items {
+		switch name {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(mbox.messages))
+		case imap.StatusUidNext:
+			status.UidNext = mbox.uidNext
+		case imap.StatusUidValidity:
+			status.UidValidity = mbox.uidValidity
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		}
+	}
+
+	return status, nil
+}
+
+func (mbox *mailbox) SetSubscribed(subscribed bool) error {
+	mbox.user.backend.mutex.Lock()
+	defer mbox.user.backend.mutex.Unlock()
+
+	mbox.subscribed = subscribed
+	return nil
+}
+
+func (mbox *mailbox) Check() error {
+	return nil
+}
+
+func (mbox *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	markSeen := false
+	for _, item := range items {
+		section, err := imap.ParseBodySectionName(item)
+		if err == nil && !section.Peek {
+			markSeen = true
+		}
+	}
+
+	// Take a snapshot of the requested messages, so that the lock isn't held
+	// while the client reads the response
+	type fetchItem struct {
+		seqNum uint32
+		msg    message
+	}
+	var l []fetchItem
+	mbox.user.backend.mutex.Lock()
+	mbox.forEach(uid, seqSet, func(seqNum uint32, msg *message) {
+		if markSeen && !msg.hasFlag(imap.SeenFlag) {
+			msg.flags = append(msg.flags, imap.SeenFlag)
+		}
+		snapshot := *msg
+		snapshot.flags = append([]string(nil), msg.flags...)
+		l = append(l, fetchItem{seqNum, snapshot})
+	})
+	mbox.user.backend.mutex.Unlock()
+
+	for _, item := range l {
+		m, err := item.msg.fetch(item.seqNum, items)
+		if err != nil {
+			continue
+		}
+		ch <- m
+	}
+
+	return nil
+}
+
+func (mbox *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	mbox.user.backend.mutex.Lock()
+	defer mbox.user.backend.mutex.Unlock()
+
+	return mbox.search(uid, criteria), nil
+}
+
+func (mbox *mailbox) search(uid bool, criteria *imap.SearchCriteria) []uint32 {
+	var ids []uint32
+	for i, msg := range mbox.messages {
+		seqNum := uint32(i + 1)
+		if !msg.match(seqNum, criteria) {
+			continue
+		}
+		if uid {
+			ids = append(ids, msg.uid)
+		} else {
+			ids = append(ids, seqNum)
+		}
+	}
+	return ids
+}
+
+func (mbox *mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	mbox.user.backend.mutex.Lock()
+	defer mbox.user.backend.mutex.Unlock()
+
+	mbox.appendMessage(b, flags, date)
+	return nil
+}
+
+func (mbox *mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	mbox.user.backend.mutex.Lock()
+	defer mbox.user.backend.mutex.Unlock()
+
+	mbox.forEach(uid, seqSet, func(_ uint32, msg *message) {
+		msg.flags = backendutil.UpdateFlags(msg.flags, op, flags)
+	})
+	return nil
+}
+
+func (mbox *mailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	mbox.user.backend.mutex.Lock()
+	defer mbox.user.backend.mutex.Unlock()
+
+	return mbox.copyMessages(uid, seqSet, destName)
+}
+
+func (mbox *mailbox) copyMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	dest, ok := mbox.user.mailboxes[normalizeMailboxName(destName)]
+	if !ok {
+		return imapbackend.ErrNoSuchMailbox
+	}
+
+	mbox.forEach(uid, seqSet, func(_ uint32, msg *message) {
+		flags := append([]string(nil), msg.flags...)
+		dest.appendMessage(msg.body, flags, msg.date)
+	})
+	return nil
+}
+
+func (mbox *mailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	mbox.user.backend.mutex.Lock()
+	defer mbox.user.backend.mutex.Unlock()
+
+	if err := mbox.copyMessages(uid, seqSet, destName); err != nil {
+		return err
+	}
+
+	moved := make(map[*message]bool)
+	mbox.forEach(uid, seqSet, func(_ uint32, msg *message) {
+		moved[msg] = true
+	})
+	mbox.removeMessages(func(msg *message) bool {
+		return moved[msg]
+	})
+	return nil
+}
+
+func (mbox *mailbox) Expunge() error {
+	mbox.user.backend.mutex.Lock()
+	defer mbox.user.backend.mutex.Unlock()
+
+	mbox.removeMessages(func(msg *message) bool {
+		return msg.hasFlag(imap.DeletedFlag)
+	})
+	return nil
+}
+
+func (mbox *mailbox) removeMessages(f func(msg *message) bool) {
+	l := mbox.messages[:0]
+	for _, msg := range mbox.messages {
+		if !f(msg) {
+			l = append(l, msg)
+		}
+	}
+	for i := len(l); i < len(mbox.messages); i++ {
+		mbox.messages[i] = nil
+	}
+	mbox.messages = l
+}
+
+type message struct {
+	uid   uint32
+	date  time.Time
+	flags []string
+	body  []byte
+}
+
+func (msg *message) hasFlag(flag string) bool {
+	for _, f := range msg.flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+func (msg *message) headerAndBody() (textproto.Header, io.Reader, error) {
+	br := bufio.NewReader(bytes.NewReader(msg.body))
+	h, err := textproto.ReadHeader(br)
+	return h, br, err
+}
+
+func (msg *message) fetch(seqNum uint32, items []imap.FetchItem) (*imap.Message, error) {
+	fetched := imap.NewMessage(seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			h, _, err := msg.headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			if fetched.Envelope, err = backendutil.FetchEnvelope(h); err != nil {
+				return nil, err
+			}
+		case imap.FetchBody, imap.FetchBodyStructure:
+			h, body, err := msg.headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			fetched.BodyStructure, err = backendutil.FetchBodyStructure(h, body, item == imap.FetchBodyStructure)
+			if err != nil {
+				return nil, err
+			}
+		case imap.FetchFlags:
+			fetched.Flags = msg.flags
+		case imap.FetchInternalDate:
+			fetched.InternalDate = msg.date
+		case imap.FetchRFC822Size:
+			fetched.Size = uint32(len(msg.body))
+		case imap.FetchUid:
+			fetched.Uid = msg.uid
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				return nil, err
+			}
+			h, body, err := msg.headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			l, err := backendutil.FetchBodySection(h, body, section)
+			if err != nil {
+				// Missing parts are returned as empty sections
+				l = bytes.NewReader(nil)
+			}
+			fetched.Body[section] = l
+		}
+	}
+	return fetched, nil
+}
+
+func (msg *message) match(seqNum uint32, criteria *imap.SearchCriteria) bool {
+	// message.Read returns a usable entity along with an error for unknown
+	// charsets and encodings
+	e, _ := gomessage.Read(bytes.NewReader(msg.body))
+	if e == nil {
+		return false
+	}
+	ok, err := backendutil.Match(e, seqNum, msg.uid, msg.date, msg.flags, criteria)
+	return err == nil && ok
+}
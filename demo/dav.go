@@ -0,0 +1,292 @@
+package demo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/caldav"
+	"github.com/emersion/go-webdav/carddav"
+)
+
+// Collection paths have no trailing slash, the go-webdav client strips it.
+const (
+	calendarPrincipalPath    = "/caldav"
+	calendarPath             = "/caldav/calendar"
+	addressBookPrincipalPath = "/carddav"
+	addressBookPath          = "/carddav/contacts"
+)
+
+// davETag returns an entity tag for the encoded form of an object.
+func davETag(b []byte) string {
+	return fmt.Sprintf("%x", sha1.Sum(b))
+}
+
+// calendarBackend is an in-memory CalDAV backend holding a single calendar.
+type calendarBackend struct {
+	mutex   sync.Mutex
+	objects map[string]caldav.CalendarObject
+}
+
+func newCalendarBackend() *calendarBackend {
+	return &calendarBackend{objects: make(map[string]caldav.CalendarObject)}
+}
+
+func (b *calendarBackend) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	return calendarPrincipalPath, nil
+}
+
+func (b *calendarBackend) CalendarHomeSetPath(ctx context.Context) (string, error) {
+	return calendarPath, nil
+}
+
+func (b *calendarBackend) Calendar(ctx context.Context) (*caldav.Calendar, error) {
+	return &caldav.Calendar{
+		Path:                  calendarPath,
+		Name:                  "Calendar",
+		SupportedComponentSet: []string{ical.CompEvent},
+	}, nil
+}
+
+func (b *calendarBackend) GetCalendarObject(ctx context.Context, p string, req *caldav.CalendarCompRequest) (*caldav.CalendarObject, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	co, ok := b.objects[p]
+	if !ok {
+		return nil, webdav.NewHTTPError(http.StatusNotFound, fmt.Errorf("calendar object %q not found", p))
+	}
+	return &co, nil
+}
+
+func (b *calendarBackend) ListCalendarObjects(ctx context.Context, req *caldav.CalendarCompRequest) ([]caldav.CalendarObject, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	paths := make([]string, 0, len(b.objects))
+	for p := range b.objects {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	l := make([]caldav.CalendarObject, 0, len(paths))
+	for _, p := range paths {
+		l = append(l, b.objects[p])
+	}
+	return l, nil
+}
+
+func (b *calendarBackend) QueryCalendarObjects(ctx context.Context, query *caldav.CalendarQuery) ([]caldav.CalendarObject, error) {
+	cos, err := b.ListCalendarObjects(ctx, &query.CompRequest)
+	if err != nil {
+		return nil, err
+	}
+	return caldav.Filter(query, cos)
+}
+
+func (b *calendarBackend) PutCalendarObject(ctx context.Context, p string, cal *ical.Calendar, opts *caldav.PutCalendarObjectOptions) (string, error) {
+	if path.Dir(p) != calendarPath {
+		return "", webdav.NewHTTPError(http.StatusForbidden, fmt.Errorf("invalid calendar object path %q", p))
+	}
+
+	var buf bytes.Buffer
+	if err := ical.NewEncoder(&buf).Encode(cal); err != nil {
+		return "", webdav.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.objects[p]; ok && opts != nil && opts.IfNoneMatch {
+		return "", webdav.NewHTTPError(http.StatusPreconditionFailed, fmt.Errorf("calendar object %q already exists", p))
+	}
+	b.objects[p] = caldav.CalendarObject{
+		Path:          p,
+		ModTime:       time.Now(),
+		ContentLength: int64(buf.Len()),
+		ETag:          davETag(buf.Bytes()),
+		Data:          cal,
+	}
+	return p, nil
+}
+
+// addressBookBackend is an in-memory CardDAV backend holding a single address
+// book.
+type addressBookBackend struct {
+	mutex   sync.Mutex
+	objects map[string]carddav.AddressObject
+}
+
+func newAddressBookBackend() *addressBookBackend {
+	return &addressBookBackend{objects: make(map[string]carddav.AddressObject)}
+}
+
+func (b *addressBookBackend) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	return addressBookPrincipalPath, nil
+}
+
+func (b *addressBookBackend) AddressbookHomeSetPath(ctx context.Context) (string, error) {
+	return addressBookPath, nil
+}
+
+func (b *addressBookBackend) AddressBook(ctx context.Context) (*carddav.AddressBook, error) {
+	return &carddav.AddressBook{
+		Path: addressBookPath,
+		Name: "Contacts",
+		SupportedAddressData: []carddav.AddressDataType{
+			{ContentType: vcard.MIMEType, Version: "3.0"},
+			{ContentType: vcard.MIMEType, Version: "4.0"},
+		},
+	}, nil
+}
+
+func (b *addressBookBackend) GetAddressObject(ctx context.Context, p string, req *carddav.AddressDataRequest) (*carddav.AddressObject, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ao, ok := b.objects[p]
+	if !ok {
+		return nil, webdav.NewHTTPError(http.StatusNotFound, fmt.Errorf("address object %q not found", p))
+	}
+	return &ao, nil
+}
+
+func (b *addressBookBackend) ListAddressObjects(ctx context.Context, req *carddav.AddressDataRequest) ([]carddav.AddressObject, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	paths := make([]string, 0, len(b.objects))
+	for p := range b.objects {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	l := make([]carddav.AddressObject, 0, len(paths))
+	for _, p := range paths {
+		l = append(l, b.objects[p])
+	}
+	return l, nil
+}
+
+func (b *addressBookBackend) QueryAddressObjects(ctx context.Context, query *carddav.AddressBookQuery) ([]carddav.AddressObject, error) {
+	aos, err := b.ListAddressObjects(ctx, &query.DataRequest)
+	if err != nil {
+		return nil, err
+	}
+	return carddav.Filter(query, aos)
+}
+
+func (b *addressBookBackend) PutAddressObject(ctx context.Context, p string, card vcard.Card, opts *carddav.PutAddressObjectOptions) (string, error) {
+	if path.Dir(p) != addressBookPath {
+		return "", webdav.NewHTTPError(http.StatusForbidden, fmt.Errorf("invalid address object path %q", p))
+	}
+
+	var buf bytes.Buffer
+	if err := vcard.NewEncoder(&buf).Encode(card); err != nil {
+		return "", webdav.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.objects[p]; ok && opts != nil && opts.IfNoneMatch {
+		return "", webdav.NewHTTPError(http.StatusPreconditionFailed, fmt.Errorf("address object %q already exists", p))
+	}
+	b.objects[p] = carddav.AddressObject{
+		Path:          p,
+		ModTime:       time.Now(),
+		ContentLength: int64(buf.Len()),
+		ETag:          davETag(buf.Bytes()),
+		Card:          card,
+	}
+	return p, nil
+}
+
+func (b *addressBookBackend) DeleteAddressObject(ctx context.Context, p string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.objects[p]; !ok {
+		return webdav.NewHTTPError(http.StatusNotFound, fmt.Errorf("address object %q not found", p))
+	}
+	delete(b.objects, p)
+	return nil
+}
+
+// seedDAV stores the seeded invitation and contacts in the calendar and the
+// address book.
+func seedDAV(cal *calendarBackend, ab *addressBookBackend) error {
+	ctx := context.Background()
+
+	invite := expandSeedDates(seedInvite, time.Now())
+	data, err := ical.NewDecoder(strings.NewReader(invite)).Decode()
+	if err != nil {
+		return fmt.Errorf("failed to parse seeded calendar: %v", err)
+	}
+	// Calendar collections don't store scheduling methods
+	data.Props.Del(ical.PropMethod)
+	p := path.Join(calendarPath, "kickoff.ics")
+	if _, err := cal.PutCalendarObject(ctx, p, data, nil); err != nil {
+		return err
+	}
+
+	dec := vcard.NewDecoder(strings.NewReader(seedContacts))
+	for {
+		card, err := dec.Decode()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to parse seeded contacts: %v", err)
+		}
+		name := strings.SplitN(card.PreferredValue(vcard.FieldEmail), "@", 2)[0]
+		p := path.Join(addressBookPath, name+".vcf")
+		if _, err := ab.PutAddressObject(ctx, p, card, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// davHandler serves the calendar and the address book to the seeded user.
+type davHandler struct {
+	mux *http.ServeMux
+}
+
+func newDAVHandler() (*davHandler, error) {
+	cal := newCalendarBackend()
+	ab := newAddressBookBackend()
+	if err := seedDAV(cal, ab); err != nil {
+		return nil, err
+	}
+
+	calHandler := &caldav.Handler{Backend: cal}
+	abHandler := &carddav.Handler{Backend: ab}
+	mux := http.NewServeMux()
+	mux.Handle(calendarPrincipalPath, calHandler)
+	mux.Handle(calendarPrincipalPath+"/", calHandler)
+	mux.Handle(addressBookPrincipalPath, abHandler)
+	mux.Handle(addressBookPrincipalPath+"/", abHandler)
+	return &davHandler{mux}, nil
+}
+
+func (h *davHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	username, password, ok := req.BasicAuth()
+	if !ok || username != Username || password != Password {
+		w.Header().Set("WWW-Authenticate", `Basic realm="alps demo"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.mux.ServeHTTP(w, req)
+}
@@ -0,0 +1,126 @@
+package demo
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-smtp"
+)
+
+// Credentials of the user seeded into the demo servers.
+const (
+	Username = "demo@example.org"
+	Password = "demo"
+)
+
+// Server runs an IMAP and an SMTP server backed by the same in-memory store.
+// Messages sent via SMTP to Username are delivered to its INBOX. A Web Key
+// Directory serves the OpenPGP keys of some correspondents, and CalDAV and
+// CardDAV servers hold a calendar and an address book.
+type Server struct {
+	// Network addresses the servers are listening on.
+	IMAPAddr string
+	SMTPAddr string
+	DAVAddr  string
+	// Base URL of the Web Key Directory
+	WKDURL string
+
+	imap *imapserver.Server
+	smtp *smtp.Server
+	wkd  *http.Server
+	dav  *http.Server
+}
+
+// Start seeds a new in-memory store with sample data and starts unencrypted
+// IMAP, SMTP and HTTP servers on random local ports.
+func Start() (*Server, error) {
+	be := newBackend()
+	seed(be.addUser(Username, Password))
+
+	wkd, err := newWKDHandler()
+	if err != nil {
+		return nil, err
+	}
+	dav, err := newDAVHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	imapLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for IMAP: %v", err)
+	}
+	smtpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		imapLn.Close()
+		return nil, fmt.Errorf("failed to listen for SMTP: %v", err)
+	}
+	wkdLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		imapLn.Close()
+		smtpLn.Close()
+		return nil, fmt.Errorf("failed to listen for HTTP: %v", err)
+	}
+	davLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		imapLn.Close()
+		smtpLn.Close()
+		wkdLn.Close()
+		return nil, fmt.Errorf("failed to listen for DAV: %v", err)
+	}
+
+	s := &Server{
+		IMAPAddr: imapLn.Addr().String(),
+		SMTPAddr: smtpLn.Addr().String(),
+		DAVAddr:  davLn.Addr().String(),
+		WKDURL:   "http://" + wkdLn.Addr().String(),
+		imap:     imapserver.New(be),
+		smtp:     smtp.NewServer(&smtpBackend{be}),
+		wkd:      &http.Server{Handler: wkd},
+		dav:      &http.Server{Handler: dav},
+	}
+
+	s.imap.AllowInsecureAuth = true
+	s.imap.Enable(extension{})
+
+	s.smtp.Domain = "localhost"
+	s.smtp.AllowInsecureAuth = true
+
+	go s.imap.Serve(imapLn)
+	go s.smtp.Serve(smtpLn)
+	go s.wkd.Serve(wkdLn)
+	go s.dav.Serve(davLn)
+
+	return s, nil
+}
+
+// Upstreams returns the upstream server URLs to use in the alps
+// configuration.
+func (s *Server) Upstreams() []string {
+	return []string{
+		"imap+insecure://" + s.IMAPAddr,
+		"smtp+insecure://" + s.SMTPAddr,
+		"caldav+insecure://" + s.DAVAddr + calendarPrincipalPath,
+		"carddav+insecure://" + s.DAVAddr + addressBookPrincipalPath,
+	}
+}
+
+// Close stops the servers. The in-memory store is discarded.
+func (s *Server) Close() error {
+	imapErr := s.imap.Close()
+	smtpErr := s.smtp.Close()
+	wkdErr := s.wkd.Close()
+	davErr := s.dav.Close()
+	if imapErr != nil {
+		return imapErr
+	}
+	if smtpErr != nil {
+		return smtpErr
+	}
+	if wkdErr != nil {
+		return wkdErr
+	}
+	return davErr
+}
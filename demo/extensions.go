@@ -0,0 +1,530 @@
+package demo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+	gomessage "github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+)
+
+// extension implements the IMAP extensions used by alps which aren't built
+// into go-imap: SORT (RFC 5256), METADATA (RFC 5464) and MULTISEARCH
+// (RFC 7377). SPECIAL-USE (RFC 6154) only needs to be advertised, the
+// attributes are returned by mailbox.Info.
+type extension struct{}
+
+func (extension) Capabilities(c server.Conn) []string {
+	return []string{"SORT", "METADATA", "SPECIAL-USE", "MULTISEARCH"}
+}
+
+func (extension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "SORT":
+		return func() server.Handler { return &sortCommand{} }
+	case "ESEARCH":
+		return func() server.Handler { return &multiSearchCommand{} }
+	case "GETMETADATA":
+		return func() server.Handler { return &getMetadataCommand{} }
+	case "SETMETADATA":
+		return func() server.Handler { return &setMetadataCommand{} }
+	}
+	return nil
+}
+
+func parseCharset(charset string) func(io.Reader) io.Reader {
+	charset = strings.ToLower(charset)
+	if charset == "utf-8" || charset == "us-ascii" || charset == "" {
+		return nil
+	}
+	return func(r io.Reader) io.Reader {
+		r, _ = imap.CharsetReader(charset, r)
+		return r
+	}
+}
+
+type sortCriterion struct {
+	field   string
+	reverse bool
+}
+
+type sortCommand struct {
+	criteria []sortCriterion
+	search   *imap.SearchCriteria
+}
+
+func (cmd *sortCommand) Parse(fields []interface{}) error {
+	if len(fields) < 3 {
+		return errors.New("Not enough arguments")
+	}
+
+	list, ok := fields[0].([]interface{})
+	if !ok || len(list) == 0 {
+		return errors.New("Sort criteria must be a non-empty list")
+	}
+	reverse := false
+	for _, f := range list {
+		s, err := imap.ParseString(f)
+		if err != nil {
+			return err
+		}
+		s = strings.ToUpper(s)
+		switch s {
+		case "REVERSE":
+			reverse = true
+			continue
+		case "ARRIVAL", "CC", "DATE", "FROM", "SIZE", "SUBJECT", "TO":
+			cmd.criteria = append(cmd.criteria, sortCriterion{s, reverse})
+			reverse = false
+		default:
+			return fmt.Errorf("Unknown sort criterion: %v", s)
+		}
+	}
+
+	charset, err := imap.ParseString(fields[1])
+	if err != nil {
+		return err
+	}
+
+	cmd.search = new(imap.SearchCriteria)
+	return cmd.search.ParseWithCharset(fields[2:], parseCharset(charset))
+}
+
+func (cmd *sortCommand) handle(uid bool, conn server.Conn) error {
+	mbox, ok := conn.Context().Mailbox.(*mailbox)
+	if !ok {
+		return server.ErrNoMailboxSelected
+	}
+
+	ids := mbox.sort(uid, cmd.criteria, cmd.search)
+
+	fields := []interface{}{imap.RawString("SORT")}
+	for _, id := range ids {
+		fields = append(fields, id)
+	}
+	return conn.WriteResp(imap.NewUntaggedResp(fields))
+}
+
+func (cmd *sortCommand) Handle(conn server.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *sortCommand) UidHandle(conn server.Conn) error {
+	return cmd.handle(true, conn)
+}
+
+// sortKeys holds the values compared by SORT for a single message.
+type sortKeys struct {
+	id      uint32
+	arrival time.Time
+	date    time.Time
+	size    int
+	subject string
+	from    string
+	to      string
+	cc      string
+}
+
+// firstAddress returns the mailbox of the first address in a header field, as
+// specified in RFC 5256 section 3.
+func firstAddress(h mail.Header, k string) string {
+	addrs, err := h.AddressList(k)
+	if err != nil || len(addrs) == 0 {
+		return ""
+	}
+	return strings.ToLower(addrs[0].Address)
+}
+
+// baseSubject is a simplified version of the base subject extraction
+// algorithm described in RFC 5256 section 2.1.
+func baseSubject(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for {
+		trimmed := s
+		for _, prefix := range []string{"re:", "fwd:", "fw:"} {
+			trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, prefix))
+		}
+		trimmed = strings.TrimSpace(strings.TrimSuffix(trimmed, "(fwd)"))
+		if trimmed == s {
+			return s
+		}
+		s = trimmed
+	}
+}
+
+func (mbox *mailbox) sort(uid bool, criteria []sortCriterion, search *imap.SearchCriteria) []uint32 {
+	mbox.user.backend.mutex.Lock()
+	defer mbox.user.backend.mutex.Unlock()
+
+	matches := make(map[uint32]bool)
+	for _, id := range mbox.search(uid, search) {
+		matches[id] = true
+	}
+
+	var l []sortKeys
+	for i, msg := range mbox.messages {
+		id := uint32(i + 1)
+		if uid {
+			id = msg.uid
+		}
+		if !matches[id] {
+			continue
+		}
+
+		keys := sortKeys{id: id, arrival: msg.date, size: len(msg.body)}
+		if th, _, err := msg.headerAndBody(); err == nil {
+			h := mail.Header{Header: gomessage.Header{Header: th}}
+			keys.subject, _ = h.Subject()
+			keys.subject = baseSubject(keys.subject)
+			keys.from = firstAddress(h, "From")
+			keys.to = firstAddress(h, "To")
+			keys.cc = firstAddress(h, "Cc")
+			keys.date, _ = h.Date()
+		}
+		if keys.date.IsZero() {
+			keys.date = keys.arrival
+		}
+		l = append(l, keys)
+	}
+
+	sort.SliceStable(l, func(i, j int) bool {
+		a, b := &l[i], &l[j]
+		for _, c := range criteria {
+			var cmp int
+			switch c.field {
+			case "ARRIVAL":
+				cmp = compareTimes(a.arrival, b.arrival)
+			case "DATE":
+				cmp = compareTimes(a.date, b.date)
+			case "SIZE":
+				cmp = a.size - b.size
+			case "SUBJECT":
+				cmp = strings.Compare(a.subject, b.subject)
+			case "FROM":
+				cmp = strings.Compare(a.from, b.from)
+			case "TO":
+				cmp = strings.Compare(a.to, b.to)
+			case "CC":
+				cmp = strings.Compare(a.cc, b.cc)
+			}
+			if c.reverse {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		// Ties are broken by sequence number, which is also the UID order
+		return a.id < b.id
+	})
+
+	ids := make([]uint32, len(l))
+	for i, keys := range l {
+		ids[i] = keys.id
+	}
+	return ids
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// multiSearchCommand is the ESEARCH command of the MULTISEARCH extension.
+// Handlers don't have access to the command tag, so responses don't include
+// the TAG correlator. Only the ALL and COUNT return options are supported.
+type multiSearchCommand struct {
+	// Source filter, either "selected", "personal", "mailboxes" or "subtree"
+	filter    string
+	mailboxes []string
+	count     bool
+	search    *imap.SearchCriteria
+}
+
+func (cmd *multiSearchCommand) Parse(fields []interface{}) error {
+	if len(fields) < 3 {
+		return errors.New("Not enough arguments")
+	}
+	if s, _ := imap.ParseString(fields[0]); !strings.EqualFold(s, "IN") {
+		return errors.New("Expected IN")
+	}
+	sources, ok := fields[1].([]interface{})
+	if !ok || len(sources) == 0 {
+		return errors.New("Source options must be a non-empty list")
+	}
+	filter, err := imap.ParseString(sources[0])
+	if err != nil {
+		return err
+	}
+	cmd.filter = strings.ToLower(filter)
+	switch cmd.filter {
+	case "selected", "personal":
+	case "mailboxes", "subtree":
+		if len(sources) < 2 {
+			return errors.New("Missing mailboxes")
+		}
+		// Mailboxes are either a single mailbox or a list
+		l, ok := sources[1].([]interface{})
+		if !ok {
+			l = sources[1:]
+		}
+		for _, f := range l {
+			name, err := imap.ParseString(f)
+			if err != nil {
+				return err
+			}
+			if name, err = utf7.Encoding.NewDecoder().String(name); err != nil {
+				return err
+			}
+			cmd.mailboxes = append(cmd.mailboxes, normalizeMailboxName(name))
+		}
+	default:
+		return fmt.Errorf("Unsupported source filter: %v", filter)
+	}
+	fields = fields[2:]
+
+	if s, _ := imap.ParseString(fields[0]); strings.EqualFold(s, "RETURN") {
+		if len(fields) < 2 {
+			return errors.New("Missing return options")
+		}
+		opts, err := imap.ParseStringList(fields[1])
+		if err != nil {
+			return err
+		}
+		for _, opt := range opts {
+			switch strings.ToUpper(opt) {
+			case "ALL":
+			case "COUNT":
+				cmd.count = true
+			default:
+				return fmt.Errorf("Unsupported return option: %v", opt)
+			}
+		}
+		fields = fields[2:]
+	}
+
+	var charset string
+	if len(fields) >= 2 {
+		if s, _ := imap.ParseString(fields[0]); strings.EqualFold(s, "CHARSET") {
+			if charset, err = imap.ParseString(fields[1]); err != nil {
+				return err
+			}
+			fields = fields[2:]
+		}
+	}
+
+	cmd.search = new(imap.SearchCriteria)
+	return cmd.search.ParseWithCharset(fields, parseCharset(charset))
+}
+
+func (cmd *multiSearchCommand) matches(mbox *mailbox, selected imapbackend.Mailbox) bool {
+	switch cmd.filter {
+	case "selected":
+		return selected != nil && selected.Name() == mbox.name
+	case "personal":
+		return true
+	}
+	for _, name := range cmd.mailboxes {
+		if mbox.name == name {
+			return true
+		}
+		if cmd.filter == "subtree" && strings.HasPrefix(mbox.name, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (cmd *multiSearchCommand) Handle(conn server.Conn) error {
+	u, err := connUser(conn)
+	if err != nil {
+		return err
+	}
+
+	var resps []imap.WriterTo
+	u.backend.mutex.Lock()
+	for _, mbox := range u.mailboxes {
+		if !cmd.matches(mbox, conn.Context().Mailbox) {
+			continue
+		}
+		uids := mbox.search(true, cmd.search)
+
+		name, err := utf7.Encoding.NewEncoder().String(mbox.name)
+		if err != nil {
+			u.backend.mutex.Unlock()
+			return err
+		}
+		fields := []interface{}{
+			imap.RawString("ESEARCH"),
+			[]interface{}{
+				imap.RawString("MAILBOX"), name,
+				imap.RawString("UIDVALIDITY"), mbox.uidValidity,
+			},
+			imap.RawString("UID"),
+		}
+		if len(uids) > 0 {
+			var seqSet imap.SeqSet
+			seqSet.AddNum(uids...)
+			fields = append(fields, imap.RawString("ALL"), imap.RawString(seqSet.String()))
+		}
+		if cmd.count {
+			fields = append(fields, imap.RawString("COUNT"), uint32(len(uids)))
+		}
+		resps = append(resps, imap.NewUntaggedResp(fields))
+	}
+	u.backend.mutex.Unlock()
+
+	for _, resp := range resps {
+		if err := conn.WriteResp(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseMetadataEntries parses either a single entry name or a list of entry
+// names.
+func parseMetadataEntries(f interface{}) ([]string, error) {
+	if _, ok := f.([]interface{}); ok {
+		return imap.ParseStringList(f)
+	}
+	entry, err := imap.ParseString(f)
+	if err != nil {
+		return nil, err
+	}
+	return []string{entry}, nil
+}
+
+func connUser(conn server.Conn) (*user, error) {
+	u, ok := conn.Context().User.(*user)
+	if !ok {
+		return nil, server.ErrNotAuthenticated
+	}
+	return u, nil
+}
+
+type getMetadataCommand struct {
+	mailbox string
+	entries []string
+}
+
+func (cmd *getMetadataCommand) Parse(fields []interface{}) error {
+	// Options such as MAXSIZE and DEPTH are ignored
+	if len(fields) > 0 {
+		if _, ok := fields[0].([]interface{}); ok {
+			fields = fields[1:]
+		}
+	}
+	if len(fields) != 2 {
+		return errors.New("Expected a mailbox and a list of entries")
+	}
+
+	var err error
+	if cmd.mailbox, err = imap.ParseString(fields[0]); err != nil {
+		return err
+	}
+	cmd.entries, err = parseMetadataEntries(fields[1])
+	return err
+}
+
+func (cmd *getMetadataCommand) Handle(conn server.Conn) error {
+	u, err := connUser(conn)
+	if err != nil {
+		return err
+	}
+	if cmd.mailbox != "" {
+		return errors.New("Only server metadata is supported")
+	}
+
+	u.backend.mutex.Lock()
+	var values []interface{}
+	for _, entry := range cmd.entries {
+		if v, ok := u.metadata[entry]; ok {
+			values = append(values, entry, v)
+		}
+	}
+	u.backend.mutex.Unlock()
+
+	if len(values) == 0 {
+		return nil
+	}
+	return conn.WriteResp(imap.NewUntaggedResp([]interface{}{
+		imap.RawString("METADATA"),
+		cmd.mailbox,
+		values,
+	}))
+}
+
+type setMetadataCommand struct {
+	mailbox string
+	entries map[string]*string
+}
+
+func (cmd *setMetadataCommand) Parse(fields []interface{}) error {
+	if len(fields) != 2 {
+		return errors.New("Expected a mailbox and a list of entries")
+	}
+
+	var err error
+	if cmd.mailbox, err = imap.ParseString(fields[0]); err != nil {
+		return err
+	}
+
+	list, ok := fields[1].([]interface{})
+	if !ok || len(list)%2 != 0 {
+		return errors.New("Expected a list of entry-value pairs")
+	}
+	cmd.entries = make(map[string]*string, len(list)/2)
+	for i := 0; i < len(list); i += 2 {
+		entry, err := imap.ParseString(list[i])
+		if err != nil {
+			return err
+		}
+		if list[i+1] == nil {
+			cmd.entries[entry] = nil
+			continue
+		}
+		value, err := imap.ParseString(list[i+1])
+		if err != nil {
+			return err
+		}
+		cmd.entries[entry] = &value
+	}
+	return nil
+}
+
+func (cmd *setMetadataCommand) Handle(conn server.Conn) error {
+	u, err := connUser(conn)
+	if err != nil {
+		return err
+	}
+	if cmd.mailbox != "" {
+		return errors.New("Only server metadata is supported")
+	}
+
+	u.backend.mutex.Lock()
+	defer u.backend.mutex.Unlock()
+
+	for entry, value := range cmd.entries {
+		if value == nil {
+			delete(u.metadata, entry)
+		} else {
+			u.metadata[entry] = *value
+		}
+	}
+	return nil
+}
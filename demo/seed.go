@@ -0,0 +1,329 @@
+package demo
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+type seedMessage struct {
+	mailbox     string
+	age         time.Duration
+	flags       []string
+	from        string
+	to          string
+	subject     string
+	messageID   string
+	references  []string
+	contentType string
+	body        string
+}
+
+const seedDomain = "example.org"
+
+// seedInvite is attached to a seeded message and also stored in the demo
+// calendar. Dates are expanded by expandSeedDates.
+const seedInvite = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//alps//demo//EN
+METHOD:REQUEST
+BEGIN:VEVENT
+UID:kickoff@` + seedDomain + `
+DTSTAMP:{{now}}
+DTSTART:{{in 3 days}}
+DTEND:{{in 3 days and 1 hour}}
+SUMMARY:Project kick-off
+LOCATION:Meeting room 2
+ORGANIZER;CN=Bob Jones:mailto:bob@` + seedDomain + `
+ATTENDEE;CN=Demo User;PARTSTAT=NEEDS-ACTION:mailto:` + Username + `
+END:VEVENT
+END:VCALENDAR
+`
+
+// seedContacts are attached to a seeded message and also stored in the demo
+// address book.
+const seedContacts = `BEGIN:VCARD
+VERSION:4.0
+FN:Alice Smith
+EMAIL:alice@` + seedDomain + `
+TEL;TYPE=cell:+1-555-0100
+END:VCARD
+BEGIN:VCARD
+VERSION:4.0
+FN:Bob Jones
+EMAIL:bob@` + seedDomain + `
+ORG:Example Corp
+END:VCARD
+`
+
+// seedMessages are stored oldest first, so that UIDs follow message dates.
+var seedMessages = []seedMessage{
+	{
+		mailbox:   "INBOX",
+		age:       9 * 24 * time.Hour,
+		flags:     []string{imap.SeenFlag},
+		from:      "Alps Team <team@" + seedDomain + ">",
+		to:        Username,
+		subject:   "Welcome to alps",
+		messageID: "welcome",
+		body: `Hi!
+
+This is the alps demo mode. Everything you see is stored in memory and will
+be lost when alps exits.
+
+Messages sent to ` + Username + ` are delivered back to this INBOX, other
+recipients are silently discarded. Feel free to move, flag and delete
+messages, create folders or change settings.
+
+--
+The alps team
+`,
+	},
+	{
+		mailbox:   "INBOX",
+		age:       6 * 24 * time.Hour,
+		flags:     []string{imap.SeenFlag},
+		from:      "Alice Smith <alice@" + seedDomain + ">",
+		to:        Username,
+		subject:   "Lunch on Friday?",
+		messageID: "lunch-1",
+		body: `Hey,
+
+Are you free for lunch on Friday? There's a new place near the station I'd
+like to try.
+
+Alice
+`,
+	},
+	{
+		mailbox:    "Sent",
+		age:        6*24*time.Hour - 2*time.Hour,
+		flags:      []string{imap.SeenFlag},
+		from:       Username,
+		to:         "Alice Smith <alice@" + seedDomain + ">",
+		subject:    "Re: Lunch on Friday?",
+		messageID:  "lunch-2",
+		references: []string{"lunch-1"},
+		body: `Sounds great, 12:30?
+
+> Are you free for lunch on Friday? There's a new place near the station I'd
+> like to try.
+`,
+	},
+	{
+		mailbox:    "INBOX",
+		age:        5 * 24 * time.Hour,
+		flags:      []string{imap.SeenFlag, imap.FlaggedFlag},
+		from:       "Alice Smith <alice@" + seedDomain + ">",
+		to:         Username,
+		subject:    "Re: Lunch on Friday?",
+		messageID:  "lunch-3",
+		references: []string{"lunch-1", "lunch-2"},
+		body: `12:30 works. I'll book a table for two.
+
+> Sounds great, 12:30?
+`,
+	},
+	{
+		mailbox:     "INBOX",
+		age:         4 * 24 * time.Hour,
+		from:        "Bob Jones <bob@" + seedDomain + ">",
+		to:          Username,
+		subject:     "Project kick-off meeting",
+		messageID:   "kickoff",
+		contentType: `multipart/mixed; boundary="seed-boundary"`,
+		body: `--seed-boundary
+Content-Type: text/plain; charset=utf-8
+
+Hi,
+
+Please find attached the invitation for the kick-off meeting.
+
+Bob
+--seed-boundary
+Content-Type: text/calendar; charset=utf-8; method=REQUEST
+Content-Disposition: attachment; filename="invite.ics"
+
+` + seedInvite + `--seed-boundary--
+`,
+	},
+	{
+		mailbox:     "INBOX",
+		age:         3 * 24 * time.Hour,
+		from:        "Alice Smith <alice@" + seedDomain + ">",
+		to:          Username,
+		subject:     "Contact details",
+		messageID:   "contacts",
+		contentType: `multipart/mixed; boundary="seed-boundary"`,
+		body: `--seed-boundary
+Content-Type: text/plain; charset=utf-8
+
+Here are the contact details you asked for.
+
+Alice
+--seed-boundary
+Content-Type: text/vcard; charset=utf-8
+Content-Disposition: attachment; filename="contacts.vcf"
+
+` + seedContacts + `--seed-boundary--
+`,
+	},
+	{
+		mailbox:     "INBOX",
+		age:         2 * 24 * time.Hour,
+		from:        "Example Newsletter <news@" + seedDomain + ">",
+		to:          Username,
+		subject:     "This month at Example Corp",
+		messageID:   "newsletter",
+		contentType: `multipart/alternative; boundary="seed-boundary"`,
+		body: `--seed-boundary
+Content-Type: text/plain; charset=utf-8
+
+This month at Example Corp
+==========================
+
+* We moved to a new office.
+* Our summer party is coming up.
+
+Unsubscribe: https://` + seedDomain + `/unsubscribe
+--seed-boundary
+Content-Type: text/html; charset=utf-8
+
+<html>
+<body>
+<h1 style="color: #2a6ebb">This month at Example Corp</h1>
+<ul>
+<li>We moved to a <strong>new office</strong>.</li>
+<li>Our summer party is coming up.</li>
+</ul>
+<p><img src="https://` + seedDomain + `/logo.png" alt="Example Corp logo"></p>
+<p><a href="https://` + seedDomain + `/unsubscribe">Unsubscribe</a></p>
+</body>
+</html>
+--seed-boundary--
+`,
+	},
+	{
+		mailbox:   "INBOX",
+		age:       5 * time.Hour,
+		from:      "Bob Jones <bob@" + seedDomain + ">",
+		to:        Username,
+		subject:   "Quarterly report draft",
+		messageID: "report",
+		body: `Hi,
+
+Could you have a look at the quarterly report draft before Thursday?
+
+Thanks,
+Bob
+`,
+	},
+	{
+		mailbox:    "Drafts",
+		age:        3 * time.Hour,
+		flags:      []string{imap.SeenFlag, imap.DraftFlag},
+		from:       Username,
+		to:         "Bob Jones <bob@" + seedDomain + ">",
+		subject:    "Re: Quarterly report draft",
+		messageID:  "report-reply",
+		references: []string{"report"},
+		body: `Hi Bob,
+
+I had a first look, a few comments:
+
+`,
+	},
+	{
+		mailbox:   "Archive",
+		age:       60 * 24 * time.Hour,
+		flags:     []string{imap.SeenFlag},
+		from:      "Carol White <carol@" + seedDomain + ">",
+		to:        Username,
+		subject:   "Holiday pictures",
+		messageID: "holiday",
+		body: `The pictures from the trip are finally online!
+`,
+	},
+	{
+		mailbox:   "Junk",
+		age:       24 * time.Hour,
+		from:      "Prize Department <winner@lottery.invalid>",
+		to:        Username,
+		subject:   "You have WON!!!",
+		messageID: "spam",
+		body: `Congratulations, send us your bank details to claim your prize.
+`,
+	},
+	{
+		mailbox:   "Lists/alps-devel",
+		age:       7 * 24 * time.Hour,
+		flags:     []string{imap.SeenFlag},
+		from:      "Dave Brown <dave@" + seedDomain + ">",
+		to:        "alps-devel@" + seedDomain,
+		subject:   "[PATCH] Fix typo in README",
+		messageID: "patch",
+		body: `---
+ README.md | 2 +-
+ 1 file changed, 1 insertion(+), 1 deletion(-)
+`,
+	},
+}
+
+// expandSeedDates replaces the date placeholders used in seed calendar
+// attachments.
+func expandSeedDates(s string, now time.Time) string {
+	const layout = "20060102T150405Z"
+	start := now.Add(3 * 24 * time.Hour).Truncate(time.Hour)
+	return strings.NewReplacer(
+		"{{now}}", now.UTC().Format(layout),
+		"{{in 3 days}}", start.UTC().Format(layout),
+		"{{in 3 days and 1 hour}}", start.Add(time.Hour).UTC().Format(layout),
+	).Replace(s)
+}
+
+func (msg *seedMessage) bytes(now time.Time) []byte {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Date: %v\n", now.Add(-msg.age).Format(time.RFC1123Z))
+	fmt.Fprintf(&sb, "From: %v\n", msg.from)
+	fmt.Fprintf(&sb, "To: %v\n", msg.to)
+	fmt.Fprintf(&sb, "Subject: %v\n", msg.subject)
+	fmt.Fprintf(&sb, "Message-Id: <%v@%v>\n", msg.messageID, seedDomain)
+	if n := len(msg.references); n > 0 {
+		refs := make([]string, n)
+		for i, ref := range msg.references {
+			refs[i] = "<" + ref + "@" + seedDomain + ">"
+		}
+		fmt.Fprintf(&sb, "In-Reply-To: %v\n", refs[n-1])
+		fmt.Fprintf(&sb, "References: %v\n", strings.Join(refs, " "))
+	}
+	contentType := msg.contentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	sb.WriteString("MIME-Version: 1.0\n")
+	fmt.Fprintf(&sb, "Content-Type: %v\n", contentType)
+	sb.WriteString("\n")
+	sb.WriteString(expandSeedDates(msg.body, now))
+	return []byte(strings.ReplaceAll(sb.String(), "\n", "\r\n"))
+}
+
+// seed creates the default mailboxes for a user and fills them with sample
+// messages.
+func seed(u *user) {
+	u.addMailbox("Archive", imap.ArchiveAttr)
+	u.addMailbox("Drafts", imap.DraftsAttr)
+	u.addMailbox("Sent", imap.SentAttr)
+	u.addMailbox("Junk", imap.JunkAttr)
+	u.addMailbox("Trash", imap.TrashAttr)
+	u.addMailbox("Lists", "")
+	u.addMailbox("Lists/alps-devel", "")
+
+	now := time.Now()
+	for _, msg := range seedMessages {
+		mbox := u.mailboxes[msg.mailbox]
+		date := now.Add(-msg.age)
+		mbox.appendMessage(msg.bytes(now), append([]string(nil), msg.flags...), date)
+	}
+}
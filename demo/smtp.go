@@ -0,0 +1,90 @@
+package demo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// smtpBackend accepts messages from authenticated users and delivers them to
+// the INBOX of local recipients. Messages to other recipients are discarded.
+type smtpBackend struct {
+	backend *backend
+}
+
+func (be *smtpBackend) Login(_ *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if _, err := be.backend.Login(nil, username, password); err != nil {
+		return nil, err
+	}
+	return &smtpSession{backend: be.backend}, nil
+}
+
+func (be *smtpBackend) AnonymousLogin(_ *smtp.ConnectionState) (smtp.Session, error) {
+	return nil, smtp.ErrAuthRequired
+}
+
+type smtpSession struct {
+	backend *backend
+	from    string
+	to      []string
+}
+
+func (s *smtpSession) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *smtpSession) Logout() error {
+	return nil
+}
+
+func (s *smtpSession) Mail(from string, opts smtp.MailOptions) error {
+	s.from = from
+	return nil
+}
+
+func (s *smtpSession) Rcpt(to string) error {
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *smtpSession) Data(r io.Reader) error {
+	if len(s.to) == 0 {
+		return errors.New("no recipients")
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Return-Path: <%v>\r\n", s.from)
+	if _, err := io.Copy(&buf, r); err != nil {
+		return err
+	}
+
+	for _, to := range s.to {
+		username := s.localUser(to)
+		if username == "" {
+			continue
+		}
+		if err := s.backend.deliver(username, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localUser returns the username matching an address, or an empty string if
+// the address doesn't belong to a local user.
+func (s *smtpSession) localUser(addr string) string {
+	s.backend.mutex.Lock()
+	defer s.backend.mutex.Unlock()
+
+	for username := range s.backend.users {
+		if strings.EqualFold(username, addr) {
+			return username
+		}
+	}
+	return ""
+}
@@ -0,0 +1,78 @@
+package demo
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// wkdKeyOwners are the seeded correspondents with an OpenPGP key, so that
+// messages to them can be encrypted.
+var wkdKeyOwners = []struct {
+	name    string
+	address string
+}{
+	{"Alice Smith", "alice@" + seedDomain},
+}
+
+var wkdKeyConfig = &packet.Config{
+	DefaultHash:   crypto.SHA256,
+	DefaultCipher: packet.CipherAES256,
+}
+
+// wkdHandler is a local stand-in for the Web Key Directory of the seeded
+// correspondents. It serves the advanced method URLs, looking up keys by the
+// "l" query parameter instead of the hashed local part.
+type wkdHandler struct {
+	// Serialized public keys, by lowercase address
+	keys map[string][]byte
+}
+
+// newWKDHandler generates keys for the correspondents. Their private keys are
+// discarded.
+func newWKDHandler() (*wkdHandler, error) {
+	h := &wkdHandler{keys: make(map[string][]byte)}
+	for _, owner := range wkdKeyOwners {
+		e, err := openpgp.NewEntity(owner.name, "", owner.address, wkdKeyConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate OpenPGP key: %v", err)
+		}
+		// Algorithm preferences are only signed when the private key is
+		// serialized
+		if err := e.SerializePrivate(ioutil.Discard, nil); err != nil {
+			return nil, fmt.Errorf("failed to sign OpenPGP key: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := e.Serialize(&buf); err != nil {
+			return nil, fmt.Errorf("failed to serialize OpenPGP key: %v", err)
+		}
+		h.keys[strings.ToLower(owner.address)] = buf.Bytes()
+	}
+	return h, nil
+}
+
+func (h *wkdHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// /.well-known/openpgpkey/<domain>/hu/<hash>
+	path := strings.TrimPrefix(req.URL.Path, "/.well-known/openpgpkey/")
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 || parts[1] != "hu" {
+		http.NotFound(w, req)
+		return
+	}
+
+	address := strings.ToLower(req.URL.Query().Get("l") + "@" + parts[0])
+	key, ok := h.keys[address]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(key)
+}
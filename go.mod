@@ -3,6 +3,7 @@ module git.sr.ht/~migadu/alps
 go 1.13
 
 require (
+	github.com/ProtonMail/go-crypto v1.0.0
 	github.com/aymerick/douceur v0.2.0
 	github.com/chris-ramon/douceur v0.2.0
 	github.com/dustin/go-humanize v1.0.0
@@ -28,15 +29,18 @@ require (
 	github.com/ssor/bom v0.0.0-20170718123548-6386211fdfcf // indirect
 	github.com/teambition/rrule-go v1.8.0 // indirect
 	github.com/tkuchiki/go-timezone v0.2.2
+	github.com/yuin/goldmark v1.4.12
 	github.com/yuin/gopher-lua v0.0.0-20220504180219-658193537a64
 	gitlab.com/golang-commonmark/linkify v0.0.0-20200225224916-64bca66f6ad3
 	go.guido-berhoerster.org/managesieve v0.8.1
-	golang.org/x/crypto v0.0.0-20220507011949-2cf3adece122 // indirect
-	golang.org/x/net v0.0.0-20220425223048-2871e0cb64e4
-	golang.org/x/sys v0.0.0-20220503163025-988cb79eb6c6 // indirect
+	go.mozilla.org/pkcs7 v0.9.0
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
+	golang.org/x/sys v0.13.0 // indirect
 	golang.org/x/time v0.0.0-20220411224347-583f2d630306 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 	gopkg.in/ini.v1 v1.66.4
 	jaytaylor.com/html2text v0.0.0-20211105163654-bc68cce691ba // indirect
 	layeh.com/gopher-luar v1.0.10
+	software.sslmate.com/src/go-pkcs12 v0.4.0
 )
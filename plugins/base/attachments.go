@@ -0,0 +1,117 @@
+package alpsbase
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	imapclient "github.com/emersion/go-imap/client"
+)
+
+// Maximum length of a file name in an archive, in bytes
+const maxFilenameLen = 200
+
+// sanitizeFilename returns a file name which can safely be used on common
+// file systems. Directories are stripped, as well as characters reserved on
+// Windows. An empty string is returned if nothing is left.
+func sanitizeFilename(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, " .")
+
+	if len(name) > maxFilenameLen {
+		ext := path.Ext(name)
+		if len(ext) > maxFilenameLen/2 {
+			ext = ""
+		}
+		base := name[:maxFilenameLen-len(ext)]
+		// Don't cut a multi-byte character in half
+		for len(base) > 0 && !utf8.ValidString(base) {
+			base = base[:len(base)-1]
+		}
+		name = strings.TrimRight(base, " .") + ext
+	}
+
+	return name
+}
+
+// attachmentFilenames returns a file name for each attachment, unique within
+// the list. Duplicates are suffixed with a counter, e.g. "report (2).pdf".
+func attachmentFilenames(attachments []IMAPPartNode) []string {
+	names := make([]string, len(attachments))
+	used := make(map[string]bool)
+	for i, att := range attachments {
+		name := sanitizeFilename(att.Filename)
+		if name == "" {
+			name = fmt.Sprintf("attachment-%d", i+1)
+		}
+
+		ext := path.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for n := 2; used[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+		}
+
+		used[strings.ToLower(name)] = true
+		names[i] = name
+	}
+	return names
+}
+
+// attachmentsArchiveName returns the name of the archive of the attachments
+// of a message, after its subject.
+func attachmentsArchiveName(msg *IMAPMessage) string {
+	var name string
+	if msg.Envelope != nil {
+		// Slashes in the subject aren't directory separators
+		subject := strings.NewReplacer("/", "_", `\`, "_").Replace(msg.Envelope.Subject)
+		name = sanitizeFilename(subject)
+	}
+	if name == "" {
+		name = "attachments"
+	}
+	return name + ".zip"
+}
+
+// writeAttachmentsZip writes the attachments of a message to a ZIP archive.
+// Attachments are fetched one at a time, and written as they are fetched.
+func writeAttachmentsZip(c *imapclient.Client, msg *IMAPMessage, w io.Writer) error {
+	attachments := msg.Attachments()
+	names := attachmentFilenames(attachments)
+
+	zw := zip.NewWriter(w)
+	for i, att := range attachments {
+		_, part, err := peekMessagePart(c, msg.Mailbox, msg.Uid, att.Path)
+		if err != nil {
+			return err
+		}
+
+		fh := &zip.FileHeader{
+			Name:   names[i],
+			Method: zip.Deflate,
+		}
+		if msg.Envelope != nil {
+			fh.Modified = msg.Envelope.Date
+		}
+		fw, err := zw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(fw, part.Body); err != nil {
+			return fmt.Errorf("failed to write attachment %q: %v", names[i], err)
+		}
+	}
+	return zw.Close()
+}
@@ -0,0 +1,227 @@
+package alpsbase
+
+import (
+	"fmt"
+	"strings"
+
+	"git.sr.ht/~migadu/alps/config"
+	"github.com/emersion/go-message/mail"
+)
+
+// AuthResult is the result of a message authentication method, as reported
+// in an Authentication-Results header field (RFC 8601).
+type AuthResult struct {
+	// Lowercase method name, e.g. "dkim"
+	Method string
+	// Lowercase result, e.g. "pass"
+	Result string
+	Reason string
+	// Identity the result applies to, e.g. the signing domain for DKIM, if
+	// reported
+	Identity string
+}
+
+// Class returns "pass", "fail" or "neutral", depending on the result.
+func (res *AuthResult) Class() string {
+	switch res.Result {
+	case "pass":
+		return "pass"
+	case "fail", "softfail", "hardfail", "permerror":
+		return "fail"
+	default:
+		return "neutral"
+	}
+}
+
+// MethodName returns the name of the method for display.
+func (res *AuthResult) MethodName() string {
+	return strings.ToUpper(res.Method)
+}
+
+// authMethods are the methods displayed to users, in order.
+var authMethods = []string{"dkim", "spf", "dmarc", "arc"}
+
+// authIdentityProperties are the properties identifying what each method
+// checked, by order of preference.
+var authIdentityProperties = map[string][]string{
+	"dkim":  {"header.d", "header.i"},
+	"spf":   {"smtp.mailfrom", "smtp.helo"},
+	"dmarc": {"header.from"},
+}
+
+// getAuthResults returns the results reported by the trusted servers. Fields
+// added by other servers are ignored, since anyone could have added them.
+func getAuthResults(cfg *config.AuthResultsConfig, h mail.Header) []AuthResult {
+	trusted := make(map[string]bool)
+	for _, id := range cfg.TrustedAuthServIDs {
+		if id = strings.TrimSpace(id); id != "" {
+			trusted[strings.ToLower(id)] = true
+		}
+	}
+	if len(trusted) == 0 {
+		return nil
+	}
+
+	var results []AuthResult
+	for _, v := range h.Values("Authentication-Results") {
+		id, l, err := parseAuthResults(v)
+		if err != nil || !trusted[strings.ToLower(id)] {
+			continue
+		}
+		results = append(results, l...)
+	}
+
+	var sorted []AuthResult
+	for _, method := range authMethods {
+		for _, res := range results {
+			if res.Method == method {
+				sorted = append(sorted, res)
+			}
+		}
+	}
+	return sorted
+}
+
+// parseAuthResults parses the value of an Authentication-Results header
+// field. Comments are discarded.
+func parseAuthResults(v string) (authServID string, results []AuthResult, err error) {
+	stmts, err := splitAuthResults(v)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(stmts) == 0 || len(stmts[0]) == 0 {
+		return "", nil, fmt.Errorf("missing authserv-id")
+	}
+	authServID = stmts[0][0]
+
+	for _, words := range stmts[1:] {
+		if len(words) == 0 {
+			continue
+		}
+		if len(words) == 1 && strings.EqualFold(words[0], "none") {
+			break
+		}
+
+		method, result, ok := splitAuthParam(words[0])
+		if !ok {
+			return "", nil, fmt.Errorf("malformed method result %q", words[0])
+		}
+		if i := strings.IndexByte(method, '/'); i >= 0 {
+			method = method[:i]
+		}
+		res := AuthResult{
+			Method: strings.ToLower(method),
+			Result: strings.ToLower(result),
+		}
+
+		props := make(map[string]string)
+		for _, word := range words[1:] {
+			k, v, ok := splitAuthParam(word)
+			if !ok {
+				continue
+			}
+			k = strings.ToLower(k)
+			if k == "reason" {
+				res.Reason = v
+			} else {
+				props[k] = v
+			}
+		}
+		for _, k := range authIdentityProperties[res.Method] {
+			if v := props[k]; v != "" {
+				res.Identity = v
+				break
+			}
+		}
+
+		results = append(results, res)
+	}
+
+	return authServID, results, nil
+}
+
+func splitAuthParam(word string) (k, v string, ok bool) {
+	i := strings.IndexByte(word, '=')
+	if i <= 0 {
+		return "", "", false
+	}
+	return word[:i], word[i+1:], true
+}
+
+// splitAuthResults splits the value of an Authentication-Results header field
+// into semicolon-separated statements made of words. Quoted strings are
+// unquoted, comments are dropped and spaces around "=" are removed.
+func splitAuthResults(v string) ([][]string, error) {
+	var stmts [][]string
+	var words []string
+	var word strings.Builder
+	inWord := false
+
+	endWord := func() {
+		if inWord {
+			words = append(words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; c {
+		case ' ', '\t', '\r', '\n':
+			endWord()
+		case ';':
+			endWord()
+			stmts = append(stmts, words)
+			words = nil
+		case '(':
+			endWord()
+			depth := 1
+			for i++; i < len(v) && depth > 0; i++ {
+				switch v[i] {
+				case '\\':
+					i++
+				case '(':
+					depth++
+				case ')':
+					depth--
+				}
+			}
+			if depth > 0 {
+				return nil, fmt.Errorf("unterminated comment")
+			}
+			i--
+		case '"':
+			inWord = true
+			for i++; i < len(v) && v[i] != '"'; i++ {
+				if v[i] == '\\' && i+1 < len(v) {
+					i++
+				}
+				word.WriteByte(v[i])
+			}
+			if i >= len(v) {
+				return nil, fmt.Errorf("unterminated quoted string")
+			}
+		default:
+			inWord = true
+			word.WriteByte(c)
+		}
+	}
+	endWord()
+	stmts = append(stmts, words)
+
+	// Parameters may be written as "key = value"
+	for i, words := range stmts {
+		var joined []string
+		for _, w := range words {
+			n := len(joined)
+			if n > 0 && (w[0] == '=' || strings.HasSuffix(joined[n-1], "=")) {
+				joined[n-1] += w
+			} else {
+				joined = append(joined, w)
+			}
+		}
+		stmts[i] = joined
+	}
+
+	return stmts, nil
+}
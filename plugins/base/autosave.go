@@ -0,0 +1,146 @@
+package alpsbase
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+)
+
+// autosaveInterval is the minimum delay between two automatic saves of a
+// draft.
+const autosaveInterval = 30 * time.Second
+
+var (
+	errAutosaveConflict = errors.New("the draft has been changed in another window")
+	errAutosaveTooSoon  = errors.New("the draft has been saved recently")
+)
+
+// AutosaveResult is returned to the compose page after a draft has been saved
+// automatically. Later saves must replace the new draft and refer to its
+// attachments.
+type AutosaveResult struct {
+	Mailbox     string
+	Uid         uint32
+	Attachments []DraftAttachment
+}
+
+type DraftAttachment struct {
+	Path      string
+	Filename  string
+	MIMEType  string
+	ContentID string
+	URL       string
+}
+
+func newAutosaveResult(msg *IMAPMessage, related bool) *AutosaveResult {
+	result := &AutosaveResult{
+		Mailbox:     msg.Mailbox,
+		Uid:         msg.Uid,
+		Attachments: []DraftAttachment{},
+	}
+
+	attachments := msg.Attachments()
+	if related {
+		attachments = append(attachments, msg.RelatedParts()...)
+	}
+	for _, node := range attachments {
+		result.Attachments = append(result.Attachments, DraftAttachment{
+			Path:      node.PathString(),
+			Filename:  node.Filename,
+			MIMEType:  node.MIMEType,
+			ContentID: node.ContentID,
+			URL:       node.URL(true).String(),
+		})
+	}
+	return result
+}
+
+// checkDraft makes sure prev is the latest copy of the draft, and returns the
+// Drafts mailbox. Another window editing the same message would have replaced
+// it with a copy with the same Message-Id.
+func checkDraft(c *imapclient.Client, messageID string, prev *messagePath) (*MailboxInfo, error) {
+	drafts, err := getMailboxByType(c, mailboxDrafts)
+	if err != nil {
+		return nil, err
+	} else if drafts == nil {
+		return nil, fmt.Errorf("Unable to resolve mailbox")
+	}
+
+	uids, err := searchMessageID(c, drafts.Name, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if prev == nil || prev.Mailbox != drafts.Name {
+		if len(uids) > 0 {
+			return nil, errAutosaveConflict
+		}
+		return drafts, nil
+	}
+	if len(uids) != 1 || uids[0] != prev.Uid {
+		return nil, errAutosaveConflict
+	}
+	return drafts, nil
+}
+
+// checkAutosave makes sure the draft can be saved automatically: prev must be
+// the latest copy of the draft, and drafts saved less than autosaveInterval
+// ago are not replaced.
+func checkAutosave(c *imapclient.Client, messageID string, prev *messagePath) error {
+	drafts, err := checkDraft(c, messageID, prev)
+	if err != nil {
+		return err
+	}
+	if prev == nil || prev.Mailbox != drafts.Name {
+		return nil
+	}
+
+	msg, err := fetchMessageStructure(c, prev.Mailbox, prev.Uid)
+	if err != nil {
+		return err
+	}
+	if time.Since(msg.InternalDate) < autosaveInterval {
+		return errAutosaveTooSoon
+	}
+	return nil
+}
+
+// fetchMessageStructure fetches the envelope, flags, body structure and
+// internal date of a message, without its body.
+func fetchMessageStructure(c *imapclient.Client, mboxName string, uid uint32) (*IMAPMessage, error) {
+	if err := ensureMailboxSelected(c, mboxName); err != nil {
+		return nil, err
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+	fetch := []imap.FetchItem{
+		imap.FetchUid,
+		imap.FetchEnvelope,
+		imap.FetchFlags,
+		imap.FetchInternalDate,
+		imap.FetchBodyStructure,
+	}
+
+	ch := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqSet, fetch, ch)
+	}()
+
+	msg := <-ch
+	if msg == nil {
+		return nil, fmt.Errorf("server didn't return message")
+	}
+	for range ch {
+	}
+
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to fetch message: %v", err)
+	}
+
+	return &IMAPMessage{msg, mboxName}, nil
+}
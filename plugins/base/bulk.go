@@ -0,0 +1,340 @@
+package alpsbase
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+)
+
+const uidPlusCapability = "UIDPLUS"
+
+const (
+	// Maximum number of messages a single command of a bulk action applies
+	// to
+	bulkBatchSize = 500
+	// Time after which a bulk action stops to report its progress. The user
+	// is then asked to resume it.
+	bulkTimeLimit = 10 * time.Second
+)
+
+// uidExpungeCommand is a UID EXPUNGE command, as defined in RFC 4315.
+type uidExpungeCommand struct {
+	SeqSet *imap.SeqSet
+}
+
+func (cmd *uidExpungeCommand) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "UID",
+		Arguments: []interface{}{imap.RawString("EXPUNGE"), cmd.SeqSet},
+	}
+}
+
+// expungeMessages permanently removes the messages with the \Deleted flag
+// among seqSet in the selected mailbox. Other messages with the \Deleted flag
+// are left alone: if the server doesn't support UID EXPUNGE, their flag is
+// removed while expunging and restored afterwards.
+func expungeMessages(c *imapclient.Client, seqSet *imap.SeqSet) error {
+	if ok, err := c.Support(uidPlusCapability); err != nil {
+		return err
+	} else if ok {
+		status, err := c.Execute(&uidExpungeCommand{seqSet}, nil)
+		if err == nil {
+			err = status.Err()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to expunge messages: %v", err)
+		}
+		return nil
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.WithFlags = []string{imap.DeletedFlag}
+	criteria.Not = []*imap.SearchCriteria{{Uid: seqSet}}
+	others, err := c.UidSearch(criteria)
+	if err != nil {
+		return fmt.Errorf("failed to search deleted messages: %v", err)
+	}
+
+	var othersSet imap.SeqSet
+	othersSet.AddNum(others...)
+	flags := []interface{}{imap.DeletedFlag}
+	if len(others) > 0 {
+		item := imap.FormatFlagsOp(imap.RemoveFlags, true)
+		if err := c.UidStore(&othersSet, item, flags, nil); err != nil {
+			return fmt.Errorf("failed to remove deleted flag: %v", err)
+		}
+	}
+
+	if err := c.Expunge(nil); err != nil {
+		return fmt.Errorf("failed to expunge mailbox: %v", err)
+	}
+
+	if len(others) > 0 {
+		item := imap.FormatFlagsOp(imap.AddFlags, true)
+		if err := c.UidStore(&othersSet, item, flags, nil); err != nil {
+			return fmt.Errorf("failed to restore deleted flag: %v", err)
+		}
+	}
+	return nil
+}
+
+// deleteMessages permanently deletes messages from a mailbox.
+func deleteMessages(c *imapclient.Client, mboxName string, seqSet *imap.SeqSet) error {
+	if err := ensureMailboxSelected(c, mboxName); err != nil {
+		return err
+	}
+
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	flags := []interface{}{imap.DeletedFlag}
+	if err := c.UidStore(seqSet, item, flags, nil); err != nil {
+		return fmt.Errorf("failed to add deleted flag: %v", err)
+	}
+
+	return expungeMessages(c, seqSet)
+}
+
+// canEmptyMailbox returns true if all messages of the mailbox can be deleted
+// at once. Only Junk and Trash can be emptied.
+func canEmptyMailbox(mailboxes []MailboxInfo, mboxName string) bool {
+	for i := range mailboxes {
+		if mailboxes[i].Name == mboxName {
+			return isJunkOrTrash(&mailboxes[i])
+		}
+	}
+	return false
+}
+
+// bulkAction keeps track of an action applied to many messages. The messages
+// are either the ones selected by the user, or all the messages matching a
+// search if the "all" field is set.
+//
+// Bulk actions are run in batches. If the action takes too long, it is
+// interrupted and the user is asked to resume it: the "resume" and "done"
+// fields are then set to the last message processed and the number of
+// messages processed so far.
+//
+// Searches in a single mailbox are limited to the messages which existed when
+// the action was confirmed, with the "uid_next" and "uid_validity" fields.
+// Otherwise, messages arriving in the meantime would be included when the
+// action is resumed.
+type bulkAction struct {
+	// Mailbox the action has been requested from, if any
+	Mailbox string
+	// Messages selected by the user, unless All is set
+	Refs map[string][]uint32
+	// If set, the action applies to the messages matching Criteria, in the
+	// mailboxes specified by Scope
+	All      bool
+	Criteria *imap.SearchCriteria
+	Scope    string
+	// Mailbox left out by the action, e.g. the destination of a move
+	Exclude string
+	// If set, only messages with a lower UID are searched in Mailbox, as long
+	// as its UIDVALIDITY matches
+	UidNext, UidValidity uint32
+
+	// Reference of the last message processed, empty if none
+	Resume string
+	// Number of messages processed so far, and in total
+	Done, Total int
+}
+
+func parseBulkAction(mboxName string, params url.Values, loc *time.Location) (*bulkAction, error) {
+	action := &bulkAction{
+		Mailbox: mboxName,
+		All:     params.Get("all") != "",
+		Resume:  params.Get("resume"),
+	}
+
+	if action.All {
+		action.Scope = params.Get("scope")
+		switch action.Scope {
+		case searchScopeMailbox:
+			if mboxName == "" {
+				return nil, fmt.Errorf("searching a single mailbox requires a mailbox")
+			}
+		case searchScopeAll, searchScopeEverywhere:
+		default:
+			return nil, fmt.Errorf("invalid search scope")
+		}
+
+		action.Criteria = imap.NewSearchCriteria()
+		if query := params.Get("query"); query != "" {
+			var err error
+			if action.Criteria, err = PrepareSearch(query, loc); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		var err error
+		if action.Refs, err = parseMessageRefs(mboxName, params); err != nil {
+			return nil, err
+		}
+	}
+
+	if action.Resume != "" {
+		if _, _, err := parseMessageRef(action.Resume); err != nil {
+			return nil, err
+		}
+	}
+	if s := params.Get("uid_next"); s != "" {
+		var err error
+		if action.UidNext, err = parseUid(s); err != nil {
+			return nil, fmt.Errorf("invalid 'uid_next' value: %v", err)
+		}
+		if action.UidValidity, err = parseUid(params.Get("uid_validity")); err != nil {
+			return nil, fmt.Errorf("invalid 'uid_validity' value: %v", err)
+		}
+	}
+	if s := params.Get("done"); s != "" {
+		var err error
+		if action.Done, err = strconv.Atoi(s); err != nil || action.Done < 0 {
+			return nil, fmt.Errorf("invalid 'done' value")
+		}
+	}
+
+	return action, nil
+}
+
+// Empty returns true if the user selected no message.
+func (action *bulkAction) Empty() bool {
+	return !action.All && countMessageRefs(action.Refs) == 0
+}
+
+// Complete returns true if the action has been applied to all messages.
+func (action *bulkAction) Complete() bool {
+	return action.Resume == ""
+}
+
+// search returns the messages the action applies to, by mailbox.
+func (action *bulkAction) search(c *imapclient.Client) (map[string][]uint32, error) {
+	if !action.All {
+		return action.Refs, nil
+	}
+
+	if action.Scope != searchScopeMailbox {
+		includeJunk := action.Scope == searchScopeEverywhere
+		return searchUidsByMailbox(c, action.Criteria, includeJunk)
+	}
+
+	if err := ensureMailboxSelected(c, action.Mailbox); err != nil {
+		return nil, err
+	}
+
+	// Remember which messages exist, for later steps
+	mbox := c.Mailbox()
+	if action.UidNext == 0 && mbox.UidNext > 0 && mbox.UidValidity > 0 {
+		action.UidNext = mbox.UidNext
+		action.UidValidity = mbox.UidValidity
+	}
+
+	criteria := *action.Criteria
+	if action.UidNext > 0 {
+		if mbox.UidValidity != action.UidValidity {
+			return nil, fmt.Errorf("mailbox %q has been recreated in the meantime", action.Mailbox)
+		} else if action.UidNext == 1 {
+			return nil, nil
+		}
+		criteria.Uid = new(imap.SeqSet)
+		criteria.Uid.AddRange(1, action.UidNext-1)
+	}
+
+	uids, err := c.UidSearch(&criteria)
+	if err != nil {
+		return nil, fmt.Errorf("UID SEARCH failed: %v", err)
+	}
+	return map[string][]uint32{action.Mailbox: uids}, nil
+}
+
+// Run applies f to the messages in batches, mailbox by mailbox, by ascending
+// UID. Messages up to Resume are skipped. Run returns early if the action
+// takes longer than bulkTimeLimit, in which case Resume is updated.
+func (action *bulkAction) Run(c *imapclient.Client, f func(mboxName string, seqSet *imap.SeqSet) error) error {
+	refs, err := action.search(c)
+	if err != nil {
+		return err
+	}
+
+	var resumeMbox string
+	var resumeUid uint32
+	if action.Resume != "" {
+		resumeMbox, resumeUid, _ = parseMessageRef(action.Resume)
+	}
+
+	var names []string
+	for name, uids := range refs {
+		if name == action.Exclude || name < resumeMbox {
+			continue
+		}
+		sort.Slice(uids, func(i, j int) bool {
+			return uids[i] < uids[j]
+		})
+		if name == resumeMbox {
+			i := sort.Search(len(uids), func(i int) bool {
+				return uids[i] > resumeUid
+			})
+			uids = uids[i:]
+		}
+		if len(uids) > 0 {
+			refs[name] = uids
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	action.Total = action.Done
+	for _, name := range names {
+		action.Total += len(refs[name])
+	}
+
+	start := time.Now()
+	batches := 0
+	for _, name := range names {
+		uids := refs[name]
+		for len(uids) > 0 {
+			// Process at least one batch, to make progress
+			if batches > 0 && time.Since(start) > bulkTimeLimit {
+				return nil
+			}
+
+			n := len(uids)
+			if n > bulkBatchSize {
+				n = bulkBatchSize
+			}
+
+			var seqSet imap.SeqSet
+			seqSet.AddNum(uids[:n]...)
+			if err := f(name, &seqSet); err != nil {
+				return err
+			}
+
+			batches++
+			action.Done += n
+			action.Resume = formatMessageRef(name, uids[n-1])
+			uids = uids[n:]
+		}
+	}
+
+	action.Resume = ""
+	return nil
+}
+
+// Params returns the form fields to post to resume the action.
+func (action *bulkAction) Params(params url.Values) url.Values {
+	next := make(url.Values)
+	for k, v := range params {
+		next[k] = v
+	}
+	next.Set("resume", action.Resume)
+	next.Set("done", strconv.Itoa(action.Done))
+	if action.UidNext > 0 {
+		next.Set("uid_next", strconv.FormatUint(uint64(action.UidNext), 10))
+		next.Set("uid_validity", strconv.FormatUint(uint64(action.UidValidity), 10))
+	}
+	return next
+}
@@ -0,0 +1,379 @@
+package alpsbase_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~migadu/alps"
+	"git.sr.ht/~migadu/alps/config"
+	"git.sr.ht/~migadu/alps/demo"
+	_ "git.sr.ht/~migadu/alps/plugins/base"
+	_ "git.sr.ht/~migadu/alps/plugins/viewtext"
+	"github.com/fernet/fernet-go"
+	"github.com/labstack/echo/v4"
+)
+
+func TestMain(m *testing.M) {
+	// Plugins and themes are loaded relative to the repository root
+	if err := os.Chdir("../.."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// testClient is an HTTP client logged into an alps server backed by the demo
+// servers.
+type testClient struct {
+	t      *testing.T
+	url    string
+	client *http.Client
+}
+
+func newTestClient(t *testing.T) *testClient {
+	demoServer, err := demo.Start()
+	if err != nil {
+		t.Fatalf("failed to start demo servers: %v", err)
+	}
+	t.Cleanup(func() { demoServer.Close() })
+
+	cfg := config.DefaultConfig("./themes")
+	cfg.General.Upstreams = demoServer.Upstreams()
+	cfg.UI.Theme = "alps"
+	cfg.OpenPGP.WKDURL = demoServer.WKDURL
+	var key fernet.Key
+	if err := key.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Security.LoginKey = &key
+
+	e := echo.New()
+	e.Logger.SetOutput(ioutil.Discard)
+	s, err := alps.New(e, cfg)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	t.Cleanup(s.Close)
+
+	ts := httptest.NewServer(e)
+	t.Cleanup(ts.Close)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := &testClient{
+		t:      t,
+		url:    ts.URL,
+		client: &http.Client{Jar: jar, Timeout: 30 * time.Second},
+	}
+
+	body := tc.post("/login", url.Values{
+		"username": {demo.Username},
+		"password": {demo.Password},
+	})
+	if !strings.Contains(body, "Welcome to alps") {
+		t.Fatalf("INBOX not displayed after login")
+	}
+	return tc
+}
+
+func (tc *testClient) check(resp *http.Response, err error) string {
+	tc.t.Helper()
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		tc.t.Fatalf("%v %v: unexpected status %v: %s", resp.Request.Method,
+			resp.Request.URL.Path, resp.Status, b)
+	}
+	return string(b)
+}
+
+func (tc *testClient) get(path string) string {
+	tc.t.Helper()
+	return tc.check(tc.client.Get(tc.url + path))
+}
+
+func (tc *testClient) post(path string, form url.Values) string {
+	tc.t.Helper()
+	return tc.check(tc.client.PostForm(tc.url+path, form))
+}
+
+func (tc *testClient) postMultipart(path string, form url.Values) string {
+	tc.t.Helper()
+	return tc.check(tc.postMultipartResponse(path, form))
+}
+
+func (tc *testClient) postMultipartResponse(path string, form url.Values) (*http.Response, error) {
+	tc.t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, values := range form {
+		for _, v := range values {
+			mw.WriteField(k, v)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		tc.t.Fatal(err)
+	}
+	return tc.client.Post(tc.url+path, mw.FormDataContentType(), &buf)
+}
+
+func TestMailbox(t *testing.T) {
+	tc := newTestClient(t)
+
+	inbox := tc.get("/mailbox/INBOX")
+	for _, subject := range []string{"Quarterly report draft", "Project kick-off meeting"} {
+		if !strings.Contains(inbox, subject) {
+			t.Errorf("INBOX doesn't list %q", subject)
+		}
+	}
+	if strings.Contains(inbox, "Holiday pictures") {
+		t.Errorf("INBOX lists a message of another mailbox")
+	}
+
+	archive := tc.get("/mailbox/Archive")
+	if !strings.Contains(archive, "Holiday pictures") {
+		t.Errorf("Archive doesn't list its message")
+	}
+}
+
+func TestMessage(t *testing.T) {
+	tc := newTestClient(t)
+
+	// The welcome message is the first one of the INBOX
+	body := tc.get("/message/INBOX/1?part=1")
+	if !strings.Contains(body, "This is the alps demo mode.") {
+		t.Errorf("message text not displayed")
+	}
+
+	raw := tc.get("/message/INBOX/1/raw")
+	if !strings.Contains(raw, "Message-Id: <welcome@example.org>") {
+		t.Errorf("raw message doesn't contain the header")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	tc := newTestClient(t)
+
+	body := tc.get("/mailbox/INBOX?query=" + url.QueryEscape("from:alice"))
+	if !strings.Contains(body, "Lunch on Friday?") {
+		t.Errorf("search didn't find the messages from Alice")
+	}
+	if strings.Contains(body, "Quarterly report draft") {
+		t.Errorf("search found a message from Bob")
+	}
+}
+
+func TestSend(t *testing.T) {
+	tc := newTestClient(t)
+
+	const subject = "End-to-end test message"
+	tc.postMultipart("/compose", url.Values{
+		"message_id": {"<e2e@example.org>"},
+		"from":       {demo.Username},
+		"to":         {demo.Username},
+		"subject":    {subject},
+		"text":       {"Sent by the end-to-end tests."},
+	})
+
+	// Messages sent to the demo user are delivered back to the INBOX
+	var inbox string
+	for i := 0; i < 50; i++ {
+		inbox = tc.get("/mailbox/INBOX")
+		if strings.Contains(inbox, subject) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !strings.Contains(inbox, subject) {
+		t.Errorf("sent message not delivered to the INBOX")
+	}
+
+	sent := tc.get("/mailbox/Sent")
+	if !strings.Contains(sent, subject) {
+		t.Errorf("sent message not saved to the Sent mailbox")
+	}
+}
+
+func TestSaveDraftConflict(t *testing.T) {
+	tc := newTestClient(t)
+
+	form := url.Values{
+		"message_id":    {"<draft@example.org>"},
+		"from":          {demo.Username},
+		"subject":       {"Draft edited in two windows"},
+		"save_as_draft": {""},
+	}
+	tc.postMultipart("/compose", form)
+
+	// A second window doesn't know about the draft saved by the first one
+	resp, err := tc.postMultipartResponse("/compose", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("unexpected status %v, want %v", resp.Status, http.StatusConflict)
+	}
+
+	drafts := tc.get("/mailbox/Drafts")
+	if n := strings.Count(drafts, "Draft edited in two windows"); n != 1 {
+		t.Errorf("Drafts lists the draft %v times, want once", n)
+	}
+}
+
+func TestEmptyMailbox(t *testing.T) {
+	tc := newTestClient(t)
+
+	page := tc.get("/empty-mailbox/Junk")
+	uidValidity := regexp.MustCompile(`name="uid_validity" value="(\d+)"`).FindStringSubmatch(page)
+	if uidValidity == nil {
+		t.Fatalf("UIDVALIDITY missing from the confirmation page")
+	}
+
+	// Messages which arrived after the confirmation page are kept
+	tc.post("/empty-mailbox/Junk", url.Values{
+		"uid_next":     {"1"},
+		"uid_validity": {uidValidity[1]},
+	})
+	if body := tc.get("/mailbox/Junk"); !strings.Contains(body, "You have WON!!!") {
+		t.Errorf("new message deleted when emptying the mailbox")
+	}
+
+	form := url.Values{}
+	for _, m := range regexp.MustCompile(`name="(uid_\w+)" value="(\d+)"`).FindAllStringSubmatch(page, -1) {
+		form.Set(m[1], m[2])
+	}
+	tc.post("/empty-mailbox/Junk", form)
+	if body := tc.get("/mailbox/Junk"); strings.Contains(body, "You have WON!!!") {
+		t.Errorf("message not deleted when emptying the mailbox")
+	}
+}
+
+func TestDeleteMailboxSavedSearch(t *testing.T) {
+	tc := newTestClient(t)
+
+	tc.post("/search", url.Values{
+		"name":    {"Patches"},
+		"query":   {"PATCH"},
+		"mailbox": {"Lists/alps-devel"},
+	})
+	tc.post("/delete-mailbox/"+url.PathEscape("Lists/alps-devel"), nil)
+
+	resp, err := tc.client.Get(tc.url + "/search/Patches")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("search in a deleted mailbox: unexpected status %v, want %v", resp.Status, http.StatusNotFound)
+	}
+}
+
+func TestExport(t *testing.T) {
+	tc := newTestClient(t)
+
+	mbox := tc.get("/mailbox/INBOX/export")
+	if !strings.HasPrefix(mbox, "From ") {
+		t.Fatalf("export isn't an mbox file")
+	}
+	if !strings.Contains(mbox, "Subject: Welcome to alps") || !strings.Contains(mbox, "Subject: Lunch on Friday?") {
+		t.Errorf("exported messages are incomplete")
+	}
+}
+
+func TestEditMarkdownDraft(t *testing.T) {
+	tc := newTestClient(t)
+
+	edit := tc.postMultipart("/compose", url.Values{
+		"from":          {demo.Username},
+		"message_id":    {"<markdown@example.org>"},
+		"subject":       {"Markdown draft"},
+		"format":        {"markdown"},
+		"text":          {"Some *emphasis*"},
+		"save_as_draft": {""},
+	})
+	if !strings.Contains(edit, `id="format" value="markdown"`) {
+		t.Errorf("Markdown draft not edited as Markdown")
+	}
+	if !strings.Contains(edit, "Some *emphasis*") {
+		t.Errorf("Markdown source missing from the draft")
+	}
+}
+
+func TestAttachmentsZipKeepsUnread(t *testing.T) {
+	tc := newTestClient(t)
+
+	search := "/mailbox/INBOX?query=" + url.QueryEscape("subject:kick-off")
+	body := tc.get(search)
+	uid := regexp.MustCompile(`name="uids" value="(\d+)"`).FindStringSubmatch(body)
+	if uid == nil || !strings.Contains(body, "message-list-unread") {
+		t.Fatalf("unread message with attachments not found")
+	}
+
+	tc.get("/message/INBOX/" + uid[1] + "/attachments.zip")
+	if body := tc.get(search); !strings.Contains(body, "message-list-unread") {
+		t.Errorf("downloading attachments marked the message as read")
+	}
+}
+
+func TestSort(t *testing.T) {
+	tc := newTestClient(t)
+
+	// "Quarterly report draft" is the newest message, "Welcome to alps" the
+	// oldest one
+	before := func(body, a, b string) bool {
+		i, j := strings.Index(body, a), strings.Index(body, b)
+		return i >= 0 && j >= 0 && i < j
+	}
+
+	body := tc.get("/mailbox/INBOX")
+	if !before(body, "Quarterly report draft", "Welcome to alps") {
+		t.Errorf("messages not sorted by descending date by default")
+	}
+
+	// A sort in the URL isn't remembered
+	body = tc.get("/mailbox/INBOX?sort=date&order=asc")
+	if !before(body, "Welcome to alps", "Quarterly report draft") {
+		t.Errorf("messages not sorted by ascending date")
+	}
+	body = tc.get("/mailbox/INBOX")
+	if !before(body, "Quarterly report draft", "Welcome to alps") {
+		t.Errorf("sort in URL was remembered")
+	}
+
+	body = tc.post("/mailbox/INBOX", url.Values{
+		"sort":  {"subject"},
+		"order": {"asc"},
+	})
+	if !before(body, "Lunch on Friday?", "Quarterly report draft") {
+		t.Errorf("messages not sorted by subject")
+	}
+	body = tc.get("/mailbox/INBOX")
+	if !before(body, "Lunch on Friday?", "Quarterly report draft") {
+		t.Errorf("sort order not remembered")
+	}
+
+	// Pages of lists not sorted by arrival can't be anchored on a
+	// missing message
+	body = tc.get("/mailbox/INBOX?after=9999")
+	if !strings.Contains(body, "the first page is shown instead") || !strings.Contains(body, "Lunch on Friday?") {
+		t.Errorf("missing cursor not replaced with the first page")
+	}
+}
@@ -0,0 +1,251 @@
+package alpsbase
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+)
+
+const (
+	exportFormatMbox    = "mbox"
+	exportFormatMaildir = "maildir"
+)
+
+// Maximum number of failures listed in an import summary
+const maxImportFailures = 100
+
+// messageArchiver writes exported messages to an archive.
+type messageArchiver interface {
+	WriteMessage(mboxName string, msg *imap.Message, r io.Reader) error
+	Close() error
+}
+
+// Maildir flags, sorted as required by the Maildir specification
+var maildirFlags = []struct {
+	letter byte
+	flag   string
+}{
+	{'D', imap.DraftFlag},
+	{'F', imap.FlaggedFlag},
+	{'P', "$Forwarded"},
+	{'R', imap.AnsweredFlag},
+	{'S', imap.SeenFlag},
+	{'T', imap.DeletedFlag},
+}
+
+// maildirWriter writes messages to a ZIP archive containing a Maildir per
+// mailbox.
+type maildirWriter struct {
+	zw   *zip.Writer
+	dirs map[string]bool
+}
+
+func newMaildirWriter(w io.Writer) *maildirWriter {
+	return &maildirWriter{
+		zw:   zip.NewWriter(w),
+		dirs: make(map[string]bool),
+	}
+}
+
+// maildirPath returns the path of the Maildir of a mailbox in the archive.
+// Path components which would escape the archive are dropped.
+func maildirPath(mboxName string) string {
+	var parts []string
+	for _, part := range strings.Split(mboxName, "/") {
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "_"
+	}
+	return strings.Join(parts, "/")
+}
+
+func (mw *maildirWriter) WriteMessage(mboxName string, msg *imap.Message, r io.Reader) error {
+	dir := maildirPath(mboxName)
+	if !mw.dirs[dir] {
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			if _, err := mw.zw.Create(dir + "/" + sub + "/"); err != nil {
+				return err
+			}
+		}
+		mw.dirs[dir] = true
+	}
+
+	var flags []byte
+	for _, f := range maildirFlags {
+		if hasFlag(msg.Flags, f.flag) {
+			flags = append(flags, f.letter)
+		}
+	}
+	filename := fmt.Sprintf("%v/cur/%d.%d.alps:2,%s", dir, msg.InternalDate.Unix(), msg.Uid, flags)
+
+	w, err := mw.zw.CreateHeader(&zip.FileHeader{
+		Name:     filename,
+		Method:   zip.Deflate,
+		Modified: msg.InternalDate,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Maildir messages use the local line endings
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			w.Write(trimLineEnding(line))
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (mw *maildirWriter) Close() error {
+	return mw.zw.Close()
+}
+
+// exportMessages writes messages to an archive, mailbox by mailbox, by
+// ascending UID.
+func exportMessages(c *imapclient.Client, refs map[string][]uint32, archiver messageArchiver) error {
+	var names []string
+	for name, uids := range refs {
+		if len(uids) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var section imap.BodySectionName
+	section.Peek = true
+	items := []imap.FetchItem{
+		imap.FetchUid,
+		imap.FetchFlags,
+		imap.FetchInternalDate,
+		imap.FetchEnvelope,
+		section.FetchItem(),
+	}
+
+	for _, name := range names {
+		uids := refs[name]
+		sort.Slice(uids, func(i, j int) bool {
+			return uids[i] < uids[j]
+		})
+
+		// Messages are fetched one by one, so that only one is kept in
+		// memory at a time
+		for _, uid := range uids {
+			var msg *imap.Message
+			err := fetchByMailbox(c, map[string][]uint32{name: {uid}}, items, func(mboxName string, m *imap.Message) {
+				if m.Uid == uid {
+					msg = m
+				}
+			})
+			if err != nil {
+				return err
+			} else if msg == nil {
+				continue // Deleted in the meantime
+			}
+
+			body := msg.GetBody(&section)
+			if body == nil {
+				return fmt.Errorf("server didn't return message body")
+			}
+			if err := archiver.WriteMessage(name, msg, body); err != nil {
+				return fmt.Errorf("failed to write message %v in %q: %v", msg.Uid, name, err)
+			}
+		}
+	}
+
+	return archiver.Close()
+}
+
+// messageImport keeps track of the import of an mbox file into a mailbox.
+// Like bulk actions, imports are interrupted after bulkTimeLimit and resumed
+// by the user.
+type messageImport struct {
+	Mailbox string
+	// Number of messages read from the file so far
+	Done int
+	// Number of messages appended to the mailbox
+	Imported int
+	// Number of messages which couldn't be imported, and a description of
+	// the first ones
+	Failures int
+	Failed   []string
+
+	complete bool
+}
+
+// Complete returns true if all messages of the file have been read.
+func (imp *messageImport) Complete() bool {
+	return imp.complete
+}
+
+func (imp *messageImport) fail(format string, v ...interface{}) {
+	imp.Failures++
+	if len(imp.Failed) < maxImportFailures {
+		imp.Failed = append(imp.Failed, fmt.Sprintf(format, v...))
+	}
+}
+
+// Run appends the messages of an mbox or .eml file to the mailbox, with their
+// flags and date. The first Done messages are skipped.
+func (imp *messageImport) Run(c *imapclient.Client, r io.Reader) error {
+	mr, err := newMboxReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %v", err)
+	}
+
+	start := time.Now()
+	skip := imp.Done
+	n := 0
+	for {
+		// Import at least one message, to make progress
+		if n > skip && time.Since(start) > bulkTimeLimit {
+			return nil
+		}
+
+		msg, err := mr.Next()
+		if err == io.EOF {
+			break
+		}
+		n++
+		if n <= skip {
+			continue
+		}
+		imp.Done = n
+		if err != nil {
+			imp.fail("Message %d: %v", n, err)
+			continue
+		}
+
+		if err := c.Append(imp.Mailbox, msg.Flags, msg.Date, bytes.NewBuffer(msg.Body)); err != nil {
+			if c.State() == imap.LogoutState {
+				return err
+			}
+			imp.fail("Message %d (%q): %v", n, msg.Subject(), err)
+			continue
+		}
+		imp.Imported++
+	}
+
+	imp.complete = true
+	return nil
+}
@@ -0,0 +1,119 @@
+package alpsbase
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+)
+
+// messageAttachment is a message forwarded as a message/rfc822 attachment,
+// with all of its header fields.
+type messageAttachment struct {
+	Mailbox string
+	Uid     uint32
+	Subject string
+
+	Body []byte
+}
+
+func (att *messageAttachment) Open() (io.ReadCloser, error) {
+	if att.Body == nil {
+		return nil, fmt.Errorf("forwarded message has not been pre-fetched")
+	}
+	return ioutil.NopCloser(bytes.NewReader(att.Body)), nil
+}
+
+func (att *messageAttachment) MIMEType() string {
+	return "message/rfc822"
+}
+
+func (att *messageAttachment) Filename() string {
+	if att.Subject == "" {
+		return "message.eml"
+	}
+	return att.Subject + ".eml"
+}
+
+func (att *messageAttachment) ContentID() string {
+	return ""
+}
+
+// fetchForwardedMessages fetches the envelopes of the messages to forward as
+// attachments, oldest first.
+func fetchForwardedMessages(c *imapclient.Client, refs map[string][]uint32) ([]IMAPMessage, error) {
+	var msgs []IMAPMessage
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}
+	err := fetchByMailbox(c, refs, items, func(mboxName string, msg *imap.Message) {
+		msgs = append(msgs, IMAPMessage{msg, mboxName})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].Envelope.Date.Before(msgs[j].Envelope.Date)
+	})
+	return msgs, nil
+}
+
+// fetchMessageAttachments fetches the messages to forward as attachments.
+// They are referred to with formatMessageRef, and are returned in the same
+// order.
+func fetchMessageAttachments(c *imapclient.Client, refs []string) ([]*messageAttachment, error) {
+	uids := make(map[string][]uint32)
+	for _, ref := range refs {
+		mboxName, uid, err := parseMessageRef(ref)
+		if err != nil {
+			return nil, err
+		}
+		uids[mboxName] = append(uids[mboxName], uid)
+	}
+
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, section.FetchItem()}
+
+	byRef := make(map[string]*messageAttachment)
+	var readErr error
+	err := fetchByMailbox(c, uids, items, func(mboxName string, msg *imap.Message) {
+		body := msg.GetBody(section)
+		if body == nil || readErr != nil {
+			return
+		}
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			readErr = fmt.Errorf("failed to read forwarded message: %v", err)
+			return
+		}
+
+		att := &messageAttachment{
+			Mailbox: mboxName,
+			Uid:     msg.Uid,
+			Body:    b,
+		}
+		if msg.Envelope != nil {
+			att.Subject = msg.Envelope.Subject
+		}
+		byRef[formatMessageRef(mboxName, msg.Uid)] = att
+	})
+	if err != nil {
+		return nil, err
+	} else if readErr != nil {
+		return nil, readErr
+	}
+
+	l := make([]*messageAttachment, len(refs))
+	for i, ref := range refs {
+		mboxName, uid, _ := parseMessageRef(ref)
+		att, ok := byRef[formatMessageRef(mboxName, uid)]
+		if !ok {
+			return nil, fmt.Errorf("forwarded message %v in %q not found", uid, mboxName)
+		}
+		l[i] = att
+	}
+	return l, nil
+}
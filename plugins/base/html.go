@@ -0,0 +1,59 @@
+package alpsbase
+
+import (
+	"net/url"
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+	"jaytaylor.com/html2text"
+)
+
+var composePolicy = newComposePolicy()
+
+// newComposePolicy returns the policy applied to HTML messages composed by
+// the user. Images are allowed to refer to attachments with "cid:" URLs.
+func newComposePolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowURLSchemes("cid")
+	p.RequireNoFollowOnLinks(false)
+	p.AllowStyles("color", "background-color", "text-align", "font-weight", "font-style", "text-decoration").Globally()
+	return p
+}
+
+func sanitizeComposedHTML(s string) string {
+	return composePolicy.Sanitize(s)
+}
+
+// htmlToText generates the plain-text alternative of an HTML message.
+func htmlToText(s string) (string, error) {
+	return html2text.FromString(s, html2text.Options{})
+}
+
+// Sanitized HTML always quotes attributes with double quotes
+var cidSrcRegexp = regexp.MustCompile(`src="cid:([^"]+)"`)
+
+// referencedContentIDs returns the set of Content-IDs referenced by an HTML
+// body.
+func referencedContentIDs(html string) map[string]bool {
+	ids := make(map[string]bool)
+	for _, m := range cidSrcRegexp.FindAllStringSubmatch(html, -1) {
+		if id, err := url.PathUnescape(m[1]); err == nil {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// splitRelatedAttachments splits attachments into the ones referenced by the
+// HTML body and the other ones.
+func splitRelatedAttachments(html string, attachments []Attachment) (related, other []Attachment) {
+	ids := referencedContentIDs(html)
+	for _, att := range attachments {
+		if id := att.ContentID(); id != "" && ids[id] {
+			related = append(related, att)
+		} else {
+			other = append(other, att)
+		}
+	}
+	return related, other
+}
@@ -0,0 +1,175 @@
+package alpsbase
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"git.sr.ht/~migadu/alps"
+	"git.sr.ht/~migadu/alps/config"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/mail"
+)
+
+const identitiesKey = "base.identities"
+
+// Identity is an address the user sends messages as.
+type Identity struct {
+	Address string
+	Name    string
+	ReplyTo string
+	// Send a copy of outgoing messages to the identity's address
+	BccSelf   bool
+	Signature string
+	// Mailbox where sent messages are saved, the Sent mailbox if empty
+	Sent string
+}
+
+// String formats the identity for the From header field.
+func (id *Identity) String() string {
+	return formatAddress(&mail.Address{Name: id.Name, Address: id.Address})
+}
+
+// apply sends the message as the identity.
+func (id *Identity) apply(msg *OutgoingMessage) {
+	msg.From = id.String()
+	msg.ReplyTo = id.ReplyTo
+	if !id.BccSelf {
+		return
+	}
+	for _, rcpt := range msg.Bcc {
+		addr, err := mail.ParseAddress(rcpt)
+		if err == nil && strings.EqualFold(addr.Address, id.Address) {
+			return
+		}
+	}
+	msg.Bcc = append(msg.Bcc, id.Address)
+}
+
+func (id *Identity) check() error {
+	if addr, err := mail.ParseAddress(id.Address); err != nil || addr.Address != id.Address {
+		return fmt.Errorf("Invalid address: %q", id.Address)
+	}
+	if len(id.Name) > 512 {
+		return fmt.Errorf("Full name must be 512 characters or fewer")
+	}
+	if id.ReplyTo != "" {
+		if _, err := mail.ParseAddress(id.ReplyTo); err != nil {
+			return fmt.Errorf("Invalid reply-to address: %q", id.ReplyTo)
+		}
+	}
+	if len(id.Signature) > 2048 {
+		return fmt.Errorf("Signature must be 2048 characters or fewer")
+	}
+	return nil
+}
+
+// Identities is a list of identities. The first one is used by default.
+type Identities []Identity
+
+// Find returns the identity with the provided address, if any.
+func (l Identities) Find(address string) *Identity {
+	for i := range l {
+		if strings.EqualFold(l[i].Address, address) {
+			return &l[i]
+		}
+	}
+	return nil
+}
+
+// Match returns the first identity among the provided recipients, if any.
+func (l Identities) Match(addrs []*imap.Address) *Identity {
+	for _, addr := range addrs {
+		if id := l.Find(addr.Address()); id != nil {
+			return id
+		}
+	}
+	return nil
+}
+
+// Recipient returns the identity a message was addressed to, if any.
+func (l Identities) Recipient(env *imap.Envelope) *Identity {
+	if id := l.Match(env.To); id != nil {
+		return id
+	}
+	return l.Match(env.Cc)
+}
+
+func (l Identities) index(address string) int {
+	for i := range l {
+		if strings.EqualFold(l[i].Address, address) {
+			return i
+		}
+	}
+	return -1
+}
+
+// LoadIdentities returns the user's identities. Until identities are set up,
+// the username is used with the full name and signature from the settings.
+// Identities the user is no longer allowed to send as are left out.
+func LoadIdentities(ctx *alps.Context) (Identities, error) {
+	var stored Identities
+	err := ctx.Session.Store().Get(identitiesKey, &stored)
+	if err == alps.ErrNoStoreEntry {
+		return defaultIdentities(ctx)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var l Identities
+	for _, id := range stored {
+		if addressAllowed(&ctx.Server.Config.Identities, ctx.Session.Username(), id.Address) {
+			l = append(l, id)
+		}
+	}
+	return l, nil
+}
+
+func defaultIdentities(ctx *alps.Context) (Identities, error) {
+	username := ctx.Session.Username()
+	if !strings.ContainsRune(username, '@') {
+		return nil, nil
+	}
+
+	settings, err := LoadSettings(ctx.Session.Store())
+	if err != nil {
+		return nil, err
+	}
+	return Identities{{
+		Address:   username,
+		Name:      settings.From,
+		Signature: settings.Signature,
+	}}, nil
+}
+
+func saveIdentities(ctx *alps.Context, l Identities) error {
+	return ctx.Session.Store().Put(identitiesKey, &l)
+}
+
+// addressAllowed checks whether the user can send as the provided address.
+// The username is always allowed.
+func addressAllowed(cfg *config.IdentitiesConfig, username, address string) bool {
+	if strings.EqualFold(username, address) || len(cfg.AllowedAddresses) == 0 {
+		return true
+	}
+
+	user, domain := username, ""
+	if i := strings.LastIndexByte(username, '@'); i >= 0 {
+		user, domain = username[:i], username[i+1:]
+	}
+
+	for _, pattern := range cfg.AllowedAddresses {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		expr := regexp.QuoteMeta(pattern)
+		expr = strings.ReplaceAll(expr, `\*`, ".*")
+		expr = strings.ReplaceAll(expr, `\{user\}`, regexp.QuoteMeta(user))
+		expr = strings.ReplaceAll(expr, `\{domain\}`, regexp.QuoteMeta(domain))
+		if regexp.MustCompile("(?i)^" + expr + "$").MatchString(address) {
+			return true
+		}
+	}
+	return false
+}
@@ -12,7 +12,6 @@ import (
 
 	"github.com/dustin/go-humanize"
 	"github.com/emersion/go-imap"
-	sortthread "github.com/emersion/go-imap-sortthread"
 	imapclient "github.com/emersion/go-imap/client"
 	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/textproto"
@@ -82,6 +81,7 @@ func (mbox *MailboxStatus) URL() *url.URL {
 func getMailboxStatus(conn *imapclient.Client, name string) (*MailboxStatus, error) {
 	items := []imap.StatusItem{
 		imap.StatusMessages,
+		imap.StatusUidNext,
 		imap.StatusUidValidity,
 		imap.StatusUnseen,
 	}
@@ -166,6 +166,12 @@ type IMAPMessage struct {
 	Mailbox string
 }
 
+// Ref returns a reference to the message, suitable for the "messages" field
+// of bulk actions.
+func (msg *IMAPMessage) Ref() string {
+	return formatMessageRef(msg.Mailbox, msg.Uid)
+}
+
 func (msg *IMAPMessage) URL() *url.URL {
 	return &url.URL{
 		Path: fmt.Sprintf("/message/%v/%v", url.PathEscape(msg.Mailbox), msg.Uid),
@@ -175,11 +181,12 @@ func (msg *IMAPMessage) URL() *url.URL {
 func newIMAPPartNode(msg *IMAPMessage, path []int, part *imap.BodyStructure) *IMAPPartNode {
 	filename, _ := part.Filename()
 	return &IMAPPartNode{
-		Path:     path,
-		MIMEType: strings.ToLower(part.MIMEType + "/" + part.MIMESubType),
-		Filename: filename,
-		Message:  msg,
-		Size:     part.Size,
+		Path:      path,
+		MIMEType:  strings.ToLower(part.MIMEType + "/" + part.MIMESubType),
+		Filename:  filename,
+		ContentID: strings.Trim(part.Id, "<>"),
+		Message:   msg,
+		Size:      part.Size,
 	}
 }
 
@@ -276,6 +283,28 @@ func (msg *IMAPMessage) Attachments() []IMAPPartNode {
 	return attachments
 }
 
+// RelatedParts returns the inline parts which can be referenced by their
+// Content-ID from an HTML part, e.g. images.
+func (msg *IMAPMessage) RelatedParts() []IMAPPartNode {
+	if msg.BodyStructure == nil {
+		return nil
+	}
+
+	var parts []IMAPPartNode
+	msg.BodyStructure.Walk(func(path []int, part *imap.BodyStructure) bool {
+		if part.Id == "" || strings.EqualFold(part.Disposition, "attachment") {
+			return true
+		}
+		if strings.EqualFold(part.MIMEType, "multipart") || strings.EqualFold(part.MIMEType, "text") {
+			return true
+		}
+
+		parts = append(parts, *newIMAPPartNode(msg, path, part))
+		return true
+	})
+	return parts
+}
+
 func pathsEqual(a, b []int) bool {
 	if len(a) != len(b) {
 		return false
@@ -325,9 +354,11 @@ type IMAPPartNode struct {
 	Path     []int
 	MIMEType string
 	Filename string
-	Children []IMAPPartNode
-	Message  *IMAPMessage
-	Size     uint32
+	// Content-ID without angle brackets, if any
+	ContentID string
+	Children  []IMAPPartNode
+	Message   *IMAPMessage
+	Size      uint32
 }
 
 func (node IMAPPartNode) PathString() string {
@@ -373,12 +404,13 @@ func imapPartTree(msg *IMAPMessage, bs *imap.BodyStructure, path []int) *IMAPPar
 	filename, _ := bs.Filename()
 
 	node := &IMAPPartNode{
-		Path:     path,
-		MIMEType: strings.ToLower(bs.MIMEType + "/" + bs.MIMESubType),
-		Filename: filename,
-		Children: make([]IMAPPartNode, len(bs.Parts)),
-		Message:  msg,
-		Size:     bs.Size,
+		Path:      path,
+		MIMEType:  strings.ToLower(bs.MIMEType + "/" + bs.MIMESubType),
+		Filename:  filename,
+		ContentID: strings.Trim(bs.Id, "<>"),
+		Children:  make([]IMAPPartNode, len(bs.Parts)),
+		Message:   msg,
+		Size:      bs.Size,
 	}
 
 	for i, part := range bs.Parts {
@@ -402,6 +434,7 @@ func (msg *IMAPMessage) PartTree() *IMAPPartNode {
 }
 
 func (msg *IMAPMessage) HasFlag(flag string) bool {
+	flag = imap.CanonicalFlag(flag)
 	for _, f := range msg.Flags {
 		if imap.CanonicalFlag(f) == flag {
 			return true
@@ -410,101 +443,37 @@ func (msg *IMAPMessage) HasFlag(flag string) bool {
 	return false
 }
 
-func listMessages(conn *imapclient.Client, mbox *MailboxStatus, page, messagesPerPage int) ([]IMAPMessage, error) {
-	if err := ensureMailboxSelected(conn, mbox.Name); err != nil {
-		return nil, err
-	}
-
-	to := int(mbox.Messages) - page*messagesPerPage
-	from := to - messagesPerPage + 1
-	if from <= 0 {
-		from = 1
-	}
-	if to <= 0 {
-		return nil, nil
-	}
-
-	var seqSet imap.SeqSet
-	seqSet.AddRange(uint32(from), uint32(to))
-
-	fetch := []imap.FetchItem{
-		imap.FetchFlags,
-		imap.FetchEnvelope,
-		imap.FetchUid,
-		imap.FetchBodyStructure,
-	}
-
-	ch := make(chan *imap.Message, 10)
-	done := make(chan error, 1)
-	go func() {
-		done <- conn.Fetch(&seqSet, fetch, ch)
-	}()
-
-	msgs := make([]IMAPMessage, 0, to-from)
-	for msg := range ch {
-		msgs = append(msgs, IMAPMessage{msg, mbox.Name})
-	}
-
-	if err := <-done; err != nil {
-		return nil, fmt.Errorf("failed to fetch message list: %v", err)
-	}
-
-	// Reverse list of messages
-	for i := len(msgs)/2 - 1; i >= 0; i-- {
-		opp := len(msgs) - 1 - i
-		msgs[i], msgs[opp] = msgs[opp], msgs[i]
-	}
-
-	return msgs, nil
-}
-
-func searchMessages(conn *imapclient.Client, mboxName, query string, page, messagesPerPage int) (msgs []IMAPMessage, total int, err error) {
+// listMessages returns a page of the messages of a mailbox matching
+// criteria. criteria may be nil to list all messages. If the message the
+// cursor refers to is gone and the list isn't sorted by arrival,
+// errPageCursorLost is returned.
+func listMessages(conn *imapclient.Client, mboxName string, criteria *imap.SearchCriteria, order MessageSort, cursor pageCursor, messagesPerPage int) (msgs []IMAPMessage, prev, next string, err error) {
 	if err := ensureMailboxSelected(conn, mboxName); err != nil {
-		return nil, 0, err
+		return nil, "", "", err
 	}
 
-	searchCriteria := PrepareSearch(query)
-
-	var nums []uint32
-	sc := sortthread.NewSortClient(conn)
-	ok, err := sc.SupportSort()
+	uids, err := sortUids(conn, criteria, order)
 	if err != nil {
-		return nil, 0, err
-	}
-	if !ok {
-		nums, err = conn.Search(searchCriteria)
-		if err != nil {
-			return nil, 0, fmt.Errorf("UID SEARCH failed: %v", err)
-		}
-	} else {
-		sortCriteria := []sortthread.SortCriterion{
-			{Field: sortthread.SortDate, Reverse: true},
-		}
-		nums, err = sc.Sort(sortCriteria, searchCriteria)
-		if err != nil {
-			return nil, 0, fmt.Errorf("SORT failed: %v", err)
-		}
+		return nil, "", "", err
 	}
 
-	total = len(nums)
-
-	from := page * messagesPerPage
-	to := from + messagesPerPage
-	if from >= len(nums) {
-		return nil, total, nil
+	ids := uidPageIDs(uids)
+	if !order.byArrival() && !cursor.found(ids) {
+		return nil, "", "", errPageCursorLost
 	}
-	if to > len(nums) {
-		to = len(nums)
+	start, end, prev, next := cursor.page(ids, messagesPerPage)
+	uids = uids[start:end]
+	if len(uids) == 0 {
+		return nil, "", "", nil
 	}
-	nums = nums[from:to]
 
 	indexes := make(map[uint32]int)
-	for i, num := range nums {
-		indexes[num] = i
+	for i, uid := range uids {
+		indexes[uid] = i
 	}
 
 	var seqSet imap.SeqSet
-	seqSet.AddNum(nums...)
+	seqSet.AddNum(uids...)
 
 	fetch := []imap.FetchItem{
 		imap.FetchEnvelope,
@@ -516,12 +485,12 @@ func searchMessages(conn *imapclient.Client, mboxName, query string, page, messa
 	ch := make(chan *imap.Message, 10)
 	done := make(chan error, 1)
 	go func() {
-		done <- conn.Fetch(&seqSet, fetch, ch)
+		done <- conn.UidFetch(&seqSet, fetch, ch)
 	}()
 
-	msgs = make([]IMAPMessage, len(nums))
+	msgs = make([]IMAPMessage, len(uids))
 	for msg := range ch {
-		i, ok := indexes[msg.SeqNum]
+		i, ok := indexes[msg.Uid]
 		if !ok {
 			continue
 		}
@@ -529,13 +498,32 @@ func searchMessages(conn *imapclient.Client, mboxName, query string, page, messa
 	}
 
 	if err := <-done; err != nil {
-		return nil, 0, fmt.Errorf("failed to fetch message list: %v", err)
+		return nil, "", "", fmt.Errorf("failed to fetch message list: %v", err)
+	}
+
+	// Messages expunged in the meantime are missing from the response
+	l := msgs[:0]
+	for _, msg := range msgs {
+		if msg.Message != nil {
+			l = append(l, msg)
+		}
 	}
 
-	return msgs, total, nil
+	return l, prev, next, nil
 }
 
 func getMessagePart(conn *imapclient.Client, mboxName string, uid uint32, partPath []int) (*IMAPMessage, *message.Entity, error) {
+	return fetchMessagePart(conn, mboxName, uid, partPath, false)
+}
+
+// peekMessagePart is like getMessagePart, but doesn't mark the message as
+// seen. It's used to fetch parts which aren't displayed with the message,
+// e.g. thumbnails.
+func peekMessagePart(conn *imapclient.Client, mboxName string, uid uint32, partPath []int) (*IMAPMessage, *message.Entity, error) {
+	return fetchMessagePart(conn, mboxName, uid, partPath, true)
+}
+
+func fetchMessagePart(conn *imapclient.Client, mboxName string, uid uint32, partPath []int, peek bool) (*IMAPMessage, *message.Entity, error) {
 	if err := ensureMailboxSelected(conn, mboxName); err != nil {
 		return nil, nil, err
 	}
@@ -553,6 +541,7 @@ func getMessagePart(conn *imapclient.Client, mboxName string, uid uint32, partPa
 	partHeaderSection.Path = partPath
 
 	var partBodySection imap.BodySectionName
+	partBodySection.Peek = peek
 	if len(partPath) > 0 {
 		partBodySection.Specifier = imap.EntireSpecifier
 	} else {
@@ -646,18 +635,66 @@ func appendMessage(c *imapclient.Client, msg *OutgoingMessage, mboxType mailboxT
 	return mbox, nil
 }
 
-func deleteMessage(c *imapclient.Client, mboxName string, uid uint32) error {
-	if err := ensureMailboxSelected(c, mboxName); err != nil {
+// appendSentMessage appends a sent message to the provided mailbox, or to the
+// Sent mailbox if empty.
+func appendSentMessage(c *imapclient.Client, msg *OutgoingMessage, mboxName string) error {
+	if mboxName == "" {
+		_, err := appendMessage(c, msg, mailboxSent)
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := msg.WriteTo(&buf); err != nil {
 		return err
 	}
+	return c.Append(mboxName, []string{imap.SeenFlag}, time.Now(), &buf)
+}
 
+func deleteMessage(c *imapclient.Client, mboxName string, uid uint32) error {
 	seqSet := new(imap.SeqSet)
 	seqSet.AddNum(uid)
-	item := imap.FormatFlagsOp(imap.AddFlags, true)
-	flags := []interface{}{imap.DeletedFlag}
-	if err := c.UidStore(seqSet, item, flags, nil); err != nil {
-		return err
+	return deleteMessages(c, mboxName, seqSet)
+}
+
+// saveDraft appends the message to the Drafts mailbox, replacing the previous
+// draft if any, and returns the path to the new draft. If the draft has been
+// saved from another window in the meantime, errAutosaveConflict is returned.
+func saveDraft(c *imapclient.Client, msg *OutgoingMessage, prev *messagePath) (*messagePath, error) {
+	if _, err := checkDraft(c, msg.MessageID, prev); err != nil {
+		return nil, err
+	}
+
+	drafts, err := appendMessage(c, msg, mailboxDrafts)
+	if err != nil {
+		return nil, err
+	}
+
+	if prev != nil {
+		if err := deleteMessage(c, prev.Mailbox, prev.Uid); err != nil {
+			return nil, err
+		}
 	}
 
-	return c.Expunge(nil)
+	uids, err := searchMessageID(c, drafts.Name, msg.MessageID)
+	if err != nil {
+		return nil, err
+	}
+	if len(uids) != 1 {
+		return nil, errAutosaveConflict
+	}
+
+	return &messagePath{Mailbox: drafts.Name, Uid: uids[0]}, nil
+}
+
+// searchMessageID returns the UIDs of the messages with the provided
+// Message-Id.
+func searchMessageID(c *imapclient.Client, mboxName, messageID string) ([]uint32, error) {
+	if err := ensureMailboxSelected(c, mboxName); err != nil {
+		return nil, err
+	}
+
+	criteria := &imap.SearchCriteria{
+		Header: map[string][]string{"Message-Id": {messageID}},
+	}
+	return c.UidSearch(criteria)
 }
@@ -0,0 +1,276 @@
+package alpsbase
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"git.sr.ht/~migadu/alps"
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+)
+
+// BaseName returns the last component of the mailbox name, e.g. "Work" for
+// "Archive/Work".
+func (mbox *MailboxInfo) BaseName() string {
+	if mbox.Delimiter == "" {
+		return mbox.Name
+	}
+	if i := strings.LastIndex(mbox.Name, mbox.Delimiter); i >= 0 {
+		return mbox.Name[i+len(mbox.Delimiter):]
+	}
+	return mbox.Name
+}
+
+// parentMailboxName returns the name of the parent of a mailbox, or an empty
+// string if the mailbox is at the top level of the hierarchy.
+func parentMailboxName(name, delim string) string {
+	if delim == "" {
+		return ""
+	}
+	if i := strings.LastIndex(name, delim); i > 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+// isMailboxDescendant returns true if the mailbox is a child of ancestor, or
+// a child of one of its children, and so on.
+func isMailboxDescendant(name, ancestor, delim string) bool {
+	return delim != "" && strings.HasPrefix(name, ancestor+delim)
+}
+
+// joinMailboxName returns the name of a child of the parent mailbox. An empty
+// parent stands for the top level of the hierarchy.
+func joinMailboxName(parent *MailboxInfo, name string) string {
+	if parent == nil {
+		return name
+	}
+	return parent.Name + parent.Delimiter + name
+}
+
+// renamedMailbox returns the name of a mailbox after from has been renamed to
+// to. Descendants of from are renamed as well.
+func renamedMailbox(name, from, to, delim string) (string, bool) {
+	if name == from {
+		return to, true
+	}
+	if isMailboxDescendant(name, from, delim) {
+		return to + name[len(from):], true
+	}
+	return name, false
+}
+
+func findMailbox(mailboxes []MailboxInfo, name string) *MailboxInfo {
+	for i := range mailboxes {
+		if mailboxes[i].Name == name {
+			return &mailboxes[i]
+		}
+	}
+	return nil
+}
+
+// mailboxDescendants returns the descendants of a mailbox, deepest first.
+func mailboxDescendants(mailboxes []MailboxInfo, mbox *MailboxInfo) []MailboxInfo {
+	var l []MailboxInfo
+	for _, child := range mailboxes {
+		if isMailboxDescendant(child.Name, mbox.Name, mbox.Delimiter) {
+			l = append(l, child)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return len(l[i].Name) > len(l[j].Name)
+	})
+	return l
+}
+
+// newMailboxTree nests mailboxes under their parent. Mailboxes whose parent
+// isn't listed are returned at the top level.
+func newMailboxTree(mailboxes []MailboxInfo, subscriptions map[string]*MailboxStatus) []*MailboxDetails {
+	byName := make(map[string]*MailboxDetails, len(mailboxes))
+	for i := range mailboxes {
+		byName[mailboxes[i].Name] = &MailboxDetails{
+			Info:   &mailboxes[i],
+			Status: subscriptions[mailboxes[i].Name],
+		}
+	}
+
+	var roots []*MailboxDetails
+	for _, mbox := range mailboxes {
+		details := byName[mbox.Name]
+		parentName := parentMailboxName(mbox.Name, mbox.Delimiter)
+		if parent, ok := byName[parentName]; ok && parentName != "" {
+			parent.Children = append(parent.Children, details)
+		} else {
+			roots = append(roots, details)
+		}
+	}
+	return roots
+}
+
+// Expanded returns true if the mailbox is the active one, or one of its
+// descendants is.
+func (details *MailboxDetails) Expanded() bool {
+	if details.Info.Active {
+		return true
+	}
+	for _, child := range details.Children {
+		if child.Expanded() {
+			return true
+		}
+	}
+	return false
+}
+
+// listSubscribedMailboxes returns the names of the mailboxes the user is
+// subscribed to on the IMAP server.
+func listSubscribedMailboxes(conn *imapclient.Client) (map[string]bool, error) {
+	ch := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.Lsub("", "*", ch)
+	}()
+
+	subscribed := make(map[string]bool)
+	for mbox := range ch {
+		subscribed[mbox.Name] = true
+	}
+
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to list subscribed mailboxes: %v", err)
+	}
+	return subscribed, nil
+}
+
+// syncSubscriptions subscribes to the mailboxes in names and unsubscribes
+// from the other mailboxes in scope.
+func syncSubscriptions(c *imapclient.Client, scope, names []string) error {
+	subscribed, err := listSubscribedMailboxes(c)
+	if err != nil {
+		return err
+	}
+
+	want := make(map[string]bool, len(names))
+	for _, name := range names {
+		want[name] = true
+	}
+
+	for _, name := range scope {
+		if want[name] && !subscribed[name] {
+			if err := c.Subscribe(name); err != nil {
+				return fmt.Errorf("failed to subscribe to %q: %v", name, err)
+			}
+		} else if !want[name] && subscribed[name] {
+			if err := c.Unsubscribe(name); err != nil {
+				return fmt.Errorf("failed to unsubscribe from %q: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// renameSubscriptions moves the IMAP subscriptions of a renamed mailbox and
+// its descendants to their new names.
+func renameSubscriptions(c *imapclient.Client, from, to, delim string) error {
+	subscribed, err := listSubscribedMailboxes(c)
+	if err != nil {
+		return err
+	}
+
+	for name := range subscribed {
+		newName, ok := renamedMailbox(name, from, to, delim)
+		if !ok {
+			continue
+		}
+		if err := c.Unsubscribe(name); err != nil {
+			return fmt.Errorf("failed to unsubscribe from %q: %v", name, err)
+		}
+		if err := c.Subscribe(newName); err != nil {
+			return fmt.Errorf("failed to subscribe to %q: %v", newName, err)
+		}
+	}
+	return nil
+}
+
+// updateMailboxReferences updates the mailbox names saved in the user's
+// settings, identities, saved searches and scheduled messages after a mailbox
+// has been renamed or deleted. f returns the new name of a mailbox, or an
+// empty string if it has been deleted.
+func updateMailboxReferences(session *alps.Session, f func(name string) string) error {
+	update := func(names []string) []string {
+		var l []string
+		for _, name := range names {
+			if name = f(name); name != "" {
+				l = append(l, name)
+			}
+		}
+		return l
+	}
+
+	s := session.Store()
+	settings, err := LoadSettings(s)
+	if err != nil {
+		return fmt.Errorf("failed to load settings: %v", err)
+	}
+	settings.Subscriptions = update(settings.Subscriptions)
+	settings.UnifiedMailboxes = update(settings.UnifiedMailboxes)
+	if err := s.Put(settingsKey, settings); err != nil {
+		return fmt.Errorf("failed to save settings: %v", err)
+	}
+
+	// Messages sent as an identity whose mailbox has been deleted are saved
+	// to the Sent mailbox
+	var identities Identities
+	if err := s.Get(identitiesKey, &identities); err == nil {
+		for i := range identities {
+			if identities[i].Sent != "" {
+				identities[i].Sent = f(identities[i].Sent)
+			}
+		}
+		if err := s.Put(identitiesKey, &identities); err != nil {
+			return fmt.Errorf("failed to save identities: %v", err)
+		}
+	} else if err != alps.ErrNoStoreEntry {
+		return fmt.Errorf("failed to load identities: %v", err)
+	}
+
+	// Searches restricted to a deleted mailbox are dropped
+	searches, err := loadSavedSearches(s)
+	if err != nil {
+		return fmt.Errorf("failed to load saved searches: %v", err)
+	}
+	var kept []SavedSearch
+	for _, search := range searches {
+		if search.Mailbox != "" {
+			if search.Mailbox = f(search.Mailbox); search.Mailbox == "" {
+				continue
+			}
+		}
+		kept = append(kept, search)
+	}
+	if err := putSavedSearches(s, kept); err != nil {
+		return fmt.Errorf("failed to save saved searches: %v", err)
+	}
+
+	for _, kind := range []string{scheduledSendJob, outboxSendJob} {
+		for _, msg := range listScheduledMessages(session, kind) {
+			if msg.Sent == "" {
+				continue
+			}
+			sent := f(msg.Sent)
+			if sent == msg.Sent {
+				continue
+			}
+			msg.ScheduledSend.Sent = sent
+			b, err := json.Marshal(&msg.ScheduledSend)
+			if err != nil {
+				return err
+			}
+			if err := session.UpdateJob(msg.ID, string(b)); err != nil && err != alps.ErrNoSuchJob {
+				return fmt.Errorf("failed to update scheduled message: %v", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package alpsbase
+
+import (
+	"html"
+	"net/url"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// URL schemes allowed in Markdown links and images. Links to other URLs are
+// rendered as plain text, images as their alternative text.
+var (
+	markdownLinkSchemes  = map[string]bool{"http": true, "https": true, "mailto": true}
+	markdownImageSchemes = map[string]bool{"http": true, "https": true, "cid": true}
+)
+
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.Linkify, extension.Strikethrough),
+	goldmark.WithParserOptions(
+		parser.WithASTTransformers(util.Prioritized(markdownURLFilter{}, 100)),
+	),
+	goldmark.WithRendererOptions(
+		renderer.WithNodeRenderers(util.Prioritized(markdownHTMLEscaper{}, 100)),
+	),
+)
+
+// renderMarkdown converts Markdown to HTML, following CommonMark. Raw HTML is
+// escaped rather than passed through, and links are restricted to a few URL
+// schemes. The result still needs to be sanitized.
+//
+// The signature, if any, isn't interpreted as Markdown.
+func renderMarkdown(src string) (string, error) {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+
+	var signature string
+	if strings.HasPrefix(src, "-- \n") {
+		src, signature = "", src[4:]
+	} else if i := strings.LastIndex(src, "\n-- \n"); i >= 0 {
+		src, signature = src[:i], src[i+5:]
+	}
+
+	var b strings.Builder
+	if err := markdown.Convert([]byte(src), &b); err != nil {
+		return "", err
+	}
+	if signature != "" {
+		b.WriteString("<p>-- <br>\n")
+		b.WriteString(strings.ReplaceAll(html.EscapeString(strings.TrimRight(signature, "\n")), "\n", "<br>\n"))
+		b.WriteString("</p>\n")
+	}
+	return b.String(), nil
+}
+
+// markdownURLAllowed returns true if the URL is absolute and its scheme is one
+// of the allowed ones.
+func markdownURLAllowed(s string, schemes map[string]bool) bool {
+	u, err := url.Parse(s)
+	return err == nil && schemes[strings.ToLower(u.Scheme)]
+}
+
+// markdownURLFilter removes links and images whose URL scheme isn't allowed,
+// keeping their text.
+type markdownURLFilter struct{}
+
+func (markdownURLFilter) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+
+	var unsafe []ast.Node
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.Link:
+			if !markdownURLAllowed(string(n.Destination), markdownLinkSchemes) {
+				unsafe = append(unsafe, n)
+			}
+		case *ast.Image:
+			if !markdownURLAllowed(string(n.Destination), markdownImageSchemes) {
+				unsafe = append(unsafe, n)
+			}
+		case *ast.AutoLink:
+			// E-mail addresses are rendered as mailto: links, and bare
+			// "www." links as http: links
+			dest := string(n.URL(source))
+			if n.AutoLinkType == ast.AutoLinkURL && !strings.Contains(dest, "://") {
+				dest = "http://" + dest
+			}
+			if n.AutoLinkType == ast.AutoLinkURL && !markdownURLAllowed(dest, markdownLinkSchemes) {
+				unsafe = append(unsafe, n)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, n := range unsafe {
+		parent := n.Parent()
+		if link, ok := n.(*ast.AutoLink); ok {
+			parent.ReplaceChild(parent, n, ast.NewString(link.Label(source)))
+			continue
+		}
+		for child := n.FirstChild(); child != nil; {
+			next := child.NextSibling()
+			parent.InsertBefore(parent, n, child)
+			child = next
+		}
+		parent.RemoveChild(parent, n)
+	}
+}
+
+// markdownHTMLEscaper renders raw HTML as text.
+type markdownHTMLEscaper struct{}
+
+func (markdownHTMLEscaper) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindHTMLBlock, renderMarkdownHTMLBlock)
+	reg.Register(ast.KindRawHTML, renderMarkdownRawHTML)
+}
+
+func renderMarkdownHTMLBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*ast.HTMLBlock)
+
+	var b strings.Builder
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		seg := lines.At(i)
+		b.Write(seg.Value(source))
+	}
+	if n.HasClosure() {
+		b.Write(n.ClosureLine.Value(source))
+	}
+
+	w.WriteString("<p>")
+	w.WriteString(html.EscapeString(strings.TrimRight(b.String(), "\n")))
+	w.WriteString("</p>\n")
+	return ast.WalkSkipChildren, nil
+}
+
+func renderMarkdownRawHTML(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*ast.RawHTML)
+	for i := 0; i < n.Segments.Len(); i++ {
+		seg := n.Segments.At(i)
+		w.WriteString(html.EscapeString(string(seg.Value(source))))
+	}
+	return ast.WalkSkipChildren, nil
+}
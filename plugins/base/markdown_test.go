@@ -0,0 +1,78 @@
+package alpsbase
+
+import (
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+	}{
+		{"paragraphs", "Hello\nworld\n\nBye", "<p>Hello\nworld</p>\n<p>Bye</p>\n"},
+		{"emphasis", "*a* **b** ~~c~~ `d`", "<p><em>a</em> <strong>b</strong> <del>c</del> <code>d</code></p>\n"},
+		{"hard break", "a  \nb\\\nc", "<p>a<br>\nb<br>\nc</p>\n"},
+		{"code block", "```\n<b>x</b>\n  y\n```", "<pre><code>&lt;b&gt;x&lt;/b&gt;\n  y\n</code></pre>\n"},
+		{"quote", "> a\n> b", "<blockquote>\n<p>a\nb</p>\n</blockquote>\n"},
+		{"list", "- a\n- b", "<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n"},
+		{"entities", "a < b & c", "<p>a &lt; b &amp; c</p>\n"},
+
+		// Raw HTML is displayed as text
+		{"inline HTML", "a <b>b</b>", "<p>a &lt;b&gt;b&lt;/b&gt;</p>\n"},
+		{"HTML block", "<div onclick=\"x()\">\nhi\n</div>", "<p>&lt;div onclick=&#34;x()&#34;&gt;\nhi\n&lt;/div&gt;</p>\n"},
+		{"script", "<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+
+		// Links
+		{"link", "[a](https://example.org)", "<p><a href=\"https://example.org\">a</a></p>\n"},
+		{"mailto link", "[a](mailto:a@example.org)", "<p><a href=\"mailto:a@example.org\">a</a></p>\n"},
+		{"autolink", "<https://example.org>", "<p><a href=\"https://example.org\">https://example.org</a></p>\n"},
+		{"bare URL", "see https://example.org.", "<p>see <a href=\"https://example.org\">https://example.org</a>.</p>\n"},
+		{"www URL", "www.example.org", "<p><a href=\"http://www.example.org\">www.example.org</a></p>\n"},
+		{"email", "<a@example.org>", "<p><a href=\"mailto:a@example.org\">a@example.org</a></p>\n"},
+		{"image", "![alt](https://example.org/a.png)", "<p><img src=\"https://example.org/a.png\" alt=\"alt\"></p>\n"},
+		{"cid image", "![alt](cid:a@example.org)", "<p><img src=\"cid:a@example.org\" alt=\"alt\"></p>\n"},
+
+		// Unsafe URLs
+		{"javascript link", "[a *b*](javascript:alert(1))", "<p>a <em>b</em></p>\n"},
+		{"uppercase javascript link", "[a](JavaScript:alert(1))", "<p>a</p>\n"},
+		{"escaped javascript link", "[a](&#106;avascript:alert(1))", "<p>a</p>\n"},
+		{"data link", "[a](data:text/html;base64,PHNjcmlwdD4=)", "<p>a</p>\n"},
+		{"relative link", "[a](/logout)", "<p>a</p>\n"},
+		{"javascript autolink", "<javascript:alert(1)>", "<p>javascript:alert(1)</p>\n"},
+		{"javascript image", "![alt](javascript:alert(1))", "<p>alt</p>\n"},
+		{"mailto image", "![alt](mailto:a@example.org)", "<p>alt</p>\n"},
+		{"reference link", "[a][x]\n\n[x]: vbscript:msgbox", "<p>a</p>\n"},
+
+		// Signatures aren't interpreted
+		{"signature", "Hi\n\n-- \n*Alice*\n<alice@example.org>\n", "<p>Hi</p>\n<p>-- <br>\n*Alice*<br>\n&lt;alice@example.org&gt;</p>\n"},
+		{"signature only", "-- \nAlice", "<p>-- <br>\nAlice</p>\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := renderMarkdown(tc.src)
+			if err != nil {
+				t.Fatalf("renderMarkdown() = %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("renderMarkdown() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatFlowed(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"a\nb", "a\r\nb"},
+		{"a  \nb ", "a\r\nb"},
+		{"    code\n", "     code\r\n"},
+		{"From me\n> quote", " From me\r\n > quote"},
+		{"Bye\n-- \nAlice", "Bye\r\n-- \r\nAlice"},
+	}
+	for _, tc := range tests {
+		if got := formatFlowed(tc.text); got != tc.want {
+			t.Errorf("formatFlowed(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package alpsbase
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+)
+
+// Layout of the date in mbox "From " lines, as written by asctime
+const mboxDateLayout = "Mon Jan _2 15:04:05 2006"
+
+// Header fields used by mail clients to store flags in mbox files. They are
+// stripped from imported messages.
+var mboxStatusFields = []string{"Status", "X-Status", "X-Mozilla-Status", "X-Mozilla-Status2"}
+
+// Letters of the X-Status header field, written by mutt among others
+var mboxXStatusFlags = []struct {
+	letter byte
+	flag   string
+}{
+	{'A', imap.AnsweredFlag},
+	{'F', imap.FlaggedFlag},
+	{'T', imap.DraftFlag},
+	{'D', imap.DeletedFlag},
+}
+
+// Bits of the X-Mozilla-Status header field, written by Thunderbird
+var mboxMozillaStatusFlags = []struct {
+	bit  uint64
+	flag string
+}{
+	{0x0001, imap.SeenFlag},
+	{0x0002, imap.AnsweredFlag},
+	{0x0004, imap.FlaggedFlag},
+	{0x1000, "$Forwarded"},
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// mboxFlags returns the flags stored in the header of a message read from an
+// mbox file.
+func mboxFlags(h *textproto.Header) []string {
+	var flags []string
+	add := func(flag string) {
+		if !hasFlag(flags, flag) {
+			flags = append(flags, flag)
+		}
+	}
+
+	if strings.ContainsRune(h.Get("Status"), 'R') {
+		add(imap.SeenFlag)
+	}
+	xstatus := h.Get("X-Status")
+	for _, f := range mboxXStatusFlags {
+		if strings.IndexByte(xstatus, f.letter) >= 0 {
+			add(f.flag)
+		}
+	}
+	if v, err := strconv.ParseUint(strings.TrimSpace(h.Get("X-Mozilla-Status")), 16, 16); err == nil {
+		for _, f := range mboxMozillaStatusFlags {
+			if v&f.bit != 0 {
+				add(f.flag)
+			}
+		}
+	}
+
+	return flags
+}
+
+// setMboxFlags stores flags in the header of a message written to an mbox
+// file.
+func setMboxFlags(h *textproto.Header, flags []string) {
+	for _, k := range mboxStatusFields {
+		h.Del(k)
+	}
+
+	var xstatus []byte
+	for _, f := range mboxXStatusFlags {
+		if hasFlag(flags, f.flag) {
+			xstatus = append(xstatus, f.letter)
+		}
+	}
+	if len(xstatus) > 0 {
+		h.Add("X-Status", string(xstatus))
+	}
+
+	if hasFlag(flags, imap.SeenFlag) {
+		h.Add("Status", "RO")
+	} else {
+		h.Add("Status", "O")
+	}
+}
+
+// isMboxFromLine returns true if the line is a "From " line, or a quoted one
+// in the mboxrd format.
+func isMboxFromLine(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From "))
+}
+
+// trimLineEnding removes the LF or CRLF at the end of a line.
+func trimLineEnding(line []byte) []byte {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r"))
+}
+
+// mboxWriter writes messages to an mbox file, in the mboxrd format: lines
+// starting with "From ", preceded by any number of ">", are quoted with an
+// additional ">".
+type mboxWriter struct {
+	w *bufio.Writer
+}
+
+func newMboxWriter(w io.Writer) *mboxWriter {
+	return &mboxWriter{bufio.NewWriter(w)}
+}
+
+// WriteMessage writes a message. The message flags are stored in the Status
+// and X-Status header fields.
+func (mw *mboxWriter) WriteMessage(mboxName string, msg *imap.Message, r io.Reader) error {
+	br := bufio.NewReader(r)
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return fmt.Errorf("failed to read message header: %v", err)
+	}
+	setMboxFlags(&h, msg.Flags)
+
+	sender := "MAILER-DAEMON"
+	if msg.Envelope != nil && len(msg.Envelope.From) > 0 {
+		if addr := msg.Envelope.From[0].Address(); addr != "" && !strings.ContainsAny(addr, " \t") {
+			sender = addr
+		}
+	}
+	fmt.Fprintf(mw.w, "From %v %v\n", sender, msg.InternalDate.UTC().Format(mboxDateLayout))
+
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, h); err != nil {
+		return err
+	}
+	if err := mw.writeLines(bufio.NewReader(&buf), false); err != nil {
+		return err
+	}
+	if err := mw.writeLines(br, true); err != nil {
+		return err
+	}
+
+	// Messages are separated by an empty line
+	if _, err := mw.w.WriteString("\n"); err != nil {
+		return err
+	}
+	return mw.w.Flush()
+}
+
+func (mw *mboxWriter) writeLines(br *bufio.Reader, quote bool) error {
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			if quote && isMboxFromLine(line) {
+				mw.w.WriteByte('>')
+			}
+			mw.w.Write(trimLineEnding(line))
+			if _, err := mw.w.WriteString("\n"); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (mw *mboxWriter) Close() error {
+	return mw.w.Flush()
+}
+
+// mboxMessage is a message read from an mbox file or an .eml file.
+type mboxMessage struct {
+	Header textproto.Header
+	// Message with CRLF line endings, without the mbox status header fields
+	Body  []byte
+	Date  time.Time
+	Flags []string
+}
+
+// Subject returns the subject of the message, for display.
+func (msg *mboxMessage) Subject() string {
+	h := mail.Header{message.Header{msg.Header}}
+	subject, _ := h.Subject()
+	return subject
+}
+
+// mboxReader reads messages from an mbox file. The mboxrd, mboxo and mboxcl
+// formats are supported, Content-Length header fields are ignored. Files
+// which don't start with a "From " line are read as a single message, e.g.
+// .eml files.
+type mboxReader struct {
+	br     *bufio.Reader
+	single bool
+	// "From " line of the next message, if any
+	fromLine []byte
+	eof      bool
+}
+
+func newMboxReader(r io.Reader) (*mboxReader, error) {
+	mr := &mboxReader{br: bufio.NewReader(r)}
+
+	start, err := mr.br.Peek(5)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(start) != "From " {
+		mr.single = true
+		return mr, nil
+	}
+
+	if mr.fromLine, err = mr.br.ReadBytes('\n'); err == io.EOF {
+		mr.eof = true
+	} else if err != nil {
+		return nil, err
+	}
+	return mr, nil
+}
+
+// parseMboxFromLine returns the date in a "From " line, or the zero time if
+// it can't be parsed.
+func parseMboxFromLine(line []byte) time.Time {
+	fields := strings.Fields(string(trimLineEnding(line)))
+	if len(fields) < 3 {
+		return time.Time{}
+	}
+	s := strings.Join(fields[2:], " ")
+	layouts := []string{
+		"Mon Jan 2 15:04:05 2006",
+		"Mon Jan 2 15:04:05 -0700 2006",
+		"Mon Jan 2 15:04:05 MST 2006",
+		"Mon Jan 2 15:04 2006",
+	}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Next returns the next message. io.EOF is returned when there are no more
+// messages. If a message can't be parsed, an error is returned and the
+// following messages can still be read.
+func (mr *mboxReader) Next() (*mboxMessage, error) {
+	if mr.eof && mr.fromLine == nil {
+		return nil, io.EOF
+	}
+
+	var date time.Time
+	if !mr.single {
+		date = parseMboxFromLine(mr.fromLine)
+	}
+	mr.fromLine = nil
+
+	var buf bytes.Buffer
+	// The empty line before a "From " line separates messages, so empty
+	// lines are only written once the next line has been read
+	var blanks int
+	for !mr.eof {
+		line, err := mr.br.ReadBytes('\n')
+		if err == io.EOF {
+			mr.eof = true
+		} else if err != nil {
+			// The rest of the file can't be read
+			mr.eof = true
+			return nil, err
+		}
+		if len(line) == 0 {
+			break
+		}
+
+		if !mr.single && (blanks > 0 || buf.Len() == 0) && bytes.HasPrefix(line, []byte("From ")) {
+			mr.fromLine = line
+			break
+		}
+
+		line = trimLineEnding(line)
+		if len(line) == 0 {
+			blanks++
+			continue
+		}
+		for ; blanks > 0; blanks-- {
+			buf.WriteString("\r\n")
+		}
+		if !mr.single && line[0] == '>' && isMboxFromLine(line) {
+			line = line[1:]
+		}
+		buf.Write(line)
+		buf.WriteString("\r\n")
+	}
+	if !mr.single {
+		// Drop the separator, before the next message or at the end of the
+		// file
+		blanks--
+	}
+	for ; blanks > 0; blanks-- {
+		buf.WriteString("\r\n")
+	}
+	if mr.single && buf.Len() == 0 {
+		return nil, io.EOF
+	}
+
+	br := bufio.NewReader(&buf)
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message header: %v", err)
+	}
+	msg := &mboxMessage{
+		Header: h,
+		Date:   date,
+		Flags:  mboxFlags(&h),
+	}
+	if msg.Date.IsZero() {
+		mh := mail.Header{message.Header{h}}
+		msg.Date, _ = mh.Date()
+	}
+
+	for _, k := range mboxStatusFields {
+		h.Del(k)
+	}
+	var body bytes.Buffer
+	if err := textproto.WriteHeader(&body, h); err != nil {
+		return nil, err
+	}
+	if _, err := body.ReadFrom(br); err != nil {
+		return nil, err
+	}
+	msg.Body = body.Bytes()
+
+	return msg, nil
+}
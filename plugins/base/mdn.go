@@ -0,0 +1,170 @@
+package alpsbase
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-smtp"
+)
+
+// mdnSentKeyword is set on messages once their read receipt request has been
+// answered, whether a receipt was sent or not (RFC 3503).
+const mdnSentKeyword = "$MDNSent"
+
+// Policies for read receipt requests, see Settings.MDNPolicy
+const (
+	mdnAsk    = ""
+	mdnAlways = "always"
+	mdnNever  = "never"
+)
+
+// MDNRequest is a read receipt requested by a message (RFC 8098).
+type MDNRequest struct {
+	// Address the receipt is sent to
+	To string
+
+	// Receipts may only be sent without asking the user when they go to
+	// the sender of the message
+	allowAutomatic bool
+}
+
+// getMDNRequest returns the read receipt requested by a message, if any and
+// if it hasn't been answered yet.
+func getMDNRequest(msg *IMAPMessage, h mail.Header, identities Identities) *MDNRequest {
+	if msg.HasFlag(mdnSentKeyword) || msg.HasFlag(imap.DraftFlag) || isMDN(msg) {
+		return nil
+	}
+	if identities.Match(msg.Envelope.From) != nil {
+		return nil
+	}
+
+	to, err := h.AddressList("Disposition-Notification-To")
+	if err != nil || len(to) == 0 {
+		return nil
+	}
+
+	returnPath := strings.Trim(strings.TrimSpace(h.Get("Return-Path")), "<>")
+	return &MDNRequest{
+		To:             to[0].Address,
+		allowAutomatic: len(to) == 1 && strings.EqualFold(returnPath, to[0].Address),
+	}
+}
+
+// isMDN checks whether a message is a read receipt itself. These must never
+// be answered.
+func isMDN(msg *IMAPMessage) bool {
+	bs := msg.BodyStructure
+	return bs != nil && strings.EqualFold(bs.MIMEType, "multipart") &&
+		strings.EqualFold(bs.MIMESubType, "report") &&
+		strings.EqualFold(bs.Params["report-type"], "disposition-notification")
+}
+
+// writeMDN writes a read receipt for msg, sent as the identity it was
+// addressed to.
+func writeMDN(w io.Writer, msg *IMAPMessage, h mail.Header, req *MDNRequest, from *Identity, automatic bool) error {
+	var mh mail.Header
+	mh.SetDate(time.Now())
+	mh.SetAddressList("From", []*mail.Address{{Name: from.Name, Address: from.Address}})
+	mh.SetAddressList("To", []*mail.Address{{Address: req.To}})
+	mh.SetText("Subject", "Read: "+msg.Envelope.Subject)
+	if err := mh.GenerateMessageID(); err != nil {
+		return err
+	}
+	if msg.Envelope.MessageId != "" {
+		mh.Set("In-Reply-To", msg.Envelope.MessageId)
+	}
+	if automatic {
+		mh.Set("Auto-Submitted", "auto-replied")
+	}
+	mh.SetContentType("multipart/report", map[string]string{
+		"report-type": "disposition-notification",
+	})
+
+	mw, err := message.CreateWriter(w, mh.Header)
+	if err != nil {
+		return fmt.Errorf("failed to create mail writer: %v", err)
+	}
+
+	text := fmt.Sprintf("This is a read receipt for the message sent on %v to %v with subject %q.\n\n"+
+		"The message has been displayed. This is no guarantee that it has been read or understood.\n",
+		msg.Envelope.Date.Format(time.RFC1123Z), from.Address, msg.Envelope.Subject)
+	if err := writeTextPart(mw, "text/plain", nil, text); err != nil {
+		return err
+	}
+
+	var ph message.Header
+	ph.SetContentType("message/disposition-notification", nil)
+	ph.Set("Content-Transfer-Encoding", "7bit")
+	pw, err := mw.CreatePart(ph)
+	if err != nil {
+		return fmt.Errorf("failed to create disposition notification part: %v", err)
+	}
+
+	mode := "manual-action/MDN-sent-manually"
+	if automatic {
+		mode = "automatic-action/MDN-sent-automatically"
+	}
+	// The order of the fields is significant
+	var fields strings.Builder
+	fields.WriteString("Reporting-UA: alps\r\n")
+	if v := h.Get("Original-Recipient"); v != "" {
+		fmt.Fprintf(&fields, "Original-Recipient: %v\r\n", v)
+	}
+	fmt.Fprintf(&fields, "Final-Recipient: rfc822;%v\r\n", from.Address)
+	if msg.Envelope.MessageId != "" {
+		fmt.Fprintf(&fields, "Original-Message-ID: %v\r\n", msg.Envelope.MessageId)
+	}
+	fmt.Fprintf(&fields, "Disposition: %v; displayed\r\n", mode)
+	if _, err := io.WriteString(pw, fields.String()); err != nil {
+		return fmt.Errorf("failed to write disposition notification: %v", err)
+	}
+	if err := pw.Close(); err != nil {
+		return fmt.Errorf("failed to close disposition notification part: %v", err)
+	}
+
+	if err := mw.Close(); err != nil {
+		return fmt.Errorf("failed to close mail writer: %v", err)
+	}
+	return nil
+}
+
+// sendMDN sends a read receipt. Its envelope sender is null, so that it can't
+// cause a bounce (RFC 8098 section 2.1).
+func sendMDN(c *smtp.Client, msg *IMAPMessage, h mail.Header, req *MDNRequest, from *Identity, automatic bool) error {
+	if err := c.Mail("", nil); err != nil {
+		return fmt.Errorf("MAIL FROM failed: %v", err)
+	}
+	if err := c.Rcpt(req.To); err != nil {
+		return fmt.Errorf("RCPT TO failed: %v (%s)", err, req.To)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("DATA failed: %v", err)
+	}
+	if err := writeMDN(w, msg, h, req, from, automatic); err != nil {
+		return fmt.Errorf("failed to write read receipt: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to close SMTP data writer: %v", err)
+	}
+	return nil
+}
+
+func markMDNSent(c *imapclient.Client, mboxName string, uid uint32) error {
+	if err := ensureMailboxSelected(c, mboxName); err != nil {
+		return err
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	flags := []interface{}{mdnSentKeyword}
+	return c.UidStore(seqSet, item, flags, nil)
+}
@@ -0,0 +1,299 @@
+package alpsbase
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+)
+
+const multiSearchCapability = "MULTISEARCH"
+
+// Values of the "scope" query parameter of the mailbox view. Searches are
+// limited to the current mailbox by default.
+const (
+	searchScopeMailbox = ""
+	// All mailboxes except Junk and Trash
+	searchScopeAll = "all"
+	// All mailboxes
+	searchScopeEverywhere = "everywhere"
+)
+
+// multiSearchCommand is an ESEARCH command searching all personal mailboxes,
+// as defined in RFC 7377.
+type multiSearchCommand struct {
+	Criteria *imap.SearchCriteria
+}
+
+func (cmd *multiSearchCommand) Command() *imap.Command {
+	args := []interface{}{
+		imap.RawString("IN"), []interface{}{imap.RawString("personal")},
+		imap.RawString("RETURN"), []interface{}{imap.RawString("ALL")},
+		imap.RawString("CHARSET"), imap.RawString("UTF-8"),
+	}
+	args = append(args, cmd.Criteria.Format()...)
+	return &imap.Command{
+		Name:      "ESEARCH",
+		Arguments: args,
+	}
+}
+
+// multiSearchResponse collects the UIDs returned in ESEARCH responses, by
+// mailbox.
+type multiSearchResponse struct {
+	Uids map[string][]uint32
+}
+
+func (r *multiSearchResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != "ESEARCH" {
+		return responses.ErrUnhandled
+	}
+
+	var mboxName string
+	if len(fields) > 0 {
+		if correlator, ok := fields[0].([]interface{}); ok {
+			fields = fields[1:]
+			for i := 0; i+1 < len(correlator); i += 2 {
+				k, _ := imap.ParseString(correlator[i])
+				if !strings.EqualFold(k, "MAILBOX") {
+					continue
+				}
+				s, err := imap.ParseString(correlator[i+1])
+				if err != nil {
+					return err
+				}
+				if mboxName, err = utf7.Encoding.NewDecoder().String(s); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if mboxName == "" {
+		// Not a MULTISEARCH response
+		return responses.ErrUnhandled
+	}
+
+	for i := 0; i < len(fields); i++ {
+		k, _ := imap.ParseString(fields[i])
+		if strings.EqualFold(k, "UID") {
+			continue
+		}
+		if i+1 >= len(fields) {
+			break
+		}
+		v := fields[i+1]
+		i++
+		if !strings.EqualFold(k, "ALL") {
+			continue
+		}
+
+		s, err := imap.ParseString(v)
+		if err != nil {
+			return err
+		}
+		seqSet, err := imap.ParseSeqSet(s)
+		if err != nil {
+			return err
+		}
+		for _, seq := range seqSet.Set {
+			for uid := seq.Start; uid <= seq.Stop; uid++ {
+				r.Uids[mboxName] = append(r.Uids[mboxName], uid)
+			}
+		}
+	}
+	return nil
+}
+
+// isJunkOrTrash returns true if the mailbox is likely to contain messages the
+// user isn't interested in when searching.
+func isJunkOrTrash(mbox *MailboxInfo) bool {
+	return mbox.HasAttr(imap.JunkAttr) || mbox.HasAttr(imap.TrashAttr) ||
+		mbox.Name == "Junk" || mbox.Name == "Trash"
+}
+
+// searchUidsByMailbox returns the UIDs of the messages matching criteria in all
+// mailboxes. Junk and Trash are left out unless includeJunk is set.
+func searchUidsByMailbox(conn *imapclient.Client, criteria *imap.SearchCriteria, includeJunk bool) (map[string][]uint32, error) {
+	if criteria == nil {
+		criteria = imap.NewSearchCriteria()
+	}
+
+	mailboxes, err := listMailboxes(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	searchable := make(map[string]bool)
+	for i := range mailboxes {
+		mbox := &mailboxes[i]
+		if mbox.HasAttr(imap.NoSelectAttr) || (!includeJunk && isJunkOrTrash(mbox)) {
+			continue
+		}
+		searchable[mbox.Name] = true
+	}
+
+	if ok, err := conn.Support(multiSearchCapability); err != nil {
+		return nil, err
+	} else if ok {
+		res := &multiSearchResponse{Uids: make(map[string][]uint32)}
+		status, err := conn.Execute(&multiSearchCommand{criteria}, res)
+		if err == nil {
+			err = status.Err()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ESEARCH failed: %v", err)
+		}
+		for name := range res.Uids {
+			if !searchable[name] {
+				delete(res.Uids, name)
+			}
+		}
+		return res.Uids, nil
+	}
+
+	var names []string
+	for _, mbox := range mailboxes {
+		if searchable[mbox.Name] {
+			names = append(names, mbox.Name)
+		}
+	}
+	return searchUidsIn(conn, names, criteria)
+}
+
+// searchUidsIn returns the UIDs of the messages matching criteria in the
+// specified mailboxes, searching each of them in turn.
+func searchUidsIn(conn *imapclient.Client, mailboxes []string, criteria *imap.SearchCriteria) (map[string][]uint32, error) {
+	if criteria == nil {
+		criteria = imap.NewSearchCriteria()
+	}
+
+	uids := make(map[string][]uint32)
+	for _, name := range mailboxes {
+		if err := ensureMailboxSelected(conn, name); err != nil {
+			return nil, err
+		}
+		l, err := conn.UidSearch(criteria)
+		if err != nil {
+			return nil, fmt.Errorf("UID SEARCH failed in %q: %v", name, err)
+		}
+		if len(l) > 0 {
+			uids[name] = l
+		}
+	}
+	return uids, nil
+}
+
+type searchHit struct {
+	mailbox string
+	uid     uint32
+	date    time.Time
+}
+
+// fetchByMailbox runs a UID FETCH command in each mailbox.
+func fetchByMailbox(conn *imapclient.Client, uids map[string][]uint32, items []imap.FetchItem, f func(mboxName string, msg *imap.Message)) error {
+	for mboxName, l := range uids {
+		if len(l) == 0 {
+			continue
+		}
+		if err := ensureMailboxSelected(conn, mboxName); err != nil {
+			return err
+		}
+
+		var seqSet imap.SeqSet
+		seqSet.AddNum(l...)
+
+		ch := make(chan *imap.Message, 10)
+		done := make(chan error, 1)
+		go func() {
+			done <- conn.UidFetch(&seqSet, items, ch)
+		}()
+
+		for msg := range ch {
+			f(mboxName, msg)
+		}
+
+		if err := <-done; err != nil {
+			return fmt.Errorf("failed to fetch messages in %q: %v", mboxName, err)
+		}
+	}
+	return nil
+}
+
+// searchAllMailboxes returns a page of the messages matching criteria in all
+// mailboxes, most recently received first.
+func searchAllMailboxes(conn *imapclient.Client, criteria *imap.SearchCriteria, includeJunk bool, cursor pageCursor, messagesPerPage int) (msgs []IMAPMessage, prev, next string, err error) {
+	uids, err := searchUidsByMailbox(conn, criteria, includeJunk)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return listMessagesByMailbox(conn, uids, cursor, messagesPerPage)
+}
+
+// listMessagesByMailbox merges messages from several mailboxes into a single
+// list, most recently received first, and returns a page of it. Messages are
+// identified by references in page cursors.
+func listMessagesByMailbox(conn *imapclient.Client, uids map[string][]uint32, cursor pageCursor, messagesPerPage int) (msgs []IMAPMessage, prev, next string, err error) {
+	var hits []searchHit
+	fetch := []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate}
+	err = fetchByMailbox(conn, uids, fetch, func(mboxName string, msg *imap.Message) {
+		hits = append(hits, searchHit{mboxName, msg.Uid, msg.InternalDate})
+	})
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		a, b := &hits[i], &hits[j]
+		if !a.date.Equal(b.date) {
+			return a.date.After(b.date)
+		}
+		if a.mailbox != b.mailbox {
+			return a.mailbox < b.mailbox
+		}
+		return a.uid > b.uid
+	})
+
+	ids := make([]string, len(hits))
+	for i := range hits {
+		ids[i] = formatMessageRef(hits[i].mailbox, hits[i].uid)
+	}
+	start, end, prev, next := cursor.page(ids, messagesPerPage)
+	hits = hits[start:end]
+
+	indexes := make(map[string]int)
+	pageUids := make(map[string][]uint32)
+	for i := range hits {
+		indexes[formatMessageRef(hits[i].mailbox, hits[i].uid)] = i
+		pageUids[hits[i].mailbox] = append(pageUids[hits[i].mailbox], hits[i].uid)
+	}
+
+	fetch = []imap.FetchItem{
+		imap.FetchEnvelope,
+		imap.FetchFlags,
+		imap.FetchUid,
+		imap.FetchBodyStructure,
+	}
+	msgs = make([]IMAPMessage, len(hits))
+	err = fetchByMailbox(conn, pageUids, fetch, func(mboxName string, msg *imap.Message) {
+		if i, ok := indexes[formatMessageRef(mboxName, msg.Uid)]; ok {
+			msgs[i] = IMAPMessage{msg, mboxName}
+		}
+	})
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	l := msgs[:0]
+	for _, msg := range msgs {
+		if msg.Message != nil {
+			l = append(l, msg)
+		}
+	}
+	return l, prev, next, nil
+}
@@ -0,0 +1,992 @@
+package alpsbase
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~migadu/alps"
+	"git.sr.ht/~migadu/alps/config"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+const pgpKeysKey = "base.pgp"
+
+// pgpStatusKey is the context key where viewers store the PGPStatus of the
+// message being displayed.
+const pgpStatusKey = "base.pgpStatus"
+
+var errWrongPassphrase = fmt.Errorf("wrong passphrase")
+
+// PGPKeys are the OpenPGP keys of a user.
+type PGPKeys struct {
+	// Private key of the user, sealed with their passphrase by
+	// sealPrivateKey
+	PrivateKey []byte
+	// Armored public key of the user
+	PublicKey string
+	// Armored public keys imported by the user, by lowercase address
+	Contacts map[string]string
+}
+
+func loadPGPKeys(s alps.Store) (*PGPKeys, error) {
+	keys := new(PGPKeys)
+	if err := s.Get(pgpKeysKey, keys); err != nil && err != alps.ErrNoStoreEntry {
+		return nil, err
+	}
+	if keys.Contacts == nil {
+		keys.Contacts = make(map[string]string)
+	}
+	return keys, nil
+}
+
+func savePGPKeys(s alps.Store, keys *PGPKeys) error {
+	return s.Put(pgpKeysKey, keys)
+}
+
+// HasPrivateKey checks whether the user has set up a key pair.
+func (keys *PGPKeys) HasPrivateKey() bool {
+	return len(keys.PrivateKey) > 0
+}
+
+// Public returns the public key of the user.
+func (keys *PGPKeys) Public() (*openpgp.Entity, error) {
+	return readArmoredPublicKey(keys.PublicKey)
+}
+
+// Unlock returns the private key of the user, ready to sign and decrypt.
+func (keys *PGPKeys) Unlock(passphrase string) (*openpgp.Entity, error) {
+	if !keys.HasPrivateKey() {
+		return nil, fmt.Errorf("no OpenPGP key is set up")
+	}
+	b, err := openPrivateKey(keys.PrivateKey, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	l, err := openpgp.ReadKeyRing(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %v", err)
+	}
+	e := l[0]
+	if err := decryptPrivateKeys(e, passphrase); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// SetPrivateKey replaces the key pair of the user. The private key is sealed
+// with the passphrase.
+func (keys *PGPKeys) SetPrivateKey(e *openpgp.Entity, passphrase string) error {
+	if e.PrivateKey == nil {
+		return fmt.Errorf("not a private key")
+	}
+	if err := decryptPrivateKeys(e, passphrase); err != nil {
+		return err
+	}
+
+	// This signs the algorithm preferences of generated keys too, so the
+	// public key is serialized afterwards
+	var priv bytes.Buffer
+	if err := e.SerializePrivate(&priv, nil); err != nil {
+		return fmt.Errorf("failed to serialize private key: %v", err)
+	}
+	sealed, err := sealPrivateKey(priv.Bytes(), passphrase)
+	if err != nil {
+		return err
+	}
+	pub, err := armorPublicKey(e)
+	if err != nil {
+		return err
+	}
+
+	keys.PrivateKey = sealed
+	keys.PublicKey = pub
+	return nil
+}
+
+// AddContact imports public keys. Each one is stored for the addresses of its
+// user IDs, and the addresses are returned.
+func (keys *PGPKeys) AddContact(armored string) ([]string, error) {
+	l, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %v", err)
+	}
+
+	var addrs []string
+	for _, e := range l {
+		pub, err := armorPublicKey(e)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range e.Identities {
+			if id.UserId == nil || id.UserId.Email == "" {
+				continue
+			}
+			addr := strings.ToLower(id.UserId.Email)
+			keys.Contacts[addr] = pub
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("public key has no address")
+	}
+	return addrs, nil
+}
+
+// pgpKeyConfig is used to generate keys. Algorithm preferences are only
+// recorded in the key if defaults are set, otherwise other clients assume
+// legacy algorithms.
+var pgpKeyConfig = &packet.Config{
+	RSABits:       3072,
+	DefaultHash:   crypto.SHA256,
+	DefaultCipher: packet.CipherAES256,
+}
+
+// generatePGPKey generates a key pair for an identity.
+func generatePGPKey(id *Identity) (*openpgp.Entity, error) {
+	e, err := openpgp.NewEntity(id.Name, "", id.Address, pgpKeyConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate OpenPGP key: %v", err)
+	}
+	return e, nil
+}
+
+func readArmoredPrivateKey(armored string) (*openpgp.Entity, error) {
+	l, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %v", err)
+	}
+	if l[0].PrivateKey == nil {
+		return nil, fmt.Errorf("not a private key")
+	}
+	return l[0], nil
+}
+
+// PGPKeyInfo describes a key for display.
+type PGPKeyInfo struct {
+	Address     string
+	UserID      string
+	Fingerprint string
+}
+
+func newPGPKeyInfo(address string, e *openpgp.Entity) PGPKeyInfo {
+	return PGPKeyInfo{
+		Address:     address,
+		UserID:      pgpUserID(e),
+		Fingerprint: fmt.Sprintf("%X", e.PrimaryKey.Fingerprint),
+	}
+}
+
+// pgpUserID returns the primary user ID of a key.
+func pgpUserID(e *openpgp.Entity) string {
+	var name string
+	for n, id := range e.Identities {
+		if sig := id.SelfSignature; sig != nil && sig.IsPrimaryId != nil && *sig.IsPrimaryId {
+			return n
+		}
+		if name == "" || n < name {
+			name = n
+		}
+	}
+	return name
+}
+
+// hasPGPAddress checks whether one of the user IDs of a key has the provided
+// address.
+func hasPGPAddress(e *openpgp.Entity, address string) bool {
+	for _, id := range e.Identities {
+		if id.UserId != nil && strings.EqualFold(id.UserId.Email, address) {
+			return true
+		}
+	}
+	return false
+}
+
+func readArmoredPublicKey(armored string) (*openpgp.Entity, error) {
+	l, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %v", err)
+	}
+	return l[0], nil
+}
+
+func armorPublicKey(e *openpgp.Entity) (string, error) {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return "", err
+	}
+	if err := e.Serialize(w); err != nil {
+		return "", fmt.Errorf("failed to serialize public key: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// decryptPrivateKeys decrypts private keys protected by an OpenPGP
+// passphrase, e.g. imported keys. The passphrase must be the one the key is
+// sealed with in the store.
+func decryptPrivateKeys(e *openpgp.Entity, passphrase string) error {
+	privs := []*packet.PrivateKey{e.PrivateKey}
+	for _, subkey := range e.Subkeys {
+		if subkey.PrivateKey != nil {
+			privs = append(privs, subkey.PrivateKey)
+		}
+	}
+	for _, priv := range privs {
+		if !priv.Encrypted {
+			continue
+		}
+		if err := priv.Decrypt([]byte(passphrase)); err != nil {
+			return errWrongPassphrase
+		}
+	}
+	return nil
+}
+
+// Parameters of the key derived from the user's passphrase to seal private
+// keys at rest.
+const (
+	sealSaltSize  = 16
+	sealNonceSize = 24
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+)
+
+func sealKey(passphrase string, salt []byte) (*[32]byte, error) {
+	b, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key from passphrase: %v", err)
+	}
+	var key [32]byte
+	copy(key[:], b)
+	return &key, nil
+}
+
+// sealPrivateKey encrypts a serialized private key. The result contains the
+// salt and nonce followed by the sealed key.
+func sealPrivateKey(b []byte, passphrase string) ([]byte, error) {
+	out := make([]byte, sealSaltSize+sealNonceSize)
+	if _, err := io.ReadFull(rand.Reader, out); err != nil {
+		return nil, err
+	}
+	salt := out[:sealSaltSize]
+	var nonce [sealNonceSize]byte
+	copy(nonce[:], out[sealSaltSize:])
+
+	key, err := sealKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(out, b, &nonce, key), nil
+}
+
+func openPrivateKey(sealed []byte, passphrase string) ([]byte, error) {
+	if len(sealed) < sealSaltSize+sealNonceSize {
+		return nil, fmt.Errorf("invalid sealed private key")
+	}
+	salt := sealed[:sealSaltSize]
+	var nonce [sealNonceSize]byte
+	copy(nonce[:], sealed[sealSaltSize:])
+
+	key, err := sealKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := secretbox.Open(nil, sealed[sealSaltSize+sealNonceSize:], &nonce, key)
+	if !ok {
+		return nil, errWrongPassphrase
+	}
+	return b, nil
+}
+
+// PGPKeyLocator looks up the public keys of an address, e.g. in the user's
+// contacts.
+type PGPKeyLocator interface {
+	// LookupPGPKeys returns the public keys of an address, or an empty list
+	// if there are none.
+	LookupPGPKeys(ctx *alps.Context, address string) (openpgp.EntityList, error)
+}
+
+var pgpKeyLocators = make(map[string]PGPKeyLocator)
+
+// RegisterPGPKeyLocator registers a public key locator. Plugins register
+// their locator each time they're loaded, replacing the previous one with the
+// same name.
+func RegisterPGPKeyLocator(name string, l PGPKeyLocator) {
+	pgpKeyLocators[name] = l
+}
+
+// lookupPGPKeys returns the public keys of an address. The keys of the user
+// and the ones they imported come first, then the ones found by locators,
+// then the Web Key Directory if wkd is set. Lookup failures are logged, and
+// treated as if there was no key.
+//
+// The Web Key Directory is only queried for the recipients of the user's
+// messages: looking up the senders of received messages would let anyone make
+// the server send requests to arbitrary hosts.
+func lookupPGPKeys(ctx *alps.Context, keys *PGPKeys, address string, wkd bool) openpgp.EntityList {
+	if keys.PublicKey != "" {
+		if e, err := keys.Public(); err == nil && hasPGPAddress(e, address) {
+			return openpgp.EntityList{e}
+		}
+	}
+	if armored, ok := keys.Contacts[strings.ToLower(address)]; ok {
+		if e, err := readArmoredPublicKey(armored); err == nil {
+			return openpgp.EntityList{e}
+		}
+	}
+
+	names := make([]string, 0, len(pgpKeyLocators))
+	for name := range pgpKeyLocators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		l, err := pgpKeyLocators[name].LookupPGPKeys(ctx, address)
+		if err != nil {
+			ctx.Logger().Printf("Failed to look up OpenPGP key of %v: %v", address, err)
+		} else if len(l) > 0 {
+			return l
+		}
+	}
+
+	if wkd && ctx.Server.Config.OpenPGP.WKD {
+		l, err := cachedLookupWKD(&ctx.Server.Config.OpenPGP, address)
+		if err != nil {
+			ctx.Logger().Printf("Failed to look up OpenPGP key of %v in the Web Key Directory: %v", address, err)
+		}
+		return l
+	}
+	return nil
+}
+
+var wkdClient = &http.Client{Timeout: 10 * time.Second}
+
+// wkdCacheTTL is how long the results of Web Key Directory lookups are kept,
+// including failed ones.
+const wkdCacheTTL = time.Hour
+
+type wkdCacheEntry struct {
+	keys    openpgp.EntityList
+	err     error
+	expires time.Time
+}
+
+// wkdCache keeps the results of lookupWKD, by directory URL and lowercase
+// address.
+var wkdCache = struct {
+	sync.Mutex
+	entries map[string]*wkdCacheEntry
+}{entries: make(map[string]*wkdCacheEntry)}
+
+func cachedLookupWKD(cfg *config.OpenPGPConfig, address string) (openpgp.EntityList, error) {
+	key := cfg.WKDURL + "\x00" + strings.ToLower(address)
+
+	wkdCache.Lock()
+	entry := wkdCache.entries[key]
+	wkdCache.Unlock()
+	if entry != nil && time.Now().Before(entry.expires) {
+		return entry.keys, entry.err
+	}
+
+	l, err := lookupWKD(cfg, address)
+
+	wkdCache.Lock()
+	defer wkdCache.Unlock()
+	now := time.Now()
+	for k, entry := range wkdCache.entries {
+		if now.After(entry.expires) {
+			delete(wkdCache.entries, k)
+		}
+	}
+	wkdCache.entries[key] = &wkdCacheEntry{keys: l, err: err, expires: now.Add(wkdCacheTTL)}
+	return l, err
+}
+
+// wkdDomainAllowed returns false for domains which can't have a Web Key
+// Directory on the Internet: IP literals and single-label names, which would
+// refer to hosts on the server's network.
+func wkdDomainAllowed(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if strings.HasPrefix(domain, "[") || net.ParseIP(domain) != nil {
+		return false
+	}
+	return strings.Contains(domain, ".") && !strings.ContainsAny(domain, "/?#:@\\")
+}
+
+// maxWKDKeySize is the maximum size of a key served by a Web Key Directory.
+const maxWKDKeySize = 1 << 20
+
+const zbase32Alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+func zbase32(b []byte) string {
+	var sb strings.Builder
+	var buf uint
+	n := 0
+	for _, c := range b {
+		buf = buf<<8 | uint(c)
+		n += 8
+		for n >= 5 {
+			n -= 5
+			sb.WriteByte(zbase32Alphabet[(buf>>uint(n))&31])
+		}
+	}
+	if n > 0 {
+		sb.WriteByte(zbase32Alphabet[(buf<<uint(5-n))&31])
+	}
+	return sb.String()
+}
+
+// lookupWKD looks up the keys of an address in the Web Key Directory of its
+// domain, with the advanced method first then the direct one. Keys without a
+// user ID matching the address are discarded.
+func lookupWKD(cfg *config.OpenPGPConfig, address string) (openpgp.EntityList, error) {
+	i := strings.LastIndexByte(address, '@')
+	if i < 0 {
+		return nil, nil
+	}
+	local, domain := address[:i], strings.ToLower(address[i+1:])
+	if !wkdDomainAllowed(domain) {
+		return nil, fmt.Errorf("invalid domain %q", domain)
+	}
+
+	sum := sha1.Sum([]byte(strings.ToLower(local)))
+	hu := zbase32(sum[:]) + "?l=" + url.QueryEscape(local)
+
+	var urls []string
+	if cfg.WKDURL != "" {
+		base := strings.TrimSuffix(cfg.WKDURL, "/")
+		urls = []string{base + "/.well-known/openpgpkey/" + domain + "/hu/" + hu}
+	} else {
+		urls = []string{
+			"https://openpgpkey." + domain + "/.well-known/openpgpkey/" + domain + "/hu/" + hu,
+			"https://" + domain + "/.well-known/openpgpkey/hu/" + hu,
+		}
+	}
+
+	var lastErr error
+	for _, u := range urls {
+		l, err := fetchWKD(u)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var matching openpgp.EntityList
+		for _, e := range l {
+			if hasPGPAddress(e, address) {
+				matching = append(matching, e)
+			}
+		}
+		return matching, nil
+	}
+	return nil, lastErr
+}
+
+func fetchWKD(u string) (openpgp.EntityList, error) {
+	resp, err := wkdClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("HTTP request failed: %v", resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxWKDKeySize+1))
+	if err != nil {
+		return nil, err
+	} else if len(b) > maxWKDKeySize {
+		return nil, fmt.Errorf("key too large")
+	}
+
+	l, err := openpgp.ReadKeyRing(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %v", err)
+	}
+	return l, nil
+}
+
+// preparePGP looks up the keys needed to sign and encrypt the message when
+// it's written. Messages are encrypted to the user too, so that they can read
+// the copy saved in the Sent mailbox.
+//
+// Encrypted messages can't have Bcc recipients: the IDs of their keys would be
+// disclosed to the other recipients.
+func preparePGP(ctx *alps.Context, msg *OutgoingMessage, sign, encrypt bool, passphrase string) error {
+	keys, err := loadPGPKeys(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load OpenPGP keys: %v", err)
+	}
+	if !keys.HasPrivateKey() {
+		return fmt.Errorf("no OpenPGP key is set up")
+	}
+
+	if sign {
+		if msg.PGPSigner, err = keys.Unlock(passphrase); err != nil {
+			return err
+		}
+	}
+
+	if encrypt && len(msg.Bcc) > 0 {
+		return fmt.Errorf("encrypted messages can't have Bcc recipients")
+	}
+
+	if encrypt {
+		self, err := keys.Public()
+		if err != nil {
+			return err
+		}
+		recipients := openpgp.EntityList{self}
+
+		var rcpts []string
+		for _, field := range [][]string{msg.To, msg.Cc} {
+			rcpts = append(rcpts, field...)
+		}
+		addrs, err := parseAddressList(rcpts)
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			l := lookupPGPKeys(ctx, keys, addr.Address, true)
+			if len(l) == 0 {
+				return fmt.Errorf("no OpenPGP key found for %v", addr.Address)
+			}
+			recipients = append(recipients, l...)
+		}
+		msg.PGPRecipients = recipients
+	}
+
+	return nil
+}
+
+func randomBoundary() (string, error) {
+	var b [30]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", b[:]), nil
+}
+
+// canonicalLineEndings converts line endings to CRLF, as required for signed
+// data (RFC 3156 section 5).
+func canonicalLineEndings(b []byte) []byte {
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+}
+
+// writePGPSigned writes a multipart/signed message (RFC 3156 section 5).
+func writePGPSigned(w io.Writer, h message.Header, signed []byte, signer *openpgp.Entity) error {
+	signed = canonicalLineEndings(signed)
+
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, signer, bytes.NewReader(signed), nil); err != nil {
+		return fmt.Errorf("failed to sign message: %v", err)
+	}
+
+	var sigHeader message.Header
+	sigHeader.SetContentType("application/pgp-signature", map[string]string{"name": "signature.asc"})
+	sigHeader.SetContentDisposition("attachment", map[string]string{"filename": "signature.asc"})
+
+	params := map[string]string{
+		"micalg":   "pgp-sha256",
+		"protocol": "application/pgp-signature",
+	}
+	return writeMultipartSigned(w, h, params, signed, sigHeader, canonicalLineEndings(sig.Bytes()))
+}
+
+// writeMultipartSigned writes a multipart/signed message (RFC 1847) with the
+// provided Content-Type parameters. The signed part is written as is, since
+// any change would break the signature.
+func writeMultipartSigned(w io.Writer, h message.Header, params map[string]string, signed []byte, sigHeader message.Header, sig []byte) error {
+	boundary, err := randomBoundary()
+	if err != nil {
+		return err
+	}
+	params["boundary"] = boundary
+	h.SetContentType("multipart/signed", params)
+	if err := textproto.WriteHeader(w, h.Header); err != nil {
+		return fmt.Errorf("failed to write header: %v", err)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	buf.Write(signed)
+	fmt.Fprintf(&buf, "\r\n--%s\r\n", boundary)
+	if err := textproto.WriteHeader(&buf, sigHeader.Header); err != nil {
+		return err
+	}
+	buf.Write(sig)
+	fmt.Fprintf(&buf, "\r\n--%s--\r\n", boundary)
+
+	if _, err := buf.WriteTo(w); err != nil {
+		return fmt.Errorf("failed to write signed message: %v", err)
+	}
+	return nil
+}
+
+// writePGPEncrypted writes a multipart/encrypted message (RFC 3156 section
+// 4). If a signer is provided, the encrypted data is signed too.
+func writePGPEncrypted(w io.Writer, h message.Header, plaintext []byte, to openpgp.EntityList, signer *openpgp.Entity) error {
+	var ciphertext bytes.Buffer
+	aw, err := armor.Encode(&ciphertext, "PGP MESSAGE", nil)
+	if err != nil {
+		return err
+	}
+	pw, err := openpgp.Encrypt(aw, to, signer, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt message: %v", err)
+	}
+	if _, err := pw.Write(plaintext); err != nil {
+		return fmt.Errorf("failed to encrypt message: %v", err)
+	}
+	if err := pw.Close(); err != nil {
+		return fmt.Errorf("failed to encrypt message: %v", err)
+	}
+	if err := aw.Close(); err != nil {
+		return fmt.Errorf("failed to armor encrypted message: %v", err)
+	}
+
+	h.SetContentType("multipart/encrypted", map[string]string{
+		"protocol": "application/pgp-encrypted",
+	})
+	mw, err := message.CreateWriter(w, h)
+	if err != nil {
+		return fmt.Errorf("failed to create mail writer: %v", err)
+	}
+
+	var vh message.Header
+	vh.SetContentType("application/pgp-encrypted", nil)
+	vh.Set("Content-Description", "PGP/MIME version identification")
+	vw, err := mw.CreatePart(vh)
+	if err != nil {
+		return fmt.Errorf("failed to create version part: %v", err)
+	}
+	if _, err := io.WriteString(vw, "Version: 1\r\n"); err != nil {
+		return err
+	}
+	if err := vw.Close(); err != nil {
+		return err
+	}
+
+	var dh message.Header
+	dh.SetContentType("application/octet-stream", map[string]string{"name": "encrypted.asc"})
+	dh.SetContentDisposition("inline", map[string]string{"filename": "encrypted.asc"})
+	dh.Set("Content-Description", "OpenPGP encrypted message")
+	dw, err := mw.CreatePart(dh)
+	if err != nil {
+		return fmt.Errorf("failed to create encrypted part: %v", err)
+	}
+	if _, err := ciphertext.WriteTo(dw); err != nil {
+		return err
+	}
+	if err := dw.Close(); err != nil {
+		return err
+	}
+
+	if err := mw.Close(); err != nil {
+		return fmt.Errorf("failed to close mail writer: %v", err)
+	}
+	return nil
+}
+
+// PGPStatus describes how a message is protected with OpenPGP.
+type PGPStatus struct {
+	Encrypted bool
+	// Whether the message could be decrypted
+	Decrypted bool
+	Signed    bool
+	// Whether the signature is valid, in which case Signer is the user ID
+	// of the key
+	Verified bool
+	Signer   string
+	// Why the message couldn't be decrypted or the signature couldn't be
+	// verified
+	Error string
+}
+
+// Locked checks whether the message needs to be decrypted with the user's
+// passphrase. It's false if the status is nil.
+func (status *PGPStatus) Locked() bool {
+	return status != nil && status.Encrypted && !status.Decrypted
+}
+
+func isPGPSigned(mimeType string, params map[string]string) bool {
+	return strings.EqualFold(mimeType, "multipart/signed") &&
+		strings.EqualFold(params["protocol"], "application/pgp-signature")
+}
+
+func isPGPEncrypted(mimeType string, params map[string]string) bool {
+	return strings.EqualFold(mimeType, "multipart/encrypted") &&
+		strings.EqualFold(params["protocol"], "application/pgp-encrypted")
+}
+
+// splitMultipartSigned splits a raw multipart/signed entity into the signed
+// part, with its header, and the decoded signature.
+func splitMultipartSigned(raw []byte) (signed, signature []byte, err error) {
+	e, err := message.Read(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read signed message: %v", err)
+	}
+	_, params, err := e.Header.ContentType()
+	if err != nil {
+		return nil, nil, err
+	}
+	delim := []byte("\n--" + params["boundary"])
+
+	i := bytes.Index(raw, []byte("\r\n\r\n"))
+	if j := bytes.Index(raw, []byte("\n\n")); i < 0 || (j >= 0 && j < i) {
+		i = j
+	}
+	if i < 0 {
+		return nil, nil, fmt.Errorf("malformed signed message")
+	}
+	body := raw[i:]
+
+	start := bytes.Index(body, delim)
+	if start < 0 {
+		return nil, nil, fmt.Errorf("malformed signed message")
+	}
+	body = body[start+len(delim):]
+	if eol := bytes.IndexByte(body, '\n'); eol >= 0 {
+		body = body[eol+1:]
+	}
+	end := bytes.Index(body, delim)
+	if end < 0 {
+		return nil, nil, fmt.Errorf("malformed signed message")
+	}
+	signed = bytes.TrimSuffix(body[:end], []byte("\r"))
+
+	mr := e.MultipartReader()
+	if _, err := mr.NextPart(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read signed part: %v", err)
+	}
+	p, err := mr.NextPart()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read signature part: %v", err)
+	}
+	if signature, err = ioutil.ReadAll(p.Body); err != nil {
+		return nil, nil, fmt.Errorf("failed to read signature: %v", err)
+	}
+
+	return canonicalLineEndings(signed), signature, nil
+}
+
+// verifyPGPSigned checks the signature of a raw multipart/signed entity with
+// the keys of the sender. The signed part is returned.
+func verifyPGPSigned(ctx *alps.Context, keys *PGPKeys, raw []byte, from string, status *PGPStatus) []byte {
+	status.Signed = true
+
+	signed, signature, err := splitMultipartSigned(raw)
+	if err != nil {
+		status.Error = err.Error()
+		return nil
+	}
+
+	keyring := lookupPGPKeys(ctx, keys, from, false)
+	if len(keyring) == 0 {
+		status.Error = fmt.Sprintf("No public key found for %v", from)
+		return signed
+	}
+
+	signer, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(signed), bytes.NewReader(signature), nil)
+	if err != nil {
+		status.Error = fmt.Sprintf("Invalid signature: %v", err)
+		return signed
+	}
+	status.Verified = true
+	status.Signer = pgpUserID(signer)
+	return signed
+}
+
+// checkPGPSignature verifies a message if it's signed with OpenPGP.
+func checkPGPSignature(ctx *alps.Context, msg *IMAPMessage, raw []byte) (*PGPStatus, error) {
+	keys, err := loadPGPKeys(ctx.Session.Store())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load OpenPGP keys: %v", err)
+	}
+
+	var from string
+	if len(msg.Envelope.From) > 0 {
+		from = msg.Envelope.From[0].Address()
+	}
+	status := new(PGPStatus)
+	verifyPGPSigned(ctx, keys, raw, from, status)
+	return status, nil
+}
+
+// pgpViewer decrypts multipart/encrypted messages with the user's private key
+// and displays their text. The passphrase is submitted along with the
+// request. Until then, the status asks for it and no view is returned.
+type pgpViewer struct{}
+
+func (pgpViewer) ViewMessagePart(ctx *alps.Context, msg *IMAPMessage, part *message.Entity) (interface{}, error) {
+	mimeType, params, err := part.Header.ContentType()
+	if err != nil || !isPGPEncrypted(mimeType, params) {
+		return nil, ErrViewUnsupported
+	}
+
+	status := &PGPStatus{Encrypted: true}
+	ctx.Set(pgpStatusKey, status)
+
+	passphrase := ctx.FormValue("pgp_passphrase")
+	if passphrase == "" {
+		return nil, nil
+	}
+
+	keys, err := loadPGPKeys(ctx.Session.Store())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load OpenPGP keys: %v", err)
+	}
+	e, err := keys.Unlock(passphrase)
+	if err == errWrongPassphrase {
+		status.Error = "Wrong passphrase."
+		return nil, nil
+	} else if err != nil {
+		status.Error = err.Error()
+		return nil, nil
+	}
+
+	var from string
+	if len(msg.Envelope.From) > 0 {
+		from = msg.Envelope.From[0].Address()
+	}
+	keyring := append(openpgp.EntityList{e}, lookupPGPKeys(ctx, keys, from, false)...)
+
+	plaintext, err := decryptPGPMessage(part, keyring, status)
+	if err != nil {
+		status.Error = err.Error()
+		return nil, nil
+	}
+	status.Decrypted = true
+
+	inner, err := message.Read(bytes.NewReader(plaintext))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read decrypted message: %v", err)
+	}
+	if mimeType, params, _ := inner.Header.ContentType(); isPGPSigned(mimeType, params) {
+		signed := verifyPGPSigned(ctx, keys, plaintext, from, status)
+		if signed == nil {
+			return nil, nil
+		}
+		if inner, err = message.Read(bytes.NewReader(signed)); err != nil {
+			return nil, fmt.Errorf("failed to read signed message: %v", err)
+		}
+	}
+
+	text, err := findTextEntity(inner)
+	if err != nil {
+		return nil, err
+	} else if text == nil {
+		return nil, ErrViewUnsupported
+	}
+	return viewMessagePart(ctx, msg, text)
+}
+
+// decryptPGPMessage decrypts the encrypted part of a multipart/encrypted
+// entity. Signatures inside the encrypted data are checked too.
+func decryptPGPMessage(e *message.Entity, keyring openpgp.EntityList, status *PGPStatus) ([]byte, error) {
+	mr := e.MultipartReader()
+	if mr == nil {
+		return nil, fmt.Errorf("malformed encrypted message")
+	}
+	var encrypted io.Reader
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read encrypted message: %v", err)
+		}
+		if t, _, _ := p.Header.ContentType(); strings.EqualFold(t, "application/octet-stream") {
+			encrypted = p.Body
+			break
+		}
+	}
+	if encrypted == nil {
+		return nil, fmt.Errorf("malformed encrypted message")
+	}
+
+	block, err := armor.Decode(encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encrypted message: %v", err)
+	}
+	md, err := openpgp.ReadMessage(block.Body, keyring, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt message: %v", err)
+	}
+	plaintext, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt message: %v", err)
+	}
+
+	if md.IsSigned {
+		status.Signed = true
+		if md.SignedBy == nil {
+			status.Error = "No public key found for the signature"
+		} else if md.SignatureError != nil {
+			status.Error = fmt.Sprintf("Invalid signature: %v", md.SignatureError)
+		} else {
+			status.Verified = true
+			status.Signer = pgpUserID(md.SignedBy.Entity)
+		}
+	}
+	return plaintext, nil
+}
+
+// findTextEntity returns the text part of a message, plain text being
+// preferred over HTML. Its body is buffered.
+func findTextEntity(e *message.Entity) (*message.Entity, error) {
+	var text *message.Entity
+	var isPlain bool
+	err := e.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil {
+			return err
+		}
+		t, _, _ := part.Header.ContentType()
+		disp, _, _ := part.Header.ContentDisposition()
+		if disp != "" && !strings.EqualFold(disp, "inline") {
+			return nil
+		}
+		plain := strings.EqualFold(t, "text/plain")
+		if (!plain && !strings.EqualFold(t, "text/html")) || (isPlain && !plain) {
+			return nil
+		}
+
+		b, err := ioutil.ReadAll(part.Body)
+		if err != nil {
+			return err
+		}
+		text, err = message.New(part.Header, bytes.NewReader(b))
+		isPlain = plain
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message text: %v", err)
+	}
+	return text, nil
+}
@@ -0,0 +1,28 @@
+package alpsbase
+
+import (
+	"testing"
+)
+
+func TestWKDDomainAllowed(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"example.org", true},
+		{"mail.example.org.", true},
+		{"intranet", false},
+		{"localhost.", false},
+		{"10.0.0.5", false},
+		{"[10.0.0.5]", false},
+		{"[ipv6:::1]", false},
+		{"::1", false},
+		{"example.org:8080", false},
+		{"example.org/x", false},
+	}
+	for _, tc := range tests {
+		if got := wkdDomainAllowed(tc.domain); got != tc.want {
+			t.Errorf("wkdDomainAllowed(%q) = %v, want %v", tc.domain, got, tc.want)
+		}
+	}
+}
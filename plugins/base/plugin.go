@@ -11,4 +11,12 @@ func init() {
 	registerRoutes(&p)
 
 	alps.RegisterPluginLoader(p.Loader())
+	alps.RegisterJobHandler(scheduledSendJob, sendScheduledMessage)
+	alps.RegisterJobHandler(outboxSendJob, sendScheduledMessage)
+
+	RegisterViewer(pgpViewer{})
+	RegisterViewer(smimeViewer{})
+	RegisterViewer(imagePreviewer{})
+	RegisterViewer(csvPreviewer{})
+	RegisterViewer(messagePreviewer{})
 }
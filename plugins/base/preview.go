@@ -0,0 +1,450 @@
+package alpsbase
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~migadu/alps"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+)
+
+const (
+	// Maximum size of a decoded message part rendered inline
+	maxPreviewSize = 1 << 20
+	// Maximum number of rows of a CSV file rendered inline
+	maxPreviewRows = 500
+
+	// Maximum size of an image thumbnails are generated from, and maximum
+	// number of pixels once decoded. Small images can declare huge
+	// dimensions, the latter guards against decompression bombs.
+	maxThumbnailSourceSize = 10 << 20
+	maxThumbnailPixels     = 25 * 1000 * 1000
+	// Maximum width and height of thumbnails
+	thumbnailSize = 128
+	// Maximum number of source pixels averaged per thumbnail pixel, in each
+	// dimension
+	thumbnailSamples = 4
+	// Maximum total size of the cached thumbnails
+	thumbnailCacheSize = 16 << 20
+)
+
+// Image formats thumbnails can be generated from, and which are displayed
+// inline
+var previewImageTypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+// HasThumbnail returns true if a thumbnail can be generated for the part.
+func (node IMAPPartNode) HasThumbnail() bool {
+	return previewImageTypes[node.MIMEType] && node.Size <= maxThumbnailSourceSize
+}
+
+// CanPreview returns true if the part can be rendered inline in the message
+// view.
+func (node IMAPPartNode) CanPreview() bool {
+	return node.IsText() || previewImageTypes[node.MIMEType] || node.MIMEType == "message/rfc822"
+}
+
+// ThumbnailURL returns the URL of the thumbnail of the part.
+func (node IMAPPartNode) ThumbnailURL() string {
+	u := node.Message.URL()
+	u.Path += "/thumbnail"
+	q := u.Query()
+	q.Set("part", node.PathString())
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// thumbnailKey identifies a message part across sessions. UIDs are only
+// valid along with the mailbox UIDVALIDITY.
+type thumbnailKey struct {
+	Username    string
+	Mailbox     string
+	UidValidity uint32
+	Uid         uint32
+	Part        string
+}
+
+type thumbnailEntry struct {
+	key  thumbnailKey
+	data []byte
+}
+
+// thumbnailCache keeps the most recently used thumbnails in memory.
+type thumbnailCache struct {
+	locker  sync.Mutex
+	maxSize int
+	size    int
+	lru     *list.List // of *thumbnailEntry, most recently used first
+	entries map[thumbnailKey]*list.Element
+}
+
+func newThumbnailCache(maxSize int) *thumbnailCache {
+	return &thumbnailCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[thumbnailKey]*list.Element),
+	}
+}
+
+var thumbnails = newThumbnailCache(thumbnailCacheSize)
+
+func (cache *thumbnailCache) Get(key thumbnailKey) ([]byte, bool) {
+	cache.locker.Lock()
+	defer cache.locker.Unlock()
+
+	elem, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	cache.lru.MoveToFront(elem)
+	return elem.Value.(*thumbnailEntry).data, true
+}
+
+func (cache *thumbnailCache) Put(key thumbnailKey, data []byte) {
+	cache.locker.Lock()
+	defer cache.locker.Unlock()
+
+	if _, ok := cache.entries[key]; ok || len(data) > cache.maxSize {
+		return
+	}
+
+	cache.entries[key] = cache.lru.PushFront(&thumbnailEntry{key, data})
+	cache.size += len(data)
+
+	for cache.size > cache.maxSize {
+		elem := cache.lru.Back()
+		entry := elem.Value.(*thumbnailEntry)
+		cache.lru.Remove(elem)
+		delete(cache.entries, entry.key)
+		cache.size -= len(entry.data)
+	}
+}
+
+// checkImageDimensions reads the header of an image and returns an error if
+// the image would be too large once decoded.
+func checkImageDimensions(r io.Reader) error {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %v", err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > maxThumbnailPixels {
+		return fmt.Errorf("image dimensions are too large")
+	}
+	return nil
+}
+
+// generateThumbnail decodes an image and returns a PNG thumbnail of it.
+func generateThumbnail(r io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxThumbnailSourceSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %v", err)
+	}
+	if len(b) > maxThumbnailSourceSize {
+		return nil, fmt.Errorf("image is too large")
+	}
+
+	if err := checkImageDimensions(bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, scaleImage(img, thumbnailSize)); err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleImage shrinks an image to fit in a square, keeping its aspect ratio.
+// Each pixel of the result is the average of a sample of the source pixels
+// it covers.
+func scaleImage(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	w, h := srcW, srcH
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, h*size/w
+		} else {
+			w, h = w*size/h, size
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := bounds.Min.Y + y*srcH/h
+		y1 := bounds.Min.Y + (y+1)*srcH/h
+		stepY := (y1-y0)/thumbnailSamples + 1
+
+		for x := 0; x < w; x++ {
+			x0 := bounds.Min.X + x*srcW/w
+			x1 := bounds.Min.X + (x+1)*srcW/w
+			stepX := (x1-x0)/thumbnailSamples + 1
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy += stepY {
+				for sx := x0; sx < x1; sx += stepX {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+const previewImageTplStr = `
+<p class="preview-image">
+  <a href="{{.}}"><img src="{{.}}" alt=""></a>
+</p>
+`
+
+const previewCSVTplStr = `
+<div class="preview-csv">
+  <table>
+    {{range $i, $row := .Rows}}
+    <tr>
+      {{range $row}}
+      {{if eq $i 0}}<th>{{.}}</th>{{else}}<td>{{.}}</td>{{end}}
+      {{end}}
+    </tr>
+    {{end}}
+  </table>
+  {{if .Truncated}}
+  <p>Only the beginning of the file is shown.</p>
+  {{end}}
+</div>
+`
+
+const previewMessageTplStr = `
+{{define "addrs"}}{{range $i, $addr := .}}{{if $i}}, {{end}}{{$addr}}{{end}}{{end}}
+<div class="preview-message">
+  <table>
+    {{with .From}}<tr><th>From</th><td>{{template "addrs" .}}</td></tr>{{end}}
+    {{with .To}}<tr><th>To</th><td>{{template "addrs" .}}</td></tr>{{end}}
+    {{with .Cc}}<tr><th>Cc</th><td>{{template "addrs" .}}</td></tr>{{end}}
+    <tr><th>Subject</th><td>{{.Subject}}</td></tr>
+    {{if not .Date.IsZero}}<tr><th>Date</th><td>{{.Date.Format "Mon Jan 02 15:04"}}</td></tr>{{end}}
+  </table>
+  {{if .Body}}
+  {{.Body}}
+  {{else}}
+  <p>This message has no text.</p>
+  {{end}}
+</div>
+`
+
+var previewTpl *template.Template
+
+func init() {
+	previewTpl = template.Must(template.New("preview-image.html").Parse(previewImageTplStr))
+	template.Must(previewTpl.New("preview-csv.html").Parse(previewCSVTplStr))
+	template.Must(previewTpl.New("preview-message.html").Parse(previewMessageTplStr))
+}
+
+func executePreviewTemplate(name string, data interface{}) (template.HTML, error) {
+	var sb strings.Builder
+	if err := previewTpl.ExecuteTemplate(&sb, name, data); err != nil {
+		return "", err
+	}
+	return template.HTML(sb.String()), nil
+}
+
+// readPreview reads at most maxPreviewSize bytes of a part. The returned
+// boolean is true if the part is larger.
+func readPreview(r io.Reader) ([]byte, bool, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxPreviewSize+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read part body: %v", err)
+	}
+	if len(b) > maxPreviewSize {
+		return b[:maxPreviewSize], true, nil
+	}
+	return b, false, nil
+}
+
+// imagePreviewer displays images inline. The image is loaded from the raw
+// part URL, the part being the one requested in the query. Images too large
+// for thumbnails aren't displayed either.
+type imagePreviewer struct{}
+
+func (imagePreviewer) ViewMessagePart(ctx *alps.Context, msg *IMAPMessage, part *message.Entity) (interface{}, error) {
+	mimeType, _, err := part.Header.ContentType()
+	if err != nil || !previewImageTypes[strings.ToLower(mimeType)] {
+		return nil, ErrViewUnsupported
+	}
+
+	partPath, err := parsePartPath(ctx.QueryParam("part"))
+	if err != nil || len(partPath) == 0 {
+		return nil, ErrViewUnsupported
+	}
+	// Browsers are exposed to decompression bombs too
+	node := msg.PartByPath(partPath)
+	if node == nil || !node.HasThumbnail() || checkImageDimensions(part.Body) != nil {
+		return nil, ErrViewUnsupported
+	}
+
+	return executePreviewTemplate("preview-image.html", node.URL(true).String())
+}
+
+// csvPreviewer displays CSV files as a table. The first row is assumed to be
+// a header.
+type csvPreviewer struct{}
+
+type csvRenderData struct {
+	Rows      [][]string
+	Truncated bool
+}
+
+func (csvPreviewer) ViewMessagePart(ctx *alps.Context, msg *IMAPMessage, part *message.Entity) (interface{}, error) {
+	mimeType, _, err := part.Header.ContentType()
+	if err != nil {
+		return nil, ErrViewUnsupported
+	}
+	switch strings.ToLower(mimeType) {
+	case "text/csv", "text/comma-separated-values":
+	default:
+		return nil, ErrViewUnsupported
+	}
+
+	b, truncated, err := readPreview(part.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	r := csv.NewReader(bytes.NewReader(b))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	// Spreadsheets use semicolons in locales with decimal commas
+	firstLine := b
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		firstLine = b[:i]
+	}
+	if bytes.Count(firstLine, []byte(";")) > bytes.Count(firstLine, []byte(",")) {
+		r.Comma = ';'
+	}
+
+	data := csvRenderData{Truncated: truncated}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// Show the rows which could be parsed
+			data.Truncated = true
+			break
+		}
+		if len(data.Rows) == maxPreviewRows {
+			data.Truncated = true
+			break
+		}
+		data.Rows = append(data.Rows, record)
+	}
+	// The last row may have been cut
+	if truncated && len(data.Rows) > 1 {
+		data.Rows = data.Rows[:len(data.Rows)-1]
+	}
+
+	return executePreviewTemplate("preview-csv.html", &data)
+}
+
+// messagePreviewer displays attached messages: their main header fields and
+// their text, rendered by the other viewers.
+type messagePreviewer struct{}
+
+type messagePreviewRenderData struct {
+	From, To, Cc []string
+	Subject      string
+	Date         time.Time
+	Body         interface{}
+}
+
+func (messagePreviewer) ViewMessagePart(ctx *alps.Context, msg *IMAPMessage, part *message.Entity) (interface{}, error) {
+	mimeType, _, err := part.Header.ContentType()
+	if err != nil || !strings.EqualFold(mimeType, "message/rfc822") {
+		return nil, ErrViewUnsupported
+	}
+
+	b, truncated, err := readPreview(part.Body)
+	if err != nil {
+		return nil, err
+	} else if truncated {
+		return nil, ErrViewUnsupported
+	}
+
+	inner, err := message.Read(bytes.NewReader(b))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return nil, fmt.Errorf("failed to read attached message: %v", err)
+	}
+
+	h := mail.Header{inner.Header}
+	data := &messagePreviewRenderData{}
+	data.Subject, _ = h.Subject()
+	data.Date, _ = h.Date()
+	fields := []struct {
+		k string
+		v *[]string
+	}{
+		{"From", &data.From},
+		{"To", &data.To},
+		{"Cc", &data.Cc},
+	}
+	for _, f := range fields {
+		addrs, _ := h.AddressList(f.k)
+		for _, addr := range addrs {
+			*f.v = append(*f.v, formatAddress(addr))
+		}
+	}
+
+	text, err := findTextEntity(inner)
+	if err != nil {
+		return nil, err
+	}
+	if text != nil {
+		data.Body, err = viewMessagePart(ctx, msg, text)
+		if err == ErrViewUnsupported {
+			data.Body = nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return executePreviewTemplate("preview-message.html", data)
+}
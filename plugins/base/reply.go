@@ -0,0 +1,200 @@
+package alpsbase
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+)
+
+// Reply modes, selected with the "mode" query parameter
+const (
+	replySender = ""
+	replyAll    = "all"
+	replyList   = "list"
+)
+
+// maxReferences is the maximum number of message IDs in the References header
+// field of replies. The first message of the thread is always kept.
+const maxReferences = 20
+
+// fetchExtraHeader fetches the header fields which aren't part of the
+// envelope, but are needed to reply to a message or to answer its read
+// receipt request.
+func fetchExtraHeader(c *imapclient.Client, mboxName string, uid uint32) (mail.Header, error) {
+	if err := ensureMailboxSelected(c, mboxName); err != nil {
+		return mail.Header{}, err
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+
+	section := &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{
+			Specifier: imap.HeaderSpecifier,
+			Fields: []string{
+				"In-Reply-To", "References", "List-Post", "Mail-Followup-To",
+				"Disposition-Notification-To", "Original-Recipient", "Return-Path",
+				"Authentication-Results",
+			},
+		},
+		Peek: true,
+	}
+	fetch := []imap.FetchItem{section.FetchItem()}
+
+	ch := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqSet, fetch, ch)
+	}()
+
+	msg := <-ch
+	if msg == nil {
+		return mail.Header{}, fmt.Errorf("server didn't return message")
+	}
+	for range ch {
+	}
+
+	if err := <-done; err != nil {
+		return mail.Header{}, fmt.Errorf("failed to fetch message header: %v", err)
+	}
+
+	// Servers may not echo the field names as requested, so don't look up
+	// the section by name
+	var body imap.Literal
+	for _, literal := range msg.Body {
+		body = literal
+	}
+	if body == nil {
+		return mail.Header{}, fmt.Errorf("server didn't return message header")
+	}
+
+	h, err := textproto.ReadHeader(bufio.NewReader(body))
+	if err != nil {
+		return mail.Header{}, fmt.Errorf("failed to parse message header: %v", err)
+	}
+	return mail.Header{message.Header{h}}, nil
+}
+
+// msgIDList returns the message IDs of a header field, with angle brackets.
+func msgIDList(h mail.Header, k string) []string {
+	ids, _ := h.MsgIDList(k)
+	l := make([]string, len(ids))
+	for i, id := range ids {
+		l[i] = "<" + id + ">"
+	}
+	return l
+}
+
+// replyReferences returns the References of a reply: the References of the
+// original message, or its In-Reply-To, followed by its Message-Id.
+func replyReferences(h mail.Header, env *imap.Envelope) []string {
+	refs := msgIDList(h, "References")
+	if len(refs) == 0 {
+		refs = msgIDList(h, "In-Reply-To")
+	}
+	if env.MessageId != "" {
+		refs = append(refs, env.MessageId)
+	}
+	if len(refs) > maxReferences {
+		refs = append(refs[:1], refs[len(refs)-maxReferences+1:]...)
+	}
+	return refs
+}
+
+// listPostAddress returns the posting address of a mailing list from the
+// List-Post header field (RFC 2369), or an empty string if posting isn't
+// allowed.
+func listPostAddress(h mail.Header) string {
+	for _, s := range strings.Split(h.Get("List-Post"), ",") {
+		s = strings.TrimSpace(s)
+		if !strings.HasPrefix(s, "<") || !strings.HasSuffix(s, ">") {
+			continue
+		}
+		u, err := url.Parse(s[1 : len(s)-1])
+		if err != nil || !strings.EqualFold(u.Scheme, "mailto") {
+			continue
+		}
+		if addr, err := url.PathUnescape(u.Opaque); err == nil && addr != "" {
+			return addr
+		}
+	}
+	return ""
+}
+
+func imapToMailAddresses(addrs []*imap.Address) []*mail.Address {
+	l := make([]*mail.Address, len(addrs))
+	for i, addr := range addrs {
+		l[i] = &mail.Address{Name: addr.PersonalName, Address: addr.Address()}
+	}
+	return l
+}
+
+// replyRecipients returns the To and Cc recipients of a reply. Replies to the
+// user's own messages go to the original recipients. When replying to all,
+// the user's identities are left out.
+func replyRecipients(env *imap.Envelope, h mail.Header, identities Identities, mode string) (to, cc []string, err error) {
+	if mode == replyList {
+		addr := listPostAddress(h)
+		if addr == "" {
+			return nil, nil, fmt.Errorf("message wasn't sent to a mailing list accepting replies")
+		}
+		return []string{addr}, nil, nil
+	} else if mode != replySender && mode != replyAll {
+		return nil, nil, fmt.Errorf("unknown reply mode %q", mode)
+	}
+
+	var toAddrs, ccAddrs []*mail.Address
+	followupTo, _ := h.AddressList("Mail-Followup-To")
+	if mode == replyAll && len(followupTo) > 0 {
+		toAddrs = followupTo
+	} else {
+		if identities.Match(env.From) != nil {
+			toAddrs = imapToMailAddresses(env.To)
+		} else if len(env.ReplyTo) > 0 {
+			toAddrs = imapToMailAddresses(env.ReplyTo)
+		} else {
+			toAddrs = imapToMailAddresses(env.From)
+		}
+		if mode == replyAll {
+			ccAddrs = append(imapToMailAddresses(env.To), imapToMailAddresses(env.Cc)...)
+		}
+	}
+
+	if mode == replySender {
+		for _, addr := range toAddrs {
+			to = append(to, formatAddress(addr))
+		}
+		return to, nil, nil
+	}
+
+	seen := make(map[string]bool)
+	keep := func(addr *mail.Address) bool {
+		k := strings.ToLower(addr.Address)
+		if seen[k] || identities.Find(addr.Address) != nil {
+			return false
+		}
+		seen[k] = true
+		return true
+	}
+	for _, addr := range toAddrs {
+		if keep(addr) {
+			to = append(to, formatAddress(addr))
+		}
+	}
+	for _, addr := range ccAddrs {
+		if keep(addr) {
+			cc = append(cc, formatAddress(addr))
+		}
+	}
+	if len(to) == 0 {
+		to, cc = cc, nil
+	}
+	return to, cc, nil
+}
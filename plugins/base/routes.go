@@ -8,7 +8,6 @@ import (
 	"io/ioutil"
 	"mime"
 	"net/http"
-	"net/textproto"
 	"net/url"
 	"regexp"
 	"sort"
@@ -39,15 +38,35 @@ func registerRoutes(p *alps.GoPlugin) {
 	p.GET("/new-mailbox", handleNewMailbox)
 	p.POST("/new-mailbox", handleNewMailbox)
 
+	p.GET("/rename-mailbox/:mbox", handleRenameMailbox)
+	p.POST("/rename-mailbox/:mbox", handleRenameMailbox)
+
 	p.GET("/delete-mailbox/:mbox", handleDeleteMailbox)
 	p.POST("/delete-mailbox/:mbox", handleDeleteMailbox)
 
+	p.GET("/empty-mailbox/:mbox", handleEmptyMailbox)
+	p.POST("/empty-mailbox/:mbox", handleEmptyMailbox)
+
+	p.GET("/mailbox/:mbox/export", handleExport)
+	p.GET("/export", handleExport)
+
+	p.GET("/import", handleImport)
+	p.POST("/import", handleImport)
+
 	p.GET("/message/:mbox/:uid", func(ctx *alps.Context) error {
 		return handleGetPart(ctx, false)
 	})
+	// Encrypted messages are displayed once the passphrase is submitted
+	p.POST("/message/:mbox/:uid", func(ctx *alps.Context) error {
+		return handleGetPart(ctx, false)
+	})
 	p.GET("/message/:mbox/:uid/raw", func(ctx *alps.Context) error {
 		return handleGetPart(ctx, true)
 	})
+	p.GET("/message/:mbox/:uid/attachments.zip", handleGetAttachmentsZip)
+	p.GET("/message/:mbox/:uid/thumbnail", handleGetThumbnail)
+
+	p.GET("/thread/:mbox/:uid", handleGetThread)
 
 	p.GET("/login", handleLogin)
 	p.POST("/login", handleLogin)
@@ -66,17 +85,63 @@ func registerRoutes(p *alps.GoPlugin) {
 	p.GET("/message/:mbox/:uid/forward", handleForward)
 	p.POST("/message/:mbox/:uid/forward", handleForward)
 
+	p.GET("/message/:mbox/forward", handleForwardAttached)
+	p.POST("/message/:mbox/forward", handleForwardAttached)
+	p.GET("/messages/forward", handleForwardAttached)
+	p.POST("/messages/forward", handleForwardAttached)
+
 	p.GET("/message/:mbox/:uid/edit", handleEdit)
 	p.POST("/message/:mbox/:uid/edit", handleEdit)
 
+	p.POST("/message/:mbox/:uid/mdn", handleMDN)
+
 	p.POST("/message/:mbox/move", handleMove)
 
 	p.POST("/message/:mbox/delete", handleDelete)
 
 	p.POST("/message/:mbox/flag", handleSetFlags)
 
+	p.POST("/messages/move", handleMove)
+	p.POST("/messages/delete", handleDelete)
+	p.POST("/messages/flag", handleSetFlags)
+
+	p.GET("/unified", func(ctx *alps.Context) error {
+		return handleGetVirtualMailbox(ctx, unifiedInboxPath, nil)
+	})
+	p.GET("/starred", func(ctx *alps.Context) error {
+		return handleGetVirtualMailbox(ctx, starredPath, nil)
+	})
+
+	p.POST("/search", handleSaveSearch)
+	p.GET("/search/:name", handleGetSavedSearch)
+	p.POST("/search/:name/delete", handleDeleteSavedSearch)
+
+	p.GET("/scheduled", handleGetScheduled)
+	p.GET("/scheduled/:id/edit", handleEditScheduled)
+	p.POST("/scheduled/:id/cancel", handleCancelScheduled)
+	p.POST("/outbox/:id/undo", handleUndoSend)
+
 	p.GET("/settings", handleSettings)
 	p.POST("/settings", handleSettings)
+
+	p.GET("/settings/identities", handleIdentities)
+	p.GET("/settings/identities/new", handleEditIdentity)
+	p.POST("/settings/identities/new", handleEditIdentity)
+	p.GET("/settings/identities/:address/edit", handleEditIdentity)
+	p.POST("/settings/identities/:address/edit", handleEditIdentity)
+	p.POST("/settings/identities/:address/delete", handleDeleteIdentity)
+
+	p.GET("/settings/pgp", handlePGPKeys)
+	p.POST("/settings/pgp/generate", handleGeneratePGPKey)
+	p.POST("/settings/pgp/import", handleImportPGPKey)
+	p.POST("/settings/pgp/delete", handleDeletePGPKey)
+	p.GET("/settings/pgp/public.asc", handleExportPGPKey)
+	p.POST("/settings/pgp/contacts", handleImportPGPContact)
+	p.POST("/settings/pgp/contacts/:address/delete", handleDeletePGPContact)
+
+	p.GET("/settings/smime", handleSMIMECertificate)
+	p.POST("/settings/smime/import", handleImportSMIMECertificate)
+	p.POST("/settings/smime/delete", handleDeleteSMIMECertificate)
 }
 
 type IMAPBaseRenderData struct {
@@ -86,18 +151,36 @@ type IMAPBaseRenderData struct {
 	Mailbox              *MailboxStatus
 	Inbox                *MailboxStatus
 	Subscriptions        map[string]*MailboxStatus
+	// Messages which can still be unsent
+	Outbox []ScheduledMessage
 }
 
 type MailboxRenderData struct {
 	IMAPBaseRenderData
-	Messages           []IMAPMessage
-	PrevPage, NextPage int
-	Query              string
+	Messages []IMAPMessage
+	Threads  []IMAPThread
+	Query    string
+	// Either empty to search the current mailbox, "all" or "everywhere" to
+	// search all mailboxes excluding or including Junk and Trash
+	SearchScope string
+	// Set if the query couldn't be parsed
+	SearchError string
+	Sort        MessageSort
+	// Cursors to pass as "before" and "after" to get the previous and next
+	// pages, empty if there is no such page
+	PrevCursor, NextCursor string
+	// Number of messages listed across all pages, only set if there are
+	// several pages
+	Total int
+	// Whether all messages can be deleted at once
+	CanEmpty bool
 }
 
 type MailboxDetails struct {
 	Info   *MailboxInfo
 	Status *MailboxStatus
+	// Child mailboxes, in the hierarchy built from the delimiter
+	Children []*MailboxDetails
 }
 
 // Organizes mailboxes into common/uncommon categories
@@ -111,14 +194,13 @@ type CategorizedMailboxes struct {
 		Archive *MailboxDetails
 	}
 	Additional []MailboxDetails
+	Virtual    []VirtualMailbox
+	// Number of messages scheduled to be sent
+	Scheduled int
 }
 
-func (cc *CategorizedMailboxes) Append(mi MailboxInfo, status *MailboxStatus) {
-	details := &MailboxDetails{
-		Info:   &mi,
-		Status: status,
-	}
-	if name := mi.Name; name == "INBOX" {
+func (cc *CategorizedMailboxes) Append(details *MailboxDetails) {
+	if name := details.Info.Name; name == "INBOX" {
 		cc.Common.Inbox = details
 	} else if name == "Drafts" {
 		cc.Common.Drafts = details
@@ -148,10 +230,17 @@ func newIMAPBaseRenderData(ctx *alps.Context,
 		return nil, fmt.Errorf("failed to load settings: %v", err)
 	}
 
+	searches, err := loadSavedSearches(ctx.Session.Store())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load saved searches: %v", err)
+	}
+
 	subscriptions := make(map[string]*MailboxStatus)
 	var mailboxes []MailboxInfo
+	virtual := newVirtualMailboxes(settings, searches)
+	countVirtual := !cachedVirtualUnseen(ctx.Session, virtual)
 	var active, inbox *MailboxStatus
-	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+	err = ctx.Session.DoIMAPIdempotent(func(c *imapclient.Client) error {
 		var err error
 		if mailboxes, err = listMailboxes(c); err != nil {
 			return err
@@ -178,11 +267,18 @@ func newIMAPBaseRenderData(ctx *alps.Context,
 				subscriptions[sub] = status
 			}
 		}
+
+		if countVirtual {
+			return countVirtualUnseen(c, virtual)
+		}
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
+	if countVirtual {
+		putVirtualUnseen(ctx.Session, virtual)
+	}
 
 	var categorized CategorizedMailboxes
 
@@ -197,9 +293,12 @@ func newIMAPBaseRenderData(ctx *alps.Context,
 			mailboxes[i].Unseen = int(inbox.Unseen)
 			mailboxes[i].Total = int(inbox.Messages)
 		}
-
-		categorized.Append(mailboxes[i], subscriptions[mailboxes[i].Name])
 	}
+	for _, details := range newMailboxTree(mailboxes, subscriptions) {
+		categorized.Append(details)
+	}
+	categorized.Virtual = virtual
+	categorized.Scheduled = len(listScheduledMessages(ctx.Session, scheduledSendJob))
 
 	return &IMAPBaseRenderData{
 		BaseRenderData:       *base,
@@ -208,6 +307,7 @@ func newIMAPBaseRenderData(ctx *alps.Context,
 		Inbox:                inbox,
 		Mailbox:              active,
 		Subscriptions:        subscriptions,
+		Outbox:               listScheduledMessages(ctx.Session, outboxSendJob),
 	}, nil
 }
 
@@ -227,12 +327,10 @@ func handleGetMailbox(ctx *alps.Context) error {
 	}
 	ibase.BaseRenderData.WithTitle(title)
 
-	page := 0
-	if pageStr := ctx.QueryParam("page"); pageStr != "" {
-		var err error
-		if page, err = strconv.Atoi(pageStr); err != nil || page < 0 {
-			return echo.NewHTTPError(http.StatusBadRequest, "invalid page index")
-		}
+	cursor := pageCursor{
+		after:  ctx.QueryParam("after"),
+		before: ctx.QueryParam("before"),
+		at:     ctx.QueryParam("at"),
 	}
 
 	settings, err := LoadSettings(ctx.Session.Store())
@@ -241,49 +339,319 @@ func handleGetMailbox(ctx *alps.Context) error {
 	}
 	messagesPerPage := settings.MessagesPerPage
 
+	order, err := loadMessageSort(ctx.Session.Store(), mbox.Name)
+	if err != nil {
+		return fmt.Errorf("failed to load sort order: %v", err)
+	}
+	if field := ctx.FormValue("sort"); field != "" {
+		order = MessageSort{
+			Field:   MessageSortField(field),
+			Reverse: ctx.FormValue("order") == "desc",
+		}
+		if !order.valid() {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid sort field")
+		}
+
+		// The sort order is only remembered when picked by the user, a
+		// sort in the URL applies to this page only
+		if ctx.Request().Method == http.MethodPost {
+			if err := saveMessageSort(ctx.Session.Store(), mbox.Name, order); err != nil {
+				return fmt.Errorf("failed to save sort order: %v", err)
+			}
+			u := mbox.URL()
+			if query := ctx.FormValue("query"); query != "" {
+				u.RawQuery = url.Values{"query": {query}}.Encode()
+			}
+			return ctx.Redirect(http.StatusFound, u.String())
+		}
+	}
+
 	query := ctx.QueryParam("query")
+	scope := ctx.QueryParam("scope")
+	switch scope {
+	case searchScopeMailbox, searchScopeAll, searchScopeEverywhere:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid search scope")
+	}
+	var (
+		criteria    *imap.SearchCriteria
+		searchError string
+	)
+	if query != "" {
+		loc, err := time.LoadLocation(settings.Timezone)
+		if err != nil {
+			return fmt.Errorf("failed to load location: %v", err)
+		}
+		if criteria, err = PrepareSearch(query, loc); err != nil {
+			searchError = err.Error()
+		}
+	}
 
 	var (
-		msgs  []IMAPMessage
-		total int
+		msgs       []IMAPMessage
+		threads    []IMAPThread
+		prev, next string
+		total      int
+		cursorLost bool
 	)
-	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+	err = ctx.Session.DoIMAPIdempotent(func(c *imapclient.Client) error {
 		var err error
-		if query != "" {
-			msgs, total, err = searchMessages(c, mbox.Name, query, page, messagesPerPage)
+		if searchError != "" {
+			return nil
+		} else if query != "" && scope != searchScopeMailbox {
+			includeJunk := scope == searchScopeEverywhere
+			msgs, prev, next, err = searchAllMailboxes(c, criteria, includeJunk, cursor, messagesPerPage)
+		} else if settings.Conversations && query == "" {
+			threads, prev, next, err = listThreads(c, mbox, cursor, messagesPerPage)
 		} else {
-			msgs, err = listMessages(c, mbox, page, messagesPerPage)
-			total = int(mbox.Messages)
+			msgs, prev, next, err = listMessages(c, mbox.Name, criteria, order, cursor, messagesPerPage)
+			if err == errPageCursorLost {
+				// Show the first page rather than an arbitrary one
+				cursorLost = true
+				msgs, prev, next, err = listMessages(c, mbox.Name, criteria, order, pageCursor{}, messagesPerPage)
+			}
 		}
-		if err != nil {
+		if err != nil || (prev == "" && next == "") {
 			return err
 		}
-		return nil
+
+		// Count messages on other pages, to offer to select them all
+		if query == "" {
+			total = int(mbox.Messages)
+			return nil
+		}
+		action := &bulkAction{
+			Mailbox:  mbox.Name,
+			All:      true,
+			Criteria: criteria,
+			Scope:    scope,
+		}
+		refs, err := action.search(c)
+		total = countMessageRefs(refs)
+		return err
 	})
 	if err != nil {
 		return err
 	}
-
-	prevPage, nextPage := -1, -1
-	if page > 0 {
-		prevPage = page - 1
-	}
-	if (page+1)*messagesPerPage < total {
-		nextPage = page + 1
+	if cursorLost {
+		ibase.BaseRenderData.GlobalData.Notice = "The message list has changed, the first page is shown instead."
 	}
 
 	return ctx.Render(http.StatusOK, "mailbox.html", &MailboxRenderData{
 		IMAPBaseRenderData: *ibase,
 		Messages:           msgs,
-		PrevPage:           prevPage,
-		NextPage:           nextPage,
+		Threads:            threads,
+		PrevCursor:         prev,
+		NextCursor:         next,
 		Query:              query,
+		SearchScope:        scope,
+		SearchError:        searchError,
+		Sort:               order,
+		Total:              total,
+		CanEmpty:           canEmptyMailbox(ibase.Mailboxes, mbox.Name),
+	})
+}
+
+type VirtualMailboxRenderData struct {
+	IMAPBaseRenderData
+	VirtualMailbox *VirtualMailbox
+	// Saved search listed in the virtual mailbox, if any
+	Search *SavedSearch
+	// Set if the saved search query can't be parsed anymore
+	SearchError            string
+	Messages               []IMAPMessage
+	PrevCursor, NextCursor string
+}
+
+func findSavedSearch(searches []SavedSearch, name string) int {
+	for i := range searches {
+		if searches[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func handleGetSavedSearch(ctx *alps.Context) error {
+	name, err := url.PathUnescape(ctx.Param("name"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	searches, err := loadSavedSearches(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load saved searches: %v", err)
+	}
+	i := findSavedSearch(searches, name)
+	if i < 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "saved search not found")
+	}
+	search := &searches[i]
+
+	return handleGetVirtualMailbox(ctx, search.URL().Path, search)
+}
+
+func handleGetVirtualMailbox(ctx *alps.Context, path string, search *SavedSearch) error {
+	ibase, err := newIMAPBaseRenderData(ctx, alps.NewBaseRenderData(ctx))
+	if err != nil {
+		return err
+	}
+
+	var vm *VirtualMailbox
+	for i := range ibase.CategorizedMailboxes.Virtual {
+		if v := &ibase.CategorizedMailboxes.Virtual[i]; v.URL.Path == path {
+			v.Active = true
+			vm = v
+		}
+	}
+	if vm == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "virtual mailbox not found")
+	}
+
+	title := vm.Name
+	if vm.Unseen > 0 {
+		title = fmt.Sprintf("(%d) %s", vm.Unseen, title)
+	}
+	ibase.BaseRenderData.WithTitle(title)
+
+	settings, err := LoadSettings(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+
+	cursor := pageCursor{
+		after:  ctx.QueryParam("after"),
+		before: ctx.QueryParam("before"),
+	}
+
+	var searchError string
+	if search != nil {
+		// Relative dates don't affect the validity of the query
+		if _, err := PrepareSearch(search.Query, time.UTC); err != nil {
+			searchError = err.Error()
+		}
+	}
+
+	var (
+		msgs       []IMAPMessage
+		prev, next string
+	)
+	err = ctx.Session.DoIMAPIdempotent(func(c *imapclient.Client) error {
+		if searchError != "" {
+			return nil
+		}
+		uids, err := vm.searchUids(c, nil)
+		if err != nil {
+			return err
+		}
+		msgs, prev, next, err = listMessagesByMailbox(c, uids, cursor, settings.MessagesPerPage)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return ctx.Render(http.StatusOK, "virtual-mailbox.html", &VirtualMailboxRenderData{
+		IMAPBaseRenderData: *ibase,
+		VirtualMailbox:     vm,
+		Search:             search,
+		SearchError:        searchError,
+		Messages:           msgs,
+		PrevCursor:         prev,
+		NextCursor:         next,
 	})
 }
 
+func handleSaveSearch(ctx *alps.Context) error {
+	search := SavedSearch{
+		Name:    strings.TrimSpace(ctx.FormValue("name")),
+		Query:   ctx.FormValue("query"),
+		Scope:   ctx.FormValue("scope"),
+		Mailbox: ctx.FormValue("mailbox"),
+	}
+	if search.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing saved search name")
+	}
+	if len(search.Name) > maxSavedSearchNameLen {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("saved search name must be %v characters or fewer", maxSavedSearchNameLen))
+	}
+	switch search.Scope {
+	case searchScopeMailbox:
+		if search.Mailbox == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "missing mailbox")
+		}
+	case searchScopeAll, searchScopeEverywhere:
+		search.Mailbox = ""
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid search scope")
+	}
+	if criteria, err := PrepareSearch(search.Query, time.UTC); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	} else if criteria == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "empty search query")
+	}
+
+	searches, err := loadSavedSearches(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load saved searches: %v", err)
+	}
+	if i := findSavedSearch(searches, search.Name); i >= 0 {
+		searches[i] = search
+	} else {
+		searches = append(searches, search)
+	}
+	if err := putSavedSearches(ctx.Session.Store(), searches); err != nil {
+		return fmt.Errorf("failed to save searches: %v", err)
+	}
+
+	return ctx.Redirect(http.StatusFound, search.URL().String())
+}
+
+func handleDeleteSavedSearch(ctx *alps.Context) error {
+	name, err := url.PathUnescape(ctx.Param("name"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	searches, err := loadSavedSearches(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load saved searches: %v", err)
+	}
+	i := findSavedSearch(searches, name)
+	if i < 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "saved search not found")
+	}
+	searches = append(searches[:i], searches[i+1:]...)
+	if err := putSavedSearches(ctx.Session.Store(), searches); err != nil {
+		return fmt.Errorf("failed to save searches: %v", err)
+	}
+
+	ctx.Session.PutNotice("Saved search deleted.")
+	return ctx.Redirect(http.StatusFound, "/")
+}
+
 type NewMailboxRenderData struct {
 	IMAPBaseRenderData
-	Error string
+	// Mailboxes which can contain the new mailbox
+	Parents []MailboxInfo
+	Parent  string
+	Error   string
+}
+
+// mailboxParents returns the mailboxes which can contain children. The
+// mailbox being moved, if any, and its descendants are left out.
+func mailboxParents(mailboxes []MailboxInfo, moved *MailboxInfo) []MailboxInfo {
+	var l []MailboxInfo
+	for _, mbox := range mailboxes {
+		if mbox.HasAttr(imap.NoInferiorsAttr) || mbox.Delimiter == "" {
+			continue
+		}
+		if moved != nil && (mbox.Name == moved.Name || isMailboxDescendant(mbox.Name, moved.Name, moved.Delimiter)) {
+			continue
+		}
+		l = append(l, mbox)
+	}
+	return l
 }
 
 func handleNewMailbox(ctx *alps.Context) error {
@@ -293,33 +661,142 @@ func handleNewMailbox(ctx *alps.Context) error {
 	}
 	ibase.BaseRenderData.WithTitle("Create new folder")
 
+	renderData := &NewMailboxRenderData{
+		IMAPBaseRenderData: *ibase,
+		Parents:            mailboxParents(ibase.Mailboxes, nil),
+		Parent:             ctx.QueryParam("parent"),
+	}
+
 	if ctx.Request().Method == http.MethodPost {
 		name := ctx.FormValue("name")
+		renderData.Parent = ctx.FormValue("parent")
 		if name == "" {
-			return ctx.Render(http.StatusOK, "new-mailbox.html", &NewMailboxRenderData{
-				IMAPBaseRenderData: *ibase,
-				Error:              "Name is required",
-			})
+			renderData.Error = "Name is required"
+			return ctx.Render(http.StatusOK, "new-mailbox.html", renderData)
+		}
+
+		var parent *MailboxInfo
+		if renderData.Parent != "" {
+			if parent = findMailbox(renderData.Parents, renderData.Parent); parent == nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid parent folder")
+			}
 		}
+		name = joinMailboxName(parent, name)
 
 		err := ctx.Session.DoIMAP(func(c *imapclient.Client) error {
-			return c.Create(name)
+			if err := c.Create(name); err != nil {
+				return err
+			}
+			return c.Subscribe(name)
 		})
 
 		if err != nil {
-			return ctx.Render(http.StatusOK, "new-mailbox.html", &NewMailboxRenderData{
-				IMAPBaseRenderData: *ibase,
-				Error:              err.Error(),
-			})
+			renderData.Error = err.Error()
+			return ctx.Render(http.StatusOK, "new-mailbox.html", renderData)
+		}
+
+		settings, err := LoadSettings(ctx.Session.Store())
+		if err != nil {
+			return fmt.Errorf("failed to load settings: %v", err)
+		}
+		if !Subscriptions(settings.Subscriptions).Has(name) {
+			settings.Subscriptions = append(settings.Subscriptions, name)
+			if err := ctx.Session.Store().Put(settingsKey, settings); err != nil {
+				return fmt.Errorf("failed to save settings: %v", err)
+			}
 		}
 
 		return ctx.Redirect(http.StatusFound, fmt.Sprintf("/mailbox/%s", url.PathEscape(name)))
 	}
 
-	return ctx.Render(http.StatusOK, "new-mailbox.html", &NewMailboxRenderData{
+	return ctx.Render(http.StatusOK, "new-mailbox.html", renderData)
+}
+
+type RenameMailboxRenderData struct {
+	IMAPBaseRenderData
+	Info *MailboxInfo
+	// Mailboxes the mailbox can be moved to
+	Parents      []MailboxInfo
+	Name, Parent string
+	Error        string
+}
+
+func handleRenameMailbox(ctx *alps.Context) error {
+	ibase, err := newIMAPBaseRenderData(ctx, alps.NewBaseRenderData(ctx))
+	if err != nil {
+		return err
+	}
+
+	mbox := findMailbox(ibase.Mailboxes, ibase.Mailbox.Name)
+	if mbox == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "no such mailbox")
+	} else if mbox.Name == "INBOX" {
+		return echo.NewHTTPError(http.StatusBadRequest, "INBOX can't be renamed")
+	}
+	ibase.BaseRenderData.WithTitle("Rename folder '" + mbox.Name + "'")
+
+	renderData := &RenameMailboxRenderData{
 		IMAPBaseRenderData: *ibase,
-		Error:              "",
+		Info:               mbox,
+		Parents:            mailboxParents(ibase.Mailboxes, mbox),
+		Name:               mbox.BaseName(),
+		Parent:             parentMailboxName(mbox.Name, mbox.Delimiter),
+	}
+
+	if ctx.Request().Method != http.MethodPost {
+		return ctx.Render(http.StatusOK, "rename-mailbox.html", renderData)
+	}
+
+	renderData.Name = ctx.FormValue("name")
+	renderData.Parent = ctx.FormValue("parent")
+	if renderData.Name == "" {
+		renderData.Error = "Name is required"
+		return ctx.Render(http.StatusOK, "rename-mailbox.html", renderData)
+	}
+
+	var parent *MailboxInfo
+	if renderData.Parent != "" {
+		if parent = findMailbox(renderData.Parents, renderData.Parent); parent == nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid parent folder")
+		}
+	}
+	name := joinMailboxName(parent, renderData.Name)
+	if name == mbox.Name {
+		return ctx.Redirect(http.StatusFound, mbox.URL().String())
+	}
+
+	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		return c.Rename(mbox.Name, name)
 	})
+	if _, ok := err.(alps.IMAPConnError); ok {
+		return redirectIMAPConnError(ctx, mbox.URL().String())
+	} else if err != nil {
+		renderData.Error = err.Error()
+		return ctx.Render(http.StatusOK, "rename-mailbox.html", renderData)
+	}
+
+	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		return renameSubscriptions(c, mbox.Name, name, mbox.Delimiter)
+	})
+	if err != nil {
+		ctx.Logger().Printf("Failed to update subscriptions of renamed mailbox %q: %v", mbox.Name, err)
+	}
+	err = updateMailboxReferences(ctx.Session, func(ref string) string {
+		ref, _ = renamedMailbox(ref, mbox.Name, name, mbox.Delimiter)
+		return ref
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx.Session.PutNotice("Folder renamed.")
+	return ctx.Redirect(http.StatusFound, fmt.Sprintf("/mailbox/%s", url.PathEscape(name)))
+}
+
+type DeleteMailboxRenderData struct {
+	IMAPBaseRenderData
+	// Descendants of the mailbox, deleted along with it
+	Children []MailboxInfo
 }
 
 func handleDeleteMailbox(ctx *alps.Context) error {
@@ -328,18 +805,62 @@ func handleDeleteMailbox(ctx *alps.Context) error {
 		return err
 	}
 
-	mbox := ibase.Mailbox
+	mbox := findMailbox(ibase.Mailboxes, ibase.Mailbox.Name)
+	if mbox == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "no such mailbox")
+	}
+	children := mailboxDescendants(ibase.Mailboxes, mbox)
 	ibase.BaseRenderData.WithTitle("Delete folder '" + mbox.Name + "'")
 
 	if ctx.Request().Method == http.MethodPost {
-		ctx.Session.DoIMAP(func(c *imapclient.Client) error {
-			return c.Delete(mbox.Name)
+		deleted := make(map[string]bool)
+		err := ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+			subscribed, err := listSubscribedMailboxes(c)
+			if err != nil {
+				return err
+			}
+
+			// Children need to be deleted first, otherwise servers may keep
+			// their parent as a \Noselect mailbox
+			for _, child := range append(children, *mbox) {
+				// Some servers drop subscriptions of deleted mailboxes
+				if subscribed[child.Name] {
+					if err := c.Unsubscribe(child.Name); err != nil {
+						return fmt.Errorf("failed to unsubscribe from %q: %v", child.Name, err)
+					}
+				}
+
+				if err := c.Delete(child.Name); err != nil {
+					return fmt.Errorf("failed to delete %q: %v", child.Name, err)
+				}
+				deleted[child.Name] = true
+			}
+			return nil
 		})
+
+		// Some mailboxes may have been deleted before the failure
+		if err := updateMailboxReferences(ctx.Session, func(name string) string {
+			if deleted[name] {
+				return ""
+			}
+			return name
+		}); err != nil {
+			ctx.Logger().Print(err)
+		}
+
+		if _, ok := err.(alps.IMAPConnError); ok {
+			return redirectIMAPConnError(ctx, mbox.URL().String())
+		} else if err != nil {
+			return fmt.Errorf("failed to delete mailbox: %v", err)
+		}
 		ctx.Session.PutNotice("Mailbox deleted.")
 		return ctx.Redirect(http.StatusFound, "/mailbox/INBOX")
 	}
 
-	return ctx.Render(http.StatusOK, "delete-mailbox.html", ibase)
+	return ctx.Render(http.StatusOK, "delete-mailbox.html", &DeleteMailboxRenderData{
+		IMAPBaseRenderData: *ibase,
+		Children:           children,
+	})
 }
 
 func handleLogin(ctx *alps.Context) error {
@@ -395,14 +916,26 @@ func handleLogout(ctx *alps.Context) error {
 
 type MessageRenderData struct {
 	IMAPBaseRenderData
-	Message     *IMAPMessage
-	Part        *IMAPPartNode
-	View        interface{}
-	MailboxPage int
-	Flags       map[string]bool
+	Message *IMAPMessage
+	Part    *IMAPPartNode
+	View    interface{}
+	Flags   map[string]bool
+	// Posting address of the mailing list the message was sent to, if any
+	ListPost string
+	// Read receipt the user is asked to send, if any
+	MDNRequest *MDNRequest
+	// OpenPGP protection of the message, if any
+	PGP *PGPStatus
+	// S/MIME protection of the message, if any
+	SMIME *SMIMEStatus
+	// Authentication of the sender
+	Sender *SenderTrust
 }
 
 func handleGetPart(ctx *alps.Context, raw bool) error {
+	// Viewing a message marks it as read
+	defer invalidateVirtualUnseen(ctx.Session)
+
 	_, uid, err := parseMboxAndUid(ctx.Param("mbox"), ctx.Param("uid"))
 	if err != nil {
 		return err
@@ -422,20 +955,41 @@ func handleGetPart(ctx *alps.Context, raw bool) error {
 	if err != nil {
 		return err
 	}
-	messagesPerPage := settings.MessagesPerPage
 	loc, err := time.LoadLocation(settings.Timezone)
 	if err != nil {
 		return fmt.Errorf("failed to load location: %v", err)
 	}
 
+	var identities Identities
+	if !raw {
+		if identities, err = LoadIdentities(ctx); err != nil {
+			return err
+		}
+	}
+
 	var msg *IMAPMessage
 	var part *message.Entity
-	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+	var h mail.Header
+	var signed []byte
+	err = ctx.Session.DoIMAPIdempotent(func(c *imapclient.Client) error {
 		var err error
 		if msg, part, err = getMessagePart(c, mbox.Name, uid, partPath); err != nil {
 			return err
 		}
-		return nil
+		if raw {
+			return nil
+		}
+		if h, err = fetchExtraHeader(c, mbox.Name, uid); err != nil {
+			return err
+		}
+		// The signed part needs to be verified as is
+		if bs := msg.BodyStructure; bs != nil {
+			mimeType := bs.MIMEType + "/" + bs.MIMESubType
+			if isPGPSigned(mimeType, bs.Params) || isSMIMESigned(mimeType, bs.Params) {
+				signed, err = fetchRawMessage(c, mbox.Name, uid)
+			}
+		}
+		return err
 	})
 	if err != nil {
 		return err
@@ -443,6 +997,13 @@ func handleGetPart(ctx *alps.Context, raw bool) error {
 
 	msg.Envelope.Date = msg.Envelope.Date.In(loc)
 
+	var sender *SenderTrust
+	if !raw {
+		if sender, err = checkSender(ctx, msg, h, identities); err != nil {
+			ctx.Logger().Printf("Failed to check sender of message: %v", err)
+		}
+	}
+
 	mimeType, _, err := part.Header.ContentType()
 	if err != nil {
 		return fmt.Errorf("failed to parse part Content-Type: %v", err)
@@ -487,6 +1048,20 @@ func handleGetPart(ctx *alps.Context, raw bool) error {
 		view = nil
 	}
 
+	var pgpStatus *PGPStatus
+	var smimeStatus *SMIMEStatus
+	if v := ctx.Get(pgpStatusKey); v != nil {
+		pgpStatus = v.(*PGPStatus)
+	} else if v := ctx.Get(smimeStatusKey); v != nil {
+		smimeStatus = v.(*SMIMEStatus)
+	} else if bs := msg.BodyStructure; signed != nil && isSMIMESigned(bs.MIMEType+"/"+bs.MIMESubType, bs.Params) {
+		smimeStatus = checkSMIMESignature(ctx, msg, signed)
+	} else if signed != nil {
+		if pgpStatus, err = checkPGPSignature(ctx, msg, signed); err != nil {
+			return err
+		}
+	}
+
 	if view != nil && ctx.QueryParam("src") == "1" {
 		tpl := template.Must(template.New("").Parse("{{.}}"))
 		var buf bytes.Buffer
@@ -506,6 +1081,22 @@ func handleGetPart(ctx *alps.Context, raw bool) error {
 		flags[f] = msg.HasFlag(f)
 	}
 
+	mdn := getMDNRequest(msg, h, identities)
+	if mdn != nil && settings.MDNPolicy == mdnNever {
+		err := ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+			return markMDNSent(c, msg.Mailbox, msg.Uid)
+		})
+		if err != nil {
+			ctx.Logger().Printf("Failed to ignore read receipt request: %v", err)
+		}
+		mdn = nil
+	} else if mdn != nil && settings.MDNPolicy == mdnAlways && mdn.allowAutomatic {
+		if err := answerMDN(ctx, msg, h, mdn, identities, true); err != nil {
+			ibase.BaseRenderData.GlobalData.Notice = fmt.Sprintf("Failed to send read receipt: %v", err)
+		}
+		mdn = nil
+	}
+
 	ibase.BaseRenderData.WithTitle(msg.Envelope.Subject)
 
 	return ctx.Render(http.StatusOK, "message.html", &MessageRenderData{
@@ -513,16 +1104,311 @@ func handleGetPart(ctx *alps.Context, raw bool) error {
 		Message:            msg,
 		Part:               msg.PartByPath(partPath),
 		View:               view,
-		MailboxPage:        int(mbox.Messages-msg.SeqNum) / messagesPerPage,
 		Flags:              flags,
+		ListPost:           listPostAddress(h),
+		MDNRequest:         mdn,
+		PGP:                pgpStatus,
+		SMIME:              smimeStatus,
+		Sender:             sender,
 	})
 }
 
-type ComposeRenderData struct {
+func handleGetThumbnail(ctx *alps.Context) error {
+	mboxName, uid, err := parseMboxAndUid(ctx.Param("mbox"), ctx.Param("uid"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	partPath, err := parsePartPath(ctx.QueryParam("part"))
+	if err != nil || len(partPath) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid part path")
+	}
+
+	var thumb []byte
+	err = ctx.Session.DoIMAPIdempotent(func(c *imapclient.Client) error {
+		if err := ensureMailboxSelected(c, mboxName); err != nil {
+			return err
+		}
+		key := thumbnailKey{
+			Username:    ctx.Session.Username(),
+			Mailbox:     mboxName,
+			UidValidity: c.Mailbox().UidValidity,
+			Uid:         uid,
+			Part:        IMAPPartNode{Path: partPath}.PathString(),
+		}
+		var ok bool
+		if thumb, ok = thumbnails.Get(key); ok {
+			return nil
+		}
+
+		// Check the part before fetching it
+		msg, err := fetchMessageStructure(c, mboxName, uid)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusNotFound, err)
+		}
+		if node := msg.PartByPath(partPath); node == nil || !node.HasThumbnail() {
+			return echo.NewHTTPError(http.StatusNotFound, "no thumbnail for this part")
+		}
+
+		_, part, err := peekMessagePart(c, mboxName, uid, partPath)
+		if err != nil {
+			return err
+		}
+		if thumb, err = generateThumbnail(part.Body); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err)
+		}
+		thumbnails.Put(key, thumb)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Message parts never change
+	ctx.Response().Header().Set("Cache-Control", "private, max-age=604800")
+	return ctx.Blob(http.StatusOK, "image/png", thumb)
+}
+
+func handleGetAttachmentsZip(ctx *alps.Context) error {
+	mboxName, uid, err := parseMboxAndUid(ctx.Param("mbox"), ctx.Param("uid"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	resp := ctx.Response()
+	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		msg, err := fetchMessageStructure(c, mboxName, uid)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusNotFound, err)
+		}
+		if len(msg.Attachments()) == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "message has no attachments")
+		}
+
+		disp := mime.FormatMediaType("attachment", map[string]string{
+			"filename": attachmentsArchiveName(msg),
+		})
+		resp.Header().Set("Content-Type", "application/zip")
+		resp.Header().Set("Content-Disposition", disp)
+		return writeAttachmentsZip(c, msg, resp)
+	})
+	if err != nil {
+		if !resp.Committed {
+			resp.Header().Del("Content-Type")
+			resp.Header().Del("Content-Disposition")
+			return err
+		}
+		// Too late to report the error to the user
+		ctx.Logger().Printf("failed to write attachments archive: %v", err)
+	}
+	return nil
+}
+
+// answerMDN sends a read receipt, as the identity the message was addressed
+// to, and marks the request as answered. Automatic receipts are marked as sent
+// beforehand, so that they are sent at most once even if the message is
+// displayed several times at once (RFC 3503 section 3.1).
+func answerMDN(ctx *alps.Context, msg *IMAPMessage, h mail.Header, req *MDNRequest, identities Identities, automatic bool) error {
+	from := identities.Recipient(msg.Envelope)
+	if from == nil && len(identities) > 0 {
+		from = &identities[0]
+	} else if from == nil {
+		return fmt.Errorf("no identity to send the read receipt from")
+	}
+
+	markSent := func() error {
+		return ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+			return markMDNSent(c, msg.Mailbox, msg.Uid)
+		})
+	}
+
+	if automatic {
+		if err := markSent(); err != nil {
+			return err
+		}
+	}
+
+	err := ctx.Session.DoSMTP(func(c *smtp.Client) error {
+		return sendMDN(c, msg, h, req, from, automatic)
+	})
+	if err != nil || automatic {
+		return err
+	}
+
+	return markSent()
+}
+
+func handleMDN(ctx *alps.Context) error {
+	mboxName, uid, err := parseMboxAndUid(ctx.Param("mbox"), ctx.Param("uid"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	identities, err := LoadIdentities(ctx)
+	if err != nil {
+		return err
+	}
+
+	var msg *IMAPMessage
+	var h mail.Header
+	err = ctx.Session.DoIMAPIdempotent(func(c *imapclient.Client) error {
+		var err error
+		if msg, err = fetchMessageStructure(c, mboxName, uid); err != nil {
+			return err
+		}
+		h, err = fetchExtraHeader(c, mboxName, uid)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	req := getMDNRequest(msg, h, identities)
+	if req == nil {
+		ctx.Session.PutNotice("The read receipt request has already been answered.")
+		return ctx.Redirect(http.StatusFound, msg.URL().String())
+	}
+
+	switch ctx.FormValue("action") {
+	case "send":
+		err = answerMDN(ctx, msg, h, req, identities, false)
+		if _, ok := err.(alps.AuthError); ok {
+			return echo.NewHTTPError(http.StatusForbidden, err)
+		} else if err != nil {
+			ctx.Session.PutNotice(fmt.Sprintf("Failed to send read receipt: %v", err))
+			return ctx.Redirect(http.StatusFound, msg.URL().String())
+		}
+		ctx.Session.PutNotice("Read receipt sent.")
+	case "ignore":
+		err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+			return markMDNSent(c, mboxName, uid)
+		})
+		if err != nil {
+			return err
+		}
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown action")
+	}
+
+	return ctx.Redirect(http.StatusFound, msg.URL().String())
+}
+
+type ThreadMessage struct {
+	*IMAPMessage
+	Part *IMAPPartNode
+	View interface{}
+	// Whether the message is shown expanded: it's the latest message or it
+	// was unread
+	Expanded bool
+}
+
+type ThreadRenderData struct {
+	IMAPBaseRenderData
+	Thread   *IMAPThread
+	Messages []ThreadMessage
+}
+
+func handleGetThread(ctx *alps.Context) error {
+	_, uid, err := parseMboxAndUid(ctx.Param("mbox"), ctx.Param("uid"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	ibase, err := newIMAPBaseRenderData(ctx, alps.NewBaseRenderData(ctx))
+	if err != nil {
+		return err
+	}
+	mbox := ibase.Mailbox
+
+	settings, err := LoadSettings(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(settings.Timezone)
+	if err != nil {
+		return fmt.Errorf("failed to load location: %v", err)
+	}
+
+	var thread *IMAPThread
+	var msgs []ThreadMessage
+	var parts []*message.Entity
+	err = ctx.Session.DoIMAPIdempotent(func(c *imapclient.Client) error {
+		var err error
+		if thread, err = getThread(c, mbox.Name, uid); err != nil {
+			return err
+		} else if thread == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "message not found")
+		}
+
+		msgs = make([]ThreadMessage, len(thread.Messages))
+		parts = make([]*message.Entity, len(thread.Messages))
+		for i := range thread.Messages {
+			msg := &thread.Messages[i]
+			node := msg.TextPart()
+			if node == nil {
+				node = msg.CalendarPart()
+			}
+			expanded := i == len(thread.Messages)-1 || !msg.HasFlag(imap.SeenFlag)
+			if node == nil {
+				msgs[i] = ThreadMessage{IMAPMessage: msg, Expanded: expanded}
+				continue
+			}
+
+			// Fetching the part marks the message as read and updates its
+			// flags
+			fetched, part, err := getMessagePart(c, mbox.Name, msg.Uid, node.Path)
+			if err != nil {
+				return err
+			}
+			msg.Flags = fetched.Flags
+			msgs[i] = ThreadMessage{IMAPMessage: msg, Part: node, Expanded: expanded}
+			parts[i] = part
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range msgs {
+		msgs[i].Envelope.Date = msgs[i].Envelope.Date.In(loc)
+		if parts[i] == nil {
+			continue
+		}
+		// Messages which can't be previewed link to the message view instead
+		if view, err := viewMessagePart(ctx, msgs[i].IMAPMessage, parts[i]); err == nil {
+			msgs[i].View = view
+		}
+	}
+
+	ibase.BaseRenderData.WithTitle(thread.First().Envelope.Subject)
+
+	return ctx.Render(http.StatusOK, "thread.html", &ThreadRenderData{
+		IMAPBaseRenderData: *ibase,
+		Thread:             thread,
+		Messages:           msgs,
+	})
+}
+
+type ComposeRenderData struct {
 	IMAPBaseRenderData
-	Message *OutgoingMessage
+	Message    *OutgoingMessage
+	Identities Identities
+	// Whether the message can be sent later
+	CanSchedule bool
+	// Time the message is scheduled to be sent at, if any
+	SendAt string
+	// Minimum delay between automatic saves, in seconds
+	AutosaveInterval int
+	// Messages forwarded as attachments
+	ForwardedMessages []IMAPMessage
+	// Whether the user has set up an OpenPGP key
+	PGP bool
+	// Whether the user has uploaded an S/MIME certificate
+	SMIME bool
 }
 
+// sendAtLayout is the format of datetime-local form inputs.
+const sendAtLayout = "2006-01-02T15:04"
+
 type messagePath struct {
 	Mailbox string
 	Uid     uint32
@@ -532,6 +1418,11 @@ type composeOptions struct {
 	Draft     *messagePath
 	Forward   *messagePath
 	InReplyTo *messagePath
+	// Messages forwarded as attachments
+	Attached []IMAPMessage
+	// Mailbox where the message is saved once sent, the Sent mailbox if
+	// empty
+	Sent string
 }
 
 // Send message, append it to the Sent mailbox, mark the original message as
@@ -542,7 +1433,17 @@ func submitCompose(ctx *alps.Context, msg *OutgoingMessage, options *composeOpti
 		return fmt.Errorf("expected a draft message")
 	}
 
-	err := ctx.Session.DoSMTP(func(c *smtp.Client) error {
+	settings, err := LoadSettings(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+	// Keys needed to protect the message aren't kept, so it can't be sent
+	// later
+	if settings.UndoSendDelay > 0 && msg.PGPSigner == nil && len(msg.PGPRecipients) == 0 && msg.SMIMEKey == nil {
+		return queueCompose(ctx, msg, options, time.Duration(settings.UndoSendDelay)*time.Second)
+	}
+
+	err = ctx.Session.DoSMTP(func(c *smtp.Client) error {
 		return sendMessage(c, msg)
 	})
 	if err != nil {
@@ -564,7 +1465,7 @@ func submitCompose(ctx *alps.Context, msg *OutgoingMessage, options *composeOpti
 	}
 
 	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
-		if _, err := appendMessage(c, msg, mailboxSent); err != nil {
+		if err := appendSentMessage(c, msg, options.Sent); err != nil {
 			return err
 		}
 		if err := deleteMessage(c, draft.Mailbox, draft.Uid); err != nil {
@@ -572,7 +1473,10 @@ func submitCompose(ctx *alps.Context, msg *OutgoingMessage, options *composeOpti
 		}
 		return nil
 	})
-	if err != nil {
+	if _, ok := err.(alps.IMAPConnError); ok {
+		ctx.Session.PutNotice("Message sent, but the connection to the mail server was lost while saving it to the Sent folder.")
+		return ctx.Redirect(http.StatusFound, "/mailbox/INBOX")
+	} else if err != nil {
 		return fmt.Errorf("failed to save message to Sent mailbox: %v", err)
 	}
 
@@ -580,21 +1484,44 @@ func submitCompose(ctx *alps.Context, msg *OutgoingMessage, options *composeOpti
 	return ctx.Redirect(http.StatusFound, "/mailbox/INBOX")
 }
 
+// queueCompose sends the draft once the undo send delay expires. In the
+// meantime, the user can cancel sending.
+func queueCompose(ctx *alps.Context, msg *OutgoingMessage, options *composeOptions, delay time.Duration) error {
+	draft := options.Draft
+	err := ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		return setScheduledFlag(c, draft.Mailbox, draft.Uid, true)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark draft as scheduled: %v", err)
+	}
+
+	err = delaySend(ctx.Session, delay, &ScheduledSend{
+		MessageID: msg.MessageID,
+		Subject:   msg.Subject,
+		To:        msg.To,
+		InReplyTo: options.InReplyTo,
+		Sent:      options.Sent,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to queue message: %v", err)
+	}
+
+	ctx.Session.PutNotice(fmt.Sprintf("Sending message in %v.", delay))
+	return ctx.Redirect(http.StatusFound, "/mailbox/INBOX")
+}
+
 func handleCompose(ctx *alps.Context, msg *OutgoingMessage, options *composeOptions) error {
 	ibase, err := newIMAPBaseRenderData(ctx, alps.NewBaseRenderData(ctx))
 	if err != nil {
 		return err
 	}
 
-	if msg.From == "" && strings.ContainsRune(ctx.Session.Username(), '@') {
-		settings, err := LoadSettings(ctx.Session.Store())
-		if err != nil {
-			return err
-		}
-		msg.From = formatAddress(&mail.Address{
-			Name:    settings.From,
-			Address: ctx.Session.Username(),
-		})
+	identities, err := LoadIdentities(ctx)
+	if err != nil {
+		return err
+	}
+	if msg.From == "" && len(identities) > 0 {
+		msg.From = identities[0].String()
 	}
 
 	if ctx.Request().Method == http.MethodPost {
@@ -603,16 +1530,87 @@ func handleCompose(ctx *alps.Context, msg *OutgoingMessage, options *composeOpti
 			return fmt.Errorf("failed to parse form: %v", err)
 		}
 		_, saveAsDraft := formParams["save_as_draft"]
+		_, schedule := formParams["schedule"]
+		_, autosave := formParams["autosave"]
+
+		// An invalid send time doesn't discard the message, which is saved
+		// as a draft instead
+		var sendAt time.Time
+		var sendAtErr string
+		if schedule {
+			settings, err := LoadSettings(ctx.Session.Store())
+			if err != nil {
+				return err
+			}
+			loc, err := time.LoadLocation(settings.Timezone)
+			if err != nil {
+				return fmt.Errorf("failed to load location: %v", err)
+			}
+			sendAt, err = time.ParseInLocation(sendAtLayout, ctx.FormValue("send_at"), loc)
+			if err != nil {
+				sendAtErr = "Invalid send time."
+			} else if !sendAt.After(time.Now()) {
+				sendAtErr = "The send time must be in the future."
+			}
+		}
 
-		msg.From = ctx.FormValue("from")
+		// Without identities, the From field is empty if the username
+		// isn't an address: there's nothing to check then
+		var from *mail.Address
+		if v := ctx.FormValue("from"); v != "" || len(identities) > 0 {
+			from, err = mail.ParseAddress(v)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("invalid From address: %v", err))
+			}
+		}
 		msg.To = parseStringList(ctx.FormValue("to"))
 		msg.Cc = parseStringList(ctx.FormValue("cc"))
 		msg.Bcc = parseStringList(ctx.FormValue("bcc"))
 		msg.Subject = ctx.FormValue("subject")
-		msg.Text = ctx.FormValue("text")
+		switch ctx.FormValue("format") {
+		case "html":
+			msg.HTML = sanitizeComposedHTML(ctx.FormValue("html"))
+			if msg.Text, err = htmlToText(msg.HTML); err != nil {
+				return fmt.Errorf("failed to convert HTML to text: %v", err)
+			}
+			msg.Markdown = false
+		case "markdown":
+			msg.Text = ctx.FormValue("text")
+			msg.HTML = ""
+			msg.Markdown = true
+		default:
+			msg.Text = ctx.FormValue("text")
+			msg.HTML = ""
+			msg.Markdown = false
+		}
 		msg.InReplyTo = ctx.FormValue("in_reply_to")
+		msg.References = strings.Fields(ctx.FormValue("references"))
+		msg.RequestMDN = ctx.FormValue("request_mdn") == "on"
 		msg.MessageID = ctx.FormValue("message_id")
 
+		// Addresses which aren't set up as identities are accepted too, e.g.
+		// when editing an old draft
+		if from == nil {
+			msg.From = ""
+		} else if identity := identities.Find(from.Address); identity != nil {
+			identity.apply(msg)
+			options.Sent = identity.Sent
+		} else if addressAllowed(&ctx.Server.Config.Identities, ctx.Session.Username(), from.Address) {
+			msg.From = ctx.FormValue("from")
+		} else {
+			return echo.NewHTTPError(http.StatusForbidden, fmt.Errorf("not allowed to send as %v", from.Address))
+		}
+
+		// The draft may have been saved automatically since the page was
+		// loaded, in which case it replaces the original draft
+		if mboxName := ctx.FormValue("draft_mailbox"); mboxName != "" {
+			uid, err := parseUid(ctx.FormValue("draft_uid"))
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err)
+			}
+			options.Draft = &messagePath{Mailbox: mboxName, Uid: uid}
+		}
+
 		form, err := ctx.MultipartForm()
 		if err != nil {
 			return fmt.Errorf("failed to get multipart form: %v", err)
@@ -633,7 +1631,7 @@ func handleCompose(ctx *alps.Context, msg *OutgoingMessage, options *composeOpti
 				}
 
 				var part *message.Entity
-				err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+				err = ctx.Session.DoIMAPIdempotent(func(c *imapclient.Client) error {
 					var err error
 					_, part, err = getMessagePart(c, original.Mailbox, original.Uid, path)
 					return err
@@ -654,9 +1652,10 @@ func handleCompose(ctx *alps.Context, msg *OutgoingMessage, options *composeOpti
 					Mailbox: original.Mailbox,
 					Uid:     original.Uid,
 					Node: &IMAPPartNode{
-						Path:     path,
-						MIMEType: mimeType,
-						Filename: filename,
+						Path:      path,
+						MIMEType:  mimeType,
+						Filename:  filename,
+						ContentID: strings.Trim(h.Get("Content-Id"), "<>"),
 					},
 					Body: buf.Bytes(),
 				})
@@ -665,8 +1664,23 @@ func handleCompose(ctx *alps.Context, msg *OutgoingMessage, options *composeOpti
 			return fmt.Errorf("previous attachments specified but no original message available")
 		}
 
+		if refs := form.Value["forward_messages"]; len(refs) > 0 {
+			var attached []*messageAttachment
+			err := ctx.Session.DoIMAPIdempotent(func(c *imapclient.Client) error {
+				var err error
+				attached, err = fetchMessageAttachments(c, refs)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to fetch forwarded messages: %v", err)
+			}
+			for _, att := range attached {
+				msg.Attachments = append(msg.Attachments, att)
+			}
+		}
+
 		for _, fh := range form.File["attachments"] {
-			msg.Attachments = append(msg.Attachments, &formAttachment{fh})
+			msg.Attachments = append(msg.Attachments, &formAttachment{FileHeader: fh})
 		}
 
 		uuids := ctx.FormValue("attachment-uuids")
@@ -679,72 +1693,354 @@ func handleCompose(ctx *alps.Context, msg *OutgoingMessage, options *composeOpti
 			if attachment == nil {
 				return fmt.Errorf("Unable to retrieve message attachment %s from session", uuid)
 			}
-			msg.Attachments = append(msg.Attachments,
-				&formAttachment{attachment.File})
+			msg.Attachments = append(msg.Attachments, &formAttachment{
+				FileHeader: attachment.File,
+				contentID:  uploadContentID(uuid),
+			})
 			defer attachment.Form.RemoveAll()
 		}
 
+		if autosave {
+			return autosaveCompose(ctx, msg, options.Draft)
+		}
+
 		// Save as draft before sending to prevent data loss
 		var draft *messagePath
 		err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
-			drafts, err := appendMessage(c, msg, mailboxDrafts)
-			if err != nil {
-				return err
-			}
+			var err error
+			draft, err = saveDraft(c, msg, options.Draft)
+			return err
+		})
+		if _, ok := err.(alps.IMAPConnError); ok {
+			return err
+		} else if err == errAutosaveConflict {
+			return echo.NewHTTPError(http.StatusConflict, err)
+		} else if err != nil {
+			return fmt.Errorf("failed to save message to Draft mailbox: %v", err)
+		}
 
-			if draft := options.Draft; draft != nil {
-				if err := deleteMessage(c, draft.Mailbox, draft.Uid); err != nil {
-					return err
+		// The draft has been replaced, which invalidates any schedule
+		for _, kind := range []string{scheduledSendJob, outboxSendJob} {
+			if scheduled := findScheduledMessage(ctx.Session, kind, msg.MessageID); scheduled != nil {
+				if err := ctx.Session.CancelJob(scheduled.ID); err != nil {
+					return fmt.Errorf("failed to cancel scheduled message: %v", err)
 				}
 			}
+		}
 
-			if err := ensureMailboxSelected(c, drafts.Name); err != nil {
-				return err
-			}
-
-			criteria := &imap.SearchCriteria{
-				Header: make(textproto.MIMEHeader),
-			}
-			criteria.Header.Add("Message-Id", msg.MessageID)
-			uids, err := c.UidSearch(criteria)
-			if err != nil {
-				return err
-			}
-			if len(uids) != 1 {
-				panic(fmt.Errorf("Duplicate message ID"))
+		// Drafts are saved unprotected: the passphrase isn't kept, so
+		// messages are protected right before being sent
+		pgpSign := ctx.FormValue("pgp_sign") == "on"
+		pgpEncrypt := ctx.FormValue("pgp_encrypt") == "on"
+		smimeSign := ctx.FormValue("smime_sign") == "on"
+		var protectErr string
+		if (pgpSign || pgpEncrypt || smimeSign) && !saveAsDraft && sendAtErr == "" {
+			if schedule {
+				protectErr = "Signed and encrypted messages can't be sent later."
+			} else if smimeSign && (pgpSign || pgpEncrypt) {
+				protectErr = "Messages can't be protected with both OpenPGP and S/MIME."
+			} else if smimeSign {
+				if err := prepareSMIME(ctx, msg, ctx.FormValue("smime_passphrase")); err != nil {
+					protectErr = fmt.Sprintf("Failed to sign message with S/MIME: %v.", err)
+				}
+			} else if err := preparePGP(ctx, msg, pgpSign, pgpEncrypt, ctx.FormValue("pgp_passphrase")); err != nil {
+				protectErr = fmt.Sprintf("Failed to protect message with OpenPGP: %v.", err)
 			}
-
-			draft = &messagePath{Mailbox: drafts.Name, Uid: uids[0]}
-			return nil
-		})
-		if err != nil {
-			return fmt.Errorf("failed to save message to Draft mailbox: %v", err)
 		}
 
-		if saveAsDraft {
+		if sendAtErr != "" || protectErr != "" {
+			ctx.Session.PutNotice(sendAtErr + protectErr + " The message was saved as draft.")
+			return ctx.Redirect(http.StatusFound, fmt.Sprintf(
+				"/message/%s/%d/edit?part=1", draft.Mailbox, draft.Uid))
+		} else if saveAsDraft {
 			ctx.Session.PutNotice("Message saved as draft.")
 			return ctx.Redirect(http.StatusFound, fmt.Sprintf(
 				"/message/%s/%d/edit?part=1", draft.Mailbox, draft.Uid))
+		} else if schedule {
+			options.Draft = draft
+			return scheduleCompose(ctx, msg, options, sendAt)
 		} else {
 			options.Draft = draft
 			return submitCompose(ctx, msg, options)
 		}
 	}
 
+	var sendAt string
+	if scheduled := findScheduledMessage(ctx.Session, scheduledSendJob, msg.MessageID); scheduled != nil {
+		settings, err := LoadSettings(ctx.Session.Store())
+		if err != nil {
+			return err
+		}
+		loc, err := time.LoadLocation(settings.Timezone)
+		if err != nil {
+			return fmt.Errorf("failed to load location: %v", err)
+		}
+		sendAt = scheduled.Time.In(loc).Format(sendAtLayout)
+	}
+
+	pgpKeys, err := loadPGPKeys(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load OpenPGP keys: %v", err)
+	}
+	smimeKeys, err := loadSMIMEKeys(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load S/MIME certificate: %v", err)
+	}
+
 	return ctx.Render(http.StatusOK, "compose.html", &ComposeRenderData{
 		IMAPBaseRenderData: *ibase,
 		Message:            msg,
+		Identities:         identities,
+		CanSchedule:        ctx.Session.CanScheduleJobs(),
+		SendAt:             sendAt,
+		AutosaveInterval:   int(autosaveInterval / time.Second),
+		ForwardedMessages:  options.Attached,
+		PGP:                pgpKeys.HasPrivateKey(),
+		SMIME:              smimeKeys.HasCertificate(),
 	})
 }
 
-func handleComposeNew(ctx *alps.Context) error {
-	text := ctx.QueryParam("body")
-	settings, err := LoadSettings(ctx.Session.Store())
-	if err != nil {
-		return nil
-	}
-	if text == "" && settings.Signature != "" {
-		text = "\n\n\n-- \n" + settings.Signature
+// autosaveCompose replaces the previous draft, if any, and replies with the
+// new draft. Unlike other saves, scheduled messages stay scheduled.
+func autosaveCompose(ctx *alps.Context, msg *OutgoingMessage, prev *messagePath) error {
+	if findScheduledMessage(ctx.Session, outboxSendJob, msg.MessageID) != nil {
+		return autosaveError(ctx, errAutosaveConflict)
+	}
+	scheduled := findScheduledMessage(ctx.Session, scheduledSendJob, msg.MessageID) != nil
+
+	var result *AutosaveResult
+	err := ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		if err := checkAutosave(c, msg.MessageID, prev); err != nil {
+			return err
+		}
+
+		draft, err := saveDraft(c, msg, prev)
+		if err != nil {
+			return err
+		}
+
+		if scheduled {
+			if err := setScheduledFlag(c, draft.Mailbox, draft.Uid, true); err != nil {
+				return err
+			}
+		}
+
+		source, err := fetchMessageStructure(c, draft.Mailbox, draft.Uid)
+		if err != nil {
+			return err
+		}
+		result = newAutosaveResult(source, msg.HTML != "" || msg.Markdown)
+		return nil
+	})
+	if err == errAutosaveConflict || err == errAutosaveTooSoon {
+		return autosaveError(ctx, err)
+	} else if err != nil {
+		return autosaveError(ctx, fmt.Errorf("failed to save message to Draft mailbox: %v", err))
+	}
+
+	return ctx.JSON(http.StatusOK, result)
+}
+
+func autosaveError(ctx *alps.Context, err error) error {
+	status := http.StatusInternalServerError
+	switch err {
+	case errAutosaveConflict:
+		status = http.StatusConflict
+	case errAutosaveTooSoon:
+		status = http.StatusTooManyRequests
+		ctx.Response().Header().Set("Retry-After", fmt.Sprint(int(autosaveInterval/time.Second)))
+	default:
+		ctx.Logger().Printf("Autosave failed: %v", err)
+	}
+	return ctx.JSON(status, map[string]string{
+		"error": err.Error(),
+	})
+}
+
+// scheduleCompose marks the draft as scheduled and schedules a job to send it.
+func scheduleCompose(ctx *alps.Context, msg *OutgoingMessage, options *composeOptions, sendAt time.Time) error {
+	draft := options.Draft
+	err := ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		return setScheduledFlag(c, draft.Mailbox, draft.Uid, true)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark draft as scheduled: %v", err)
+	}
+
+	err = scheduleSend(ctx.Session, sendAt, &ScheduledSend{
+		MessageID: msg.MessageID,
+		Subject:   msg.Subject,
+		To:        msg.To,
+		InReplyTo: options.InReplyTo,
+		Sent:      options.Sent,
+	})
+	if err == alps.ErrSchedulerDisabled {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	} else if err != nil {
+		return fmt.Errorf("failed to schedule message: %v", err)
+	}
+
+	ctx.Session.PutNotice("Message scheduled.")
+	return ctx.Redirect(http.StatusFound, "/scheduled")
+}
+
+type ScheduledRenderData struct {
+	IMAPBaseRenderData
+	Messages []ScheduledMessage
+}
+
+func handleGetScheduled(ctx *alps.Context) error {
+	ibase, err := newIMAPBaseRenderData(ctx, alps.NewBaseRenderData(ctx))
+	if err != nil {
+		return err
+	}
+
+	settings, err := LoadSettings(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(settings.Timezone)
+	if err != nil {
+		return fmt.Errorf("failed to load location: %v", err)
+	}
+
+	messages := listScheduledMessages(ctx.Session, scheduledSendJob)
+	for i := range messages {
+		messages[i].Time = messages[i].Time.In(loc)
+	}
+
+	return ctx.Render(http.StatusOK, "scheduled.html", &ScheduledRenderData{
+		IMAPBaseRenderData: *ibase,
+		Messages:           messages,
+	})
+}
+
+// findScheduledDraft returns the path to the draft of a scheduled message, or
+// nil if it can't be found.
+func findScheduledDraft(ctx *alps.Context, scheduled *ScheduledMessage) (*messagePath, error) {
+	var draft *messagePath
+	err := ctx.Session.DoIMAPIdempotent(func(c *imapclient.Client) error {
+		drafts, err := getMailboxByType(c, mailboxDrafts)
+		if err != nil || drafts == nil {
+			return err
+		}
+		uid, err := searchScheduledDraft(c, drafts.Name, scheduled.MessageID)
+		if err != nil || uid == 0 {
+			return err
+		}
+		draft = &messagePath{Mailbox: drafts.Name, Uid: uid}
+		return nil
+	})
+	return draft, err
+}
+
+func findScheduledMessageByID(ctx *alps.Context, kind, id string) (*ScheduledMessage, error) {
+	for _, msg := range listScheduledMessages(ctx.Session, kind) {
+		if msg.ID == id {
+			return &msg, nil
+		}
+	}
+	return nil, echo.NewHTTPError(http.StatusNotFound, "scheduled message not found")
+}
+
+func handleEditScheduled(ctx *alps.Context) error {
+	scheduled, err := findScheduledMessageByID(ctx, scheduledSendJob, ctx.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	draft, err := findScheduledDraft(ctx, scheduled)
+	if err != nil {
+		return err
+	} else if draft == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "scheduled draft not found")
+	}
+
+	return ctx.Redirect(http.StatusFound, fmt.Sprintf(
+		"/message/%s/%d/edit?part=1", url.PathEscape(draft.Mailbox), draft.Uid))
+}
+
+// cancelScheduledSend cancels a scheduled message and returns the path to its
+// draft, if it can be found.
+func cancelScheduledSend(ctx *alps.Context, scheduled *ScheduledMessage) (*messagePath, error) {
+	if err := ctx.Session.CancelJob(scheduled.ID); err != nil {
+		return nil, err
+	}
+
+	draft, err := findScheduledDraft(ctx, scheduled)
+	if err != nil || draft == nil {
+		return nil, err
+	}
+	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		return setScheduledFlag(c, draft.Mailbox, draft.Uid, false)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmark scheduled draft: %v", err)
+	}
+	return draft, nil
+}
+
+func handleCancelScheduled(ctx *alps.Context) error {
+	scheduled, err := findScheduledMessageByID(ctx, scheduledSendJob, ctx.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	if _, err := cancelScheduledSend(ctx, scheduled); err == alps.ErrJobRunning {
+		ctx.Session.PutNotice("The message is being sent.")
+		return ctx.Redirect(http.StatusFound, "/scheduled")
+	} else if err == alps.ErrNoSuchJob {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	} else if err != nil {
+		return fmt.Errorf("failed to cancel scheduled message: %v", err)
+	}
+
+	ctx.Session.PutNotice("Scheduled message cancelled, it was kept in Drafts.")
+	return ctx.Redirect(http.StatusFound, "/scheduled")
+}
+
+// handleUndoSend cancels sending a message before the undo send delay
+// expires, and returns to its draft.
+func handleUndoSend(ctx *alps.Context) error {
+	var scheduled *ScheduledMessage
+	for _, msg := range listScheduledMessages(ctx.Session, outboxSendJob) {
+		if msg.ID == ctx.Param("id") {
+			scheduled = &msg
+			break
+		}
+	}
+	if scheduled == nil {
+		ctx.Session.PutNotice("The message has already been sent.")
+		return ctx.Redirect(http.StatusFound, "/mailbox/INBOX")
+	}
+
+	draft, err := cancelScheduledSend(ctx, scheduled)
+	if err == alps.ErrJobRunning || err == alps.ErrNoSuchJob {
+		ctx.Session.PutNotice("The message has already been sent.")
+		return ctx.Redirect(http.StatusFound, "/mailbox/INBOX")
+	} else if err != nil {
+		return fmt.Errorf("failed to unsend message: %v", err)
+	} else if draft == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "draft not found")
+	}
+
+	ctx.Session.PutNotice("Sending cancelled.")
+	return ctx.Redirect(http.StatusFound, fmt.Sprintf(
+		"/message/%s/%d/edit?part=1", url.PathEscape(draft.Mailbox), draft.Uid))
+}
+
+func handleComposeNew(ctx *alps.Context) error {
+	text := ctx.QueryParam("body")
+	settings, err := LoadSettings(ctx.Session.Store())
+	if err != nil {
+		return nil
+	}
+	identities, err := LoadIdentities(ctx)
+	if err != nil {
+		return err
+	}
+	if text == "" && len(identities) > 0 && identities[0].Signature != "" {
+		text = "\n\n\n-- \n" + identities[0].Signature
 	}
 
 	// These are common mailto URL query parameters
@@ -759,6 +2055,7 @@ func handleComposeNew(ctx *alps.Context) error {
 		MessageID: "<" + mid + ">",
 		InReplyTo: ctx.QueryParam("in-reply-to"),
 		Text:      text,
+		Markdown:  settings.Markdown,
 	}, &composeOptions{})
 }
 
@@ -853,11 +2150,21 @@ func handleReply(ctx *alps.Context) error {
 			return echo.NewHTTPError(http.StatusBadRequest, err)
 		}
 
+		identities, err := LoadIdentities(ctx)
+		if err != nil {
+			return err
+		}
+
 		var inReplyTo *IMAPMessage
 		var part *message.Entity
-		err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		var h mail.Header
+		err = ctx.Session.DoIMAPIdempotent(func(c *imapclient.Client) error {
 			var err error
 			inReplyTo, part, err = getMessagePart(c, inReplyToPath.Mailbox, inReplyToPath.Uid, partPath)
+			if err != nil {
+				return err
+			}
+			h, err = fetchExtraHeader(c, inReplyToPath.Mailbox, inReplyToPath.Uid)
 			return err
 		})
 		if err != nil {
@@ -893,12 +2200,15 @@ func handleReply(ctx *alps.Context) error {
 		mid, _ := hdr.MessageID()
 		msg.MessageID = "<" + mid + ">"
 		msg.InReplyTo = inReplyTo.Envelope.MessageId
-		// TODO: populate From from known user addresses and inReplyTo.Envelope.To
-		replyTo := inReplyTo.Envelope.ReplyTo
-		if len(replyTo) == 0 {
-			replyTo = inReplyTo.Envelope.From
+		msg.References = replyReferences(h, inReplyTo.Envelope)
+		msg.To, msg.Cc, err = replyRecipients(inReplyTo.Envelope, h, identities, ctx.QueryParam("mode"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		// Reply as the identity the original message was addressed to
+		if identity := identities.Recipient(inReplyTo.Envelope); identity != nil {
+			msg.From = identity.String()
 		}
-		msg.To = formatIMAPAddressList(replyTo)
 		msg.Subject = inReplyTo.Envelope.Subject
 		if !strings.HasPrefix(strings.ToLower(msg.Subject), "re:") {
 			msg.Subject = "Re: " + msg.Subject
@@ -926,7 +2236,7 @@ func handleForward(ctx *alps.Context) error {
 
 		var source *IMAPMessage
 		var part *message.Entity
-		err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		err = ctx.Session.DoIMAPIdempotent(func(c *imapclient.Client) error {
 			var err error
 			source, part, err = getMessagePart(c, sourcePath.Mailbox, sourcePath.Uid, partPath)
 			return err
@@ -959,11 +2269,7 @@ func handleForward(ctx *alps.Context) error {
 		hdr.GenerateMessageID()
 		mid, _ := hdr.MessageID()
 		msg.MessageID = "<" + mid + ">"
-		msg.Subject = source.Envelope.Subject
-		if !strings.HasPrefix(strings.ToLower(msg.Subject), "fwd:") &&
-			!strings.HasPrefix(strings.ToLower(msg.Subject), "fw:") {
-			msg.Subject = "Fwd: " + msg.Subject
-		}
+		msg.Subject = forwardSubject(source.Envelope.Subject)
 		msg.InReplyTo = source.Envelope.InReplyTo
 
 		attachments := source.Attachments()
@@ -981,6 +2287,64 @@ func handleForward(ctx *alps.Context) error {
 	return handleCompose(ctx, &msg, &composeOptions{Forward: &sourcePath})
 }
 
+func forwardSubject(subject string) string {
+	if strings.HasPrefix(strings.ToLower(subject), "fwd:") ||
+		strings.HasPrefix(strings.ToLower(subject), "fw:") {
+		return subject
+	}
+	return "Fwd: " + subject
+}
+
+// handleForwardAttached forwards messages as attachments, with all of their
+// header fields. Several messages can be forwarded at once.
+func handleForwardAttached(ctx *alps.Context) error {
+	mboxName, err := url.PathUnescape(ctx.Param("mbox"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	var msg OutgoingMessage
+	var options composeOptions
+	if ctx.Request().Method == http.MethodGet {
+		refs, err := parseMessageRefs(mboxName, ctx.QueryParams())
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		if countMessageRefs(refs) == 0 {
+			ctx.Session.PutNotice("No messages selected.")
+			if mboxName == "" {
+				return ctx.Redirect(http.StatusFound, "/")
+			}
+			return ctx.Redirect(http.StatusFound, mailboxPath(mboxName))
+		}
+
+		err = ctx.Session.DoIMAPIdempotent(func(c *imapclient.Client) error {
+			var err error
+			options.Attached, err = fetchForwardedMessages(c, refs)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if len(options.Attached) == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "messages not found")
+		}
+
+		var hdr mail.Header
+		hdr.GenerateMessageID()
+		mid, _ := hdr.MessageID()
+		msg.MessageID = "<" + mid + ">"
+		if len(options.Attached) == 1 {
+			msg.Subject = forwardSubject(options.Attached[0].Envelope.Subject)
+		} else {
+			msg.Subject = fmt.Sprintf("Fwd: %v messages", len(options.Attached))
+		}
+	}
+
+	return handleCompose(ctx, &msg, &options)
+}
+
 func handleEdit(ctx *alps.Context) error {
 	var sourcePath messagePath
 	var err error
@@ -1000,31 +2364,74 @@ func handleEdit(ctx *alps.Context) error {
 		}
 
 		var source *IMAPMessage
-		var part *message.Entity
-		err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		var part, htmlPart, textPart *message.Entity
+		var h mail.Header
+		err = ctx.Session.DoIMAPIdempotent(func(c *imapclient.Client) error {
 			var err error
 			source, part, err = getMessagePart(c, sourcePath.Mailbox, sourcePath.Uid, partPath)
+			if err != nil {
+				return err
+			}
+			if h, err = fetchExtraHeader(c, sourcePath.Mailbox, sourcePath.Uid); err != nil {
+				return err
+			}
+			// Drafts composed in HTML are edited in HTML, whichever part
+			// was requested
+			node := source.HTMLPart()
+			if node == nil {
+				return nil
+			}
+			_, htmlPart, err = getMessagePart(c, sourcePath.Mailbox, sourcePath.Uid, node.Path)
+			if err != nil {
+				return err
+			}
+			// The text alternative of drafts composed in Markdown holds the
+			// source, marked with markdownField
+			if node := source.TextPart(); node != nil {
+				_, textPart, err = getMessagePart(c, sourcePath.Mailbox, sourcePath.Uid, node.Path)
+			}
 			return err
 		})
 		if err != nil {
 			return err
 		}
 
-		mimeType, _, err := part.Header.ContentType()
-		if err != nil {
-			return fmt.Errorf("failed to parse part Content-Type: %v", err)
+		if textPart != nil {
+			msg.Markdown = textPart.Header.Get(markdownField) != ""
 		}
 
-		if !strings.EqualFold(mimeType, "text/plain") {
-			err := fmt.Errorf("cannot edit %q part", mimeType)
-			return echo.NewHTTPError(http.StatusBadRequest, err)
-		}
+		if msg.Markdown {
+			b, err := ioutil.ReadAll(textPart.Body)
+			if err != nil {
+				return fmt.Errorf("failed to read part body: %v", err)
+			}
+			msg.Text = unflow(string(b))
+		} else if htmlPart != nil {
+			b, err := ioutil.ReadAll(htmlPart.Body)
+			if err != nil {
+				return fmt.Errorf("failed to read part body: %v", err)
+			}
+			msg.HTML = sanitizeComposedHTML(string(b))
+			if msg.Text, err = htmlToText(msg.HTML); err != nil {
+				return fmt.Errorf("failed to convert HTML to text: %v", err)
+			}
+		} else {
+			mimeType, _, err := part.Header.ContentType()
+			if err != nil {
+				return fmt.Errorf("failed to parse part Content-Type: %v", err)
+			}
 
-		b, err := ioutil.ReadAll(part.Body)
-		if err != nil {
-			return fmt.Errorf("failed to read part body: %v", err)
+			if !strings.EqualFold(mimeType, "text/plain") {
+				err := fmt.Errorf("cannot edit %q part", mimeType)
+				return echo.NewHTTPError(http.StatusBadRequest, err)
+			}
+
+			b, err := ioutil.ReadAll(part.Body)
+			if err != nil {
+				return fmt.Errorf("failed to read part body: %v", err)
+			}
+			msg.Text = string(b)
 		}
-		msg.Text = string(b)
 
 		if len(source.Envelope.From) > 0 {
 			msg.From = source.Envelope.From[0].Address()
@@ -1034,9 +2441,14 @@ func handleEdit(ctx *alps.Context) error {
 		msg.Bcc = formatIMAPAddressList(source.Envelope.Bcc)
 		msg.Subject = source.Envelope.Subject
 		msg.InReplyTo = source.Envelope.InReplyTo
+		msg.References = msgIDList(h, "References")
+		msg.RequestMDN = h.Has("Disposition-Notification-To")
 		msg.MessageID = source.Envelope.MessageId
 
 		attachments := source.Attachments()
+		if msg.HTML != "" || msg.Markdown {
+			attachments = append(attachments, source.RelatedParts()...)
+		}
 		for i := range attachments {
 			// No need to populate attachment body here, we just need the
 			// metadata
@@ -1051,6 +2463,14 @@ func handleEdit(ctx *alps.Context) error {
 	return handleCompose(ctx, &msg, &composeOptions{Draft: &sourcePath})
 }
 
+// redirectIMAPConnError redirects to the provided URL after the connection to
+// the IMAP server has been lost while performing an operation. The operation
+// may or may not have been applied, so the user is asked to check.
+func redirectIMAPConnError(ctx *alps.Context, to string) error {
+	ctx.Session.PutNotice("The connection to the mail server was lost. Please check whether your changes were applied and try again.")
+	return ctx.Redirect(http.StatusFound, to)
+}
+
 func formOrQueryParam(ctx *alps.Context, k string) string {
 	if v := ctx.FormValue(k); v != "" {
 		return v
@@ -1058,7 +2478,53 @@ func formOrQueryParam(ctx *alps.Context, k string) string {
 	return ctx.QueryParam(k)
 }
 
+// mailboxPath returns the path to redirect to after an action in a mailbox.
+// The mailbox name is empty for actions on messages of several mailboxes.
+func mailboxPath(mboxName string) string {
+	if mboxName == "" {
+		return "/"
+	}
+	return fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName))
+}
+
+func countMessageRefs(refs map[string][]uint32) int {
+	n := 0
+	for _, uids := range refs {
+		n += len(uids)
+	}
+	return n
+}
+
+// BulkProgressRenderData is the data of the page displayed when a bulk action
+// needs to be resumed.
+type BulkProgressRenderData struct {
+	IMAPBaseRenderData
+	// URL and form fields to post to resume the action
+	Action string
+	Params url.Values
+	// Number of messages processed so far, and in total
+	Done, Total int
+}
+
+func renderBulkProgress(ctx *alps.Context, action *bulkAction) error {
+	ibase, err := newIMAPBaseRenderData(ctx, alps.NewBaseRenderData(ctx))
+	if err != nil {
+		return err
+	}
+	ibase.BaseRenderData.WithTitle("Working…")
+
+	return ctx.Render(http.StatusOK, "bulk-progress.html", &BulkProgressRenderData{
+		IMAPBaseRenderData: *ibase,
+		Action:             ctx.Request().URL.String(),
+		Params:             action.Params(ctx.Request().PostForm),
+		Done:               action.Done,
+		Total:              action.Total,
+	})
+}
+
 func handleMove(ctx *alps.Context) error {
+	defer invalidateVirtualUnseen(ctx.Session)
+
 	mboxName, err := url.PathUnescape(ctx.Param("mbox"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err)
@@ -1068,49 +2534,60 @@ func handleMove(ctx *alps.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err)
 	}
-	uids, err := parseUidList(formParams["uids"])
+	loc, err := loadLocation(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+	action, err := parseBulkAction(mboxName, formParams, loc)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err)
 	}
 
-	if len(uids) == 0 {
+	if action.Empty() {
 		ctx.Session.PutNotice("No messages selected.")
-		return ctx.Redirect(http.StatusFound, fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName)))
+		return ctx.Redirect(http.StatusFound, mailboxPath(mboxName))
 	}
 
 	to := formOrQueryParam(ctx, "to")
 	if to == "" {
 		return echo.NewHTTPError(http.StatusBadRequest, "missing 'to' form parameter")
 	}
+	action.Exclude = to
 
 	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
 		mc := imapmove.NewClient(c)
 
-		if err := ensureMailboxSelected(c, mboxName); err != nil {
-			return err
-		}
-
-		var seqSet imap.SeqSet
-		seqSet.AddNum(uids...)
-		if err := mc.UidMoveWithFallback(&seqSet, to); err != nil {
-			return fmt.Errorf("failed to move message: %v", err)
-		}
-
 		// TODO: get the UID of the message in the destination mailbox with UIDPLUS
-		return nil
+		return action.Run(c, func(name string, seqSet *imap.SeqSet) error {
+			if err := ensureMailboxSelected(c, name); err != nil {
+				return err
+			}
+			if err := mc.UidMoveWithFallback(seqSet, to); err != nil {
+				return fmt.Errorf("failed to move message: %v", err)
+			}
+			return nil
+		})
 	})
-	if err != nil {
+	if _, ok := err.(alps.IMAPConnError); ok {
+		return redirectIMAPConnError(ctx, mailboxPath(mboxName))
+	} else if err != nil {
 		return err
 	}
 
-	ctx.Session.PutNotice("Message(s) moved.")
+	if !action.Complete() {
+		return renderBulkProgress(ctx, action)
+	}
+
+	ctx.Session.PutNotice(fmt.Sprintf("%d message(s) moved.", action.Done))
 	if path := formOrQueryParam(ctx, "next"); path != "" {
 		return ctx.Redirect(http.StatusFound, path)
 	}
-	return ctx.Redirect(http.StatusFound, fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName)))
+	return ctx.Redirect(http.StatusFound, mailboxPath(mboxName))
 }
 
 func handleDelete(ctx *alps.Context) error {
+	defer invalidateVirtualUnseen(ctx.Session)
+
 	mboxName, err := url.PathUnescape(ctx.Param("mbox"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err)
@@ -1120,54 +2597,112 @@ func handleDelete(ctx *alps.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err)
 	}
-	uids, err := parseUidList(formParams["uids"])
+	loc, err := loadLocation(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+	action, err := parseBulkAction(mboxName, formParams, loc)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err)
 	}
 
-	if len(uids) == 0 {
+	if action.Empty() {
 		ctx.Session.PutNotice("No messages selected.")
-		return ctx.Redirect(http.StatusFound, fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName)))
+		return ctx.Redirect(http.StatusFound, mailboxPath(mboxName))
 	}
 
 	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
-		if err := ensureMailboxSelected(c, mboxName); err != nil {
-			return err
-		}
-
-		var seqSet imap.SeqSet
-		seqSet.AddNum(uids...)
-
-		item := imap.FormatFlagsOp(imap.AddFlags, true)
-		flags := []interface{}{imap.DeletedFlag}
-		if err := c.UidStore(&seqSet, item, flags, nil); err != nil {
-			return fmt.Errorf("failed to add deleted flag: %v", err)
-		}
+		return runDeleteAction(c, action)
+	})
+	if _, ok := err.(alps.IMAPConnError); ok {
+		return redirectIMAPConnError(ctx, mailboxPath(mboxName))
+	} else if err != nil {
+		return err
+	}
 
-		if err := c.Expunge(nil); err != nil {
-			return fmt.Errorf("failed to expunge mailbox: %v", err)
-		}
+	if !action.Complete() {
+		return renderBulkProgress(ctx, action)
+	}
 
-		// Deleting a message invalidates our cached message count
-		// TODO: listen to async updates instead
-		if _, err := c.Select(mboxName, false); err != nil {
+	ctx.Session.PutNotice(fmt.Sprintf("%d message(s) deleted.", action.Done))
+	if path := formOrQueryParam(ctx, "next"); path != "" {
+		return ctx.Redirect(http.StatusFound, path)
+	}
+	return ctx.Redirect(http.StatusFound, mailboxPath(mboxName))
+}
+
+func runDeleteAction(c *imapclient.Client, action *bulkAction) error {
+	err := action.Run(c, func(name string, seqSet *imap.SeqSet) error {
+		return deleteMessages(c, name, seqSet)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Deleting a message invalidates our cached message count
+	// TODO: listen to async updates instead
+	if mbox := c.Mailbox(); mbox != nil {
+		if _, err := c.Select(mbox.Name, false); err != nil {
 			return fmt.Errorf("failed to select mailbox: %v", err)
 		}
+	}
+	return nil
+}
 
-		return nil
-	})
+func handleEmptyMailbox(ctx *alps.Context) error {
+	defer invalidateVirtualUnseen(ctx.Session)
+
+	ibase, err := newIMAPBaseRenderData(ctx, alps.NewBaseRenderData(ctx))
 	if err != nil {
 		return err
 	}
 
-	ctx.Session.PutNotice("Message(s) deleted.")
-	if path := formOrQueryParam(ctx, "next"); path != "" {
-		return ctx.Redirect(http.StatusFound, path)
+	mbox := ibase.Mailbox
+	if !canEmptyMailbox(ibase.Mailboxes, mbox.Name) {
+		return echo.NewHTTPError(http.StatusBadRequest, "only Junk and Trash can be emptied")
+	}
+	ibase.BaseRenderData.WithTitle("Empty folder '" + mbox.Name + "'")
+
+	if ctx.Request().Method != http.MethodPost {
+		return ctx.Render(http.StatusOK, "empty-mailbox.html", ibase)
 	}
-	return ctx.Redirect(http.StatusFound, fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName)))
+
+	formParams, err := ctx.FormParams()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	formParams.Set("all", "1")
+	formParams.Del("query")
+	formParams.Del("scope")
+	loc, err := loadLocation(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+	action, err := parseBulkAction(mbox.Name, formParams, loc)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		return runDeleteAction(c, action)
+	})
+	if _, ok := err.(alps.IMAPConnError); ok {
+		return redirectIMAPConnError(ctx, mbox.URL().String())
+	} else if err != nil {
+		return err
+	}
+
+	if !action.Complete() {
+		return renderBulkProgress(ctx, action)
+	}
+
+	ctx.Session.PutNotice(fmt.Sprintf("%d message(s) deleted.", action.Done))
+	return ctx.Redirect(http.StatusFound, mbox.URL().String())
 }
 
 func handleSetFlags(ctx *alps.Context) error {
+	defer invalidateVirtualUnseen(ctx.Session)
+
 	mboxName, err := url.PathUnescape(ctx.Param("mbox"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err)
@@ -1178,7 +2713,11 @@ func handleSetFlags(ctx *alps.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err)
 	}
 
-	uids, err := parseUidList(formParams["uids"])
+	loc, err := loadLocation(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+	action, err := parseBulkAction(mboxName, formParams, loc)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err)
 	}
@@ -1209,49 +2748,304 @@ func handleSetFlags(ctx *alps.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "invalid 'action' value")
 	}
 
-	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
-		if err := ensureMailboxSelected(c, mboxName); err != nil {
-			return err
+	// Leave out messages which already have the right flag
+	if action.All && len(flags) == 1 {
+		switch op {
+		case imap.AddFlags:
+			action.Criteria.WithoutFlags = append(action.Criteria.WithoutFlags, flags[0])
+		case imap.RemoveFlags:
+			action.Criteria.WithFlags = append(action.Criteria.WithFlags, flags[0])
 		}
+	}
 
-		var seqSet imap.SeqSet
-		seqSet.AddNum(uids...)
-
+	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
 		storeItems := make([]interface{}, len(flags))
 		for i, f := range flags {
 			storeItems[i] = f
 		}
-
 		item := imap.FormatFlagsOp(op, true)
-		if err := c.UidStore(&seqSet, item, storeItems, nil); err != nil {
-			return fmt.Errorf("failed to add deleted flag: %v", err)
-		}
 
-		return nil
+		return action.Run(c, func(name string, seqSet *imap.SeqSet) error {
+			if err := ensureMailboxSelected(c, name); err != nil {
+				return err
+			}
+			if err := c.UidStore(seqSet, item, storeItems, nil); err != nil {
+				return fmt.Errorf("failed to add deleted flag: %v", err)
+			}
+			return nil
+		})
 	})
-	if err != nil {
+	if _, ok := err.(alps.IMAPConnError); ok {
+		return redirectIMAPConnError(ctx, mailboxPath(mboxName))
+	} else if err != nil {
 		return err
 	}
 
+	if !action.Complete() {
+		return renderBulkProgress(ctx, action)
+	}
+
+	if action.All {
+		ctx.Session.PutNotice(fmt.Sprintf("%d message(s) updated.", action.Done))
+	}
 	if path := formOrQueryParam(ctx, "next"); path != "" {
 		return ctx.Redirect(http.StatusFound, path)
 	}
-	if len(uids) != 1 || (op == imap.RemoveFlags && len(flags) == 1 && flags[0] == imap.SeenFlag) {
+	refs := action.Refs
+	if action.All || countMessageRefs(refs) != 1 || (op == imap.RemoveFlags && len(flags) == 1 && flags[0] == imap.SeenFlag) {
 		// Redirecting to the message view would mark the message as read again
-		return ctx.Redirect(http.StatusFound, fmt.Sprintf("/mailbox/%v", url.PathEscape(mboxName)))
+		return ctx.Redirect(http.StatusFound, mailboxPath(mboxName))
+	}
+	var path string
+	for name, uids := range refs {
+		path = fmt.Sprintf("/message/%v/%v", url.PathEscape(name), uids[0])
 	}
-	return ctx.Redirect(http.StatusFound, fmt.Sprintf("/message/%v/%v", url.PathEscape(mboxName), uids[0]))
+	return ctx.Redirect(http.StatusFound, path)
+}
+
+func handleExport(ctx *alps.Context) error {
+	mboxName, err := url.PathUnescape(ctx.Param("mbox"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	params := make(url.Values)
+	for k, v := range ctx.QueryParams() {
+		params[k] = v
+	}
+	params.Set("all", "1")
+	params.Del("resume")
+	if mboxName == "" {
+		params.Set("scope", searchScopeEverywhere)
+	}
+	loc, err := loadLocation(ctx.Session.Store())
+	if err != nil {
+		return err
+	}
+	action, err := parseBulkAction(mboxName, params, loc)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	filename := "mail"
+	if mboxName != "" {
+		filename = mboxName
+	}
+	var contentType string
+	switch format := ctx.QueryParam("format"); format {
+	case "", exportFormatMbox:
+		contentType = "application/mbox"
+		filename += ".mbox"
+	case exportFormatMaildir:
+		contentType = "application/zip"
+		filename += ".zip"
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid export format")
+	}
+
+	resp := ctx.Response()
+	disp := mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+	resp.Header().Set("Content-Type", contentType)
+	resp.Header().Set("Content-Disposition", disp)
+
+	// Messages are written to the response as they are fetched
+	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		refs, err := action.search(c)
+		if err != nil {
+			return err
+		}
+		var archiver messageArchiver
+		if contentType == "application/zip" {
+			archiver = newMaildirWriter(resp)
+		} else {
+			archiver = newMboxWriter(resp)
+		}
+		return exportMessages(c, refs, archiver)
+	})
+	if err != nil {
+		if !resp.Committed {
+			resp.Header().Del("Content-Type")
+			resp.Header().Del("Content-Disposition")
+			return err
+		}
+		// Too late to report the error to the user
+		ctx.Logger().Printf("failed to export messages: %v", err)
+		return nil
+	}
+
+	if !resp.Committed {
+		resp.WriteHeader(http.StatusOK)
+	}
+	return nil
+}
+
+type ImportRenderData struct {
+	IMAPBaseRenderData
+	// Mailbox the messages are imported into
+	Target string
+	Error  string
+	// Set once the import is complete
+	Import *messageImport
+}
+
+func handleImport(ctx *alps.Context) error {
+	defer invalidateVirtualUnseen(ctx.Session)
+
+	ibase, err := newIMAPBaseRenderData(ctx, alps.NewBaseRenderData(ctx))
+	if err != nil {
+		return err
+	}
+	ibase.BaseRenderData.WithTitle("Import messages")
+
+	renderData := &ImportRenderData{
+		IMAPBaseRenderData: *ibase,
+		Target:             ctx.QueryParam("mailbox"),
+	}
+	if renderData.Target == "" {
+		renderData.Target = "INBOX"
+	}
+
+	if ctx.Request().Method != http.MethodPost {
+		return ctx.Render(http.StatusOK, "import.html", renderData)
+	}
+
+	// The file is uploaded with the first request, and kept in the session
+	// while the import is resumed
+	imp := new(messageImport)
+	var upload *alps.Attachment
+	mediaType, _, _ := mime.ParseMediaType(ctx.Request().Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		reader, err := ctx.Request().MultipartReader()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		form, err := reader.ReadForm(32 << 20) // 32 MB
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		if v := form.Value["mailbox"]; len(v) > 0 {
+			renderData.Target = v[0]
+		}
+		files := form.File["file"]
+		if len(files) == 0 {
+			form.RemoveAll()
+			renderData.Error = "No file selected."
+			return ctx.Render(http.StatusOK, "import.html", renderData)
+		}
+		upload = &alps.Attachment{File: files[0], Form: form}
+	} else {
+		renderData.Target = ctx.FormValue("mailbox")
+		if upload = ctx.Session.PopAttachment(ctx.FormValue("upload")); upload == nil {
+			renderData.Error = "The upload has expired, please try again."
+			return ctx.Render(http.StatusOK, "import.html", renderData)
+		}
+
+		counts := []struct {
+			k string
+			v *int
+		}{
+			{"done", &imp.Done},
+			{"imported", &imp.Imported},
+			{"failures", &imp.Failures},
+		}
+		for _, count := range counts {
+			if *count.v, err = strconv.Atoi(ctx.FormValue(count.k)); err != nil || *count.v < 0 {
+				upload.Form.RemoveAll()
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid '%v' value", count.k))
+			}
+		}
+		formParams, err := ctx.FormParams()
+		if err != nil {
+			upload.Form.RemoveAll()
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		imp.Failed = formParams["failed"]
+	}
+
+	mbox := findMailbox(ibase.Mailboxes, renderData.Target)
+	if mbox == nil || mbox.HasAttr(imap.NoSelectAttr) {
+		upload.Form.RemoveAll()
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid mailbox")
+	}
+	imp.Mailbox = mbox.Name
+
+	// The file is stored before importing anything, so that a file too
+	// large to be resumed is rejected upfront
+	uuid, err := ctx.Session.PutAttachment(upload.File, upload.Form)
+	if err == alps.ErrAttachmentCacheSize {
+		upload.Form.RemoveAll()
+		renderData.Error = "The file is too large."
+		return ctx.Render(http.StatusOK, "import.html", renderData)
+	} else if err != nil {
+		upload.Form.RemoveAll()
+		return fmt.Errorf("failed to store uploaded file: %v", err)
+	}
+	discard := func() {
+		ctx.Session.PopAttachment(uuid)
+		upload.Form.RemoveAll()
+	}
+
+	f, err := upload.File.Open()
+	if err != nil {
+		discard()
+		return fmt.Errorf("failed to open uploaded file: %v", err)
+	}
+	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+		return imp.Run(c, f)
+	})
+	f.Close()
+	if _, ok := err.(alps.IMAPConnError); ok {
+		discard()
+		return redirectIMAPConnError(ctx, "/import")
+	} else if err != nil {
+		discard()
+		return err
+	}
+
+	if imp.Complete() {
+		discard()
+		renderData.Import = imp
+		return ctx.Render(http.StatusOK, "import.html", renderData)
+	}
+
+	params := url.Values{
+		"upload":   {uuid},
+		"mailbox":  {imp.Mailbox},
+		"done":     {strconv.Itoa(imp.Done)},
+		"imported": {strconv.Itoa(imp.Imported)},
+		"failures": {strconv.Itoa(imp.Failures)},
+		"failed":   imp.Failed,
+	}
+	ibase.BaseRenderData.WithTitle("Working…")
+	return ctx.Render(http.StatusOK, "bulk-progress.html", &BulkProgressRenderData{
+		IMAPBaseRenderData: *ibase,
+		Action:             "/import",
+		Params:             params,
+		Done:               imp.Done,
+	})
 }
 
 const settingsKey = "base.settings"
 const maxMessagesPerPage = 100
+const maxUndoSendDelay = 300
 
 type Settings struct {
 	MessagesPerPage int
-	Signature       string
-	From            string
-	Subscriptions   []string
-	Timezone        string
+	// Full name and signature of the username, until identities are set up
+	Signature     string
+	From          string
+	Subscriptions []string
+	Timezone      string
+	Conversations bool
+	// Compose new messages in Markdown
+	Markdown bool
+	// Seconds during which sending can be undone
+	UndoSendDelay int
+	// How read receipt requests are answered: mdnAsk, mdnAlways or
+	// mdnNever
+	MDNPolicy string
+	// Mailboxes merged into the unified inbox
+	UnifiedMailboxes []string
 }
 
 func LoadSettings(s alps.Store) (*Settings, error) {
@@ -1267,6 +3061,19 @@ func LoadSettings(s alps.Store) (*Settings, error) {
 	return settings, nil
 }
 
+// loadLocation returns the time zone picked by the user.
+func loadLocation(s alps.Store) (*time.Location, error) {
+	settings, err := LoadSettings(s)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(settings.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load location: %v", err)
+	}
+	return loc, nil
+}
+
 func (s *Settings) check() error {
 	if s.MessagesPerPage <= 0 || s.MessagesPerPage > maxMessagesPerPage {
 		return fmt.Errorf("messages per page out of bounds: %v", s.MessagesPerPage)
@@ -1277,16 +3084,43 @@ func (s *Settings) check() error {
 	if len(s.From) > 512 {
 		return fmt.Errorf("Full name must be 512 characters or fewer")
 	}
+	if s.UndoSendDelay < 0 || s.UndoSendDelay > maxUndoSendDelay {
+		return fmt.Errorf("undo send delay out of bounds: %v", s.UndoSendDelay)
+	}
+	switch s.MDNPolicy {
+	case mdnAsk, mdnAlways, mdnNever:
+	default:
+		return fmt.Errorf("unknown read receipt policy %q", s.MDNPolicy)
+	}
 	return nil
 }
 
+// undoSendDelay is a choice for the undo send delay, in seconds.
+type undoSendDelay int
+
+func (d undoSendDelay) String() string {
+	switch {
+	case d == 0:
+		return "Off"
+	case d < 60:
+		return fmt.Sprintf("%d seconds", d)
+	case d == 60:
+		return "1 minute"
+	default:
+		return fmt.Sprintf("%d minutes", d/60)
+	}
+}
+
 type SettingsRenderData struct {
 	alps.BaseRenderData
-	Mailboxes     []MailboxInfo
-	Settings      *Settings
-	Subscriptions Subscriptions
-	Regions       []string
-	Timezones     map[string][]string
+	UndoSendDelays []undoSendDelay
+	Mailboxes      []MailboxInfo
+	Settings       *Settings
+	Subscriptions  Subscriptions
+	// Mailboxes merged into the unified inbox
+	UnifiedMailboxes Subscriptions
+	Regions          []string
+	Timezones        map[string][]string
 }
 
 type Subscriptions []string
@@ -1306,9 +3140,15 @@ func handleSettings(ctx *alps.Context) error {
 		return fmt.Errorf("failed to load settings: %v", err)
 	}
 
-	var mailboxes []MailboxInfo
-	err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
-		mailboxes, err = listMailboxes(c)
+	var (
+		mailboxes  []MailboxInfo
+		subscribed map[string]bool
+	)
+	err = ctx.Session.DoIMAPIdempotent(func(c *imapclient.Client) error {
+		if mailboxes, err = listMailboxes(c); err != nil {
+			return err
+		}
+		subscribed, err = listSubscribedMailboxes(c)
 		return err
 	})
 	if err != nil {
@@ -1334,19 +3174,43 @@ func handleSettings(ctx *alps.Context) error {
 		if err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest, "invalid messages per page: %v", err)
 		}
-		settings.Signature = ctx.FormValue("signature")
-		settings.From = ctx.FormValue("from")
 		settings.Timezone = ctx.FormValue("timezones")
+		settings.Conversations = ctx.FormValue("conversations") == "on"
+		settings.Markdown = ctx.FormValue("markdown") == "on"
+		if v := ctx.FormValue("undo_send_delay"); v != "" {
+			settings.UndoSendDelay, err = strconv.Atoi(v)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("invalid undo send delay: %v", err))
+			}
+		}
+		settings.MDNPolicy = ctx.FormValue("mdn_policy")
 
 		params, err := ctx.FormParams()
 		if err != nil {
 			return err
 		}
 		settings.Subscriptions = params["subscriptions"]
+		settings.UnifiedMailboxes = params["unified"]
 
 		if err := settings.check(); err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest, err)
 		}
+
+		// Keep IMAP subscriptions in sync, for other clients. INBOX isn't
+		// listed in the settings and is left alone.
+		var listed []string
+		for _, mbox := range mailboxes {
+			if mbox.Name != "INBOX" && !mbox.HasAttr(imap.NoSelectAttr) {
+				listed = append(listed, mbox.Name)
+			}
+		}
+		err = ctx.Session.DoIMAP(func(c *imapclient.Client) error {
+			return syncSubscriptions(c, listed, settings.Subscriptions)
+		})
+		if err != nil {
+			return err
+		}
+
 		if err := ctx.Session.Store().Put(settingsKey, settings); err != nil {
 			return fmt.Errorf("failed to save settings: %v", err)
 		}
@@ -1354,12 +3218,394 @@ func handleSettings(ctx *alps.Context) error {
 		return ctx.Redirect(http.StatusFound, "/mailbox/INBOX")
 	}
 
+	// Mailboxes subscribed to by other clients are listed as well
+	subscriptions := Subscriptions(settings.Subscriptions)
+	for name := range subscribed {
+		if name != "INBOX" && !subscriptions.Has(name) {
+			subscriptions = append(subscriptions, name)
+		}
+	}
+
 	return ctx.Render(http.StatusOK, "settings.html", &SettingsRenderData{
+		BaseRenderData:   *alps.NewBaseRenderData(ctx),
+		Settings:         settings,
+		Mailboxes:        mailboxes,
+		Subscriptions:    subscriptions,
+		UnifiedMailboxes: Subscriptions(settings.UnifiedMailboxes),
+		UndoSendDelays:   []undoSendDelay{0, 5, 10, 20, 30, 60, 120, 300},
+		Regions:          regions,
+		Timezones:        timezones,
+	})
+}
+
+type IdentitiesRenderData struct {
+	alps.BaseRenderData
+	Identities Identities
+}
+
+func handleIdentities(ctx *alps.Context) error {
+	identities, err := LoadIdentities(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load identities: %v", err)
+	}
+
+	return ctx.Render(http.StatusOK, "identities.html", &IdentitiesRenderData{
 		BaseRenderData: *alps.NewBaseRenderData(ctx),
-		Settings:       settings,
+		Identities:     identities,
+	})
+}
+
+type IdentityRenderData struct {
+	alps.BaseRenderData
+	Identity  *Identity
+	Default   bool
+	Mailboxes []MailboxInfo
+}
+
+func handleEditIdentity(ctx *alps.Context) error {
+	identities, err := LoadIdentities(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load identities: %v", err)
+	}
+
+	// The index of the identity being edited, or -1 for a new one
+	index := -1
+	identity := new(Identity)
+	if address := ctx.Param("address"); address != "" {
+		address, err := url.PathUnescape(address)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		if index = identities.index(address); index < 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "no such identity")
+		}
+		identity = &identities[index]
+	}
+
+	if ctx.Request().Method == http.MethodPost {
+		updated := Identity{
+			Address:   strings.TrimSpace(ctx.FormValue("address")),
+			Name:      ctx.FormValue("name"),
+			ReplyTo:   strings.TrimSpace(ctx.FormValue("reply_to")),
+			BccSelf:   ctx.FormValue("bcc_self") == "on",
+			Signature: ctx.FormValue("signature"),
+			Sent:      ctx.FormValue("sent"),
+		}
+		if err := updated.check(); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		if !addressAllowed(&ctx.Server.Config.Identities, ctx.Session.Username(), updated.Address) {
+			return echo.NewHTTPError(http.StatusForbidden, fmt.Errorf("not allowed to send as %v", updated.Address))
+		}
+		if i := identities.index(updated.Address); i >= 0 && i != index {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Errorf("an identity already exists for %v", updated.Address))
+		}
+
+		if index >= 0 {
+			identities = append(identities[:index], identities[index+1:]...)
+		}
+		if ctx.FormValue("default") == "on" {
+			identities = append(Identities{updated}, identities...)
+		} else if index >= 0 {
+			identities = append(identities[:index], append(Identities{updated}, identities[index:]...)...)
+		} else {
+			identities = append(identities, updated)
+		}
+
+		if err := saveIdentities(ctx, identities); err != nil {
+			return fmt.Errorf("failed to save identities: %v", err)
+		}
+		return ctx.Redirect(http.StatusFound, "/settings/identities")
+	}
+
+	var mailboxes []MailboxInfo
+	err = ctx.Session.DoIMAPIdempotent(func(c *imapclient.Client) error {
+		mailboxes, err = listMailboxes(c)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return ctx.Render(http.StatusOK, "identity.html", &IdentityRenderData{
+		BaseRenderData: *alps.NewBaseRenderData(ctx),
+		Identity:       identity,
+		Default:        index == 0 || len(identities) == 0,
 		Mailboxes:      mailboxes,
-		Subscriptions:  Subscriptions(settings.Subscriptions),
-		Regions:        regions,
-		Timezones:      timezones,
 	})
 }
+
+func handleDeleteIdentity(ctx *alps.Context) error {
+	identities, err := LoadIdentities(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load identities: %v", err)
+	}
+
+	address, err := url.PathUnescape(ctx.Param("address"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	index := identities.index(address)
+	if index < 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "no such identity")
+	}
+
+	identities = append(identities[:index], identities[index+1:]...)
+	if err := saveIdentities(ctx, identities); err != nil {
+		return fmt.Errorf("failed to save identities: %v", err)
+	}
+	return ctx.Redirect(http.StatusFound, "/settings/identities")
+}
+
+type PGPKeysRenderData struct {
+	alps.BaseRenderData
+	// Key pair of the user, if set up
+	Key        *PGPKeyInfo
+	Contacts   []PGPKeyInfo
+	Identities Identities
+}
+
+func handlePGPKeys(ctx *alps.Context) error {
+	keys, err := loadPGPKeys(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load OpenPGP keys: %v", err)
+	}
+	identities, err := LoadIdentities(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load identities: %v", err)
+	}
+
+	data := &PGPKeysRenderData{
+		BaseRenderData: *alps.NewBaseRenderData(ctx),
+		Identities:     identities,
+	}
+	if keys.HasPrivateKey() {
+		e, err := keys.Public()
+		if err != nil {
+			return err
+		}
+		info := newPGPKeyInfo("", e)
+		data.Key = &info
+	}
+
+	addrs := make([]string, 0, len(keys.Contacts))
+	for addr := range keys.Contacts {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		e, err := readArmoredPublicKey(keys.Contacts[addr])
+		if err != nil {
+			return err
+		}
+		data.Contacts = append(data.Contacts, newPGPKeyInfo(addr, e))
+	}
+
+	return ctx.Render(http.StatusOK, "pgp.html", data)
+}
+
+func handleGeneratePGPKey(ctx *alps.Context) error {
+	identities, err := LoadIdentities(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load identities: %v", err)
+	}
+	identity := identities.Find(ctx.FormValue("address"))
+	if identity == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "no such identity")
+	}
+
+	passphrase := ctx.FormValue("passphrase")
+	if passphrase == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "a passphrase is required")
+	} else if passphrase != ctx.FormValue("passphrase_confirm") {
+		return echo.NewHTTPError(http.StatusBadRequest, "passphrases don't match")
+	}
+
+	e, err := generatePGPKey(identity)
+	if err != nil {
+		return err
+	}
+
+	keys, err := loadPGPKeys(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load OpenPGP keys: %v", err)
+	}
+	if err := keys.SetPrivateKey(e, passphrase); err != nil {
+		return err
+	}
+	if err := savePGPKeys(ctx.Session.Store(), keys); err != nil {
+		return fmt.Errorf("failed to save OpenPGP keys: %v", err)
+	}
+
+	ctx.Session.PutNotice("OpenPGP key generated.")
+	return ctx.Redirect(http.StatusFound, "/settings/pgp")
+}
+
+func handleImportPGPKey(ctx *alps.Context) error {
+	e, err := readArmoredPrivateKey(ctx.FormValue("key"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	passphrase := ctx.FormValue("passphrase")
+	if passphrase == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "a passphrase is required")
+	}
+
+	keys, err := loadPGPKeys(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load OpenPGP keys: %v", err)
+	}
+	if err := keys.SetPrivateKey(e, passphrase); err == errWrongPassphrase {
+		return echo.NewHTTPError(http.StatusBadRequest, "wrong passphrase for the private key")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	if err := savePGPKeys(ctx.Session.Store(), keys); err != nil {
+		return fmt.Errorf("failed to save OpenPGP keys: %v", err)
+	}
+
+	ctx.Session.PutNotice("OpenPGP key imported.")
+	return ctx.Redirect(http.StatusFound, "/settings/pgp")
+}
+
+func handleDeletePGPKey(ctx *alps.Context) error {
+	keys, err := loadPGPKeys(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load OpenPGP keys: %v", err)
+	}
+	keys.PrivateKey = nil
+	keys.PublicKey = ""
+	if err := savePGPKeys(ctx.Session.Store(), keys); err != nil {
+		return fmt.Errorf("failed to save OpenPGP keys: %v", err)
+	}
+	return ctx.Redirect(http.StatusFound, "/settings/pgp")
+}
+
+func handleExportPGPKey(ctx *alps.Context) error {
+	keys, err := loadPGPKeys(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load OpenPGP keys: %v", err)
+	}
+	if !keys.HasPrivateKey() {
+		return echo.NewHTTPError(http.StatusNotFound, "no OpenPGP key is set up")
+	}
+
+	disp := mime.FormatMediaType("attachment", map[string]string{"filename": "public.asc"})
+	ctx.Response().Header().Set("Content-Disposition", disp)
+	return ctx.Blob(http.StatusOK, "application/pgp-keys", []byte(keys.PublicKey))
+}
+
+func handleImportPGPContact(ctx *alps.Context) error {
+	keys, err := loadPGPKeys(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load OpenPGP keys: %v", err)
+	}
+	addrs, err := keys.AddContact(ctx.FormValue("key"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	if err := savePGPKeys(ctx.Session.Store(), keys); err != nil {
+		return fmt.Errorf("failed to save OpenPGP keys: %v", err)
+	}
+
+	ctx.Session.PutNotice(fmt.Sprintf("Public key imported for %v.", strings.Join(addrs, ", ")))
+	return ctx.Redirect(http.StatusFound, "/settings/pgp")
+}
+
+func handleDeletePGPContact(ctx *alps.Context) error {
+	address, err := url.PathUnescape(ctx.Param("address"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	keys, err := loadPGPKeys(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load OpenPGP keys: %v", err)
+	}
+	address = strings.ToLower(address)
+	if _, ok := keys.Contacts[address]; !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "no such public key")
+	}
+	delete(keys.Contacts, address)
+	if err := savePGPKeys(ctx.Session.Store(), keys); err != nil {
+		return fmt.Errorf("failed to save OpenPGP keys: %v", err)
+	}
+	return ctx.Redirect(http.StatusFound, "/settings/pgp")
+}
+
+type SMIMERenderData struct {
+	alps.BaseRenderData
+	// Certificate of the user, if uploaded
+	Certificate *SMIMECertInfo
+	// Certificates of the issuers of the user's certificate
+	Issuers []*SMIMECertInfo
+}
+
+func handleSMIMECertificate(ctx *alps.Context) error {
+	keys, err := loadSMIMEKeys(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load S/MIME certificate: %v", err)
+	}
+
+	data := &SMIMERenderData{
+		BaseRenderData: *alps.NewBaseRenderData(ctx),
+	}
+	if keys.HasCertificate() {
+		chain, err := keys.Chain()
+		if err != nil {
+			return err
+		}
+		data.Certificate = newSMIMECertInfo(chain[0])
+		for _, cert := range chain[1:] {
+			data.Issuers = append(data.Issuers, newSMIMECertInfo(cert))
+		}
+	}
+
+	return ctx.Render(http.StatusOK, "smime.html", data)
+}
+
+func handleImportSMIMECertificate(ctx *alps.Context) error {
+	fh, err := ctx.FormFile("certificate")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "a certificate file is required")
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open uploaded certificate: %v", err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("failed to read uploaded certificate: %v", err)
+	}
+
+	passphrase := ctx.FormValue("passphrase")
+	if passphrase == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "a passphrase is required")
+	}
+	chain, key, err := readSMIMECertificate(b, passphrase)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	keys, err := loadSMIMEKeys(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load S/MIME certificate: %v", err)
+	}
+	if err := keys.SetCertificate(chain, key, passphrase); err != nil {
+		return err
+	}
+	if err := saveSMIMEKeys(ctx.Session.Store(), keys); err != nil {
+		return fmt.Errorf("failed to save S/MIME certificate: %v", err)
+	}
+
+	ctx.Session.PutNotice("S/MIME certificate imported.")
+	return ctx.Redirect(http.StatusFound, "/settings/smime")
+}
+
+func handleDeleteSMIMECertificate(ctx *alps.Context) error {
+	if err := saveSMIMEKeys(ctx.Session.Store(), new(SMIMEKeys)); err != nil {
+		return fmt.Errorf("failed to save S/MIME certificate: %v", err)
+	}
+	return ctx.Redirect(http.StatusFound, "/settings/smime")
+}
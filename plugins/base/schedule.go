@@ -0,0 +1,291 @@
+package alpsbase
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"git.sr.ht/~migadu/alps"
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	scheduledSendJob = "base.send"
+	// Messages waiting for the undo send delay to expire
+	outboxSendJob = "base.outbox"
+)
+
+// scheduledKeyword is set on drafts which are scheduled to be sent.
+const scheduledKeyword = "$Scheduled"
+
+// ScheduledSend is the data of a scheduled send job. The message itself is
+// kept in the Drafts mailbox.
+type ScheduledSend struct {
+	MessageID string
+	Subject   string
+	To        []string
+	InReplyTo *messagePath `json:",omitempty"`
+	// Mailbox where the message is saved once sent, the Sent mailbox if
+	// empty
+	Sent string `json:",omitempty"`
+}
+
+// ScheduledMessage is a message waiting to be sent.
+type ScheduledMessage struct {
+	alps.ScheduledJob
+	ScheduledSend
+}
+
+func listScheduledMessages(s *alps.Session, kind string) []ScheduledMessage {
+	var l []ScheduledMessage
+	for _, job := range s.ScheduledJobs() {
+		if job.Kind != kind {
+			continue
+		}
+		msg := ScheduledMessage{ScheduledJob: job}
+		if err := json.Unmarshal([]byte(job.Data), &msg.ScheduledSend); err != nil {
+			continue
+		}
+		l = append(l, msg)
+	}
+	return l
+}
+
+func findScheduledMessage(s *alps.Session, kind, messageID string) *ScheduledMessage {
+	for _, msg := range listScheduledMessages(s, kind) {
+		if msg.MessageID == messageID {
+			return &msg
+		}
+	}
+	return nil
+}
+
+func scheduleSend(s *alps.Session, t time.Time, data *ScheduledSend) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = s.ScheduleJob(scheduledSendJob, t, string(b))
+	return err
+}
+
+func delaySend(s *alps.Session, d time.Duration, data *ScheduledSend) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = s.DelayJob(outboxSendJob, d, string(b))
+	return err
+}
+
+// searchScheduledDraft returns the UID of the scheduled draft with the
+// provided Message-Id, or zero if there is none.
+func searchScheduledDraft(c *imapclient.Client, mboxName, messageID string) (uint32, error) {
+	if err := ensureMailboxSelected(c, mboxName); err != nil {
+		return 0, err
+	}
+
+	criteria := &imap.SearchCriteria{
+		Header:    map[string][]string{"Message-Id": {messageID}},
+		WithFlags: []string{scheduledKeyword},
+	}
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return 0, err
+	}
+	if len(uids) == 0 {
+		return 0, nil
+	}
+	return uids[0], nil
+}
+
+func setScheduledFlag(c *imapclient.Client, mboxName string, uid uint32, scheduled bool) error {
+	if err := ensureMailboxSelected(c, mboxName); err != nil {
+		return err
+	}
+
+	var op imap.FlagsOp = imap.AddFlags
+	if !scheduled {
+		op = imap.RemoveFlags
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+	item := imap.FormatFlagsOp(op, true)
+	flags := []interface{}{scheduledKeyword}
+	return c.UidStore(seqSet, item, flags, nil)
+}
+
+func fetchRawMessage(c *imapclient.Client, mboxName string, uid uint32) ([]byte, error) {
+	if err := ensureMailboxSelected(c, mboxName); err != nil {
+		return nil, err
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+
+	section := &imap.BodySectionName{Peek: true}
+	fetch := []imap.FetchItem{section.FetchItem()}
+
+	ch := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqSet, fetch, ch)
+	}()
+
+	msg := <-ch
+	if msg == nil {
+		return nil, fmt.Errorf("server didn't return message")
+	}
+	for range ch {
+	}
+
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to fetch message: %v", err)
+	}
+
+	body := msg.GetBody(section)
+	if body == nil {
+		return nil, fmt.Errorf("server didn't return message body")
+	}
+	return ioutil.ReadAll(body)
+}
+
+// sendRawMessage sends a message as-is, except for the Bcc header field which
+// is stripped.
+func sendRawMessage(c *smtp.Client, h mail.Header, body []byte) error {
+	from, err := h.AddressList("From")
+	if err != nil || len(from) == 0 {
+		return fmt.Errorf("invalid From header field: %v", err)
+	}
+	if err := c.Mail(from[0].Address, nil); err != nil {
+		return fmt.Errorf("MAIL FROM failed: %v", err)
+	}
+
+	for _, k := range []string{"To", "Cc", "Bcc"} {
+		rcpts, err := h.AddressList(k)
+		if err != nil {
+			return fmt.Errorf("invalid %v header field: %v", k, err)
+		}
+		for _, rcpt := range rcpts {
+			if err := c.Rcpt(rcpt.Address); err != nil {
+				return fmt.Errorf("RCPT TO failed: %v (%s)", err, rcpt.Address)
+			}
+		}
+	}
+
+	stripped := h.Copy()
+	stripped.Del("Bcc")
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("DATA failed: %v", err)
+	}
+	if err := textproto.WriteHeader(w, stripped.Header.Header); err != nil {
+		return fmt.Errorf("failed to write outgoing message: %v", err)
+	}
+	if _, err := w.Write(body); err != nil {
+		return fmt.Errorf("failed to write outgoing message: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to close SMTP data writer: %v", err)
+	}
+
+	return nil
+}
+
+// sendScheduledMessage is the handler of scheduled and delayed send jobs. It
+// sends the scheduled draft, then moves it to the Sent mailbox.
+func sendScheduledMessage(s *alps.Session, job *alps.ScheduledJob) error {
+	var data ScheduledSend
+	if err := json.Unmarshal([]byte(job.Data), &data); err != nil {
+		return fmt.Errorf("invalid scheduled send data: %v", err)
+	}
+
+	var drafts *MailboxInfo
+	var uid uint32
+	var raw []byte
+	err := s.DoIMAPIdempotent(func(c *imapclient.Client) error {
+		var err error
+		if drafts, err = getMailboxByType(c, mailboxDrafts); err != nil {
+			return err
+		} else if drafts == nil {
+			return fmt.Errorf("Unable to resolve mailbox")
+		}
+
+		if uid, err = searchScheduledDraft(c, drafts.Name, data.MessageID); err != nil {
+			return err
+		} else if uid == 0 {
+			return fmt.Errorf("scheduled draft %v not found", data.MessageID)
+		}
+
+		raw, err = fetchRawMessage(c, drafts.Name, uid)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(bytes.NewReader(raw))
+	th, err := textproto.ReadHeader(br)
+	if err != nil {
+		return fmt.Errorf("failed to parse scheduled draft: %v", err)
+	}
+	body, err := ioutil.ReadAll(br)
+	if err != nil {
+		return err
+	}
+
+	h := mail.Header{message.Header{th}}
+	h.SetDate(time.Now())
+
+	err = s.DoSMTP(func(c *smtp.Client) error {
+		return sendRawMessage(c, h, body)
+	})
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, h.Header.Header); err != nil {
+		return err
+	}
+	buf.Write(body)
+
+	err = s.DoIMAP(func(c *imapclient.Client) error {
+		sentName := data.Sent
+		if sentName == "" {
+			sent, err := getMailboxByType(c, mailboxSent)
+			if err != nil {
+				return err
+			} else if sent == nil {
+				return fmt.Errorf("Unable to resolve mailbox")
+			}
+			sentName = sent.Name
+		}
+		if err := c.Append(sentName, []string{imap.SeenFlag}, time.Now(), &buf); err != nil {
+			return err
+		}
+
+		if inReplyTo := data.InReplyTo; inReplyTo != nil {
+			if err := markMessageAnswered(c, inReplyTo.Mailbox, inReplyTo.Uid); err != nil {
+				return err
+			}
+		}
+
+		return deleteMessage(c, drafts.Name, uid)
+	})
+	if err != nil {
+		// The message has been sent, retrying would send it again
+		return alps.JobWarning{Err: fmt.Errorf("message %v sent, but failed to move it to the Sent mailbox: %v", data.MessageID, err)}
+	}
+	return nil
+}
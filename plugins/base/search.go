@@ -1,11 +1,14 @@
 package alpsbase
 
 import (
-	"bufio"
-	"bytes"
+	"fmt"
 	"net/textproto"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
+	"github.com/dustin/go-humanize"
 	"github.com/emersion/go-imap"
 )
 
@@ -53,110 +56,410 @@ func searchCriteriaAnd(criteria ...*imap.SearchCriteria) *imap.SearchCriteria {
 		and.Text = append(and.Text, c.Text...)
 		and.WithFlags = append(and.WithFlags, c.WithFlags...)
 		and.WithoutFlags = append(and.WithoutFlags, c.WithoutFlags...)
-		// TODO: Merge more things
+		and.Not = append(and.Not, c.Not...)
+		and.Or = append(and.Or, c.Or...)
+
+		// Keep the narrowest ranges
+		if c.Since.After(and.Since) {
+			and.Since = c.Since
+		}
+		if !c.Before.IsZero() && (and.Before.IsZero() || c.Before.Before(and.Before)) {
+			and.Before = c.Before
+		}
+		if c.SentSince.After(and.SentSince) {
+			and.SentSince = c.SentSince
+		}
+		if !c.SentBefore.IsZero() && (and.SentBefore.IsZero() || c.SentBefore.Before(and.SentBefore)) {
+			and.SentBefore = c.SentBefore
+		}
+		if c.Larger > and.Larger {
+			and.Larger = c.Larger
+		}
+		if c.Smaller != 0 && (and.Smaller == 0 || c.Smaller < and.Smaller) {
+			and.Smaller = c.Smaller
+		}
 	}
 	return and
 }
 
-// Splits search up into the longest string of non-functional parts and
-// functional parts
-//
-// Input: hello world foo:bar baz trains:"are cool"
-// Output: ["hello world", "foo:bar", "baz", "trains:are cool"]
-func splitSearchTokens(buf []byte, eof bool) (int, []byte, error) {
-	if len(buf) == 0 {
-		return 0, nil, nil
-	}
-
-	if buf[0] == ' ' {
-		return 1, nil, nil
-	}
-
-	colon := bytes.IndexByte(buf, byte(':'))
-	if colon == -1 && eof {
-		return len(buf), buf, nil
-	} else if colon == -1 {
-		return 0, nil, nil
-	} else {
-		space := bytes.LastIndexByte(buf[:colon], byte(' '))
-		if space != -1 {
-			return space, buf[:space], nil
-		}
-
-		var (
-			terminator int
-			quoted     bool
-		)
-		if colon+1 < len(buf) && buf[colon+1] == byte('"') {
-			terminator = bytes.IndexByte(buf[colon+2:], byte('"'))
-			terminator += colon + 3
-			quoted = true
-		} else {
-			terminator = bytes.IndexByte(buf[colon:], byte(' '))
-			terminator += colon
+// searchOperators maps the keys of "key:value" search terms to functions
+// building the matching criteria.
+var searchOperators = map[string]func(value string, now time.Time) (*imap.SearchCriteria, error){
+	"from":    searchHeaderOperator("From"),
+	"to":      searchHeaderOperator("To"),
+	"cc":      searchHeaderOperator("Cc"),
+	"bcc":     searchHeaderOperator("Bcc"),
+	"subject": searchHeaderOperator("Subject"),
+	"body": func(value string, now time.Time) (*imap.SearchCriteria, error) {
+		return &imap.SearchCriteria{Body: []string{value}}, nil
+	},
+	"text": func(value string, now time.Time) (*imap.SearchCriteria, error) {
+		return &imap.SearchCriteria{Text: []string{value}}, nil
+	},
+	"before": func(value string, now time.Time) (*imap.SearchCriteria, error) {
+		t, err := parseSearchDate(value, now)
+		if err != nil {
+			return nil, err
+		}
+		return &imap.SearchCriteria{SentBefore: t}, nil
+	},
+	"after": func(value string, now time.Time) (*imap.SearchCriteria, error) {
+		t, err := parseSearchDate(value, now)
+		if err != nil {
+			return nil, err
+		}
+		return &imap.SearchCriteria{SentSince: t}, nil
+	},
+	"on": func(value string, now time.Time) (*imap.SearchCriteria, error) {
+		t, err := parseSearchDate(value, now)
+		if err != nil {
+			return nil, err
+		}
+		return &imap.SearchCriteria{SentSince: t, SentBefore: t.AddDate(0, 0, 1)}, nil
+	},
+	"is": func(value string, now time.Time) (*imap.SearchCriteria, error) {
+		f, ok := searchFlags[strings.ToLower(value)]
+		if !ok {
+			return nil, fmt.Errorf("unknown state %q", value)
 		}
+		if f.set {
+			return &imap.SearchCriteria{WithFlags: []string{f.flag}}, nil
+		}
+		return &imap.SearchCriteria{WithoutFlags: []string{f.flag}}, nil
+	},
+	"has": func(value string, now time.Time) (*imap.SearchCriteria, error) {
+		switch strings.ToLower(value) {
+		case "attachment", "attachments":
+			// IMAP can't search for attachments, mixed multipart messages
+			// are a good approximation
+			return searchCriteriaHeader("Content-Type", "multipart/mixed"), nil
+		}
+		return nil, fmt.Errorf("unknown attribute %q", value)
+	},
+	"larger": func(value string, now time.Time) (*imap.SearchCriteria, error) {
+		n, err := parseSearchSize(value)
+		if err != nil {
+			return nil, err
+		}
+		return &imap.SearchCriteria{Larger: n}, nil
+	},
+	"smaller": func(value string, now time.Time) (*imap.SearchCriteria, error) {
+		n, err := parseSearchSize(value)
+		if err != nil {
+			return nil, err
+		}
+		return &imap.SearchCriteria{Smaller: n}, nil
+	},
+	"keyword": func(value string, now time.Time) (*imap.SearchCriteria, error) {
+		if strings.ContainsAny(value, ` (){%*"\]`) {
+			return nil, fmt.Errorf("invalid keyword %q", value)
+		}
+		return &imap.SearchCriteria{WithFlags: []string{value}}, nil
+	},
+}
+
+func searchHeaderOperator(k string) func(value string, now time.Time) (*imap.SearchCriteria, error) {
+	return func(value string, now time.Time) (*imap.SearchCriteria, error) {
+		return searchCriteriaHeader(k, value), nil
+	}
+}
+
+// searchFlags lists the values of the "is" search operator.
+var searchFlags = map[string]struct {
+	flag string
+	set  bool
+}{
+	"unread":     {imap.SeenFlag, false},
+	"read":       {imap.SeenFlag, true},
+	"flagged":    {imap.FlaggedFlag, true},
+	"starred":    {imap.FlaggedFlag, true},
+	"unflagged":  {imap.FlaggedFlag, false},
+	"answered":   {imap.AnsweredFlag, true},
+	"replied":    {imap.AnsweredFlag, true},
+	"unanswered": {imap.AnsweredFlag, false},
+	"draft":      {imap.DraftFlag, true},
+	"forwarded":  {"$Forwarded", true},
+}
 
-		if terminator == -1 {
-			return 0, nil, nil
-		} else if terminator == -1 && eof {
-			terminator = len(buf)
+var searchDateLayouts = []string{"2006-01-02", "2006/01/02"}
+
+// parseSearchDate parses an absolute date or a date relative to now: "today",
+// "yesterday", or a number of days, weeks, months or years ago such as "3d"
+// or "2w". Relative dates are resolved in the time zone of now.
+func parseSearchDate(s string, now time.Time) (time.Time, error) {
+	// IMAP search dates have no time zone, only the day matters
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch strings.ToLower(s) {
+	case "today":
+		return today, nil
+	case "yesterday":
+		return today.AddDate(0, 0, -1), nil
+	}
+
+	for _, layout := range searchDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
 		}
+	}
 
-		if quoted {
-			trimmed := append(buf[:colon+1], buf[colon+2:terminator-1]...)
-			return terminator, trimmed, nil
+	if len(s) >= 2 {
+		if n, err := strconv.Atoi(s[:len(s)-1]); err == nil && n >= 0 {
+			switch unicode.ToLower(rune(s[len(s)-1])) {
+			case 'd':
+				return today.AddDate(0, 0, -n), nil
+			case 'w':
+				return today.AddDate(0, 0, -7*n), nil
+			case 'm':
+				return today.AddDate(0, -n, 0), nil
+			case 'y':
+				return today.AddDate(-n, 0, 0), nil
+			}
 		}
+	}
 
-		return terminator, buf[:terminator], nil
+	return time.Time{}, fmt.Errorf("invalid date %q", s)
+}
+
+func parseSearchSize(s string) (uint32, error) {
+	n, err := humanize.ParseBytes(s)
+	if err != nil || n > 1<<32-1 {
+		return 0, fmt.Errorf("invalid size %q", s)
 	}
+	return uint32(n), nil
 }
 
-// TODO: Document search functionality somewhere
-func PrepareSearch(terms string) *imap.SearchCriteria {
-	// XXX: If Migadu's IMAP servers can learn a better Full-Text Search then
-	// we can probably start matching on the message bodies by default (gated
-	// behind some kind of flag, perhaps)
-	var criteria *imap.SearchCriteria
+type searchTokenKind int
 
-	scanner := bufio.NewScanner(strings.NewReader(terms))
-	scanner.Split(splitSearchTokens)
-
-	for scanner.Scan() {
-		term := scanner.Text()
-		if !strings.ContainsRune(term, ':') {
-			criteria = searchCriteriaAnd(
-				criteria,
-				searchCriteriaOr(
-					searchCriteriaHeader("From", term),
-					searchCriteriaHeader("To", term),
-					searchCriteriaHeader("Cc", term),
-					searchCriteriaHeader("Subject", term),
-				),
-			)
+const (
+	searchTokenTerm searchTokenKind = iota
+	searchTokenOr
+	searchTokenNot
+	searchTokenOpen
+	searchTokenClose
+)
+
+type searchToken struct {
+	kind searchTokenKind
+	// For terms, the key is empty for free text
+	key, value string
+}
+
+// tokenizeSearch splits a search query into tokens. Terms are either free
+// text or "key:value" pairs, and both may be quoted to include spaces and
+// parentheses.
+func tokenizeSearch(s string) ([]searchToken, error) {
+	var tokens []searchToken
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if s == "" {
+			return tokens, nil
+		}
+
+		switch s[0] {
+		case '(':
+			tokens = append(tokens, searchToken{kind: searchTokenOpen})
+			s = s[1:]
+			continue
+		case ')':
+			tokens = append(tokens, searchToken{kind: searchTokenClose})
+			s = s[1:]
+			continue
+		case '-':
+			tokens = append(tokens, searchToken{kind: searchTokenNot})
+			s = s[1:]
+			continue
+		}
+
+		// Text before a colon which isn't an operator, e.g. "Re:" or
+		// "https:", is part of the value
+		var key, prefix string
+		if i := strings.IndexAny(s, ` ()":`); i > 0 && s[i] == ':' {
+			if _, ok := searchOperators[strings.ToLower(s[:i])]; ok {
+				key = strings.ToLower(s[:i])
+			} else {
+				prefix = s[:i+1]
+			}
+			s = s[i+1:]
+		}
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			value = s[1 : end+1]
+			s = s[end+2:]
 		} else {
-			parts := strings.SplitN(term, ":", 2)
-			key, value := parts[0], parts[1]
-			switch strings.ToLower(key) {
-			case "from":
-				criteria = searchCriteriaAnd(
-					criteria, searchCriteriaHeader("From", value))
-			case "to":
-				criteria = searchCriteriaAnd(
-					criteria, searchCriteriaHeader("To", value))
-			case "cc":
-				criteria = searchCriteriaAnd(
-					criteria, searchCriteriaHeader("Cc", value))
-			case "subject":
-				criteria = searchCriteriaAnd(
-					criteria, searchCriteriaHeader("Subject", value))
-			case "body":
-				criteria = searchCriteriaAnd(
-					criteria, &imap.SearchCriteria{Body: []string{value}})
-			default:
+			end := strings.IndexFunc(s, func(r rune) bool {
+				return unicode.IsSpace(r) || r == '(' || r == ')'
+			})
+			if end < 0 {
+				end = len(s)
+			}
+			value = s[:end]
+			s = s[end:]
+
+			if key == "" && prefix == "" && value == "OR" {
+				tokens = append(tokens, searchToken{kind: searchTokenOr})
 				continue
 			}
 		}
+
+		value = prefix + value
+		if value == "" {
+			return nil, fmt.Errorf("missing value for %q", key+":")
+		}
+		tokens = append(tokens, searchToken{
+			kind:  searchTokenTerm,
+			key:   key,
+			value: value,
+		})
+	}
+}
+
+// searchParser is a recursive descent parser for the following grammar:
+//
+//	query = and
+//	and   = or *or
+//	or    = not *("OR" not)
+//	not   = "-" not / "(" and ")" / term
+type searchParser struct {
+	tokens []searchToken
+	now    time.Time
+	// Number of open parentheses
+	depth int
+}
+
+func (p *searchParser) peek() *searchToken {
+	if len(p.tokens) == 0 {
+		return nil
+	}
+	return &p.tokens[0]
+}
+
+func (p *searchParser) next() *searchToken {
+	tok := p.peek()
+	if tok != nil {
+		p.tokens = p.tokens[1:]
 	}
+	return tok
+}
 
-	return criteria
+func (p *searchParser) parseAnd() (*imap.SearchCriteria, error) {
+	var criteria *imap.SearchCriteria
+	for {
+		if tok := p.peek(); tok == nil || tok.kind == searchTokenClose {
+			break
+		}
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		criteria = searchCriteriaAnd(criteria, c)
+	}
+	if criteria == nil && p.depth == 0 && p.peek() != nil {
+		return nil, fmt.Errorf("unexpected closing parenthesis")
+	} else if criteria == nil {
+		return nil, fmt.Errorf("empty expression")
+	}
+	return criteria, nil
+}
+
+func (p *searchParser) parseOr() (*imap.SearchCriteria, error) {
+	criteria, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if tok := p.peek(); tok == nil || tok.kind != searchTokenOr {
+			return criteria, nil
+		}
+		p.next()
+		c, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		criteria = searchCriteriaOr(criteria, c)
+	}
+}
+
+func (p *searchParser) parseNot() (*imap.SearchCriteria, error) {
+	tok := p.next()
+	if tok == nil {
+		return nil, fmt.Errorf("unexpected end of query")
+	}
+
+	switch tok.kind {
+	case searchTokenNot:
+		c, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &imap.SearchCriteria{Not: []*imap.SearchCriteria{c}}, nil
+	case searchTokenOpen:
+		p.depth++
+		c, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		p.depth--
+		if tok := p.next(); tok == nil || tok.kind != searchTokenClose {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return c, nil
+	case searchTokenTerm:
+		return p.parseTerm(tok)
+	case searchTokenOr:
+		return nil, fmt.Errorf("unexpected OR")
+	default:
+		return nil, fmt.Errorf("unexpected closing parenthesis")
+	}
+}
+
+func (p *searchParser) parseTerm(tok *searchToken) (*imap.SearchCriteria, error) {
+	if tok.key == "" {
+		// XXX: If Migadu's IMAP servers can learn a better Full-Text Search
+		// then we can probably start matching on the message bodies by
+		// default (gated behind some kind of flag, perhaps)
+		return searchCriteriaOr(
+			searchCriteriaHeader("From", tok.value),
+			searchCriteriaHeader("To", tok.value),
+			searchCriteriaHeader("Cc", tok.value),
+			searchCriteriaHeader("Subject", tok.value),
+		), nil
+	}
+
+	c, err := searchOperators[tok.key](tok.value, p.now)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", tok.key, err)
+	}
+	return c, nil
+}
+
+// PrepareSearch parses a search query into IMAP search criteria. A nil
+// criteria is returned for empty queries. Relative dates are resolved in the
+// specified time zone. The query language is described in docs/search.md.
+func PrepareSearch(terms string, loc *time.Location) (*imap.SearchCriteria, error) {
+	return prepareSearch(terms, time.Now().In(loc))
+}
+
+func prepareSearch(terms string, now time.Time) (*imap.SearchCriteria, error) {
+	tokens, err := tokenizeSearch(terms)
+	if err != nil {
+		return nil, fmt.Errorf("invalid search query: %v", err)
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	p := searchParser{tokens: tokens, now: now}
+	criteria, err := p.parseAnd()
+	if err == nil && len(p.tokens) > 0 {
+		err = fmt.Errorf("unexpected closing parenthesis")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid search query: %v", err)
+	}
+	return criteria, nil
 }
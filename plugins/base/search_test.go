@@ -0,0 +1,204 @@
+package alpsbase
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func searchText(value string) *imap.SearchCriteria {
+	return searchCriteriaOr(
+		searchCriteriaHeader("From", value),
+		searchCriteriaHeader("To", value),
+		searchCriteriaHeader("Cc", value),
+		searchCriteriaHeader("Subject", value),
+	)
+}
+
+func searchDate(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestPrepareSearch(t *testing.T) {
+	// Late in the evening in UTC, but already the next day for the user
+	now := time.Date(2024, time.March, 9, 23, 30, 0, 0, time.UTC).
+		In(time.FixedZone("UTC+2", 2*60*60))
+
+	tests := []struct {
+		query string
+		want  *imap.SearchCriteria
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"alice", searchText("alice")},
+		{`"quarterly report"`, searchText("quarterly report")},
+		{"from:alice", searchCriteriaHeader("From", "alice")},
+		{"FROM:alice", searchCriteriaHeader("From", "alice")},
+		{`from:"Alice Smith"`, searchCriteriaHeader("From", "Alice Smith")},
+		{"to:bob", searchCriteriaHeader("To", "bob")},
+		{"cc:carol", searchCriteriaHeader("Cc", "carol")},
+		{"bcc:dave", searchCriteriaHeader("Bcc", "dave")},
+		{`subject:"(report)"`, searchCriteriaHeader("Subject", "(report)")},
+		{"body:invoice", &imap.SearchCriteria{Body: []string{"invoice"}}},
+		{"text:invoice", &imap.SearchCriteria{Text: []string{"invoice"}}},
+		{"from:alice subject:lunch", &imap.SearchCriteria{Header: map[string][]string{
+			"From":    {"alice"},
+			"Subject": {"lunch"},
+		}}},
+		{"subject:a subject:b", &imap.SearchCriteria{Header: map[string][]string{
+			"Subject": {"a", "b"},
+		}}},
+
+		// Flags and attributes
+		{"is:unread", &imap.SearchCriteria{WithoutFlags: []string{imap.SeenFlag}}},
+		{"is:read", &imap.SearchCriteria{WithFlags: []string{imap.SeenFlag}}},
+		{"is:starred", &imap.SearchCriteria{WithFlags: []string{imap.FlaggedFlag}}},
+		{"is:Forwarded", &imap.SearchCriteria{WithFlags: []string{"$Forwarded"}}},
+		{"has:attachment", searchCriteriaHeader("Content-Type", "multipart/mixed")},
+		{"keyword:$label1", &imap.SearchCriteria{WithFlags: []string{"$label1"}}},
+		{"larger:10kB", &imap.SearchCriteria{Larger: 10000}},
+		{"smaller:2MiB", &imap.SearchCriteria{Smaller: 2 << 20}},
+		{"larger:1kB larger:5kB smaller:9kB smaller:7kB", &imap.SearchCriteria{Larger: 5000, Smaller: 7000}},
+
+		// Dates
+		{"before:2024-03-01", &imap.SearchCriteria{SentBefore: searchDate(2024, time.March, 1)}},
+		{"after:2024/03/01", &imap.SearchCriteria{SentSince: searchDate(2024, time.March, 1)}},
+		{"on:2024-02-29", &imap.SearchCriteria{
+			SentSince:  searchDate(2024, time.February, 29),
+			SentBefore: searchDate(2024, time.March, 1),
+		}},
+		{"after:today", &imap.SearchCriteria{SentSince: searchDate(2024, time.March, 10)}},
+		{"on:yesterday", &imap.SearchCriteria{
+			SentSince:  searchDate(2024, time.March, 9),
+			SentBefore: searchDate(2024, time.March, 10),
+		}},
+		{"after:3d", &imap.SearchCriteria{SentSince: searchDate(2024, time.March, 7)}},
+		{"after:2W", &imap.SearchCriteria{SentSince: searchDate(2024, time.February, 25)}},
+		{"before:6m", &imap.SearchCriteria{SentBefore: searchDate(2023, time.September, 10)}},
+		{"before:1y", &imap.SearchCriteria{SentBefore: searchDate(2023, time.March, 10)}},
+		{"after:2024-01-01 after:2024-02-01 before:2024-03-01 before:2024-04-01", &imap.SearchCriteria{
+			SentSince:  searchDate(2024, time.February, 1),
+			SentBefore: searchDate(2024, time.March, 1),
+		}},
+
+		// Negation, OR and parentheses
+		{"-is:read", &imap.SearchCriteria{Not: []*imap.SearchCriteria{
+			{WithFlags: []string{imap.SeenFlag}},
+		}}},
+		{"--is:read", &imap.SearchCriteria{Not: []*imap.SearchCriteria{
+			{Not: []*imap.SearchCriteria{{WithFlags: []string{imap.SeenFlag}}}},
+		}}},
+		{"from:alice OR from:bob", &imap.SearchCriteria{Or: [][2]*imap.SearchCriteria{{
+			searchCriteriaHeader("From", "alice"),
+			searchCriteriaHeader("From", "bob"),
+		}}}},
+		{"from:a OR from:b OR from:c", &imap.SearchCriteria{Or: [][2]*imap.SearchCriteria{{
+			{Or: [][2]*imap.SearchCriteria{{
+				searchCriteriaHeader("From", "a"),
+				searchCriteriaHeader("From", "b"),
+			}}},
+			searchCriteriaHeader("From", "c"),
+		}}}},
+		{"(from:alice OR from:bob) is:unread", &imap.SearchCriteria{
+			Or: [][2]*imap.SearchCriteria{{
+				searchCriteriaHeader("From", "alice"),
+				searchCriteriaHeader("From", "bob"),
+			}},
+			WithoutFlags: []string{imap.SeenFlag},
+		}},
+		{"-(from:alice OR from:bob)", &imap.SearchCriteria{Not: []*imap.SearchCriteria{
+			{Or: [][2]*imap.SearchCriteria{{
+				searchCriteriaHeader("From", "alice"),
+				searchCriteriaHeader("From", "bob"),
+			}}},
+		}}},
+		{"is:unread (from:alice subject:lunch)", &imap.SearchCriteria{
+			Header: map[string][]string{
+				"From":    {"alice"},
+				"Subject": {"lunch"},
+			},
+			WithoutFlags: []string{imap.SeenFlag},
+		}},
+		{"a or b", searchCriteriaAnd(searchText("a"), searchText("or"), searchText("b"))},
+		{`"OR"`, searchText("OR")},
+
+		// Colons in free text
+		{"Re: invoice", searchCriteriaAnd(searchText("Re:"), searchText("invoice"))},
+		{"https://example.org/a", searchText("https://example.org/a")},
+		{"10:30", searchText("10:30")},
+		{`re:"quarterly report"`, searchText("re:quarterly report")},
+		{"subject:Re:lunch", searchCriteriaHeader("Subject", "Re:lunch")},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			got, err := prepareSearch(tc.query, now)
+			if err != nil {
+				t.Fatalf("prepareSearch() = %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("prepareSearch() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPrepareSearch_errors(t *testing.T) {
+	tests := []struct {
+		query, err string
+	}{
+		{`"unterminated`, "unterminated quote"},
+		{`from:"unterminated`, "unterminated quote"},
+		{"from:", "missing value"},
+		{`from:""`, "missing value"},
+		{"OR", "unexpected OR"},
+		{"from:a OR", "unexpected end of query"},
+		{"OR from:a", "unexpected OR"},
+		{"-", "unexpected end of query"},
+		{"()", "empty expression"},
+		{"(from:a", "missing closing parenthesis"},
+		{"from:a)", "unexpected closing parenthesis"},
+		{")", "unexpected closing parenthesis"},
+		{"is:shiny", "unknown state"},
+		{"has:pictures", "unknown attribute"},
+		{"before:tomorrow", "invalid date"},
+		{"after:-3d", "invalid date"},
+		{"on:2024-13-01", "invalid date"},
+		{"larger:huge", "invalid size"},
+		{"smaller:10TB", "invalid size"},
+		{`keyword:"a b"`, "invalid keyword"},
+	}
+
+	now := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			got, err := prepareSearch(tc.query, now)
+			if err == nil {
+				t.Fatalf("prepareSearch() = %+v, want error", got)
+			}
+			if !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("prepareSearch() = %q, want error containing %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestPrepareSearch_timezone(t *testing.T) {
+	loc, err := time.LoadLocation("Pacific/Kiritimati")
+	if err != nil {
+		t.Skipf("time zone database unavailable: %v", err)
+	}
+
+	criteria, err := PrepareSearch("after:today", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().In(loc)
+	want := searchDate(now.Year(), now.Month(), now.Day())
+	if !criteria.SentSince.Equal(want) {
+		t.Errorf("SentSince = %v, want %v", criteria.SentSince, want)
+	}
+}
@@ -0,0 +1,584 @@
+package alpsbase
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"git.sr.ht/~migadu/alps"
+	"git.sr.ht/~migadu/alps/config"
+	"github.com/emersion/go-message"
+	"go.mozilla.org/pkcs7"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+const smimeKeysKey = "base.smime"
+
+// smimeStatusKey is the context key where viewers store the SMIMEStatus of
+// the message being displayed.
+const smimeStatusKey = "base.smimeStatus"
+
+// SMIMEKeys is the S/MIME certificate of a user.
+type SMIMEKeys struct {
+	// PEM certificate chain of the user, their own certificate first
+	Certificates string
+	// PKCS #8 private key of the user, sealed with their passphrase by
+	// sealPrivateKey
+	PrivateKey []byte
+}
+
+func loadSMIMEKeys(s alps.Store) (*SMIMEKeys, error) {
+	keys := new(SMIMEKeys)
+	if err := s.Get(smimeKeysKey, keys); err != nil && err != alps.ErrNoStoreEntry {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func saveSMIMEKeys(s alps.Store, keys *SMIMEKeys) error {
+	return s.Put(smimeKeysKey, keys)
+}
+
+// HasCertificate checks whether the user has uploaded a certificate.
+func (keys *SMIMEKeys) HasCertificate() bool {
+	return len(keys.PrivateKey) > 0
+}
+
+// Chain returns the certificate chain of the user.
+func (keys *SMIMEKeys) Chain() ([]*x509.Certificate, error) {
+	chain, _, err := readPEMCertificate([]byte(keys.Certificates))
+	if err != nil {
+		return nil, err
+	} else if len(chain) == 0 {
+		return nil, fmt.Errorf("no S/MIME certificate is set up")
+	}
+	return chain, nil
+}
+
+// Unlock returns the private key of the user, ready to sign and decrypt.
+func (keys *SMIMEKeys) Unlock(passphrase string) (crypto.PrivateKey, error) {
+	if !keys.HasCertificate() {
+		return nil, fmt.Errorf("no S/MIME certificate is set up")
+	}
+	b, err := openPrivateKey(keys.PrivateKey, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %v", err)
+	}
+	return key, nil
+}
+
+// SetCertificate replaces the certificate of the user. The private key is
+// sealed with the passphrase.
+func (keys *SMIMEKeys) SetCertificate(chain []*x509.Certificate, key crypto.PrivateKey, passphrase string) error {
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to serialize private key: %v", err)
+	}
+	sealed, err := sealPrivateKey(b, passphrase)
+	if err != nil {
+		return err
+	}
+
+	var certs bytes.Buffer
+	for _, cert := range chain {
+		if err := pem.Encode(&certs, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			return err
+		}
+	}
+
+	keys.Certificates = certs.String()
+	keys.PrivateKey = sealed
+	return nil
+}
+
+// readSMIMECertificate reads a certificate chain and its private key, either
+// PEM-encoded or in a PKCS #12 file protected with the password. The
+// certificate matching the private key comes first in the chain.
+func readSMIMECertificate(b []byte, password string) ([]*x509.Certificate, crypto.PrivateKey, error) {
+	var chain []*x509.Certificate
+	var key crypto.PrivateKey
+	var err error
+	if bytes.Contains(b, []byte("-----BEGIN ")) {
+		chain, key, err = readPEMCertificate(b)
+	} else {
+		var cert *x509.Certificate
+		var caCerts []*x509.Certificate
+		if key, cert, caCerts, err = pkcs12.DecodeChain(b, password); err != nil {
+			return nil, nil, fmt.Errorf("failed to read PKCS #12 file: %v", err)
+		}
+		chain = append([]*x509.Certificate{cert}, caCerts...)
+	}
+	if err != nil {
+		return nil, nil, err
+	} else if key == nil {
+		return nil, nil, fmt.Errorf("no private key found")
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, cert := range chain {
+		if bytes.Equal(cert.RawSubjectPublicKeyInfo, pub) {
+			chain[0], chain[i] = chain[i], chain[0]
+			return chain, key, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("no certificate matches the private key")
+}
+
+// readPEMCertificate reads the certificates and the private key, if any, of
+// PEM blocks.
+func readPEMCertificate(b []byte) ([]*x509.Certificate, crypto.PrivateKey, error) {
+	var chain []*x509.Certificate
+	var key crypto.PrivateKey
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to read certificate: %v", err)
+			}
+			chain = append(chain, cert)
+		case "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY":
+			if x509.IsEncryptedPEMBlock(block) {
+				return nil, nil, fmt.Errorf("encrypted PEM private keys aren't supported")
+			}
+			var err error
+			if key, err = parsePrivateKey(block.Bytes); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if len(chain) == 0 {
+		return nil, nil, fmt.Errorf("no certificate found")
+	}
+	return chain, key, nil
+}
+
+// parsePrivateKey parses a DER private key. PKCS #12 files converted to PEM
+// label PKCS #1 and SEC 1 keys as PKCS #8, so all formats are tried.
+func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		switch key := key.(type) {
+		case *rsa.PrivateKey, *ecdsa.PrivateKey:
+			return key, nil
+		default:
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("failed to read private key")
+}
+
+// SMIMECertInfo describes a certificate.
+type SMIMECertInfo struct {
+	Subject   string
+	Addresses []string
+	Issuer    string
+	NotAfter  time.Time
+	// Hexadecimal SHA-256 fingerprint
+	Fingerprint string
+}
+
+func newSMIMECertInfo(cert *x509.Certificate) *SMIMECertInfo {
+	subject := cert.Subject.CommonName
+	if subject == "" {
+		subject = cert.Subject.String()
+	}
+	issuer := cert.Issuer.CommonName
+	if issuer == "" {
+		issuer = cert.Issuer.String()
+	}
+	sum := sha256.Sum256(cert.Raw)
+	return &SMIMECertInfo{
+		Subject:     subject,
+		Addresses:   certAddresses(cert),
+		Issuer:      issuer,
+		NotAfter:    cert.NotAfter,
+		Fingerprint: fmt.Sprintf("%X", sum[:]),
+	}
+}
+
+// certAddresses returns the email addresses of a certificate. Old
+// certificates store them in the subject instead of the alternative names.
+func certAddresses(cert *x509.Certificate) []string {
+	addrs := cert.EmailAddresses
+	if len(addrs) > 0 {
+		return addrs
+	}
+	for _, name := range cert.Subject.Names {
+		if !name.Type.Equal(oidEmailAddress) {
+			continue
+		}
+		if s, ok := name.Value.(string); ok {
+			addrs = append(addrs, s)
+		}
+	}
+	return addrs
+}
+
+var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+func certHasAddress(cert *x509.Certificate, address string) bool {
+	for _, addr := range certAddresses(cert) {
+		if strings.EqualFold(addr, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadSMIMETrustStore returns the authorities trusted to issue certificates.
+func loadSMIMETrustStore(cfg *config.SMIMEConfig) (*x509.CertPool, error) {
+	if cfg.TrustStore == "" {
+		return x509.SystemCertPool()
+	}
+	b, err := ioutil.ReadFile(cfg.TrustStore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read S/MIME trust store: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificate found in S/MIME trust store %q", cfg.TrustStore)
+	}
+	return pool, nil
+}
+
+// senderAddress returns the address of the first sender of a message.
+func senderAddress(msg *IMAPMessage) string {
+	if len(msg.Envelope.From) == 0 {
+		return ""
+	}
+	return msg.Envelope.From[0].Address()
+}
+
+// prepareSMIME unlocks the key needed to sign the message when it's written.
+func prepareSMIME(ctx *alps.Context, msg *OutgoingMessage, passphrase string) error {
+	keys, err := loadSMIMEKeys(ctx.Session.Store())
+	if err != nil {
+		return fmt.Errorf("failed to load S/MIME certificate: %v", err)
+	}
+	chain, err := keys.Chain()
+	if err != nil {
+		return err
+	}
+	key, err := keys.Unlock(passphrase)
+	if err != nil {
+		return err
+	}
+	if !certHasAddress(chain[0], msg.FromAddress()) {
+		return fmt.Errorf("the certificate wasn't issued to %v", msg.FromAddress())
+	}
+	msg.SMIMEChain = chain
+	msg.SMIMEKey = key
+	return nil
+}
+
+// writeSMIMESigned writes a multipart/signed message with a detached S/MIME
+// signature (RFC 8551 section 3.5.3).
+func writeSMIMESigned(w io.Writer, h message.Header, signed []byte, chain []*x509.Certificate, key crypto.PrivateKey) error {
+	signed = canonicalLineEndings(signed)
+
+	sd, err := pkcs7.NewSignedData(signed)
+	if err != nil {
+		return fmt.Errorf("failed to sign message: %v", err)
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err := sd.AddSignerChain(chain[0], key, chain[1:], pkcs7.SignerInfoConfig{}); err != nil {
+		return fmt.Errorf("failed to sign message: %v", err)
+	}
+	sd.Detach()
+	der, err := sd.Finish()
+	if err != nil {
+		return fmt.Errorf("failed to sign message: %v", err)
+	}
+
+	var sigHeader message.Header
+	sigHeader.SetContentType("application/pkcs7-signature", map[string]string{"name": "smime.p7s"})
+	sigHeader.SetContentDisposition("attachment", map[string]string{"filename": "smime.p7s"})
+	sigHeader.Set("Content-Transfer-Encoding", "base64")
+
+	params := map[string]string{
+		"micalg":   "sha-256",
+		"protocol": "application/pkcs7-signature",
+	}
+	return writeMultipartSigned(w, h, params, signed, sigHeader, wrapBase64(der))
+}
+
+// wrapBase64 encodes data in base64 with CRLF line breaks.
+func wrapBase64(b []byte) []byte {
+	const lineLen = 76
+	s := base64.StdEncoding.EncodeToString(b)
+	var buf bytes.Buffer
+	for len(s) > lineLen {
+		buf.WriteString(s[:lineLen])
+		buf.WriteString("\r\n")
+		s = s[lineLen:]
+	}
+	buf.WriteString(s)
+	return buf.Bytes()
+}
+
+// SMIMEStatus describes how a message is protected with S/MIME.
+type SMIMEStatus struct {
+	Encrypted bool
+	// Whether the message could be decrypted
+	Decrypted bool
+	Signed    bool
+	// Whether the signature is valid and the certificate of the signer is
+	// trusted
+	Verified bool
+	// Certificate of the signer, if the message is signed
+	Signer *SMIMECertInfo
+	// Why the message couldn't be decrypted or the signature couldn't be
+	// verified
+	Error string
+}
+
+// Locked checks whether the message needs to be decrypted with the user's
+// passphrase. It's false if the status is nil.
+func (status *SMIMEStatus) Locked() bool {
+	return status != nil && status.Encrypted && !status.Decrypted
+}
+
+func isSMIMESigned(mimeType string, params map[string]string) bool {
+	if !strings.EqualFold(mimeType, "multipart/signed") {
+		return false
+	}
+	protocol := strings.ToLower(params["protocol"])
+	return protocol == "application/pkcs7-signature" || protocol == "application/x-pkcs7-signature"
+}
+
+// smimeType returns the kind of data of an application/pkcs7-mime entity, or
+// an empty string if it isn't one. Old clients don't specify it, in which
+// case the data is assumed to be enveloped.
+func smimeType(mimeType string, params map[string]string) string {
+	mimeType = strings.ToLower(mimeType)
+	if mimeType != "application/pkcs7-mime" && mimeType != "application/x-pkcs7-mime" {
+		return ""
+	}
+	if t := strings.ToLower(params["smime-type"]); t != "" {
+		return t
+	}
+	return "enveloped-data"
+}
+
+// verifySMIME checks the signature of S/MIME signed data. Messages are only
+// verified if the certificate of the signer is trusted and was issued to the
+// sender.
+func verifySMIME(ctx *alps.Context, p7 *pkcs7.PKCS7, from string, status *SMIMEStatus) {
+	status.Signed = true
+
+	if err := p7.Verify(); err != nil {
+		if _, ok := err.(*pkcs7.MessageDigestMismatchError); ok {
+			status.Error = "Invalid signature: the message was modified"
+		} else {
+			status.Error = fmt.Sprintf("Invalid signature: %v", err)
+		}
+		return
+	}
+	cert := p7.GetOnlySigner()
+	if cert == nil {
+		status.Error = "The message must have exactly one signer"
+		return
+	}
+	status.Signer = newSMIMECertInfo(cert)
+
+	roots, err := loadSMIMETrustStore(&ctx.Server.Config.SMIME)
+	if err != nil {
+		ctx.Logger().Print(err)
+		status.Error = "Failed to load the trusted certificates"
+		return
+	}
+	if err := p7.VerifyWithChain(roots); err != nil {
+		status.Error = fmt.Sprintf("The certificate of the signer isn't trusted: %v", err)
+		return
+	}
+	if !certHasAddress(cert, from) {
+		status.Error = fmt.Sprintf("The certificate of the signer wasn't issued to %v", from)
+		return
+	}
+	status.Verified = true
+}
+
+// verifySMIMESigned checks the signature of a raw signed entity, either
+// multipart/signed or opaque. The signed content is returned.
+func verifySMIMESigned(ctx *alps.Context, raw []byte, from string, status *SMIMEStatus) []byte {
+	e, err := message.Read(bytes.NewReader(raw))
+	if err != nil {
+		status.Error = fmt.Sprintf("Failed to read signed message: %v", err)
+		return nil
+	}
+	mimeType, params, _ := e.Header.ContentType()
+
+	var p7 *pkcs7.PKCS7
+	if isSMIMESigned(mimeType, params) {
+		signed, signature, err := splitMultipartSigned(raw)
+		if err != nil {
+			status.Error = err.Error()
+			return nil
+		}
+		if p7, err = pkcs7.Parse(signature); err != nil {
+			status.Signed = true
+			status.Error = fmt.Sprintf("Failed to read signature: %v", err)
+			return signed
+		}
+		p7.Content = signed
+	} else {
+		if p7, err = readPKCS7(e); err != nil {
+			status.Signed = true
+			status.Error = err.Error()
+			return nil
+		}
+	}
+
+	verifySMIME(ctx, p7, from, status)
+	return p7.Content
+}
+
+func readPKCS7(e *message.Entity) (*pkcs7.PKCS7, error) {
+	b, err := ioutil.ReadAll(e.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read S/MIME data: %v", err)
+	}
+	p7, err := pkcs7.Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read S/MIME data: %v", err)
+	}
+	return p7, nil
+}
+
+// checkSMIMESignature verifies a message if it's signed with S/MIME.
+func checkSMIMESignature(ctx *alps.Context, msg *IMAPMessage, raw []byte) *SMIMEStatus {
+	status := new(SMIMEStatus)
+	verifySMIMESigned(ctx, raw, senderAddress(msg), status)
+	return status
+}
+
+// smimeViewer displays the text of application/pkcs7-mime messages. Signed
+// data is verified, enveloped data is decrypted with the user's certificate
+// once the passphrase is submitted along with the request.
+type smimeViewer struct{}
+
+func (smimeViewer) ViewMessagePart(ctx *alps.Context, msg *IMAPMessage, part *message.Entity) (interface{}, error) {
+	mimeType, params, err := part.Header.ContentType()
+	if err != nil {
+		return nil, ErrViewUnsupported
+	}
+
+	status := new(SMIMEStatus)
+	var content []byte
+	switch smimeType(mimeType, params) {
+	case "signed-data":
+		ctx.Set(smimeStatusKey, status)
+		p7, err := readPKCS7(part)
+		if err != nil {
+			status.Signed = true
+			status.Error = err.Error()
+			return nil, nil
+		}
+		verifySMIME(ctx, p7, senderAddress(msg), status)
+		content = p7.Content
+	case "enveloped-data":
+		status.Encrypted = true
+		ctx.Set(smimeStatusKey, status)
+		if content, err = decryptSMIME(ctx, part, status); err != nil || content == nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrViewUnsupported
+	}
+
+	inner, err := message.Read(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read S/MIME content: %v", err)
+	}
+	mimeType, params, _ = inner.Header.ContentType()
+	if isSMIMESigned(mimeType, params) || smimeType(mimeType, params) == "signed-data" {
+		if content = verifySMIMESigned(ctx, content, senderAddress(msg), status); content == nil {
+			return nil, nil
+		}
+		if inner, err = message.Read(bytes.NewReader(content)); err != nil {
+			return nil, fmt.Errorf("failed to read signed message: %v", err)
+		}
+	}
+
+	text, err := findTextEntity(inner)
+	if err != nil {
+		return nil, err
+	} else if text == nil {
+		return nil, ErrViewUnsupported
+	}
+	return viewMessagePart(ctx, msg, text)
+}
+
+// decryptSMIME decrypts enveloped data with the user's certificate. Nil is
+// returned if the passphrase is missing or the data couldn't be decrypted,
+// in which case the status is updated.
+func decryptSMIME(ctx *alps.Context, part *message.Entity, status *SMIMEStatus) ([]byte, error) {
+	passphrase := ctx.FormValue("smime_passphrase")
+	if passphrase == "" {
+		return nil, nil
+	}
+
+	keys, err := loadSMIMEKeys(ctx.Session.Store())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load S/MIME certificate: %v", err)
+	}
+	key, err := keys.Unlock(passphrase)
+	if err == errWrongPassphrase {
+		status.Error = "Wrong passphrase."
+		return nil, nil
+	} else if err != nil {
+		status.Error = err.Error()
+		return nil, nil
+	}
+	chain, err := keys.Chain()
+	if err != nil {
+		return nil, err
+	}
+
+	p7, err := readPKCS7(part)
+	if err != nil {
+		status.Error = err.Error()
+		return nil, nil
+	}
+	plaintext, err := p7.Decrypt(chain[0], key)
+	if err != nil {
+		status.Error = fmt.Sprintf("Failed to decrypt message: %v", err)
+		return nil, nil
+	}
+	status.Decrypted = true
+	return plaintext, nil
+}
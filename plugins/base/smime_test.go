@@ -0,0 +1,56 @@
+package alpsbase
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestReadSMIMECertificate_pkcs12(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "alice@example.org"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// PBES2 with AES-256, like files exported by OpenSSL 3
+	pfx, err := pkcs12.Modern2023.Encode(key, cert, nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain, priv, err := readSMIMECertificate(pfx, "secret")
+	if err != nil {
+		t.Fatalf("readSMIMECertificate() = %v", err)
+	}
+	if len(chain) != 1 || !chain[0].Equal(cert) {
+		t.Errorf("readSMIMECertificate() returned the wrong chain")
+	}
+	if !key.Equal(priv) {
+		t.Errorf("readSMIMECertificate() returned the wrong key")
+	}
+
+	if _, _, err := readSMIMECertificate(pfx, "wrong"); err == nil {
+		t.Errorf("readSMIMECertificate() accepted a wrong password")
+	}
+}
@@ -3,6 +3,8 @@ package alpsbase
 import (
 	"bufio"
 	"bytes"
+	"crypto"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,6 +13,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/mail"
 	"github.com/emersion/go-smtp"
 )
@@ -30,14 +34,52 @@ func quote(r io.Reader) (string, error) {
 	return builder.String(), nil
 }
 
+// formatFlowed encodes text as format=flowed (RFC 3676). Lines aren't
+// wrapped, so that code blocks are left intact: trailing spaces are removed to
+// avoid soft line breaks, and lines are space-stuffed where needed.
+func formatFlowed(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	lines := strings.Split(text, "\n")
+	for i, l := range lines {
+		if l != "-- " {
+			l = strings.TrimRight(l, " ")
+		}
+		if strings.HasPrefix(l, " ") || strings.HasPrefix(l, "From ") || strings.HasPrefix(l, ">") {
+			l = " " + l
+		}
+		lines[i] = l
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// unflow decodes format=flowed text, joining lines ending with a soft line
+// break. Quote depth is not interpreted.
+func unflow(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	var builder strings.Builder
+	for _, l := range strings.Split(text, "\n") {
+		l = strings.TrimPrefix(l, " ")
+		builder.WriteString(l)
+		if l == "-- " || !strings.HasSuffix(l, " ") {
+			builder.WriteString("\n")
+		}
+	}
+	return strings.TrimSuffix(builder.String(), "\n")
+}
+
 type Attachment interface {
 	MIMEType() string
 	Filename() string
+	// ContentID returns the Content-ID of the attachment without angle
+	// brackets, or an empty string
+	ContentID() string
 	Open() (io.ReadCloser, error)
 }
 
 type formAttachment struct {
 	*multipart.FileHeader
+
+	contentID string
 }
 
 func (att *formAttachment) Open() (io.ReadCloser, error) {
@@ -54,6 +96,16 @@ func (att *formAttachment) Filename() string {
 	return att.FileHeader.Filename
 }
 
+func (att *formAttachment) ContentID() string {
+	return att.contentID
+}
+
+// uploadContentID returns the Content-ID of an attachment uploaded to the
+// session. HTML parts refer to it as "cid:<uuid>@alps" until it's sent.
+func uploadContentID(uuid string) string {
+	return uuid + "@alps"
+}
+
 type imapAttachment struct {
 	Mailbox string
 	Uid     uint32
@@ -77,16 +129,48 @@ func (att *imapAttachment) Filename() string {
 	return att.Node.Filename
 }
 
+func (att *imapAttachment) ContentID() string {
+	return att.Node.ContentID
+}
+
 type OutgoingMessage struct {
-	From        string
-	To          []string
-	Cc          []string
-	Bcc         []string
-	Subject     string
-	MessageID   string
-	InReplyTo   string
-	Text        string
+	From      string
+	To        []string
+	Cc        []string
+	Bcc       []string
+	ReplyTo   string
+	Subject   string
+	MessageID string
+	InReplyTo string
+	// Message IDs of the thread, with angle brackets
+	References []string
+	Text       string
+	// Sanitized HTML body, if the message was composed in HTML. Text is
+	// the plain-text alternative.
+	HTML string
+	// If true, Text is Markdown source and an HTML alternative is rendered
+	// from it when the message is written.
+	Markdown bool
+	// Ask the recipients for a read receipt
+	RequestMDN  bool
 	Attachments []Attachment
+	// Sign the message with this key, if set
+	PGPSigner *openpgp.Entity
+	// Encrypt the message to these keys, if set
+	PGPRecipients openpgp.EntityList
+	// Sign the message with S/MIME with this certificate chain and key, if
+	// set
+	SMIMEChain []*x509.Certificate
+	SMIMEKey   crypto.PrivateKey
+}
+
+// FromAddress returns the address of the sender, without the name.
+func (msg *OutgoingMessage) FromAddress() string {
+	addr, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return msg.From
+	}
+	return addr.Address
 }
 
 func (msg *OutgoingMessage) ToString() string {
@@ -101,12 +185,28 @@ func (msg *OutgoingMessage) BccString() string {
 	return strings.Join(msg.Bcc, ", ")
 }
 
-func writeAttachment(mw *mail.Writer, att Attachment) error {
+func writeAttachment(mw *message.Writer, att Attachment, inline bool) error {
 	var h mail.AttachmentHeader
 	h.SetContentType(att.MIMEType(), nil)
-	h.SetFilename(att.Filename())
+	if inline {
+		params := make(map[string]string)
+		if filename := att.Filename(); filename != "" {
+			params["filename"] = filename
+		}
+		h.SetContentDisposition("inline", params)
+		h.Set("Content-Id", "<"+att.ContentID()+">")
+	} else {
+		h.SetFilename(att.Filename())
+	}
+	if strings.EqualFold(att.MIMEType(), "message/rfc822") {
+		// Encoding message/rfc822 parts isn't allowed, see RFC 2046
+		// section 5.2.1
+		h.Set("Content-Transfer-Encoding", "8bit")
+	} else {
+		h.Set("Content-Transfer-Encoding", "base64")
+	}
 
-	aw, err := mw.CreateAttachment(h)
+	aw, err := mw.CreatePart(h.Header)
 	if err != nil {
 		return fmt.Errorf("failed to create attachment: %v", err)
 	}
@@ -132,24 +232,122 @@ func writeAttachment(mw *mail.Writer, att Attachment) error {
 	return nil
 }
 
-func (msg *OutgoingMessage) WriteTo(w io.Writer) error {
-	fromAddr, err := mail.ParseAddress(msg.From)
+func writeTextPart(mw *message.Writer, mimeType string, params map[string]string, text string) error {
+	return writeTextPartHeader(mw, mail.InlineHeader{}, mimeType, params, text)
+}
+
+// writeTextPartHeader writes a text part with additional header fields.
+func writeTextPartHeader(mw *message.Writer, h mail.InlineHeader, mimeType string, params map[string]string, text string) error {
+	if params == nil {
+		params = make(map[string]string)
+	}
+	params["charset"] = "utf-8"
+
+	h.SetContentType(mimeType, params)
+	h.Set("Content-Disposition", "inline")
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	tw, err := mw.CreatePart(h.Header)
+	if err != nil {
+		return fmt.Errorf("failed to create text part: %v", err)
+	}
+	defer tw.Close()
+
+	if _, err := io.WriteString(tw, text); err != nil {
+		return fmt.Errorf("failed to write text part: %v", err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to close text part: %v", err)
+	}
+
+	return nil
+}
+
+// markdownField marks the plain-text part holding the Markdown source, so that
+// drafts are edited in Markdown again.
+const markdownField = "X-Alps-Markdown"
+
+// writeTextBody writes the plain-text body. Markdown source is sent as
+// format=flowed text.
+func (msg *OutgoingMessage) writeTextBody(mw *message.Writer) error {
+	if msg.Markdown {
+		var h mail.InlineHeader
+		h.Set(markdownField, "yes")
+		params := map[string]string{"format": "flowed"}
+		return writeTextPartHeader(mw, h, "text/plain", params, formatFlowed(msg.Text))
+	}
+	return writeTextPart(mw, "text/plain", nil, msg.Text)
+}
+
+// writeHTMLBody writes a multipart/alternative part with the plain-text and
+// HTML bodies. If related attachments are provided, they are written along
+// with it in a multipart/related part.
+func (msg *OutgoingMessage) writeHTMLBody(mw *message.Writer, html string, related []Attachment) error {
+	if len(related) > 0 {
+		var h message.Header
+		h.SetContentType("multipart/related", map[string]string{"type": "multipart/alternative"})
+
+		rw, err := mw.CreatePart(h)
+		if err != nil {
+			return fmt.Errorf("failed to create related part: %v", err)
+		}
+
+		mw = rw
+	}
+
+	var h message.Header
+	h.SetContentType("multipart/alternative", nil)
+
+	aw, err := mw.CreatePart(h)
 	if err != nil {
+		return fmt.Errorf("failed to create alternative part: %v", err)
+	}
+
+	if err := msg.writeTextBody(aw); err != nil {
+		return err
+	}
+	if err := writeTextPart(aw, "text/html", nil, html); err != nil {
 		return err
 	}
+
+	if err := aw.Close(); err != nil {
+		return fmt.Errorf("failed to close alternative part: %v", err)
+	}
+
+	for _, att := range related {
+		if err := writeAttachment(mw, att, true); err != nil {
+			return err
+		}
+	}
+
+	if len(related) > 0 {
+		if err := mw.Close(); err != nil {
+			return fmt.Errorf("failed to close related part: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (msg *OutgoingMessage) header() (*mail.Header, error) {
+	fromAddr, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return nil, err
+	}
 	from := []*mail.Address{fromAddr}
 
 	to, err := parseAddressList(msg.To)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	cc, err := parseAddressList(msg.Cc)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	bcc, err := parseAddressList(msg.Bcc)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	var h mail.Header
 	h.SetDate(time.Now())
@@ -161,42 +359,65 @@ func (msg *OutgoingMessage) WriteTo(w io.Writer) error {
 	if len(bcc) > 0 {
 		h.SetAddressList("Bcc", bcc)
 	}
+	if msg.ReplyTo != "" {
+		replyTo, err := mail.ParseAddress(msg.ReplyTo)
+		if err != nil {
+			return nil, err
+		}
+		h.SetAddressList("Reply-To", []*mail.Address{replyTo})
+	}
 	if msg.Subject != "" {
 		h.SetText("Subject", msg.Subject)
 	}
 	if msg.InReplyTo != "" {
 		h.Set("In-Reply-To", msg.InReplyTo)
 	}
+	if len(msg.References) > 0 {
+		h.Set("References", strings.Join(msg.References, " "))
+	}
+	if msg.RequestMDN {
+		h.SetAddressList("Disposition-Notification-To", from)
+	}
 
 	h.Set("Message-Id", msg.MessageID)
 	if msg.MessageID == "" {
 		panic(fmt.Errorf("Attempting to send message without message ID"))
 	}
 
-	mw, err := mail.CreateWriter(w, h)
+	return &h, nil
+}
+
+// writeBody writes the body of the message with the provided header.
+func (msg *OutgoingMessage) writeBody(w io.Writer, h message.Header) error {
+	h.Set("Content-Type", "multipart/mixed")
+	mw, err := message.CreateWriter(w, h)
 	if err != nil {
 		return fmt.Errorf("failed to create mail writer: %v", err)
 	}
 
-	var th mail.InlineHeader
-	th.Set("Content-Type", "text/plain; charset=utf-8")
-
-	tw, err := mw.CreateSingleInline(th)
-	if err != nil {
-		return fmt.Errorf("failed to create text part: %v", err)
+	html := msg.HTML
+	if msg.Markdown {
+		rendered, err := renderMarkdown(msg.Text)
+		if err != nil {
+			return fmt.Errorf("failed to render Markdown: %v", err)
+		}
+		html = sanitizeComposedHTML(rendered)
 	}
-	defer tw.Close()
 
-	if _, err := io.WriteString(tw, msg.Text); err != nil {
-		return fmt.Errorf("failed to write text part: %v", err)
+	attachments := msg.Attachments
+	if html == "" {
+		err = msg.writeTextBody(mw)
+	} else {
+		var related []Attachment
+		related, attachments = splitRelatedAttachments(html, attachments)
+		err = msg.writeHTMLBody(mw, html, related)
 	}
-
-	if err := tw.Close(); err != nil {
-		return fmt.Errorf("failed to close text part: %v", err)
+	if err != nil {
+		return err
 	}
 
-	for _, att := range msg.Attachments {
-		if err := writeAttachment(mw, att); err != nil {
+	for _, att := range attachments {
+		if err := writeAttachment(mw, att, false); err != nil {
 			return err
 		}
 	}
@@ -208,6 +429,32 @@ func (msg *OutgoingMessage) WriteTo(w io.Writer) error {
 	return nil
 }
 
+// WriteTo writes the message. If keys are provided, the body is signed
+// and/or encrypted with PGP/MIME (RFC 3156) or signed with S/MIME. The header
+// is left in the clear.
+func (msg *OutgoingMessage) WriteTo(w io.Writer) error {
+	h, err := msg.header()
+	if err != nil {
+		return err
+	}
+
+	if msg.PGPSigner == nil && len(msg.PGPRecipients) == 0 && msg.SMIMEKey == nil {
+		return msg.writeBody(w, h.Header)
+	}
+
+	var body bytes.Buffer
+	if err := msg.writeBody(&body, message.Header{}); err != nil {
+		return err
+	}
+
+	if msg.SMIMEKey != nil {
+		return writeSMIMESigned(w, h.Header, body.Bytes(), msg.SMIMEChain, msg.SMIMEKey)
+	} else if len(msg.PGPRecipients) > 0 {
+		return writePGPEncrypted(w, h.Header, body.Bytes(), msg.PGPRecipients, msg.PGPSigner)
+	}
+	return writePGPSigned(w, h.Header, body.Bytes(), msg.PGPSigner)
+}
+
 func sendMessage(c *smtp.Client, msg *OutgoingMessage) error {
 	addr, _ := mail.ParseAddress(msg.From)
 	if err := c.Mail(addr.Address, nil); err != nil {
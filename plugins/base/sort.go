@@ -0,0 +1,399 @@
+package alpsbase
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~migadu/alps"
+	"github.com/emersion/go-imap"
+	sortthread "github.com/emersion/go-imap-sortthread"
+	imapclient "github.com/emersion/go-imap/client"
+)
+
+const messageSortsKey = "base.sorts"
+
+// MessageSortField is a key message lists can be sorted by.
+type MessageSortField string
+
+const (
+	SortByDate    MessageSortField = "date"
+	SortByFrom    MessageSortField = "from"
+	SortBySubject MessageSortField = "subject"
+	SortBySize    MessageSortField = "size"
+	SortByFlagged MessageSortField = "flagged"
+)
+
+// MessageSort is the order of a message list.
+type MessageSort struct {
+	Field MessageSortField
+	// Whether to sort in descending order. For SortByFlagged, this lists
+	// flagged messages first.
+	Reverse bool
+}
+
+var defaultMessageSort = MessageSort{Field: SortByDate, Reverse: true}
+
+// byArrival returns true if the order roughly follows UIDs. Messages are
+// mostly received in the order they were sent.
+func (s MessageSort) byArrival() bool {
+	return s.Field == SortByDate
+}
+
+func (s MessageSort) valid() bool {
+	switch s.Field {
+	case SortByDate, SortByFrom, SortBySubject, SortBySize, SortByFlagged:
+		return true
+	}
+	return false
+}
+
+// loadMessageSort returns the sort order the user picked for a mailbox.
+func loadMessageSort(s alps.Store, mboxName string) (MessageSort, error) {
+	sorts := make(map[string]MessageSort)
+	if err := s.Get(messageSortsKey, &sorts); err != nil && err != alps.ErrNoStoreEntry {
+		return defaultMessageSort, err
+	}
+	if order, ok := sorts[mboxName]; ok && order.valid() {
+		return order, nil
+	}
+	return defaultMessageSort, nil
+}
+
+func saveMessageSort(s alps.Store, mboxName string, order MessageSort) error {
+	sorts := make(map[string]MessageSort)
+	if err := s.Get(messageSortsKey, &sorts); err != nil && err != alps.ErrNoStoreEntry {
+		return err
+	}
+	if order == defaultMessageSort {
+		delete(sorts, mboxName)
+	} else {
+		sorts[mboxName] = order
+	}
+	return s.Put(messageSortsKey, &sorts)
+}
+
+var sortFields = map[MessageSortField]sortthread.SortField{
+	SortByDate:    sortthread.SortDate,
+	SortByFrom:    sortthread.SortFrom,
+	SortBySubject: sortthread.SortSubject,
+	SortBySize:    sortthread.SortSize,
+}
+
+// sortUids returns the UIDs of the messages of the currently selected mailbox
+// matching criteria, in the specified order.
+func sortUids(conn *imapclient.Client, criteria *imap.SearchCriteria, order MessageSort) ([]uint32, error) {
+	if criteria == nil {
+		criteria = imap.NewSearchCriteria()
+	}
+
+	if order.Field == SortByFlagged {
+		flagged := *criteria
+		flagged.WithFlags = append(append([]string(nil), criteria.WithFlags...), imap.FlaggedFlag)
+		unflagged := *criteria
+		unflagged.WithoutFlags = append(append([]string(nil), criteria.WithoutFlags...), imap.FlaggedFlag)
+
+		first, second := &flagged, &unflagged
+		if !order.Reverse {
+			first, second = second, first
+		}
+		var uids []uint32
+		for _, c := range []*imap.SearchCriteria{first, second} {
+			l, err := conn.UidSearch(c)
+			if err != nil {
+				return nil, fmt.Errorf("UID SEARCH failed: %v", err)
+			}
+			sortUidsByArrival(l, true)
+			uids = append(uids, l...)
+		}
+		return uids, nil
+	}
+
+	sc := sortthread.NewSortClient(conn)
+	if ok, err := sc.SupportSort(); err != nil {
+		return nil, err
+	} else if ok {
+		sortCriteria := []sortthread.SortCriterion{
+			{Field: sortFields[order.Field], Reverse: order.Reverse},
+		}
+		uids, err := sc.UidSort(sortCriteria, criteria)
+		if err != nil {
+			return nil, fmt.Errorf("UID SORT failed: %v", err)
+		}
+		return uids, nil
+	}
+
+	return sortUidsLocally(conn, criteria, order)
+}
+
+func sortUidsByArrival(uids []uint32, reverse bool) {
+	sort.Slice(uids, func(i, j int) bool {
+		if reverse {
+			return uids[i] > uids[j]
+		}
+		return uids[i] < uids[j]
+	})
+}
+
+type messageSortKey struct {
+	s    string
+	size uint32
+	date time.Time
+}
+
+// sortUidsLocally sorts messages for servers which don't support SORT. Keys
+// are compared the same way as RFC 5256 does: ties are broken by arrival
+// order, even when sorting in reverse.
+func sortUidsLocally(conn *imapclient.Client, criteria *imap.SearchCriteria, order MessageSort) ([]uint32, error) {
+	uids, err := conn.UidSearch(criteria)
+	if err != nil {
+		return nil, fmt.Errorf("UID SEARCH failed: %v", err)
+	}
+	if len(uids) == 0 {
+		return nil, nil
+	}
+
+	var seqSet imap.SeqSet
+	seqSet.AddNum(uids...)
+
+	fetch := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}
+	switch order.Field {
+	case SortBySize:
+		fetch = []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size}
+	case SortByDate:
+		fetch = append(fetch, imap.FetchInternalDate)
+	}
+
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.UidFetch(&seqSet, fetch, ch)
+	}()
+
+	keys := make(map[uint32]messageSortKey, len(uids))
+	for msg := range ch {
+		var k messageSortKey
+		switch order.Field {
+		case SortBySize:
+			k.size = msg.Size
+		case SortByDate:
+			// Like SORT DATE, fall back to the internal date if the
+			// message has no valid Date header field
+			if msg.Envelope != nil {
+				k.date = msg.Envelope.Date
+			}
+			if k.date.IsZero() {
+				k.date = msg.InternalDate
+			}
+		case SortByFrom:
+			if msg.Envelope != nil && len(msg.Envelope.From) > 0 {
+				k.s = strings.ToLower(msg.Envelope.From[0].MailboxName)
+			}
+		case SortBySubject:
+			if msg.Envelope != nil {
+				k.s = baseSubject(msg.Envelope.Subject)
+			}
+		}
+		keys[msg.Uid] = k
+	}
+
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to fetch message sort keys: %v", err)
+	}
+
+	sortUidsByArrival(uids, false)
+	sort.SliceStable(uids, func(i, j int) bool {
+		a, b := keys[uids[i]], keys[uids[j]]
+		if order.Reverse {
+			a, b = b, a
+		}
+		switch order.Field {
+		case SortBySize:
+			return a.size < b.size
+		case SortByDate:
+			return a.date.Before(b.date)
+		}
+		return a.s < b.s
+	})
+	return uids, nil
+}
+
+// baseSubject strips reply and forward markers from a subject, as described
+// in RFC 5256 section 2.1.
+func baseSubject(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for {
+		trimmed := s
+		for _, prefix := range []string{"re:", "fwd:", "fw:"} {
+			trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, prefix))
+		}
+		trimmed = strings.TrimSpace(strings.TrimSuffix(trimmed, "(fwd)"))
+		if trimmed == s {
+			return s
+		}
+		s = trimmed
+	}
+}
+
+// pageCursor identifies a page of a list by the ID of an item next to it, so
+// that pages don't shift when items are added or removed. For messages of a
+// single mailbox, IDs are UIDs.
+type pageCursor struct {
+	// The page starts right after this item
+	after string
+	// The page ends right before this item
+	before string
+	// The page starts with this item
+	at string
+}
+
+// errPageCursorLost is returned when the item a page is anchored on doesn't
+// exist anymore and its position can't be guessed.
+var errPageCursorLost = errors.New("the page cursor doesn't exist anymore")
+
+// found returns true if the item the cursor refers to is in ids, or if the
+// cursor refers to the first page.
+func (c pageCursor) found(ids []string) bool {
+	id := c.after
+	if c.before != "" {
+		id = c.before
+	} else if c.at != "" {
+		id = c.at
+	}
+	if id == "" {
+		return true
+	}
+	for _, cand := range ids {
+		if cand == id {
+			return true
+		}
+	}
+	return false
+}
+
+func uidPageIDs(uids []uint32) []string {
+	ids := make([]string, len(uids))
+	for i, uid := range uids {
+		ids[i] = strconv.FormatUint(uint64(uid), 10)
+	}
+	return ids
+}
+
+// page returns the bounds of the page of ids, along with the cursors to the
+// previous and next pages. Cursors are empty if there are no such pages. If
+// the cursor doesn't exist in ids anymore, e.g. because the message was
+// expunged, the page is anchored on the nearest remaining item. This only
+// makes sense for lists sorted by arrival, other lists need to check the
+// cursor is found first.
+func (c pageCursor) page(ids []string, perPage int) (start, end int, prev, next string) {
+	index := func(id string) (int, bool) {
+		for i, cand := range ids {
+			if cand == id {
+				return i, true
+			}
+		}
+		return nearestPageIndex(ids, id), false
+	}
+
+	switch {
+	case c.before != "":
+		i, _ := index(c.before)
+		start = i - perPage
+		if start < 0 {
+			start = 0
+		}
+	case c.after != "":
+		i, ok := index(c.after)
+		if ok {
+			i++
+		}
+		start = i
+	case c.at != "":
+		start, _ = index(c.at)
+	}
+
+	if start >= len(ids) {
+		// The cursor was the last item, show the last page instead of an
+		// empty one
+		start = len(ids) - perPage
+		if start < 0 {
+			start = 0
+		}
+	}
+
+	end = start + perPage
+	if end > len(ids) {
+		end = len(ids)
+	}
+	if start > 0 {
+		prev = ids[start]
+	}
+	if end < len(ids) {
+		next = ids[end-1]
+	}
+	return start, end, prev, next
+}
+
+// splitPageID splits an item ID into a UID and the name of the mailbox, if
+// any.
+func splitPageID(id string) (uid uint32, mboxName string, ok bool) {
+	s := id
+	if i := strings.IndexByte(id, ':'); i >= 0 {
+		s, mboxName = id[:i], id[i+1:]
+	}
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, "", false
+	}
+	return uint32(v), mboxName, true
+}
+
+// nearestPageIndex returns the index at which a missing item would be in ids.
+// UIDs grow with arrival dates, so the item is placed next to the one of the
+// same mailbox with the closest UID. Items are assumed to be sorted by UID
+// around it, newest first unless the neighbours say otherwise.
+func nearestPageIndex(ids []string, id string) int {
+	uid, mboxName, ok := splitPageID(id)
+	if !ok {
+		return 0
+	}
+
+	dist := func(v uint32) uint32 {
+		if v > uid {
+			return v - uid
+		}
+		return uid - v
+	}
+	nearest := -1
+	var nearestUid uint32
+	for i, cand := range ids {
+		v, name, ok := splitPageID(cand)
+		if !ok || name != mboxName {
+			continue
+		}
+		if nearest < 0 || dist(v) < dist(nearestUid) {
+			nearest, nearestUid = i, v
+		}
+	}
+	if nearest < 0 {
+		return 0
+	}
+
+	ascending := false
+	for _, j := range []int{nearest + 1, nearest - 1} {
+		if j < 0 || j >= len(ids) {
+			continue
+		}
+		if v, name, ok := splitPageID(ids[j]); ok && name == mboxName {
+			ascending = (j > nearest) == (v > nearestUid)
+			break
+		}
+	}
+	if ascending == (uid > nearestUid) {
+		return nearest + 1
+	}
+	return nearest
+}
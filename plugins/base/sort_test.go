@@ -0,0 +1,94 @@
+package alpsbase
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPageCursor(t *testing.T) {
+	// Newest first, UIDs 3 and 7 were expunged
+	desc := []string{"10", "9", "8", "6", "5", "4", "2", "1"}
+	asc := []string{"1", "2", "4", "5", "6", "8", "9", "10"}
+	refs := []string{"9:INBOX", "5:Archive", "4:INBOX", "2:INBOX"}
+
+	tests := []struct {
+		name   string
+		ids    []string
+		cursor pageCursor
+		page   []string
+		prev   string
+		next   string
+	}{
+		{"first", desc, pageCursor{}, []string{"10", "9", "8"}, "", "8"},
+		{"after", desc, pageCursor{after: "8"}, []string{"6", "5", "4"}, "6", "4"},
+		{"before", desc, pageCursor{before: "6"}, []string{"10", "9", "8"}, "", "8"},
+		{"at", desc, pageCursor{at: "5"}, []string{"5", "4", "2"}, "5", "2"},
+		{"last", desc, pageCursor{after: "4"}, []string{"2", "1"}, "2", ""},
+		{"after last", desc, pageCursor{after: "1"}, []string{"4", "2", "1"}, "4", ""},
+		{"after expunged", desc, pageCursor{after: "7"}, []string{"6", "5", "4"}, "6", "4"},
+		{"before expunged", desc, pageCursor{before: "3"}, []string{"6", "5", "4"}, "6", "4"},
+		{"at expunged", desc, pageCursor{at: "3"}, []string{"2", "1"}, "2", ""},
+		{"after expunged ascending", asc, pageCursor{after: "7"}, []string{"8", "9", "10"}, "8", ""},
+		{"before expunged ascending", asc, pageCursor{before: "7"}, []string{"4", "5", "6"}, "4", "6"},
+		{"after newer", desc, pageCursor{after: "12"}, []string{"10", "9", "8"}, "", "8"},
+		{"after expunged ref", refs, pageCursor{after: "8:INBOX"}, []string{"5:Archive", "4:INBOX", "2:INBOX"}, "5:Archive", ""},
+		{"invalid", desc, pageCursor{after: "foo"}, []string{"10", "9", "8"}, "", "8"},
+		{"empty", nil, pageCursor{after: "3"}, []string{}, "", ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			start, end, prev, next := tc.cursor.page(tc.ids, 3)
+			page := tc.ids[start:end]
+			if len(page) == 0 {
+				page = []string{}
+			}
+			if !reflect.DeepEqual(page, tc.page) {
+				t.Errorf("page = %v, want %v", page, tc.page)
+			}
+			if prev != tc.prev {
+				t.Errorf("prev = %q, want %q", prev, tc.prev)
+			}
+			if next != tc.next {
+				t.Errorf("next = %q, want %q", next, tc.next)
+			}
+		})
+	}
+}
+
+func TestPageCursorFound(t *testing.T) {
+	ids := []string{"10", "9", "8"}
+	tests := []struct {
+		cursor pageCursor
+		want   bool
+	}{
+		{pageCursor{}, true},
+		{pageCursor{after: "9"}, true},
+		{pageCursor{before: "8"}, true},
+		{pageCursor{at: "10"}, true},
+		{pageCursor{after: "7"}, false},
+		{pageCursor{at: "foo"}, false},
+	}
+	for _, tc := range tests {
+		if got := tc.cursor.found(ids); got != tc.want {
+			t.Errorf("%+v.found() = %v, want %v", tc.cursor, got, tc.want)
+		}
+	}
+}
+
+func TestBaseSubject(t *testing.T) {
+	tests := []struct {
+		subject, want string
+	}{
+		{"Hello", "hello"},
+		{"Re: Hello", "hello"},
+		{"RE: Fwd: re:Hello (fwd)", "hello"},
+		{"  Fw:  Hello  ", "hello"},
+		{"Regarding", "regarding"},
+	}
+	for _, tc := range tests {
+		if got := baseSubject(tc.subject); got != tc.want {
+			t.Errorf("baseSubject(%q) = %q, want %q", tc.subject, got, tc.want)
+		}
+	}
+}
@@ -29,16 +29,60 @@ func parseMboxAndUid(mboxString, uidString string) (string, uint32, error) {
 	return mboxName, uid, err
 }
 
+// parseUidList parses a list of UIDs. Each value may contain several
+// comma-separated UIDs.
 func parseUidList(values []string) ([]uint32, error) {
 	var uids []uint32
 	for _, v := range values {
-		uid, err := parseUid(v)
+		for _, s := range strings.Split(v, ",") {
+			uid, err := parseUid(s)
+			if err != nil {
+				return nil, err
+			}
+			uids = append(uids, uid)
+		}
+	}
+	return uids, nil
+}
+
+// formatMessageRef formats a reference to a message, identifying both its
+// mailbox and its UID.
+func formatMessageRef(mboxName string, uid uint32) string {
+	return fmt.Sprintf("%v:%v", uid, mboxName)
+}
+
+func parseMessageRef(s string) (string, uint32, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", 0, fmt.Errorf("invalid message reference %q", s)
+	}
+	uid, err := parseUid(parts[0])
+	return parts[1], uid, err
+}
+
+// parseMessageRefs returns the messages a bulk action applies to, by mailbox.
+// Messages are either UIDs in the "uids" field, relative to mboxName, or
+// references in the "messages" field.
+func parseMessageRefs(mboxName string, params url.Values) (map[string][]uint32, error) {
+	refs := make(map[string][]uint32)
+	if len(params["uids"]) > 0 {
+		if mboxName == "" {
+			return nil, fmt.Errorf("UIDs require a mailbox")
+		}
+		uids, err := parseUidList(params["uids"])
 		if err != nil {
 			return nil, err
 		}
-		uids = append(uids, uid)
+		refs[mboxName] = uids
 	}
-	return uids, nil
+	for _, s := range params["messages"] {
+		name, uid, err := parseMessageRef(s)
+		if err != nil {
+			return nil, err
+		}
+		refs[name] = append(refs[name], uid)
+	}
+	return refs, nil
 }
 
 func parsePartPath(s string) ([]int, error) {
@@ -33,13 +33,15 @@ var templateFuncs = template.FuncMap{
 			return "Starred"
 		case imap.DraftFlag:
 			return "Draft"
+		case scheduledKeyword:
+			return "Scheduled"
 		default:
 			return flag
 		}
 	},
 	"ismutableflag": func(flag string) bool {
 		switch flag {
-		case imap.AnsweredFlag, imap.DeletedFlag, imap.DraftFlag:
+		case imap.AnsweredFlag, imap.DeletedFlag, imap.DraftFlag, scheduledKeyword:
 			return false
 		default:
 			return true
@@ -0,0 +1,358 @@
+package alpsbase
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	sortthread "github.com/emersion/go-imap-sortthread"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-message/textproto"
+)
+
+const threadReferencesCapability = "THREAD=REFERENCES"
+
+// IMAPThread is a conversation made of messages from a single mailbox.
+type IMAPThread struct {
+	Mailbox string
+	// Messages in chronological order
+	Messages []IMAPMessage
+}
+
+// URL returns the URL of the conversation view. Any message of the thread
+// can be used to identify it, the first one is used.
+func (t *IMAPThread) URL() *url.URL {
+	return &url.URL{
+		Path: fmt.Sprintf("/thread/%v/%v", url.PathEscape(t.Mailbox), t.Messages[0].Uid),
+	}
+}
+
+func (t *IMAPThread) First() *IMAPMessage {
+	return &t.Messages[0]
+}
+
+func (t *IMAPThread) Latest() *IMAPMessage {
+	return &t.Messages[len(t.Messages)-1]
+}
+
+func (t *IMAPThread) Uids() []uint32 {
+	uids := make([]uint32, len(t.Messages))
+	for i, msg := range t.Messages {
+		uids[i] = msg.Uid
+	}
+	return uids
+}
+
+// UidList returns the UIDs of the messages in the thread as a comma-separated
+// list, suitable for parseUidList.
+func (t *IMAPThread) UidList() string {
+	l := make([]string, len(t.Messages))
+	for i, msg := range t.Messages {
+		l[i] = fmt.Sprint(msg.Uid)
+	}
+	return strings.Join(l, ",")
+}
+
+// HasFlag returns true if any message of the thread has the flag.
+func (t *IMAPThread) HasFlag(flag string) bool {
+	for i := range t.Messages {
+		if t.Messages[i].HasFlag(flag) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *IMAPThread) Unseen() int {
+	n := 0
+	for i := range t.Messages {
+		if !t.Messages[i].HasFlag(imap.SeenFlag) {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *IMAPThread) HasAttachments() bool {
+	for i := range t.Messages {
+		if len(t.Messages[i].Attachments()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Participants returns the senders of the messages of the thread, without
+// duplicates.
+func (t *IMAPThread) Participants() []*imap.Address {
+	var addrs []*imap.Address
+	seen := make(map[string]bool)
+	for _, msg := range t.Messages {
+		if msg.Envelope == nil {
+			continue
+		}
+		for _, addr := range msg.Envelope.From {
+			k := strings.ToLower(addr.Address())
+			if !seen[k] {
+				seen[k] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// threadUids groups the messages of the currently selected mailbox by thread.
+// Threads are sorted by most recent message first, and UIDs in each thread are
+// in ascending order.
+func threadUids(conn *imapclient.Client) ([][]uint32, error) {
+	var threads [][]uint32
+	if ok, err := conn.Support(threadReferencesCapability); err != nil {
+		return nil, err
+	} else if ok {
+		tc := sortthread.NewThreadClient(conn)
+		res, err := tc.UidThread(sortthread.References, imap.NewSearchCriteria())
+		if err != nil {
+			return nil, fmt.Errorf("UID THREAD failed: %v", err)
+		}
+		for _, t := range res {
+			threads = append(threads, flattenThread(t, nil))
+		}
+	} else {
+		var err error
+		if threads, err = threadUidsByReferences(conn); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, uids := range threads {
+		sort.Slice(uids, func(i, j int) bool {
+			return uids[i] < uids[j]
+		})
+	}
+	// UIDs are assigned in ascending order, so the thread with the highest
+	// UID is the one which most recently received a message
+	sort.Slice(threads, func(i, j int) bool {
+		a, b := threads[i], threads[j]
+		return a[len(a)-1] > b[len(b)-1]
+	})
+	return threads, nil
+}
+
+func flattenThread(t *sortthread.Thread, uids []uint32) []uint32 {
+	// Threads without an ID are placeholders for missing parents
+	if t.Id != 0 {
+		uids = append(uids, t.Id)
+	}
+	for _, child := range t.Children {
+		uids = flattenThread(child, uids)
+	}
+	return uids
+}
+
+var msgIDRegexp = regexp.MustCompile(`<[^<>]+>`)
+
+// threadUidsByReferences groups messages by thread on the client side, for
+// servers which don't support THREAD=REFERENCES. Messages referring to each
+// other via Message-Id, In-Reply-To or References belong to the same thread.
+func threadUidsByReferences(conn *imapclient.Client) ([][]uint32, error) {
+	mbox := conn.Mailbox()
+	if mbox == nil || mbox.Messages == 0 {
+		return nil, nil
+	}
+
+	section := &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{
+			Specifier: imap.HeaderSpecifier,
+			Fields:    []string{"Message-Id", "In-Reply-To", "References"},
+		},
+		Peek: true,
+	}
+
+	var seqSet imap.SeqSet
+	seqSet.AddRange(1, 0)
+	fetch := []imap.FetchItem{imap.FetchUid, section.FetchItem()}
+
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.Fetch(&seqSet, fetch, ch)
+	}()
+
+	// Union-find over UIDs, message IDs are mapped to the first UID which
+	// mentioned them
+	parents := make(map[uint32]uint32)
+	owners := make(map[string]uint32)
+	var find func(uid uint32) uint32
+	find = func(uid uint32) uint32 {
+		parent := parents[uid]
+		if parent == uid {
+			return uid
+		}
+		root := find(parent)
+		parents[uid] = root
+		return root
+	}
+
+	for msg := range ch {
+		parents[msg.Uid] = msg.Uid
+
+		body := msg.GetBody(section)
+		if body == nil {
+			continue
+		}
+		h, err := textproto.ReadHeader(bufio.NewReader(body))
+		if err != nil {
+			continue
+		}
+
+		var ids []string
+		for _, k := range section.Fields {
+			ids = append(ids, msgIDRegexp.FindAllString(h.Get(k), -1)...)
+		}
+		for _, id := range ids {
+			if owner, ok := owners[id]; ok {
+				parents[find(msg.Uid)] = find(owner)
+			} else {
+				owners[id] = msg.Uid
+			}
+		}
+	}
+
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to fetch message headers: %v", err)
+	}
+
+	groups := make(map[uint32][]uint32)
+	for uid := range parents {
+		root := find(uid)
+		groups[root] = append(groups[root], uid)
+	}
+	threads := make([][]uint32, 0, len(groups))
+	for _, uids := range groups {
+		threads = append(threads, uids)
+	}
+	return threads, nil
+}
+
+// fetchThreads fetches the messages of the threads identified by UID lists.
+// Threads whose messages have all been removed meanwhile are skipped.
+func fetchThreads(conn *imapclient.Client, mboxName string, threads [][]uint32) ([]IMAPThread, error) {
+	var seqSet imap.SeqSet
+	for _, uids := range threads {
+		seqSet.AddNum(uids...)
+	}
+	if seqSet.Empty() {
+		return nil, nil
+	}
+
+	fetch := []imap.FetchItem{
+		imap.FetchFlags,
+		imap.FetchEnvelope,
+		imap.FetchUid,
+		imap.FetchBodyStructure,
+	}
+
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.UidFetch(&seqSet, fetch, ch)
+	}()
+
+	msgs := make(map[uint32]*imap.Message)
+	for msg := range ch {
+		msgs[msg.Uid] = msg
+	}
+
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to fetch message list: %v", err)
+	}
+
+	l := make([]IMAPThread, 0, len(threads))
+	for _, uids := range threads {
+		t := IMAPThread{Mailbox: mboxName}
+		for _, uid := range uids {
+			if msg, ok := msgs[uid]; ok {
+				t.Messages = append(t.Messages, IMAPMessage{msg, mboxName})
+			}
+		}
+		if len(t.Messages) == 0 {
+			continue
+		}
+
+		sort.SliceStable(t.Messages, func(i, j int) bool {
+			a, b := t.Messages[i].Envelope, t.Messages[j].Envelope
+			if a == nil || b == nil {
+				return false
+			}
+			return a.Date.Before(b.Date)
+		})
+		l = append(l, t)
+	}
+	return l, nil
+}
+
+// listThreads returns a page of the threads of a mailbox. Threads are
+// identified by their most recent UID in page cursors.
+func listThreads(conn *imapclient.Client, mbox *MailboxStatus, cursor pageCursor, threadsPerPage int) (threads []IMAPThread, prev, next string, err error) {
+	if err := ensureMailboxSelected(conn, mbox.Name); err != nil {
+		return nil, "", "", err
+	}
+
+	uids, err := threadUids(conn)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	latest := make([]uint32, len(uids))
+	for i, l := range uids {
+		latest[i] = l[len(l)-1]
+	}
+	ids := uidPageIDs(latest)
+
+	// The "at" cursor may refer to any message of a thread
+	if cursor.at != "" {
+		for i, l := range uids {
+			for _, uid := range uidPageIDs(l) {
+				if uid == cursor.at {
+					cursor.at = ids[i]
+				}
+			}
+		}
+	}
+
+	start, end, prev, next := cursor.page(ids, threadsPerPage)
+	threads, err = fetchThreads(conn, mbox.Name, uids[start:end])
+	return threads, prev, next, err
+}
+
+// getThread returns the thread containing the message with the specified UID,
+// or nil if there is no such message.
+func getThread(conn *imapclient.Client, mboxName string, uid uint32) (*IMAPThread, error) {
+	if err := ensureMailboxSelected(conn, mboxName); err != nil {
+		return nil, err
+	}
+
+	threads, err := threadUids(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, uids := range threads {
+		for _, u := range uids {
+			if u != uid {
+				continue
+			}
+			l, err := fetchThreads(conn, mboxName, [][]uint32{uids})
+			if err != nil || len(l) == 0 {
+				return nil, err
+			}
+			return &l[0], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,260 @@
+package alpsbase
+
+import (
+	"fmt"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~migadu/alps"
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-message/mail"
+)
+
+// Contact is a correspondent known to the user.
+type Contact struct {
+	Name    string
+	Address string
+}
+
+// ContactLocator looks up the contacts of the user, e.g. in an address book.
+type ContactLocator interface {
+	// LookupContacts returns the contacts with the provided address or name.
+	// Names are compared case-insensitively.
+	LookupContacts(ctx *alps.Context, address, name string) ([]Contact, error)
+}
+
+var contactLocators = make(map[string]ContactLocator)
+
+// RegisterContactLocator registers a contact locator. Locators registered
+// with the same name replace each other.
+func RegisterContactLocator(name string, l ContactLocator) {
+	contactLocators[name] = l
+}
+
+// lookupContacts returns the contacts found by all locators, and the user's
+// identities. Lookup failures are logged, and treated as if there was no
+// contact.
+func lookupContacts(ctx *alps.Context, identities Identities, address, name string) []Contact {
+	var contacts []Contact
+	for _, id := range identities {
+		if strings.EqualFold(id.Address, address) || (name != "" && strings.EqualFold(id.Name, name)) {
+			contacts = append(contacts, Contact{Name: id.Name, Address: id.Address})
+		}
+	}
+
+	names := make([]string, 0, len(contactLocators))
+	for name := range contactLocators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, locator := range names {
+		l, err := contactLocators[locator].LookupContacts(ctx, address, name)
+		if err != nil {
+			ctx.Logger().Printf("Failed to look up contacts of %v: %v", address, err)
+			continue
+		}
+		contacts = append(contacts, l...)
+	}
+	return contacts
+}
+
+// SenderTrust describes the authentication of a message and whether its
+// sender is known to the user.
+type SenderTrust struct {
+	// Results of the checks made by trusted servers
+	AuthResults []AuthResult
+	// Contact the sender pretends to be, if the sender uses the name of a
+	// contact with another address
+	Impersonated *Contact
+	// Whether the user never corresponded with the sender
+	FirstTime bool
+}
+
+// checkSender looks up the sender of a message in the user's contacts, to
+// detect senders impersonating a contact. The sender is also looked up in
+// the Sent mailbox, unless they're known already. Results are cached for
+// senderTrustTTL.
+func checkSender(ctx *alps.Context, msg *IMAPMessage, h mail.Header, identities Identities) (*SenderTrust, error) {
+	trust := &SenderTrust{
+		AuthResults: getAuthResults(&ctx.Server.Config.AuthResults, h),
+	}
+	if len(msg.Envelope.From) == 0 || identities.Match(msg.Envelope.From) != nil {
+		return trust, nil
+	}
+	from := msg.Envelope.From[0]
+	address := from.Address()
+	name := strings.TrimSpace(from.PersonalName)
+
+	key := strings.ToLower(address) + "\x00" + strings.ToLower(name)
+	if entry := cachedSenderTrust(ctx.Session, key); entry != nil {
+		trust.Impersonated = entry.impersonated
+		trust.FirstTime = entry.firstTime
+		return trust, nil
+	}
+
+	contacts := lookupContacts(ctx, identities, address, name)
+	for _, contact := range contacts {
+		if strings.EqualFold(contact.Address, address) {
+			putSenderTrust(ctx.Session, key, trust)
+			return trust, nil
+		}
+	}
+	for _, contact := range contacts {
+		if name != "" && strings.EqualFold(contact.Name, name) {
+			trust.Impersonated = &contact
+			break
+		}
+	}
+
+	err := ctx.Session.DoIMAPIdempotent(func(c *imapclient.Client) error {
+		sent, err := hasSentTo(c, address)
+		trust.FirstTime = err == nil && !sent
+		return err
+	})
+	if err != nil {
+		return trust, err
+	}
+	putSenderTrust(ctx.Session, key, trust)
+	return trust, nil
+}
+
+// Time during which the results of checkSender are cached. Looking up a
+// sender requires querying the address books and searching the Sent mailbox.
+const senderTrustTTL = 10 * time.Minute
+
+type senderTrustEntry struct {
+	impersonated *Contact
+	firstTime    bool
+	expires      time.Time
+}
+
+// senderTrustCache keeps the results of checkSender, by session and by
+// lowercase sender address and name.
+var senderTrustCache = struct {
+	sync.Mutex
+	entries map[*alps.Session]map[string]*senderTrustEntry
+}{entries: make(map[*alps.Session]map[string]*senderTrustEntry)}
+
+func cachedSenderTrust(session *alps.Session, key string) *senderTrustEntry {
+	senderTrustCache.Lock()
+	defer senderTrustCache.Unlock()
+
+	entry := senderTrustCache.entries[session][key]
+	if entry == nil || time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry
+}
+
+func putSenderTrust(session *alps.Session, key string, trust *SenderTrust) {
+	senderTrustCache.Lock()
+	defer senderTrustCache.Unlock()
+
+	now := time.Now()
+	for s, entries := range senderTrustCache.entries {
+		for k, entry := range entries {
+			if now.After(entry.expires) {
+				delete(entries, k)
+			}
+		}
+		if len(entries) == 0 {
+			delete(senderTrustCache.entries, s)
+		}
+	}
+
+	entries := senderTrustCache.entries[session]
+	if entries == nil {
+		entries = make(map[string]*senderTrustEntry)
+		senderTrustCache.entries[session] = entries
+	}
+	entries[key] = &senderTrustEntry{
+		impersonated: trust.Impersonated,
+		firstTime:    trust.FirstTime,
+		expires:      now.Add(senderTrustTTL),
+	}
+}
+
+// Number of envelopes fetched at once by hasSentTo.
+const sentToBatchSize = 100
+
+// hasSentTo checks whether the Sent mailbox contains a message addressed to
+// the provided address. It returns true if there's no Sent mailbox, since
+// the answer is unknown.
+//
+// Header searches match substrings, so the recipients of the messages found
+// are compared with the address, starting with the most recent messages.
+func hasSentTo(c *imapclient.Client, address string) (bool, error) {
+	sent, err := getMailboxByType(c, mailboxSent)
+	if err != nil {
+		return false, err
+	} else if sent == nil {
+		return true, nil
+	}
+	if err := ensureMailboxSelected(c, sent.Name); err != nil {
+		return false, err
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Or = [][2]*imap.SearchCriteria{{
+		{Header: textproto.MIMEHeader{"To": {address}}},
+		{Or: [][2]*imap.SearchCriteria{{
+			{Header: textproto.MIMEHeader{"Cc": {address}}},
+			{Header: textproto.MIMEHeader{"Bcc": {address}}},
+		}}},
+	}}
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return false, fmt.Errorf("failed to search Sent mailbox: %v", err)
+	}
+
+	sort.Slice(uids, func(i, j int) bool {
+		return uids[i] > uids[j]
+	})
+	for len(uids) > 0 {
+		n := sentToBatchSize
+		if n > len(uids) {
+			n = len(uids)
+		}
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uids[:n]...)
+		uids = uids[n:]
+
+		if found, err := envelopesAddressedTo(c, seqSet, address); err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+// envelopesAddressedTo checks whether one of the messages is addressed to
+// the provided address.
+func envelopesAddressedTo(c *imapclient.Client, seqSet *imap.SeqSet, address string) (bool, error) {
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqSet, []imap.FetchItem{imap.FetchEnvelope}, ch)
+	}()
+
+	found := false
+	for msg := range ch {
+		if msg.Envelope == nil || found {
+			continue
+		}
+		for _, l := range [][]*imap.Address{msg.Envelope.To, msg.Envelope.Cc, msg.Envelope.Bcc} {
+			for _, addr := range l {
+				if strings.EqualFold(addr.Address(), address) {
+					found = true
+				}
+			}
+		}
+	}
+
+	if err := <-done; err != nil {
+		return false, fmt.Errorf("failed to fetch Sent messages: %v", err)
+	}
+	return found, nil
+}
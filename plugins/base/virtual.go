@@ -0,0 +1,228 @@
+package alpsbase
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"git.sr.ht/~migadu/alps"
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+)
+
+const savedSearchesKey = "base.searches"
+
+const maxSavedSearchNameLen = 128
+
+// SavedSearch is a search query saved by the user. It's listed as a virtual
+// mailbox.
+type SavedSearch struct {
+	Name  string
+	Query string
+	Scope string
+	// Mailbox to search when Scope is searchScopeMailbox
+	Mailbox string
+}
+
+func (s *SavedSearch) URL() *url.URL {
+	return &url.URL{
+		Path:    "/search/" + s.Name,
+		RawPath: "/search/" + url.PathEscape(s.Name),
+	}
+}
+
+// searchUids returns the UIDs of the messages matching the saved search and
+// additional criteria, by mailbox.
+func (s *SavedSearch) searchUids(conn *imapclient.Client, extra *imap.SearchCriteria, loc *time.Location) (map[string][]uint32, error) {
+	criteria, err := PrepareSearch(s.Query, loc)
+	if err != nil {
+		return nil, err
+	}
+	if criteria == nil {
+		criteria = imap.NewSearchCriteria()
+	}
+	if extra != nil {
+		criteria = searchCriteriaAnd(criteria, extra)
+	}
+
+	if s.Scope != searchScopeMailbox {
+		return searchUidsByMailbox(conn, criteria, s.Scope == searchScopeEverywhere)
+	}
+
+	if err := ensureMailboxSelected(conn, s.Mailbox); err != nil {
+		return nil, err
+	}
+	uids, err := conn.UidSearch(criteria)
+	if err != nil {
+		return nil, fmt.Errorf("UID SEARCH failed: %v", err)
+	}
+	return map[string][]uint32{s.Mailbox: uids}, nil
+}
+
+func loadSavedSearches(s alps.Store) ([]SavedSearch, error) {
+	var searches []SavedSearch
+	if err := s.Get(savedSearchesKey, &searches); err != nil && err != alps.ErrNoStoreEntry {
+		return nil, err
+	}
+	return searches, nil
+}
+
+func putSavedSearches(s alps.Store, searches []SavedSearch) error {
+	return s.Put(savedSearchesKey, &searches)
+}
+
+// Paths of the built-in virtual mailboxes
+const (
+	unifiedInboxPath = "/unified"
+	starredPath      = "/starred"
+)
+
+// VirtualMailbox is a message list which doesn't map to a single IMAP
+// mailbox.
+type VirtualMailbox struct {
+	Name   string
+	URL    *url.URL
+	Active bool
+	// Number of unread messages, -1 if unknown
+	Unseen int
+
+	// Returns the UIDs of the messages listed in the virtual mailbox and
+	// matching the additional criteria, by mailbox
+	searchUids func(conn *imapclient.Client, extra *imap.SearchCriteria) (map[string][]uint32, error)
+}
+
+// newVirtualMailboxes returns the built-in virtual mailboxes followed by the
+// user's saved searches.
+func newVirtualMailboxes(settings *Settings, searches []SavedSearch) []VirtualMailbox {
+	var l []VirtualMailbox
+
+	if unified := settings.UnifiedMailboxes; len(unified) > 0 {
+		l = append(l, VirtualMailbox{
+			Name: "Unified inbox",
+			URL:  &url.URL{Path: unifiedInboxPath},
+			searchUids: func(conn *imapclient.Client, extra *imap.SearchCriteria) (map[string][]uint32, error) {
+				return searchUidsIn(conn, unified, extra)
+			},
+		})
+	}
+
+	l = append(l, VirtualMailbox{
+		Name: "Starred",
+		URL:  &url.URL{Path: starredPath},
+		searchUids: func(conn *imapclient.Client, extra *imap.SearchCriteria) (map[string][]uint32, error) {
+			criteria := &imap.SearchCriteria{WithFlags: []string{imap.FlaggedFlag}}
+			if extra != nil {
+				criteria = searchCriteriaAnd(criteria, extra)
+			}
+			return searchUidsByMailbox(conn, criteria, false)
+		},
+	})
+
+	loc, locErr := time.LoadLocation(settings.Timezone)
+	for i := range searches {
+		s := &searches[i]
+		l = append(l, VirtualMailbox{
+			Name: s.Name,
+			URL:  s.URL(),
+			searchUids: func(conn *imapclient.Client, extra *imap.SearchCriteria) (map[string][]uint32, error) {
+				if locErr != nil {
+					return nil, fmt.Errorf("failed to load location: %v", locErr)
+				}
+				return s.searchUids(conn, extra, loc)
+			},
+		})
+	}
+
+	return l
+}
+
+// Time during which the unread message counts of virtual mailboxes are
+// cached. Without MULTISEARCH, counting requires searching every mailbox.
+const virtualUnseenTTL = 30 * time.Second
+
+type virtualUnseenEntry struct {
+	// Unread message counts by virtual mailbox URL
+	counts  map[string]int
+	expires time.Time
+}
+
+// virtualUnseenCache keeps the unread message counts of virtual mailboxes,
+// by session.
+var virtualUnseenCache = struct {
+	sync.Mutex
+	entries map[*alps.Session]*virtualUnseenEntry
+}{entries: make(map[*alps.Session]*virtualUnseenEntry)}
+
+// cachedVirtualUnseen populates the unread message counts of virtual
+// mailboxes from the cache. It returns false if some counts are missing.
+func cachedVirtualUnseen(session *alps.Session, l []VirtualMailbox) bool {
+	virtualUnseenCache.Lock()
+	defer virtualUnseenCache.Unlock()
+
+	entry := virtualUnseenCache.entries[session]
+	if entry == nil || time.Now().After(entry.expires) {
+		return false
+	}
+	for i := range l {
+		n, ok := entry.counts[l[i].URL.String()]
+		if !ok {
+			return false
+		}
+		l[i].Unseen = n
+	}
+	return true
+}
+
+func putVirtualUnseen(session *alps.Session, l []VirtualMailbox) {
+	virtualUnseenCache.Lock()
+	defer virtualUnseenCache.Unlock()
+
+	now := time.Now()
+	for s, entry := range virtualUnseenCache.entries {
+		if now.After(entry.expires) {
+			delete(virtualUnseenCache.entries, s)
+		}
+	}
+
+	counts := make(map[string]int, len(l))
+	for _, vm := range l {
+		counts[vm.URL.String()] = vm.Unseen
+	}
+	virtualUnseenCache.entries[session] = &virtualUnseenEntry{
+		counts:  counts,
+		expires: now.Add(virtualUnseenTTL),
+	}
+}
+
+// invalidateVirtualUnseen drops the cached unread message counts of a
+// session, after messages have been changed.
+func invalidateVirtualUnseen(session *alps.Session) {
+	virtualUnseenCache.Lock()
+	delete(virtualUnseenCache.entries, session)
+	virtualUnseenCache.Unlock()
+}
+
+// countVirtualUnseen populates the unread message count of virtual mailboxes.
+// Search errors are not fatal: a virtual mailbox may refer to a mailbox which
+// has been deleted since. Losing the connection is.
+func countVirtualUnseen(conn *imapclient.Client, l []VirtualMailbox) error {
+	unseen := &imap.SearchCriteria{WithoutFlags: []string{imap.SeenFlag}}
+
+	for i := range l {
+		vm := &l[i]
+		vm.Unseen = -1
+
+		uids, err := vm.searchUids(conn, unseen)
+		if err != nil && conn.State() == imap.LogoutState {
+			return err
+		} else if err != nil {
+			continue
+		}
+		vm.Unseen = 0
+		for _, mboxUids := range uids {
+			vm.Unseen += len(mboxUids)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package alpscarddav
+
+import (
+	"fmt"
+	"strings"
+
+	"git.sr.ht/~migadu/alps"
+	alpsbase "git.sr.ht/~migadu/alps/plugins/base"
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav/carddav"
+)
+
+// contactLocator looks up contacts in the address book, to recognize known
+// senders.
+type contactLocator struct {
+	p *plugin
+}
+
+func (l *contactLocator) LookupContacts(ctx *alps.Context, address, name string) ([]alpsbase.Contact, error) {
+	c, addressBook, err := l.p.clientWithAddressBook(ctx.Session)
+	if err == errNoAddressBook {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	filters := []carddav.PropFilter{{
+		Name:        vcard.FieldEmail,
+		TextMatches: []carddav.TextMatch{{Text: address}},
+	}}
+	if name != "" {
+		filters = append(filters, carddav.PropFilter{
+			Name:        vcard.FieldFormattedName,
+			TextMatches: []carddav.TextMatch{{Text: name, MatchType: carddav.MatchEquals}},
+		})
+	}
+	query := carddav.AddressBookQuery{
+		DataRequest: carddav.AddressDataRequest{
+			Props: []string{vcard.FieldFormattedName, vcard.FieldEmail},
+		},
+		PropFilters: filters,
+		FilterTest:  carddav.FilterAnyOf,
+	}
+	addrs, err := c.QueryAddressBook(addressBook.Path, &query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query CardDAV addresses: %v", err)
+	}
+
+	var contacts []alpsbase.Contact
+	for _, addr := range addrs {
+		fn := addr.Card.Value(vcard.FieldFormattedName)
+		// Text matches are substring matches
+		if !hasEmail(addr.Card, address) && (name == "" || !strings.EqualFold(fn, name)) {
+			continue
+		}
+		for _, email := range addr.Card.Values(vcard.FieldEmail) {
+			contacts = append(contacts, alpsbase.Contact{Name: fn, Address: email})
+		}
+	}
+	return contacts, nil
+}
@@ -0,0 +1,103 @@
+package alpscarddav
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"git.sr.ht/~migadu/alps"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav/carddav"
+)
+
+// pgpKeyLocator looks up OpenPGP keys in the KEY property of contacts.
+type pgpKeyLocator struct {
+	p *plugin
+}
+
+func (l *pgpKeyLocator) LookupPGPKeys(ctx *alps.Context, address string) (openpgp.EntityList, error) {
+	c, addressBook, err := l.p.clientWithAddressBook(ctx.Session)
+	if err == errNoAddressBook {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	query := carddav.AddressBookQuery{
+		DataRequest: carddav.AddressDataRequest{
+			Props: []string{vcard.FieldEmail, vcard.FieldKey},
+		},
+		PropFilters: []carddav.PropFilter{{
+			Name:        vcard.FieldEmail,
+			TextMatches: []carddav.TextMatch{{Text: address}},
+		}},
+	}
+	addrs, err := c.QueryAddressBook(addressBook.Path, &query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query CardDAV addresses: %v", err)
+	}
+
+	var keys openpgp.EntityList
+	for _, addr := range addrs {
+		// Text matches are substring matches
+		if !hasEmail(addr.Card, address) {
+			continue
+		}
+		for _, field := range addr.Card[vcard.FieldKey] {
+			// Other kinds of keys, e.g. S/MIME certificates, are skipped
+			if l, err := readVCardPGPKey(field); err == nil {
+				keys = append(keys, l...)
+			}
+		}
+	}
+	return keys, nil
+}
+
+func hasEmail(card vcard.Card, address string) bool {
+	for _, email := range card.Values(vcard.FieldEmail) {
+		if strings.EqualFold(email, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// readVCardPGPKey reads an OpenPGP key from a KEY property. vCard 4 stores
+// keys as data URIs, vCard 3 as base64 with an ENCODING parameter.
+func readVCardPGPKey(field *vcard.Field) (openpgp.EntityList, error) {
+	v := field.Value
+	if strings.HasPrefix(v, "data:") {
+		i := strings.IndexByte(v, ',')
+		if i < 0 {
+			return nil, fmt.Errorf("malformed data URI")
+		}
+		meta, data := v[len("data:"):i], v[i+1:]
+		if strings.HasSuffix(meta, ";base64") {
+			b, err := base64.StdEncoding.DecodeString(data)
+			if err != nil {
+				return nil, err
+			}
+			v = string(b)
+		} else {
+			s, err := url.PathUnescape(data)
+			if err != nil {
+				return nil, err
+			}
+			v = s
+		}
+	} else if enc := field.Params.Get("ENCODING"); strings.EqualFold(enc, "b") || strings.EqualFold(enc, "base64") {
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, err
+		}
+		v = string(b)
+	}
+
+	if strings.Contains(v, "-----BEGIN PGP PUBLIC KEY BLOCK-----") {
+		return openpgp.ReadArmoredKeyRing(strings.NewReader(v))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader([]byte(v)))
+}
@@ -110,6 +110,8 @@ func newPlugin(srv *alps.Server) (alps.Plugin, error) {
 	}
 
 	registerRoutes(p)
+	alpsbase.RegisterPGPKeyLocator("carddav", &pgpKeyLocator{p})
+	alpsbase.RegisterContactLocator("carddav", &contactLocator{p})
 
 	p.Inject("compose.html", func(ctx *alps.Context, _data alps.RenderData) error {
 		data := _data.(*alpsbase.ComposeRenderData)
@@ -0,0 +1,510 @@
+package alps
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"git.sr.ht/~migadu/alps/config"
+	"github.com/fernet/fernet-go"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	ErrSchedulerDisabled = errors.New("scheduled jobs require a login key")
+	ErrNoSuchJob         = errors.New("no such scheduled job")
+	ErrJobRunning        = errors.New("scheduled job is running")
+)
+
+const (
+	maxJobAttempts = 3
+	jobRetryDelay  = 5 * time.Minute
+	// Failed jobs are listed until they expire, unless they are cancelled
+	failedJobExpiry = 7 * 24 * time.Hour
+)
+
+// ScheduledJob is run on behalf of a user at a given time, even if they are
+// logged out.
+type ScheduledJob struct {
+	ID       string
+	Kind     string
+	Username string
+	Time     time.Time
+	// Opaque data for the job handler
+	Data string
+
+	// Number of failed attempts and error of the last one
+	Attempts int
+	Err      string
+	// True if the job won't be retried
+	Failed bool
+}
+
+// JobHandler runs a scheduled job. The session is logged in as the user who
+// scheduled the job and is closed when the handler returns. A failed job is
+// retried, unless the error is of type JobWarning.
+type JobHandler func(s *Session, job *ScheduledJob) error
+
+// JobWarning is returned by a JobHandler when the job has run, but a
+// subsequent step failed. The error is logged and the job isn't retried.
+type JobWarning struct {
+	Err error
+}
+
+func (err JobWarning) Error() string {
+	return err.Err.Error()
+}
+
+var jobHandlers = make(map[string]JobHandler)
+
+// RegisterJobHandler registers a handler for scheduled jobs of the provided
+// kind. Kinds should be prefixed with the plugin name.
+func RegisterJobHandler(kind string, h JobHandler) {
+	jobHandlers[kind] = h
+}
+
+type scheduledEntry struct {
+	ScheduledJob
+
+	// Username and password encrypted with the login key, dropped once the
+	// job has failed
+	Credentials []byte
+	NextAttempt time.Time
+	// Time at which a failed job is removed
+	Expires time.Time
+
+	// Delayed jobs are never saved to disk, and keep their plain credentials
+	// in memory instead
+	delayed bool
+	creds   *jobCredentials
+	running bool
+}
+
+type jobCredentials struct {
+	Username string
+	Password string
+}
+
+// scheduler runs scheduled and delayed jobs. Scheduled jobs are saved to disk
+// if a path is configured.
+type scheduler struct {
+	sessions *SessionManager
+	key      *fernet.Key
+	path     string
+	logger   echo.Logger
+
+	locker  sync.Mutex
+	entries map[string]*scheduledEntry // protected by locker
+
+	wake   chan struct{}
+	closed chan struct{}
+	done   chan struct{}
+}
+
+func newScheduler(sessions *SessionManager, config *config.AlpsConfig, logger echo.Logger) (*scheduler, error) {
+	s := &scheduler{
+		sessions: sessions,
+		key:      config.Security.LoginKey,
+		path:     config.Scheduler.Path,
+		logger:   logger,
+		entries:  make(map[string]*scheduledEntry),
+		wake:     make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if s.key != nil && s.path == "" {
+		logger.Print("No scheduler path configured, scheduled jobs won't survive restarts")
+	}
+
+	if s.path == "" {
+		return s, nil
+	}
+
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read scheduled jobs: %v", err)
+	}
+
+	var l []scheduledEntry
+	if err := json.Unmarshal(b, &l); err != nil {
+		return nil, fmt.Errorf("failed to parse scheduled jobs: %v", err)
+	}
+	now := time.Now()
+	for i := range l {
+		e := &l[i]
+		if e.Failed && e.Expires.IsZero() {
+			e.Expires = now.Add(failedJobExpiry)
+			e.Credentials = nil
+		}
+		s.entries[e.ID] = e
+	}
+
+	return s, nil
+}
+
+// save writes pending jobs to disk. The caller must hold the lock.
+func (s *scheduler) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	l := make([]*scheduledEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		if !e.delayed {
+			l = append(l, e)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Time.Before(l[j].Time)
+	})
+
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so that a crash doesn't leave a
+	// truncated file behind
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("failed to save scheduled jobs: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to save scheduled jobs: %v", err)
+	}
+	return nil
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func newScheduledEntry(username, kind string, t time.Time, data string) *scheduledEntry {
+	return &scheduledEntry{
+		ScheduledJob: ScheduledJob{
+			ID:       uuid.New().String(),
+			Kind:     kind,
+			Username: username,
+			Time:     t,
+			Data:     data,
+		},
+		NextAttempt: t,
+	}
+}
+
+func (s *scheduler) schedule(username, password, kind string, t time.Time, data string) (*ScheduledJob, error) {
+	if s.key == nil {
+		return nil, ErrSchedulerDisabled
+	}
+
+	payload, err := json.Marshal(jobCredentials{username, password})
+	if err != nil {
+		panic(err) // Should never happen
+	}
+
+	e := newScheduledEntry(username, kind, t, data)
+	e.Credentials, err = fernet.EncryptAndSign(payload, s.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt credentials: %v", err)
+	}
+	return s.put(e)
+}
+
+func (s *scheduler) delay(username, password, kind string, d time.Duration, data string) (*ScheduledJob, error) {
+	e := newScheduledEntry(username, kind, time.Now().Add(d), data)
+	e.delayed = true
+	e.creds = &jobCredentials{username, password}
+	return s.put(e)
+}
+
+func (s *scheduler) put(e *scheduledEntry) (*ScheduledJob, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.entries[e.ID] = e
+	if err := s.save(); err != nil {
+		delete(s.entries, e.ID)
+		return nil, err
+	}
+
+	s.notify()
+	job := e.ScheduledJob
+	return &job, nil
+}
+
+func (s *scheduler) list(username string) []ScheduledJob {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	var l []ScheduledJob
+	for _, e := range s.entries {
+		if e.Username == username {
+			l = append(l, e.ScheduledJob)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Time.Before(l[j].Time)
+	})
+	return l
+}
+
+func (s *scheduler) cancel(username, id string) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	e, ok := s.entries[id]
+	if !ok || e.Username != username {
+		return ErrNoSuchJob
+	} else if e.running {
+		return ErrJobRunning
+	}
+	delete(s.entries, id)
+	return s.save()
+}
+
+func (s *scheduler) update(username, id, data string) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	e, ok := s.entries[id]
+	if !ok || e.Username != username {
+		return ErrNoSuchJob
+	} else if e.running {
+		return ErrJobRunning
+	}
+	prev := e.Data
+	e.Data = data
+	if err := s.save(); err != nil {
+		e.Data = prev
+		return err
+	}
+	return nil
+}
+
+func (s *scheduler) start() {
+	go func() {
+		defer close(s.done)
+
+		alive := true
+		for alive {
+			var timer *time.Timer
+			var wait <-chan time.Time
+			if t, ok := s.next(); ok {
+				timer = time.NewTimer(time.Until(t))
+				wait = timer.C
+			}
+
+			select {
+			case <-wait:
+				s.runDue()
+			case <-s.wake:
+			case <-s.closed:
+				alive = false
+			}
+
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}()
+}
+
+// close stops the scheduler. Delayed jobs are run right away, since they
+// would be lost otherwise.
+func (s *scheduler) close() {
+	close(s.closed)
+	<-s.done
+
+	s.locker.Lock()
+	var delayed []scheduledEntry
+	for _, e := range s.entries {
+		if e.delayed && !e.Failed {
+			delayed = append(delayed, *e)
+		}
+	}
+	s.locker.Unlock()
+
+	for i := range delayed {
+		if err := s.run(&delayed[i]); err != nil {
+			s.logger.Printf("Delayed job %v failed: %v", delayed[i].ID, err)
+		}
+	}
+}
+
+// next returns the time at which the next job should run or the next failed
+// job expires, if any.
+func (s *scheduler) next() (time.Time, bool) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	var next time.Time
+	found := false
+	for _, e := range s.entries {
+		t := e.NextAttempt
+		if e.Failed {
+			t = e.Expires
+		}
+		if !found || t.Before(next) {
+			next, found = t, true
+		}
+	}
+	return next, found
+}
+
+func (s *scheduler) runDue() {
+	now := time.Now()
+
+	s.locker.Lock()
+	var due []scheduledEntry
+	expired := false
+	for id, e := range s.entries {
+		if e.Failed && !e.Expires.After(now) {
+			delete(s.entries, id)
+			expired = true
+		} else if !e.Failed && !e.NextAttempt.After(now) {
+			due = append(due, *e)
+		}
+	}
+	if expired {
+		if err := s.save(); err != nil {
+			s.logger.Print(err)
+		}
+	}
+	s.locker.Unlock()
+
+	for i := range due {
+		// The job may have been cancelled, updated or delayed in the meantime
+		s.locker.Lock()
+		e, ok := s.entries[due[i].ID]
+		if ok && !e.Failed && !e.NextAttempt.After(now) {
+			e.running = true
+			due[i] = *e
+		} else {
+			ok = false
+		}
+		s.locker.Unlock()
+		if !ok {
+			continue
+		}
+
+		err := s.run(&due[i])
+		if warning, ok := err.(JobWarning); ok {
+			s.logger.Printf("Scheduled job %v: %v", due[i].ID, warning)
+			err = nil
+		}
+
+		s.locker.Lock()
+		e.running = false
+		if err == nil {
+			delete(s.entries, e.ID)
+		} else {
+			s.logger.Printf("Scheduled job %v failed: %v", e.ID, err)
+			e.Attempts++
+			e.Err = err.Error()
+			_, authErr := err.(AuthError)
+			if authErr || e.Attempts >= maxJobAttempts {
+				e.Failed = true
+				e.Expires = time.Now().Add(failedJobExpiry)
+				e.Credentials = nil
+				e.creds = nil
+			} else {
+				e.NextAttempt = time.Now().Add(jobRetryDelay)
+			}
+		}
+		if err := s.save(); err != nil {
+			s.logger.Print(err)
+		}
+		s.locker.Unlock()
+	}
+}
+
+func (s *scheduler) run(e *scheduledEntry) error {
+	h, ok := jobHandlers[e.Kind]
+	if !ok {
+		return fmt.Errorf("unknown job kind %q", e.Kind)
+	}
+
+	creds := e.creds
+	if creds == nil {
+		payload := fernet.VerifyAndDecrypt(e.Credentials, 0, []*fernet.Key{s.key})
+		if payload == nil {
+			return fmt.Errorf("failed to decrypt credentials")
+		}
+		creds = new(jobCredentials)
+		if err := json.Unmarshal(payload, creds); err != nil {
+			return fmt.Errorf("failed to parse credentials: %v", err)
+		}
+	}
+
+	session, err := s.sessions.Put(creds.Username, creds.Password)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	job := e.ScheduledJob
+	return h(session, &job)
+}
+
+// CanScheduleJobs returns true if jobs can be scheduled on behalf of the user.
+func (s *Session) CanScheduleJobs() bool {
+	return s.manager.scheduler != nil && s.manager.scheduler.key != nil
+}
+
+// ScheduleJob schedules a job to be run at the provided time. The user's
+// credentials are kept with the job, encrypted with the login key, until it
+// has run.
+func (s *Session) ScheduleJob(kind string, t time.Time, data string) (*ScheduledJob, error) {
+	if s.manager.scheduler == nil {
+		return nil, ErrSchedulerDisabled
+	}
+	return s.manager.scheduler.schedule(s.username, s.password, kind, t, data)
+}
+
+// DelayJob schedules a job to be run after a short delay. Unlike ScheduleJob,
+// it doesn't require a login key: the job is only kept in memory, and is run
+// early if the server shuts down.
+func (s *Session) DelayJob(kind string, d time.Duration, data string) (*ScheduledJob, error) {
+	if s.manager.scheduler == nil {
+		return nil, ErrSchedulerDisabled
+	}
+	return s.manager.scheduler.delay(s.username, s.password, kind, d, data)
+}
+
+// ScheduledJobs returns the user's pending and failed jobs, sorted by time.
+func (s *Session) ScheduledJobs() []ScheduledJob {
+	if s.manager.scheduler == nil {
+		return nil
+	}
+	return s.manager.scheduler.list(s.username)
+}
+
+// CancelJob cancels one of the user's scheduled jobs. ErrJobRunning is
+// returned if the job is running.
+func (s *Session) CancelJob(id string) error {
+	if s.manager.scheduler == nil {
+		return ErrNoSuchJob
+	}
+	return s.manager.scheduler.cancel(s.username, id)
+}
+
+// UpdateJob replaces the data of one of the user's scheduled jobs.
+// ErrJobRunning is returned if the job is running.
+func (s *Session) UpdateJob(id, data string) error {
+	if s.manager.scheduler == nil {
+		return ErrNoSuchJob
+	}
+	return s.manager.scheduler.update(s.username, id, data)
+}
@@ -21,6 +21,8 @@ type Server struct {
 	Sessions *SessionManager
 	Config   *config.AlpsConfig
 
+	scheduler *scheduler
+
 	mutex   sync.RWMutex // used for server reload
 	plugins []Plugin
 
@@ -62,10 +64,19 @@ func newServer(e *echo.Echo, config *config.AlpsConfig) (*Server, error) {
 	}
 
 	s.Sessions = newSessionManager(s.dialIMAP, s.dialSMTP, e.Logger, config)
+
+	var err error
+	s.scheduler, err = newScheduler(s.Sessions, config, e.Logger)
+	if err != nil {
+		return nil, err
+	}
+	s.Sessions.scheduler = s.scheduler
+
 	return s, nil
 }
 
 func (s *Server) Close() {
+	s.scheduler.close()
 	s.Sessions.Close()
 }
 
@@ -416,6 +427,8 @@ func New(e *echo.Echo, config *config.AlpsConfig) (*Server, error) {
 		code := http.StatusInternalServerError
 		if he, ok := err.(*echo.HTTPError); ok {
 			code = he.Code
+		} else if _, ok := err.(IMAPConnError); ok {
+			code = http.StatusServiceUnavailable
 		}
 
 		type ErrorRenderData struct {
@@ -486,5 +499,7 @@ func New(e *echo.Echo, config *config.AlpsConfig) (*Server, error) {
 
 	e.Static("/themes", config.UI.ThemesPath)
 
+	s.scheduler.start()
+
 	return s, nil
 }
@@ -5,13 +5,16 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
 	"sync"
 	"time"
 
 	"git.sr.ht/~migadu/alps/config"
+	"github.com/emersion/go-imap"
 	imapclient "github.com/emersion/go-imap/client"
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
@@ -41,6 +44,17 @@ func (err AuthError) Error() string {
 	return fmt.Sprintf("authentication failed: %v", err.cause)
 }
 
+// IMAPConnError is returned by Session.DoIMAP when the connection to the
+// upstream IMAP server is lost while running an operation. The operation may
+// or may not have been applied by the server.
+type IMAPConnError struct {
+	cause error
+}
+
+func (err IMAPConnError) Error() string {
+	return fmt.Sprintf("connection to IMAP server lost: %v", err.cause)
+}
+
 // Session is an active user session. It may also hold an IMAP connection.
 //
 // The session's password is not available to plugins. Plugins should use the
@@ -80,20 +94,97 @@ func (s *Session) Username() string {
 
 // DoIMAP executes an IMAP operation on this session. The IMAP client can only
 // be used from inside f.
+//
+// If the connection to the IMAP server is lost while f is running, the session
+// re-connects and an IMAPConnError is returned. Operations which can safely be
+// run twice should use DoIMAPIdempotent instead.
 func (s *Session) DoIMAP(f func(*imapclient.Client) error) error {
+	return s.doIMAP(f, false)
+}
+
+// DoIMAPIdempotent is like DoIMAP, except that f is retried once on a fresh
+// connection if the connection to the IMAP server is lost. f must only issue
+// idempotent commands, such as LIST, STATUS, FETCH or SEARCH.
+func (s *Session) DoIMAPIdempotent(f func(*imapclient.Client) error) error {
+	return s.doIMAP(f, true)
+}
+
+func (s *Session) doIMAP(f func(*imapclient.Client) error, retry bool) error {
 	s.imapLocker.Lock()
 	defer s.imapLocker.Unlock()
 
 	if s.imapConn == nil {
-		var err error
-		s.imapConn, err = s.manager.connectIMAP(s.username, s.password)
-		if err != nil {
-			s.Close()
-			return fmt.Errorf("failed to re-connect to IMAP server: %v", err)
+		if err := s.connectIMAP(nil); err != nil {
+			return err
 		}
 	}
 
-	return f(s.imapConn)
+	// Remember the selected mailbox, so that it can be restored before
+	// retrying f
+	selected := s.imapConn.Mailbox()
+
+	err := f(s.imapConn)
+	if err == nil || !isIMAPConnLost(s.imapConn, err) {
+		return err
+	}
+
+	s.manager.logger.Printf("Lost connection to IMAP server: %v", err)
+	s.imapConn.Terminate()
+	s.imapConn = nil
+	if err := s.connectIMAP(selected); err != nil {
+		return err
+	}
+
+	if !retry {
+		return IMAPConnError{err}
+	}
+
+	err = f(s.imapConn)
+	if err != nil && isIMAPConnLost(s.imapConn, err) {
+		s.imapConn.Terminate()
+		s.imapConn = nil
+		return IMAPConnError{err}
+	}
+	return err
+}
+
+// connectIMAP opens a new IMAP connection for this session and selects the
+// provided mailbox, if any. It must be called with imapLocker held.
+func (s *Session) connectIMAP(selected *imap.MailboxStatus) error {
+	c, err := s.manager.connectIMAP(s.username, s.password)
+	if err != nil {
+		s.Close()
+		return fmt.Errorf("failed to re-connect to IMAP server: %v", err)
+	}
+
+	if selected != nil {
+		if _, err := c.Select(selected.Name, selected.ReadOnly); err != nil {
+			c.Logout()
+			return fmt.Errorf("failed to re-select mailbox %q: %v", selected.Name, err)
+		}
+	}
+
+	s.imapConn = c
+	return nil
+}
+
+// isIMAPConnLost checks whether err has been caused by a connection-level
+// failure, as opposed to e.g. a NO or BAD response from the server.
+func isIMAPConnLost(c *imapclient.Client, err error) bool {
+	select {
+	case <-c.LoggedOut():
+		return true
+	default:
+	}
+	if c.State() == imap.LogoutState {
+		return true
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
 }
 
 // DoSMTP executes an SMTP operation on this session. The SMTP client can only
@@ -168,6 +259,7 @@ func (s *Session) PutAttachment(in *multipart.FileHeader,
 	form *multipart.Form) (string, error) {
 	id := uuid.New()
 	s.attachmentsLocker.Lock()
+	defer s.attachmentsLocker.Unlock()
 
 	var size int64
 	for _, a := range s.attachments {
@@ -181,7 +273,6 @@ func (s *Session) PutAttachment(in *multipart.FileHeader,
 		File: in,
 		Form: form,
 	}
-	s.attachmentsLocker.Unlock()
 	return id.String(), nil
 }
 
@@ -231,6 +322,9 @@ type SessionManager struct {
 	debug    bool
 	config   *config.SessionConfig
 
+	// Set by the server, used to schedule jobs on behalf of users
+	scheduler *scheduler
+
 	locker   sync.Mutex
 	sessions map[string]*Session // protected by locker
 }
@@ -328,17 +422,22 @@ func (sm *SessionManager) Put(username, password string) (*Session, error) {
 
 		alive := true
 		for alive {
+			var conn *imapclient.Client
 			var loggedOut <-chan struct{}
 			s.imapLocker.Lock()
 			if s.imapConn != nil {
-				loggedOut = s.imapConn.LoggedOut()
+				conn = s.imapConn
+				loggedOut = conn.LoggedOut()
 			}
 			s.imapLocker.Unlock()
 
 			select {
 			case <-loggedOut:
 				s.imapLocker.Lock()
-				s.imapConn = nil
+				// DoIMAP may have already replaced the connection
+				if s.imapConn == conn {
+					s.imapConn = nil
+				}
 				s.imapLocker.Unlock()
 			case <-s.pings:
 				if !timer.Stop() {
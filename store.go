@@ -75,7 +75,7 @@ type imapStore struct {
 var errIMAPMetadataUnsupported = fmt.Errorf("alps: IMAP server doesn't support METADATA extension")
 
 func newIMAPStore(session *Session) (*imapStore, error) {
-	err := session.DoIMAP(func(c *imapclient.Client) error {
+	err := session.DoIMAPIdempotent(func(c *imapclient.Client) error {
 		mc := imapmetadata.NewClient(c)
 		ok, err := mc.SupportMetadata()
 		if err != nil {
@@ -102,7 +102,7 @@ func (s *imapStore) Get(key string, out interface{}) error {
 	}
 
 	var entries map[string]string
-	err := s.session.DoIMAP(func(c *imapclient.Client) error {
+	err := s.session.DoIMAPIdempotent(func(c *imapclient.Client) error {
 		mc := imapmetadata.NewClient(c)
 		var err error
 		entries, err = mc.GetMetadata("", []string{s.key(key)}, nil)
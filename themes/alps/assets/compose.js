@@ -14,6 +14,9 @@ const sendButton = document.getElementById("send-button"),
 const composeForm = document.getElementById("compose-form");
 const sendProgress = document.getElementById("send-progress");
 composeForm.addEventListener("submit", ev => {
+	if (formatInput.value === "html") {
+		saveEditor();
+	}
 	[...document.querySelectorAll("input, textarea")].map(
 		i => i.setAttribute("readonly", "readonly"));
 	sendProgress.style.display = 'flex';
@@ -23,6 +26,152 @@ saveButton.addEventListener("click", ev => {
 	sendProgress.querySelector(".info").innerText = "Saving draft...";
 });
 
+// The send time is only required when scheduling the message
+const scheduleButton = document.getElementById("schedule-button"),
+	sendAtInput = document.getElementById("send-at");
+if (scheduleButton) {
+	scheduleButton.addEventListener("click", ev => {
+		sendAtInput.required = true;
+		sendProgress.querySelector(".info").innerText = "Scheduling message...";
+	});
+	[sendButton, saveButton].forEach(button => {
+		button.addEventListener("click", ev => {
+			sendAtInput.required = false;
+		});
+	});
+}
+
+const formatInput = document.getElementById("format"),
+	formatSelect = document.getElementById("format-select"),
+	formatToolbar = document.querySelector(".format-toolbar"),
+	textInput = document.querySelector("textarea[name='text']"),
+	htmlInput = document.querySelector("textarea[name='html']");
+
+// In the HTML source, images refer to attachments with "cid:" URLs. The
+// editor displays them with URLs the browser can load instead.
+const imageSources = {};
+document.querySelectorAll("input[data-cid]").forEach(input => {
+	imageSources[input.dataset.cid] = input.dataset.src;
+});
+
+const editor = document.createElement("div");
+editor.classList.add("body", "html-editor");
+editor.contentEditable = "true";
+htmlInput.parentNode.insertBefore(editor, htmlInput);
+
+function loadEditor() {
+	editor.innerHTML = htmlInput.value;
+	editor.querySelectorAll("img[src^='cid:']").forEach(img => {
+		const cid = img.getAttribute("src").slice("cid:".length);
+		if (imageSources[cid]) {
+			img.dataset.cid = cid;
+			img.src = imageSources[cid];
+		}
+	});
+}
+
+function saveEditor() {
+	const clone = editor.cloneNode(true);
+	clone.querySelectorAll("img[data-cid]").forEach(img => {
+		img.setAttribute("src", "cid:" + img.dataset.cid);
+		img.removeAttribute("data-cid");
+	});
+	htmlInput.value = clone.innerHTML;
+}
+
+function setFormat(format) {
+	const html = format === "html";
+	formatInput.value = format;
+	textInput.style.display = html ? "none" : "";
+	htmlInput.style.display = "none";
+	editor.style.display = html ? "" : "none";
+	formatToolbar.style.display = html ? "" : "none";
+	formatSelect.value = format;
+	textInput.placeholder = format === "markdown" ? "Write in Markdown" : "";
+}
+
+function insertImage(cid, src) {
+	if (formatInput.value !== "html") {
+		formatSelect.value = "html";
+		formatSelect.dispatchEvent(new Event("change"));
+	}
+	imageSources[cid] = src;
+	editor.focus();
+	document.execCommand("insertImage", false, src);
+	editor.querySelectorAll("img").forEach(img => {
+		if (img.getAttribute("src") === src) {
+			img.dataset.cid = cid;
+		}
+	});
+}
+
+formatSelect.style.display = "";
+formatSelect.addEventListener("change", () => {
+	// Plain text and Markdown share the same text area
+	const format = formatSelect.value;
+	if (formatInput.value === "html" && format !== "html") {
+		textInput.value = editor.innerText;
+		setFormat(format);
+	} else if (format !== "html") {
+		setFormat(format);
+	} else if (formatInput.value !== "html") {
+		editor.replaceChildren(...textInput.value.split("\n").map(line => {
+			const div = document.createElement("div");
+			if (line) {
+				div.textContent = line;
+			} else {
+				div.appendChild(document.createElement("br"));
+			}
+			return div;
+		}));
+		setFormat("html");
+	}
+});
+
+formatToolbar.querySelectorAll("button").forEach(button => {
+	button.addEventListener("click", () => {
+		const command = button.dataset.command;
+		let value = null;
+		if (command === "createLink") {
+			value = prompt("Link URL:");
+			if (!value) {
+				return;
+			}
+		}
+		editor.focus();
+		document.execCommand(command, false, value);
+	});
+});
+
+document.execCommand("styleWithCSS", false, false);
+loadEditor();
+setFormat(formatInput.value);
+
+// The signature follows the identity the message is sent as
+const fromSelect = document.querySelector("select#from");
+function selectedSignature() {
+	const option = fromSelect.selectedOptions[0];
+	return (option.dataset.signature || "").replace(/\r\n/g, "\n");
+}
+if (fromSelect) {
+	let signature = selectedSignature();
+	fromSelect.addEventListener("change", () => {
+		const next = selectedSignature();
+		if (formatInput.value !== "html") {
+			const text = textInput.value, sep = "\n-- \n";
+			if (signature && text.endsWith(sep + signature)) {
+				textInput.value = text.slice(0, text.length - sep.length - signature.length);
+				if (next) {
+					textInput.value += sep + next;
+				}
+			} else if (!signature && next && !text.includes(sep)) {
+				textInput.value = text + "\n\n" + sep + next;
+			}
+		}
+		signature = next;
+	});
+}
+
 let attachments = [];
 
 const headers = document.querySelector(".create-update .headers");
@@ -71,7 +220,7 @@ function updateState() {
 		}
 	}
 
-	if (complete) {
+	if (complete && !autosaving) {
 		sendButton.removeAttribute("disabled");
 		saveButton.removeAttribute("disabled");
 	} else {
@@ -102,6 +251,7 @@ function attachFile(file) {
 		attachments = attachments.filter(a => a !== attachment);
 		node.remove();
 		updateState();
+		dirty = true;
 
 		if (typeof attachment.uuid !== "undefined") {
 			const cancel = new XMLHttpRequest();
@@ -142,6 +292,18 @@ function attachFile(file) {
 		}
 
 		attachment.uuid = resp[0];
+		dirty = true;
+		if (file.type.startsWith("image/")) {
+			// Must match the Content-ID assigned by the server
+			const cid = `${attachment.uuid}@alps`;
+			const insert = document.createElement("button");
+			insert.type = "button";
+			insert.innerText = "Insert";
+			insert.addEventListener("click", () => {
+				insertImage(cid, URL.createObjectURL(file));
+			});
+			node.appendChild(insert);
+		}
 		updateState();
 	});
 	xhr.addEventListener("error", () => {
@@ -180,6 +342,123 @@ function attachmentNodeFor(file) {
 	return node;
 }
 
+// Drafts are saved automatically while the message is being edited. The saved
+// draft replaces the original one: later saves, and sending the message, refer
+// to it instead.
+const autosaveInterval = parseInt(composeForm.dataset.autosave, 10) * 1000,
+	autosaveStatus = document.getElementById("autosave-status"),
+	draftMailboxInput = document.getElementById("draft-mailbox"),
+	draftUIDInput = document.getElementById("draft-uid");
+let dirty = false, autosaving = false, submitted = false;
+
+composeForm.addEventListener("input", () => {
+	dirty = true;
+});
+composeForm.addEventListener("submit", () => {
+	submitted = true;
+});
+
+function setAutosaveStatus(text, error) {
+	autosaveStatus.innerText = text;
+	autosaveStatus.classList.toggle("error", !!error);
+}
+
+function draftAttachmentNodeFor(att) {
+	const node = document.createElement("div"),
+		label = document.createElement("label"),
+		input = document.createElement("input");
+	node.classList.add("upload");
+	label.classList.add("filename");
+
+	input.type = "checkbox";
+	input.name = "prev_attachments";
+	input.value = att.Path;
+	input.checked = true;
+	if (att.ContentID) {
+		input.dataset.cid = att.ContentID;
+		input.dataset.src = att.URL;
+	}
+	label.appendChild(input);
+	label.append(" " + (att.Filename || att.MIMEType));
+
+	node.appendChild(label);
+	return node;
+}
+
+// Attachments of the previous draft and uploads sent with the request are now
+// attachments of the new draft
+function applyAutosave(result, uuids) {
+	draftMailboxInput.value = result.Mailbox;
+	draftUIDInput.value = result.Uid;
+
+	// Forwarded messages are now attachments of the draft
+	attachmentsNode.querySelectorAll("input[name='prev_attachments'], input[name='forward_messages']").forEach(
+		input => input.closest(".upload").remove());
+	attachments = attachments.filter(a => {
+		if (uuids.includes(a.uuid)) {
+			a.node.remove();
+			return false;
+		}
+		return true;
+	});
+	result.Attachments.forEach(att => {
+		attachmentsNode.appendChild(draftAttachmentNodeFor(att));
+	});
+}
+
+function autosave() {
+	// Uploads in progress disable the send button
+	if (!dirty || submitted || sendButton.disabled) {
+		setTimeout(autosave, autosaveInterval);
+		return;
+	}
+
+	if (formatInput.value === "html") {
+		saveEditor();
+	}
+	const formData = new FormData(composeForm);
+	formData.append("autosave", "");
+	const uuids = attachmentUUIDsNode.value.split(",").filter(uuid => uuid);
+
+	dirty = false;
+	autosaving = true;
+	sendButton.setAttribute("disabled", "disabled");
+	saveButton.setAttribute("disabled", "disabled");
+	setAutosaveStatus("Saving draft...");
+
+	let retry = true;
+	fetch(composeForm.action, { method: "POST", body: formData }).then(resp => {
+		return resp.json().then(data => {
+			if (resp.ok) {
+				applyAutosave(data, uuids);
+				setAutosaveStatus("Draft saved at " + new Date().toLocaleTimeString());
+			} else if (resp.status === 409) {
+				retry = false;
+				setAutosaveStatus("This draft has been changed in another window, it won't be saved automatically.", true);
+			} else if (resp.status === 429) {
+				// Saved recently, try again later
+				dirty = true;
+			} else {
+				dirty = true;
+				setAutosaveStatus("Failed to save draft: " + data.error, true);
+			}
+		});
+	}).catch(() => {
+		dirty = true;
+		setAutosaveStatus("Failed to save draft", true);
+	}).finally(() => {
+		autosaving = false;
+		updateState();
+		if (retry) {
+			setTimeout(autosave, autosaveInterval);
+		}
+	});
+}
+
+if (autosaveInterval > 0) {
+	setTimeout(autosave, autosaveInterval);
+}
+
 // via https://github.com/ThomWright/format-si-prefix; MIT license
 // Copyright (c) 2015 Thom Wright
 const PREFIXES = {
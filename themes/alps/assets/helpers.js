@@ -11,4 +11,10 @@ if (check_all) {
 	});
 }
 
+// Resume interrupted bulk actions without waiting for the user
+const resume_form = document.querySelector("form.bulk-progress");
+if (resume_form) {
+	resume_form.submit();
+}
+
 // @license-end